@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+/**
+ * Object storage payloads too big for the queue are uploaded to, daemon fetches them for worker from buckets in its
+ * --claim-buckets and deletes them once job succeeds
+ */
+type PayloadStore interface {
+	Upload(body []byte) (url string, err error) // Returns s3://bucket/key of uploaded body
+}
+
+/**
+ * Reference to payload in object storage, put instead of the payload
+ */
+type ClaimCheck struct {
+	WorkermanClaim int    // Format version, 1
+	URL            string // s3://bucket/key
+	Size           int64
+}
+
+/**
+ * Uploads body to store and returns claim check to put instead, e.g. into tube not going through Put
+ */
+func OffloadPayload(store PayloadStore, body []byte) ([]byte, error) {
+	url, err := store.Upload(body)
+	if err != nil {
+		return nil, fmt.Errorf("workerman: could not offload payload: %v", err)
+	}
+	return json.Marshal(ClaimCheck{1, url, int64(len(body))})
+}
+
+/**
+ * PayloadStore in S3 bucket, or S3 compatible storage like MinIO with endpoint set in client options.
+ * Objects are named Prefix plus random id, set lifecycle rule on the bucket for ones of jobs never succeeding
+ */
+type S3Store struct {
+	Client *s3.Client
+	Bucket string
+	Prefix string // e.g. "jobs/"
+}
+
+func (s *S3Store) Upload(body []byte) (string, error) {
+	id, err := newRequestId()
+	if err != nil {
+		return "", err
+	}
+	key := s.Prefix + id
+	_, err = s.Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + s.Bucket + "/" + key, nil
+}
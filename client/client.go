@@ -0,0 +1,770 @@
+/**
+ * Package client manages running workerman daemon through its control protocol
+ *
+ * Commands are put into "Worker-to.<instance>" tube, each with random request id and
+ * private reply tube "Worker-from.<instance>.<client id>", so several clients can share the daemon.
+ *
+ * Example:
+ *
+ *	c, err := client.Dial("127.0.0.1:11300", "myhost")
+ *	if err != nil {
+ *		log.Fatal(err)
+ *	}
+ *	defer c.Close()
+ *	status, err := c.GetStatus()
+ */
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	INPUT_PREFIX    = "Worker-to."
+	OUTPUT_PREFIX   = "Worker-from."
+	DEFAULT_TIMEOUT = 5 * time.Second
+
+	DEFAULT_OFFLOAD_OVER = 48 * 1024 // Bodies bigger are offloaded by Put with PayloadStore, leaving room within put command
+)
+
+/** Returned when daemon did not respond in time */
+var ErrTimeout = errors.New("workerman: no response within timeout")
+
+type Command struct {
+	Command     string
+	Options     map[string]string `json:",omitempty"`
+	Limits      *LimitsUpdate     `json:",omitempty"`
+	Job         *Job              `json:",omitempty"`
+	Replay      *Replay           `json:",omitempty"`
+	Feature     *featureToggle    `json:",omitempty"`
+	Deploy      *Deploy           `json:",omitempty"`
+	RequestId   string
+	ReplyTo     string
+	ResponseTTL string `json:",omitempty"` // Response is deleted if not taken in time, e.g. "5s"
+	Timestamp   int64  `json:",omitempty"`
+	Nonce       string `json:",omitempty"`
+}
+
+/** Command put into tube when client has a key, see Options.Key */
+type signedCommand struct {
+	KeyId     string `json:",omitempty"`
+	Signed    string
+	Signature string
+}
+
+/**
+ * Limits change, fields left nil are not changed
+ */
+type LimitsUpdate struct {
+	Total   *int           `json:"total,omitempty"`
+	Min     *int           `json:"min,omitempty"`
+	Tubes   map[string]int `json:"tubes,omitempty"`
+	Tenants map[string]int `json:"tenants,omitempty"` // Workers over all tubes of tenant, daemon needs --tenants
+}
+
+/**
+ * Returned when daemon rejected limits change, holds validation errors
+ */
+type LimitsError []string
+
+func (e LimitsError) Error() string {
+	return "workerman: limits rejected: " + strings.Join(e, "; ")
+}
+
+/**
+ * Job to publish, nil Priority and empty TTR are sent as defaults 1024 and 60s
+ */
+type Job struct {
+	Tube     string
+	Body     string
+	Priority *uint32 `json:",omitempty"`
+	Delay    string  `json:",omitempty"`
+	TTR      string  `json:",omitempty"`
+	Base64   bool    `json:",omitempty"` // Body is base64 of binary one
+}
+
+/**
+ * Replay of buried jobs, or of jobs from another tube if From is set
+ */
+type Replay struct {
+	Tube  string
+	Count uint
+	Rate  uint
+	From  string `json:",omitempty"`
+}
+
+type ReplayStatus struct {
+	From     string
+	Count    uint
+	Replayed uint
+	Started  time.Time
+	Done     bool
+	Error    string
+}
+
+/**
+ * Worker to deploy: tar archive, gzipped or not, holding only the worker file named after it, given in Tarball or
+ * fetched by daemon from URL. Checksum is hex sha256 of the archive
+ */
+type Deploy struct {
+	Worker   string
+	Tarball  []byte `json:",omitempty"`
+	URL      string `json:",omitempty"`
+	Checksum string
+	Override string `json:",omitempty"` // Why worker is deployed during freeze window of daemon
+}
+
+/**
+ * Deployed worker, Reason tells why it is not subscribed or would not run
+ */
+type Deployed struct {
+	Worker     string
+	Checksum   string
+	Replaced   bool
+	Subscribed bool
+	Reason     string
+}
+
+/**
+ * Worker installed from artifact store, Error tells why Version is not installed yet
+ */
+type ArtifactStatus struct {
+	Version   string
+	Installed *time.Time
+	Error     string
+}
+
+/**
+ * Rollout of new worker version, State is "testing", "promoted" or "rolled back"
+ */
+type CanaryStatus struct {
+	State   string
+	Stable  string // Checksum of stable version
+	Canary  string // Checksum of new version
+	Runs    uint64
+	Errors  uint64
+	Started time.Time
+	Decided *time.Time
+}
+
+/**
+ * Git sync of workers directory
+ */
+type WorkersSync struct {
+	Commit  string
+	Synced  time.Time
+	Changed []string // Files changed by last sync
+	Error   string
+}
+
+type featureToggle struct {
+	Feature string
+	Tube    string `json:",omitempty"`
+	Enabled bool
+}
+
+type limitsUpdateResponse struct {
+	Applied bool
+	Errors  []string
+	Limits  *Limits
+}
+
+type Limits struct {
+	Total   uint
+	Min     uint
+	Queues  map[string]uint
+	Tenants map[string]uint
+}
+
+type Status struct {
+	Instance        string
+	TotalRuns       uint64
+	TotalCycles     uint64
+	TotalRecoveries uint64
+	LastError       string
+	Degraded        map[string]string
+	Integrity       map[string]string // Workers refused by integrity check, with why
+	Tags            []string          // Tags of host
+	Unmatched       map[string]string // Tubes not subscribed, with tags they require host lacks
+	BuriedCommands  uint64
+	DroppedCommands uint64
+	Servers         map[string]*ServerStatus
+	Ready           bool
+	NotReady        string
+	Runs            map[string]uint64
+	Errors          map[string]uint64
+	Running         map[string]uint
+	TotalRunning    uint
+	Units           map[string]uint            // Resource units of running workers by tube
+	TotalUnits      uint                       // Counted against total limit
+	AutoTotal       uint                       // Total limit derived from host, 0 unless --auto-total
+	Autoscaled      map[string]uint            // Tube limits raised by autoscaling
+	Predicted       map[string]uint            // Workers predicted from load history
+	Shares          map[string]float64         // Share attainment of contending tubes, 1 is their weighted share
+	Fleet           map[string]uint            // Workers of tubes with GlobalLimit running on other instances
+	Mirrored        map[string]uint64          // Jobs copied into shadow tubes, by tube they came from
+	Invalid         map[string][]InvalidJob    // Latest jobs buried for not matching Schema of tube
+	RuleHits        map[string][]uint64        // Jobs each of Rules of tube applied to
+	Migrated        map[string]uint64          // Jobs upgraded by migration scripts of tube
+	WorkersSync     *WorkersSync               // Commit workers directory is at, nil unless --workers-git
+	Artifacts       map[string]*ArtifactStatus // Workers of --artifact-manifest by name
+	Canaries        map[string]*CanaryStatus   // Latest rollout of new version by tube, for tubes with Canary
+	Tenants         map[string]*TenantStatus
+	Leader          string              // Instance leading cluster, empty unless --cluster
+	Shards          map[string][]string // Instances serving each tube, empty unless --shard-replicas
+	Resident        map[string]uint
+	TotalResident   uint
+	Prefork         map[string]uint // Warm prefork processes by tube
+	Stalls          uint64
+	LastStall       string
+	Paused          map[string]bool
+	Draining        bool
+	DryRun          bool
+	Replays         map[string]*ReplayStatus
+	Limits          *Limits
+}
+
+/**
+ * Job buried by daemon because its payload does not match Schema of its tube
+ */
+type InvalidJob struct {
+	Id    string
+	Time  time.Time
+	Error string
+}
+
+/**
+ * Tubes of tenant rolled up, when daemon runs with --tenants
+ */
+type TenantStatus struct {
+	Tubes   uint
+	Running uint
+	Runs    uint64
+	Errors  uint64
+	Limit   *uint // Nil for no tenant limit
+	Paused  bool
+}
+
+/**
+ * Health of beanstalkd server used by daemon
+ */
+type ServerStatus struct {
+	Role      string
+	Healthy   bool
+	Active    bool
+	Tubes     uint
+	LastCheck string
+	LastError string
+}
+
+/**
+ * Effective tube settings, Sources tell where each setting comes from
+ */
+type TubeConfig struct {
+	Limit    uint
+	Timeout  string
+	Retry    uint
+	Priority uint32
+	Env      map[string]string
+	Features []string
+	Resident uint
+	Server   string
+	Sources  map[string]string
+}
+
+type Config struct {
+	Defaults json.RawMessage
+	Tubes    map[string]TubeConfig
+}
+
+type response struct {
+	RequestId string
+	Response  json.RawMessage
+}
+
+type commandError struct {
+	Error string
+}
+
+type Client struct {
+	Timeout time.Duration // How long to wait for response
+
+	mu       sync.Mutex
+	conn     *beanstalk.Conn
+	commands *beanstalk.Tube
+	replyTo  string
+	replies  *beanstalk.TubeSet
+	key      []byte
+	keyId    string
+
+	payloadKeyId string
+	payloadKey   []byte
+	payloadStore PayloadStore
+	offloadOver  int
+	encoding     byte
+	responseTTL  time.Duration
+}
+
+/**
+ * Dial settings, for daemons run with non-default --command-prefix or --response-prefix,
+ * or beanstalkd reachable only over TLS or through proxy
+ */
+type Options struct {
+	CommandPrefix  string
+	ResponsePrefix string
+	Timeout        time.Duration
+	TLS            *tls.Config                                  // Wrap connection in TLS, ServerName defaults to host of addr
+	Dial           func(network, addr string) (net.Conn, error) // Opens connection instead of net.Dial, e.g. through proxy
+	Key            []byte                                       // Shared key of daemon run with --command-key, commands are signed with it
+	KeyId          string                                       // Id of Key in Keys of daemon's access file, empty for --command-key
+	PayloadKeyId   string                                       // Put encrypts bodies with PayloadKey, id of it in daemon's --payload-keys
+	PayloadKey     []byte                                       // 32 bytes shared payload key
+	PayloadStore   PayloadStore                                 // Put uploads bodies bigger than OffloadOver there and puts claim check instead
+	OffloadOver    int                                          // Body size in bytes Put offloads beyond, DEFAULT_OFFLOAD_OVER if 0
+	Encoding       string                                       // "msgpack" or "protobuf" for smaller commands and responses than JSON
+	ResponseTTL    time.Duration                                // Daemon deletes responses not taken in time, e.g. Timeout as later ones are skipped anyway
+}
+
+/**
+ * Connects to beanstalkd server used by workerman instance
+ *
+ * Instance is the name used in control tube names, which is the host name by default.
+ */
+func Dial(addr, instance string) (*Client, error) {
+	return DialOptions(addr, instance, Options{})
+}
+
+/**
+ * Connects to beanstalkd server used by workerman instance, zero options are set to defaults
+ */
+func DialOptions(addr, instance string, options Options) (*Client, error) {
+	if options.CommandPrefix == "" {
+		options.CommandPrefix = INPUT_PREFIX
+	}
+	if options.ResponsePrefix == "" {
+		options.ResponsePrefix = OUTPUT_PREFIX
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	if options.OffloadOver == 0 {
+		options.OffloadOver = DEFAULT_OFFLOAD_OVER
+	}
+	encoding, err := encodingByte(options.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	var netConn net.Conn
+	if options.Dial != nil {
+		netConn, err = options.Dial("tcp", addr)
+	} else {
+		netConn, err = net.DialTimeout("tcp", addr, options.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.TLS != nil {
+		config := options.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(netConn, config)
+		tlsConn.SetDeadline(time.Now().Add(options.Timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+	clientId, err := newRequestId()
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn := beanstalk.NewConn(netConn)
+	replyTo := options.ResponsePrefix + instance + "." + clientId
+	return &Client{
+		Timeout:  options.Timeout,
+		conn:     conn,
+		commands: &beanstalk.Tube{conn, options.CommandPrefix + instance},
+		replyTo:  replyTo,
+		replies:  &beanstalk.TubeSet{conn, map[string]bool{replyTo: true, "default": false}},
+		key:      options.Key,
+		keyId:    options.KeyId,
+
+		payloadKeyId: options.PayloadKeyId,
+		payloadKey:   options.PayloadKey,
+		payloadStore: options.PayloadStore,
+		offloadOver:  options.OffloadOver,
+		encoding:     encoding,
+		responseTTL:  options.ResponseTTL,
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+/**
+ * Sends command and returns raw JSON response
+ */
+func (c *Client) Do(command string, options map[string]string) (json.RawMessage, error) {
+	return c.send(Command{Command: command, Options: options})
+}
+
+func (c *Client) send(cmd Command) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := newRequestId()
+	if err != nil {
+		return nil, err
+	}
+	cmd.RequestId, cmd.ReplyTo = id, c.replyTo
+	if c.responseTTL > 0 {
+		cmd.ResponseTTL = c.responseTTL.String()
+	}
+	body, err := c.encode(cmd)
+	if err == nil {
+		body, err = encodeDocument(c.encoding, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.commands.Put(body, 0, 0, c.Timeout); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, ErrTimeout
+		}
+		jobId, reply, err := c.replies.Reserve(left)
+		if err != nil {
+			if strings.Contains(err.Error(), "timeout") {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		c.conn.Delete(jobId)
+		if reply, err = inflate(reply); err == nil {
+			reply, err = decodeDocument(reply)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var r response
+		if json.Unmarshal(reply, &r) != nil || r.RequestId != id {
+			// Late response to a request timed out before
+			continue
+		}
+		var e commandError
+		if json.Unmarshal(r.Response, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("workerman: %s", e.Error)
+		}
+		return r.Response, nil
+	}
+}
+
+/**
+ * Decompresses response daemon gzipped for being bigger than its --compress-responses
+ */
+func inflate(reply []byte) ([]byte, error) {
+	if !bytes.HasPrefix(reply, []byte{0x1f, 0x8b}) {
+		return reply, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(reply))
+	if err != nil {
+		return nil, fmt.Errorf("workerman: could not decompress response: %v", err)
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+/**
+ * Encodes command, signing it with timestamp and nonce (HMAC-SHA256 of command JSON) when client has a key
+ */
+func (c *Client) encode(cmd Command) ([]byte, error) {
+	if c.key == nil {
+		return json.Marshal(cmd)
+	}
+	nonce, err := newRequestId()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Timestamp, cmd.Nonce = time.Now().Unix(), nonce
+	signed, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(signed)
+	return json.Marshal(signedCommand{c.keyId, string(signed), hex.EncodeToString(mac.Sum(nil))})
+}
+
+/**
+ * Sends command and decodes response into value
+ */
+func (c *Client) call(command string, options map[string]string, value interface{}) error {
+	reply, err := c.Do(command, options)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(reply, value)
+}
+
+func (c *Client) GetStatus() (*Status, error) {
+	var status Status
+	return &status, c.call("getStatus", nil, &status)
+}
+
+func (c *Client) GetLimits() (*Limits, error) {
+	var limits Limits
+	return &limits, c.call("getLimits", nil, &limits)
+}
+
+/**
+ * Returns effective settings of tubes, all tubes if none given
+ */
+func (c *Client) GetConfig(tubes ...string) (*Config, error) {
+	options := make(map[string]string)
+	for _, tube := range tubes {
+		options[tube] = ""
+	}
+	var config Config
+	return &config, c.call("getConfig", options, &config)
+}
+
+/**
+ * Changes limits, returns LimitsError if daemon rejected the change
+ */
+func (c *Client) SetLimits(update LimitsUpdate) (*Limits, error) {
+	reply, err := c.send(Command{Command: "setLimits", Limits: &update})
+	if err != nil {
+		return nil, err
+	}
+	var r limitsUpdateResponse
+	if err := json.Unmarshal(reply, &r); err != nil {
+		return nil, err
+	}
+	if !r.Applied {
+		return r.Limits, LimitsError(r.Errors)
+	}
+	return r.Limits, nil
+}
+
+/**
+ * Stops dispatching workers for tubes, all tubes if none given
+ */
+func (c *Client) Pause(tubes ...string) (*Status, error) {
+	var status Status
+	return &status, c.call("pause", tubeOptions(tubes), &status)
+}
+
+/**
+ * Resumes dispatching workers for tubes, all tubes if none given
+ */
+func (c *Client) Resume(tubes ...string) (*Status, error) {
+	var status Status
+	return &status, c.call("resume", tubeOptions(tubes), &status)
+}
+
+/**
+ * Publishes job into tube subscribed by daemon, returns job id. Body is encrypted with PayloadKey, then offloaded to
+ * PayloadStore when still bigger than OffloadOver
+ */
+func (c *Client) Put(tube string, body []byte, delay time.Duration) (uint64, error) {
+	if c.payloadKey != nil {
+		sealed, err := EncryptPayload(c.payloadKeyId, c.payloadKey, nil, body)
+		if err != nil {
+			return 0, err
+		}
+		body = sealed
+	}
+	if c.payloadStore != nil && len(body) > c.offloadOver {
+		claim, err := OffloadPayload(c.payloadStore, body)
+		if err != nil {
+			return 0, err
+		}
+		body = claim
+	}
+	job := &Job{Tube: tube, Body: string(body)}
+	if !utf8.Valid(body) {
+		// JSON would replace invalid sequences
+		job.Body, job.Base64 = base64.StdEncoding.EncodeToString(body), true
+	}
+	if delay > 0 {
+		job.Delay = delay.String()
+	}
+	reply, err := c.send(Command{Command: "put", Job: job})
+	if err != nil {
+		return 0, err
+	}
+	var r struct {
+		Id uint64
+	}
+	return r.Id, json.Unmarshal(reply, &r)
+}
+
+/**
+ * Starts replaying jobs in background, progress is reported in status
+ */
+func (c *Client) Replay(replay Replay) (*ReplayStatus, error) {
+	reply, err := c.send(Command{Command: "replay", Replay: &replay})
+	if err != nil {
+		return nil, err
+	}
+	var status ReplayStatus
+	return &status, json.Unmarshal(reply, &status)
+}
+
+/**
+ * Writes worker into workers directory of daemon and waits for it to be subscribed, Checksum is computed from Tarball
+ * if empty
+ */
+func (c *Client) Deploy(deploy Deploy) (*Deployed, error) {
+	if deploy.Checksum == "" && len(deploy.Tarball) > 0 {
+		sum := sha256.Sum256(deploy.Tarball)
+		deploy.Checksum = hex.EncodeToString(sum[:])
+	}
+	reply, err := c.send(Command{Command: "deployWorker", Deploy: &deploy})
+	if err != nil {
+		return nil, err
+	}
+	var deployed Deployed
+	return &deployed, json.Unmarshal(reply, &deployed)
+}
+
+/**
+ * Toggles experimental behavior for a tube, or for all tubes if tube is empty
+ */
+func (c *Client) SetFeature(feature, tube string, enabled bool) (*Config, error) {
+	reply, err := c.send(Command{Command: "setFeature", Feature: &featureToggle{feature, tube, enabled}})
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	return &config, json.Unmarshal(reply, &config)
+}
+
+/**
+ * Restores limits and settings from the most recent config backup
+ */
+func (c *Client) RollbackConfig() (*Config, error) {
+	var config Config
+	return &config, c.call("rollbackConfig", nil, &config)
+}
+
+/**
+ * Pulls git checkout of workers directory of daemon run with --workers-git now
+ */
+func (c *Client) SyncWorkers() (*WorkersSync, error) {
+	var sync WorkersSync
+	return &sync, c.call("syncWorkers", nil, &sync)
+}
+
+/**
+ * Pulls workers directory like SyncWorkers during freeze window of daemon, reason is logged by daemon
+ */
+func (c *Client) SyncWorkersOverride(reason string) (*WorkersSync, error) {
+	var sync WorkersSync
+	return &sync, c.call("syncWorkers", map[string]string{"override": reason}, &sync)
+}
+
+/**
+ * Switches worker back to the version its last Deploy replaced, the version rolled back from can be promoted again
+ */
+func (c *Client) RollbackWorker(worker string) (*Deployed, error) {
+	var deployed Deployed
+	return &deployed, c.call("rollbackWorker", map[string]string{worker: ""}, &deployed)
+}
+
+/**
+ * Switches worker forward to the version RollbackWorker rolled back from
+ */
+func (c *Client) PromoteWorker(worker string) (*Deployed, error) {
+	var deployed Deployed
+	return &deployed, c.call("promoteWorker", map[string]string{worker: ""}, &deployed)
+}
+
+/**
+ * Makes daemon exit once running workers finish
+ */
+func (c *Client) Drain() (*Status, error) {
+	var status Status
+	return &status, c.call("drain", nil, &status)
+}
+
+func tubeOptions(tubes []string) map[string]string {
+	options := make(map[string]string)
+	for _, tube := range tubes {
+		options[tube] = ""
+	}
+	if len(options) == 0 {
+		options["*"] = ""
+	}
+	return options
+}
+
+/**
+ * Encrypted job body, opened by workerman before worker gets it
+ */
+type payloadEnvelope struct {
+	WorkermanEnvelope int
+	KeyId             string
+	DataKey           []byte `json:",omitempty"`
+	Nonce             []byte
+	Ciphertext        []byte
+}
+
+/**
+ * Encrypts job body with AES-256-GCM for daemons with --payload-keys or KMS access, so it is stored encrypted in the queue.
+ * With shared key, keyId is its id in --payload-keys and wrappedKey nil. With KMS, key is plaintext data key from
+ * GenerateDataKey of KMS key keyId, and wrappedKey its CiphertextBlob
+ */
+func EncryptPayload(keyId string, key, wrappedKey, body []byte) ([]byte, error) {
+	if len(key) != 32 {
+		return nil, errors.New("workerman: payload key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(payloadEnvelope{1, keyId, wrappedKey, nonce, gcm.Seal(nil, nonce, body, []byte(keyId))})
+}
+
+func newRequestId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"strconv"
+)
+
+/**
+ * Header byte of commands and responses encoded otherwise than JSON, select encoding with Encoding of Options.
+ * Protobuf message is google.protobuf.Value of the same document as JSON
+ */
+const (
+	ENCODING_MSGPACK  = 0x01
+	ENCODING_PROTOBUF = 0x02
+)
+
+/**
+ * Returns header byte of encoding, 0 for JSON
+ */
+func encodingByte(name string) (byte, error) {
+	switch name {
+	case "", "json":
+		return 0, nil
+	case "msgpack":
+		return ENCODING_MSGPACK, nil
+	case "protobuf":
+		return ENCODING_PROTOBUF, nil
+	}
+	return 0, fmt.Errorf("workerman: unknown encoding %q, use json, msgpack or protobuf", name)
+}
+
+/**
+ * Returns JSON document in encoding of header byte, as it is for JSON
+ */
+func encodeDocument(encoding byte, document []byte) ([]byte, error) {
+	if encoding == 0 {
+		return document, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value = plainNumbers(value)
+	var data []byte
+	var err error
+	if encoding == ENCODING_MSGPACK {
+		data, err = msgpack.Marshal(value)
+	} else {
+		var message *structpb.Value
+		if message, err = structpb.NewValue(value); err == nil {
+			data, err = proto.Marshal(message)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{encoding}, data...), nil
+}
+
+/**
+ * Returns response as JSON document, whatever encoding it came in
+ */
+func decodeDocument(body []byte) ([]byte, error) {
+	if len(body) == 0 || body[0] != ENCODING_MSGPACK && body[0] != ENCODING_PROTOBUF {
+		return body, nil
+	}
+	var document interface{}
+	if body[0] == ENCODING_MSGPACK {
+		if err := msgpack.Unmarshal(body[1:], &document); err != nil {
+			return nil, fmt.Errorf("workerman: invalid msgpack response: %v", err)
+		}
+	} else {
+		var value structpb.Value
+		if err := proto.Unmarshal(body[1:], &value); err != nil {
+			return nil, fmt.Errorf("workerman: invalid protobuf response: %v", err)
+		}
+		document = value.AsInterface()
+	}
+	return json.Marshal(document)
+}
+
+/** Returns decoded JSON with numbers as integers where they are */
+func plainNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = plainNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = plainNumbers(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+/**
+ * Access scopes: read allows status queries only, operate also pausing, resuming and draining, configure also
+ * changing limits and features, admin allows everything
+ */
+const (
+	SCOPE_READ      = "read"
+	SCOPE_OPERATE   = "operate"
+	SCOPE_CONFIGURE = "configure"
+	SCOPE_ADMIN     = "admin"
+)
+
+/**
+ * Access file contents, e.g. {"Tokens": {"s3cr3t": "admin"}, "Clients": {"monitoring": "read"}}
+ */
+type AccessConfig struct {
+	Tokens  map[string]string    // Bearer token => scope
+	Clients map[string]string    // Client certificate common name => scope
+	Keys    map[string]AccessKey `json:",omitempty"` // Key id => key commands from tubes are signed with
+}
+
+/**
+ * Named key for signing commands put into command tube, see --command-key
+ */
+type AccessKey struct {
+	Secret string
+	Scope  string
+}
+
+var (
+	accessFile = flag.String("access-file", "", "JSON file with control API tokens, client certificate names and command signing keys with their scopes")
+
+	access *AccessConfig
+
+	/** Scope each command needs, commands not listed need admin */
+	commandScopes = map[string]string{
+		"getLimits": SCOPE_READ, "getStatus": SCOPE_READ, "getConfig": SCOPE_READ,
+		"pause": SCOPE_OPERATE, "resume": SCOPE_OPERATE, "drain": SCOPE_OPERATE,
+		"setLimits": SCOPE_CONFIGURE, "setFeature": SCOPE_CONFIGURE, "rollbackConfig": SCOPE_CONFIGURE,
+	}
+)
+
+/**
+ * Loads access file, if configured
+ */
+func readAccessConfig() {
+	if *accessFile == "" {
+		return
+	}
+	file, err := ioutil.ReadFile(*accessFile)
+	if err != nil {
+		log.Fatalf("Fatal error: could not read access file: %v", err)
+	}
+	var config AccessConfig
+	if err := json.Unmarshal(file, &config); err != nil {
+		log.Fatalf("Fatal error: could not parse access file %s: %v", *accessFile, err)
+	}
+	scopes := make([]string, 0, len(config.Tokens)+len(config.Clients)+len(config.Keys))
+	for _, names := range []map[string]string{config.Tokens, config.Clients} {
+		for _, scope := range names {
+			scopes = append(scopes, scope)
+		}
+	}
+	for id, key := range config.Keys {
+		if key.Secret == "" {
+			log.Fatalf("Fatal error: key '%s' has no secret in access file %s", id, *accessFile)
+		}
+		scopes = append(scopes, key.Scope)
+	}
+	for _, scope := range scopes {
+		if scope != SCOPE_READ && scope != SCOPE_OPERATE && scope != SCOPE_CONFIGURE && scope != SCOPE_ADMIN {
+			log.Fatalf("Fatal error: unknown scope '%s' in access file %s", scope, *accessFile)
+		}
+	}
+	access = &config
+	log.Printf("Loaded %d token(s), %d client name(s) and %d key(s) from %s", len(config.Tokens), len(config.Clients), len(config.Keys), *accessFile)
+}
+
+/**
+ * Returns scope required to execute command
+ */
+func commandScope(command string) string {
+	if scope, has := commandScopes[command]; has {
+		return scope
+	}
+	return SCOPE_ADMIN
+}
+
+/**
+ * Checks if scope grants access to what needs another scope. Every scope allows reading,
+ * operate and configure allow nothing of each other
+ */
+func scopeAllows(scope, need string) bool {
+	return scope == SCOPE_ADMIN || scope == need || need == SCOPE_READ && scope != ""
+}
+
+/**
+ * Returns scope of bearer token from "Authorization" header value, empty if token is unknown
+ */
+func tokenScope(authorization string) string {
+	if access == nil || !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	scope := ""
+	// Compare against every token to not leak which one matched through timing
+	for known, knownScope := range access.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(known)) == 1 {
+			scope = knownScope
+		}
+	}
+	return scope
+}
+
+/**
+ * Checks bearer token from "Authorization" value or verified client certificate against scope needed, the same for
+ * HTTP and gRPC. Read-only calls are open when no access file is configured, changes always need token or verified
+ * client certificate with the scope. Returns empty reason if allowed, authenticated tells credentials lacking the
+ * scope from missing or invalid ones
+ */
+func authorize(authorization string, chains [][]*x509.Certificate, need string) (reason string, authenticated bool) {
+	if authorization != "" {
+		scope := tokenScope(authorization)
+		if scope == "" {
+			return "invalid token", false
+		}
+		if !scopeAllows(scope, need) {
+			return fmt.Sprintf("token scope '%s' does not allow this, '%s' needed", scope, need), true
+		}
+		return "", true
+	}
+	if len(chains) > 0 {
+		name := chains[0][0].Subject.CommonName
+		if scope := clientScope(name); scope != "" && scopeAllows(scope, need) {
+			return "", true
+		}
+		return fmt.Sprintf("client '%s' is not allowed this, '%s' needed", name, need), true
+	}
+	if need == SCOPE_READ && access == nil {
+		return "", false
+	}
+	return "token or client certificate required", false
+}
+
+/**
+ * Returns scope of verified client certificate by its common name
+ *
+ * Without access file any verified client is admin.
+ */
+func clientScope(commonName string) string {
+	if access == nil {
+		return SCOPE_ADMIN
+	}
+	return access.Clients[commonName]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+/**
+ * Verified chain of client certificate with common name, as TLS leaves it
+ */
+func clientChains(commonName string) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}
+}
+
+func TestAuthorize(t *testing.T) {
+	saved := access
+	defer func() { access = saved }()
+	configured := &AccessConfig{
+		Tokens:  map[string]string{"ops-token": SCOPE_OPERATE, "admin-token": SCOPE_ADMIN},
+		Clients: map[string]string{"monitoring": SCOPE_READ, "deployer": SCOPE_ADMIN},
+	}
+	tests := []struct {
+		name          string
+		access        *AccessConfig
+		authorization string
+		chains        [][]*x509.Certificate
+		need          string
+		wantReason    string
+		authenticated bool
+	}{
+		{"read open without access file", nil, "", nil, SCOPE_READ, "", false},
+		{"change needs credentials without access file", nil, "", nil, SCOPE_ADMIN, "required", false},
+		{"any verified client is admin without access file", nil, "", clientChains("anyone"), SCOPE_ADMIN, "", true},
+		{"read needs credentials with access file", configured, "", nil, SCOPE_READ, "required", false},
+		{"token with scope", configured, "Bearer ops-token", nil, SCOPE_OPERATE, "", true},
+		{"token scope too narrow", configured, "Bearer ops-token", nil, SCOPE_CONFIGURE, "token scope 'operate'", true},
+		{"unknown token", configured, "Bearer guessed", nil, SCOPE_READ, "invalid token", false},
+		{"token is checked before client certificate", configured, "Bearer guessed", clientChains("deployer"), SCOPE_READ, "invalid token", false},
+		{"client with scope", configured, "", clientChains("deployer"), SCOPE_ADMIN, "", true},
+		{"client scope too narrow", configured, "", clientChains("monitoring"), SCOPE_OPERATE, "client 'monitoring'", true},
+		{"unknown client", configured, "", clientChains("stranger"), SCOPE_READ, "client 'stranger'", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access = test.access
+			reason, authenticated := authorize(test.authorization, test.chains, test.need)
+			if test.wantReason == "" && reason != "" || test.wantReason != "" && !strings.Contains(reason, test.wantReason) {
+				t.Errorf("got reason %q, want %q", reason, test.wantReason)
+			}
+			if authenticated != test.authenticated {
+				t.Errorf("got authenticated %v, want %v", authenticated, test.authenticated)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+ * Status of instances merged by aggregate command
+ */
+type FleetStatus struct {
+	Instances    map[string]string // Instances asked, with error for ones that did not respond, empty if they did
+	TotalRunning uint
+	Tubes        map[string]*FleetTube
+}
+
+/** Tube over instances that responded */
+type FleetTube struct {
+	Instances uint   // Instances serving the tube
+	Running   uint   // Workers running over all of them
+	Runs      uint64 // Runs since each instance started
+	Errors    uint64 // Worker errors since each instance started
+	Backlog   int    // Ready jobs, most any instance saw, as instances usually share the queue
+}
+
+func runAggregate(name string, args []string) int {
+	fs := newFlagSet(name, "[instance ...]")
+	instances := parseFlagSet(fs, args)
+	if len(instances) == 0 {
+		var err error
+		if instances, err = fleetInstances(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	fleet := aggregateStatus(instances)
+	responded := 0
+	for _, failure := range fleet.Instances {
+		if failure == "" {
+			responded++
+		}
+	}
+	data, err := json.Marshal(fleet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	printJson(data)
+	if responded == 0 {
+		return 1
+	}
+	return 0
+}
+
+/**
+ * Returns names of instances registered with --register or sharing --coordination, for aggregate command without
+ * instances given
+ */
+func fleetInstances() ([]string, error) {
+	if *registerURL != "" {
+		backend, err := newRegistry(*registerURL)
+		if err != nil {
+			return nil, err
+		}
+		names, err := backend.instances()
+		if err != nil {
+			return nil, fmt.Errorf("could not read instances from %s: %v", *registerURL, err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no instances registered with %s", *registerURL)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	if *coordinationURL == "" {
+		return nil, fmt.Errorf("no instances given and no --register or --coordination to find them in")
+	}
+	conn, err := coordinationPool().Dial()
+	if err != nil {
+		return nil, fmt.Errorf("could not reach coordination backend: %v", err)
+	}
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", *coordinationPrefix+"instances"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read fleet instances: %v", err)
+	}
+	// Ids are name and process id, several processes may serve one name
+	var names []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if colon := strings.LastIndex(id, ":"); colon > 0 {
+			id = id[:colon]
+		}
+		if !seen[id] {
+			seen[id] = true
+			names = append(names, id)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no instances in fleet %s", *coordinationPrefix)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/**
+ * Asks instances for status through their command tubes at once and merges responses by tube
+ */
+func aggregateStatus(instances []string) *FleetStatus {
+	statuses := make([]*Stats, len(instances))
+	failures := make([]error, len(instances))
+	var wait sync.WaitGroup
+	for i, instance := range instances {
+		wait.Add(1)
+		go func(i int, instance string) {
+			defer wait.Done()
+			statuses[i], failures[i] = instanceStatus(instance)
+		}(i, instance)
+	}
+	wait.Wait()
+	fleet := &FleetStatus{Instances: make(map[string]string), Tubes: make(map[string]*FleetTube)}
+	for i, instance := range instances {
+		if failures[i] != nil {
+			fleet.Instances[instance] = failures[i].Error()
+			continue
+		}
+		fleet.Instances[instance] = ""
+		status := statuses[i]
+		fleet.TotalRunning += status.TotalRunning
+		for tube, runs := range status.Runs {
+			merged := fleet.Tubes[tube]
+			if merged == nil {
+				merged = &FleetTube{}
+				fleet.Tubes[tube] = merged
+			}
+			merged.Instances++
+			merged.Runs += runs
+			merged.Running += status.Running[tube]
+			merged.Errors += status.Errors[tube]
+			if status.Backlog[tube] > merged.Backlog {
+				merged.Backlog = status.Backlog[tube]
+			}
+		}
+	}
+	return fleet
+}
+
+/**
+ * Reads status of instance through its command tube
+ */
+func instanceStatus(instance string) (*Stats, error) {
+	response, err := sendTubeCommand(WorkerCommand{Command: "getStatus", RequestId: newRequestId()}, instance)
+	if err != nil {
+		return nil, err
+	}
+	response = unwrapResponse(response)
+	var failure CommandError
+	if json.Unmarshal(response, &failure) == nil && failure.Error != "" {
+		return nil, fmt.Errorf("%s", failure.Error)
+	}
+	status := &Stats{}
+	if err := json.Unmarshal(response, status); err != nil {
+		return nil, fmt.Errorf("could not decode status: %v", err)
+	}
+	return status, nil
+}
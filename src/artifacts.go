@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	/** Artifact manifest is checked that often */
+	ARTIFACT_RECHECK = 10 * time.Second
+	/** How long downloading one worker may take */
+	ARTIFACT_TIMEOUT = 5 * time.Minute
+	/** Largest worker downloaded */
+	ARTIFACT_MAX_SIZE = 512 << 20
+)
+
+var (
+	/** Workers fetched from artifact store by name and version */
+	artifactManifest = flag.String("artifact-manifest", "", "JSON file of workers to fetch from --artifact-store, {\"email\": {\"Version\": \"1.4.2\", \"Checksum\": \"<sha256>\"}}. Default: none")
+	artifactStore    = flag.String("artifact-store", "", "Base URL of worker artifacts, s3://bucket/prefix or https://host/path, worker is fetched from <store>/<name>/<version>. Default: none")
+	artifactCache    = flag.String("artifact-cache", "", "Directory downloaded workers are cached in by name and version. Default: workerman/artifacts in user cache directory")
+
+	artifactClient = &http.Client{Timeout: ARTIFACT_TIMEOUT}
+)
+
+/**
+ * Worker of artifact manifest
+ */
+type Artifact struct {
+	Version  string
+	Checksum string // Hex sha256 of worker file
+	URL      string `json:",omitempty"` // Where to fetch it from instead of --artifact-store
+}
+
+/**
+ * Worker installed from artifact store, shown in status
+ */
+type ArtifactStatus struct {
+	Version   string     // Version of manifest
+	Installed *time.Time `json:",omitempty"` // Since when worker file is that version
+	Error     string     `json:",omitempty"` // Why it could not be installed, previous version is left in place
+}
+
+/**
+ * Makes artifact manifest and cache paths absolute, must be called before changing working directory
+ */
+func resolveArtifactPaths() {
+	if *artifactManifest == "" {
+		return
+	}
+	if *readOnlyWorkers {
+		log.Fatalf("Fatal error: --artifact-manifest can not be used with --read-only-workers")
+	}
+	if *artifactCache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("Fatal error: no --artifact-cache given and no user cache directory: %v", err)
+		}
+		*artifactCache = filepath.Join(dir, "workerman", "artifacts")
+	}
+	for _, path := range []*string{artifactManifest, artifactCache} {
+		if abs, err := filepath.Abs(*path); err == nil {
+			*path = abs
+		}
+	}
+}
+
+/**
+ * Installs workers of artifact manifest into workers directory every ARTIFACT_RECHECK, so watcher subscribes them.
+ * A worker is installed when its manifest entry is new or changed, or its install failed, so deploys, rollbacks and
+ * promotes of worker file in between stay until the manifest says otherwise. Nothing is installed or removed during
+ * freeze windows, changes wait for them to end
+ */
+func syncArtifacts() {
+	if *artifactManifest == "" {
+		return
+	}
+	var lastManifest time.Time
+	var lastError, frozen string
+	// Manifest entries worker files were made to match
+	applied := make(map[string]Artifact)
+	for {
+		stateLock.Lock()
+		window := activeFreeze(time.Now())
+		stateLock.Unlock()
+		if window != "" && window != frozen {
+			log.Printf("Not installing workers of artifact manifest during freeze window %s", window)
+		}
+		if frozen = window; window != "" {
+			time.Sleep(ARTIFACT_RECHECK)
+			continue
+		}
+		changed := false
+		info, err := os.Stat(*artifactManifest)
+		var manifest map[string]Artifact
+		if err == nil {
+			manifest, err = readArtifactManifest()
+		}
+		if err != nil {
+			// Workers installed before stay
+			if err.Error() != lastError {
+				log.Printf("Could not read artifact manifest %s: %v", *artifactManifest, err)
+				lastError = err.Error()
+			}
+		} else {
+			lastError = ""
+			for name, artifact := range manifest {
+				if applied[name] == artifact {
+					continue
+				}
+				replaced, err := installArtifact(name, artifact)
+				if err == nil {
+					applied[name] = artifact
+				}
+				changed = replaced || changed
+			}
+			if !info.ModTime().Equal(lastManifest) {
+				changed = removeDroppedArtifacts(manifest) || changed
+				lastManifest = info.ModTime()
+				for name := range applied {
+					if _, listed := manifest[name]; !listed {
+						delete(applied, name)
+					}
+				}
+			}
+		}
+		if changed {
+			stateLock.Lock()
+			watchRequested = true
+			stateLock.Unlock()
+		}
+		time.Sleep(ARTIFACT_RECHECK)
+	}
+}
+
+/**
+ * Reads artifact manifest, checking names, versions and checksums can be used
+ */
+func readArtifactManifest() (map[string]Artifact, error) {
+	data, err := ioutil.ReadFile(*artifactManifest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]Artifact
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	for name, artifact := range manifest {
+		if err := checkWorkerName(name); err != nil {
+			return nil, err
+		}
+		if artifact.Version == "" || strings.ContainsAny(artifact.Version, "/\\") || artifact.Version[0] == '.' {
+			return nil, fmt.Errorf("worker %s has invalid version '%s'", name, artifact.Version)
+		}
+		if len(artifact.Checksum) != sha256.Size*2 {
+			return nil, fmt.Errorf("worker %s has no hex sha256 Checksum", name)
+		}
+		if artifact.URL == "" && *artifactStore == "" {
+			return nil, fmt.Errorf("worker %s has no URL and there is no --artifact-store", name)
+		}
+	}
+	return manifest, nil
+}
+
+/**
+ * Makes worker file match manifest, from cache or downloaded into it, keeping the file it replaces for rollbackWorker
+ * as deployWorker does. Returns true if worker file was replaced. Failures are returned, kept in Artifacts of status
+ * and logged when they change. Takes stateLock and deployLock itself
+ */
+func installArtifact(name string, artifact Artifact) (bool, error) {
+	want := strings.ToLower(artifact.Checksum)
+	integrityLock.Lock()
+	sum, _ := workerChecksum("./" + name)
+	integrityLock.Unlock()
+	if sum == want {
+		noteArtifact(name, artifact.Version, nil)
+		return false, nil
+	}
+	content, err := cachedArtifact(name, artifact, want)
+	if err == nil {
+		deployLock.Lock()
+		if err = keepPrevious(name); err == nil {
+			err = writeFileAtomic(name, content, 0755)
+		}
+		deployLock.Unlock()
+	}
+	if err != nil {
+		noteArtifact(name, artifact.Version, err)
+		return false, err
+	}
+	log.Printf("Installed worker %s version %s from artifact store", name, artifact.Version)
+	publishEvent("installed", name, artifact.Version)
+	noteArtifact(name, artifact.Version, nil)
+	return true, nil
+}
+
+/**
+ * Returns worker of version from cache, downloading and caching it if it is not there yet or does not match checksum
+ */
+func cachedArtifact(name string, artifact Artifact, want string) ([]byte, error) {
+	path := filepath.Join(*artifactCache, name, artifact.Version)
+	if content, err := ioutil.ReadFile(path); err == nil && checksumOf(content) == want {
+		return content, nil
+	}
+	location := artifact.URL
+	if location == "" {
+		location = strings.TrimSuffix(*artifactStore, "/") + "/" + url.PathEscape(name) + "/" + url.PathEscape(artifact.Version)
+	}
+	content, err := fetchArtifact(location)
+	if err != nil {
+		return nil, err
+	}
+	if sum := checksumOf(content); sum != want {
+		return nil, fmt.Errorf("%s has checksum %s, not %s", location, sum, want)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return content, writeFileAtomic(path, content, 0755)
+}
+
+/**
+ * Downloads artifact over HTTP(S) or from S3, with --claim-endpoint and --claim-region
+ */
+func fetchArtifact(location string) ([]byte, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	switch parsed.Scheme {
+	case "http", "https":
+		resp, err := artifactClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: %s", location, resp.Status)
+		}
+		body = resp.Body
+	case "s3":
+		ctx, cancel := context.WithTimeout(context.Background(), ARTIFACT_TIMEOUT)
+		defer cancel()
+		client, err := claimStore(ctx)
+		if err != nil {
+			return nil, err
+		}
+		object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(parsed.Host), Key: aws.String(strings.TrimPrefix(parsed.Path, "/"))})
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", location, err)
+		}
+		body = object.Body
+	default:
+		return nil, errors.New("artifact store must be s3, http or https URL")
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(body, ARTIFACT_MAX_SIZE+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", location, err)
+	}
+	if len(content) > ARTIFACT_MAX_SIZE {
+		return nil, fmt.Errorf("%s is over %d bytes", location, ARTIFACT_MAX_SIZE)
+	}
+	return content, nil
+}
+
+/**
+ * Removes workers dropped from manifest, if they are still a version cached from artifact store. Returns true if any was
+ */
+func removeDroppedArtifacts(manifest map[string]Artifact) bool {
+	names, err := ioutil.ReadDir(*artifactCache)
+	if err != nil {
+		return false
+	}
+	removed := false
+	for _, entry := range names {
+		name := entry.Name()
+		if _, listed := manifest[name]; listed || !entry.IsDir() {
+			continue
+		}
+		current, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		versions, _ := filepath.Glob(filepath.Join(*artifactCache, name, "*"))
+		for _, version := range versions {
+			if cached, err := ioutil.ReadFile(version); err == nil && checksumOf(cached) == checksumOf(current) {
+				if err := os.Remove(name); err != nil {
+					log.Printf("Could not remove worker %s dropped from artifact manifest: %v", name, err)
+				} else {
+					log.Printf("Removed worker %s dropped from artifact manifest", name)
+					removed = true
+				}
+				break
+			}
+		}
+	}
+	stateLock.Lock()
+	for name := range stats.Artifacts {
+		if _, listed := manifest[name]; !listed {
+			delete(stats.Artifacts, name)
+		}
+	}
+	stateLock.Unlock()
+	return removed
+}
+
+/**
+ * Records outcome of installing worker in status, logging failure when it is new. Takes stateLock itself
+ */
+func noteArtifact(name, version string, err error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stats.Artifacts == nil {
+		stats.Artifacts = make(map[string]*ArtifactStatus)
+	}
+	status := stats.Artifacts[name]
+	if status == nil {
+		status = &ArtifactStatus{}
+		stats.Artifacts[name] = status
+	}
+	if err != nil {
+		if message := err.Error(); status.Version != version || status.Error != message {
+			log.Printf("Could not install worker %s version %s: %v", name, version, err)
+			status.Error = message
+		}
+		if status.Version != version {
+			status.Installed = nil
+		}
+		status.Version = version
+		return
+	}
+	if status.Version != version || status.Error != "" || status.Installed == nil {
+		now := time.Now()
+		status.Installed = &now
+	}
+	status.Version, status.Error = version, ""
+}
+
+/**
+ * Returns hex sha256 of content
+ */
+func checksumOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/** How often backlog of autoscaled tubes is checked, and defaults of their settings */
+const (
+	AUTOSCALE_INTERVAL = 5 * time.Second
+	AUTOSCALE_BACKLOG  = 10
+	AUTOSCALE_STEP     = 1
+	AUTOSCALE_COOLDOWN = 30 * time.Second
+)
+
+/**
+ * Autoscaling of tube limit by backlog, between Limit and Max. Raised by Step while ready jobs are more than
+ * Backlog per allowed worker or oldest one waits longer than Age, lowered by Step once they are fewer than half of that.
+ * With Predict, limit does not go below workers predicted from history
+ */
+type Autoscale struct {
+	Max      uint      // Highest limit autoscaling goes to
+	Backlog  uint      `json:",omitempty"` // Ready jobs per worker tolerated, AUTOSCALE_BACKLOG if not set
+	Age      *Duration `json:",omitempty"` // Oldest ready job may wait that long, not considered if not set
+	Step     uint      `json:",omitempty"` // Workers added or removed at once, AUTOSCALE_STEP if not set
+	Cooldown *Duration `json:",omitempty"` // Least time between changes, AUTOSCALE_COOLDOWN if not set
+	Predict  bool      `json:",omitempty"` // Raise limit ahead of load same hour of past weeks had, see predict.go
+}
+
+/**
+ * Optionally implemented by brokers that can tell how long oldest ready job of tube has waited, for Age of autoscaling
+ */
+type brokerAger interface {
+	OldestReady(tube string) (time.Duration, error)
+}
+
+/** When limit of autoscaled tube last changed, used only by autoscaler goroutine */
+var autoscaleChanged = make(map[string]time.Time)
+
+/**
+ * Adjusts limits of tubes with Autoscale every AUTOSCALE_INTERVAL
+ */
+func autoscaleTubes() {
+	for range time.Tick(AUTOSCALE_INTERVAL) {
+		stateLock.Lock()
+		// Followers of cluster take limits of leader
+		if !decidesScaling() {
+			stateLock.Unlock()
+			continue
+		}
+		configs := make(map[string]EffectiveConfig)
+		for tube := range subscriptions {
+			if config := schedulingConfig(tube); config.Autoscale != nil {
+				configs[tube] = config
+			}
+		}
+		// Tubes no longer autoscaled go back to their limit
+		for tube := range stats.Autoscaled {
+			if _, has := configs[tube]; !has {
+				delete(stats.Autoscaled, tube)
+				delete(stats.Predicted, tube)
+				log.Printf("Stopped autoscaling %s", tube)
+			}
+		}
+		stateLock.Unlock()
+		for tube, config := range configs {
+			autoscaleTube(tube, config)
+		}
+	}
+}
+
+/**
+ * Reads backlog of tube and moves its limit a step when it is out of bounds and cooldown passed
+ */
+func autoscaleTube(tube string, config EffectiveConfig) {
+	scale := config.Autoscale
+	ready, err := broker.Stats(tube)
+	if err != nil {
+		return
+	}
+	var age time.Duration
+	if ager, ok := broker.(brokerAger); ok && scale.Age != nil && ready > 0 {
+		if age, err = ager.OldestReady(tube); err != nil {
+			return
+		}
+	}
+	backlog, step, cooldown := scale.Backlog, scale.Step, AUTOSCALE_COOLDOWN
+	if backlog == 0 {
+		backlog = AUTOSCALE_BACKLOG
+	}
+	if step == 0 {
+		step = AUTOSCALE_STEP
+	}
+	if scale.Cooldown != nil {
+		cooldown = scale.Cooldown.Duration
+	}
+	stateLock.Lock()
+	running := stats.Running[tube]
+	stats.Backlog[tube] = ready
+	stateLock.Unlock()
+	// Workers wanted: running ones and ones backlog beyond them would keep busy
+	recordLoad(tube, float64(running)+float64(ready)/float64(backlog), AUTOSCALE_INTERVAL)
+	// Limit of effective config includes autoscaling, base is the one configured, floor the predicted one when higher
+	current, base := config.Limit, config.baseLimit
+	floor := base
+	var predicted uint
+	if scale.Predict {
+		if predicted = predictedLoad(tube); predicted > floor {
+			floor = predicted
+		}
+		if floor > scale.Max {
+			floor = scale.Max
+		}
+	}
+	stateLock.Lock()
+	if predicted > 0 {
+		if stats.Predicted == nil {
+			stats.Predicted = make(map[string]uint)
+		}
+		stats.Predicted[tube] = predicted
+	} else {
+		delete(stats.Predicted, tube)
+	}
+	stateLock.Unlock()
+	if scale.Max <= base || time.Since(autoscaleChanged[tube]) < cooldown {
+		return
+	}
+	next := current
+	aged := scale.Age != nil && age > scale.Age.Duration
+	if current < floor {
+		next = floor
+	} else if uint(ready) > current*backlog || aged {
+		if next += step; next > scale.Max {
+			next = scale.Max
+		}
+	} else if uint(ready)*2 < current*backlog && (scale.Age == nil || age < scale.Age.Duration/2) {
+		if next = floor; current > floor+step {
+			next = current - step
+		}
+	}
+	if next == current {
+		return
+	}
+	autoscaleChanged[tube] = time.Now()
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if next <= base {
+		delete(stats.Autoscaled, tube)
+	} else {
+		if stats.Autoscaled == nil {
+			stats.Autoscaled = make(map[string]uint)
+		}
+		stats.Autoscaled[tube] = next
+	}
+	backlogText := fmt.Sprintf("%d job(s) ready", ready)
+	if scale.Age != nil {
+		backlogText += fmt.Sprintf(", oldest waiting %s", age.Round(time.Second))
+	}
+	if predicted > 0 {
+		backlogText += fmt.Sprintf(", %d worker(s) predicted", predicted)
+	}
+	log.Printf("Autoscaled limit of %s from %d to %d, %s", tube, current, next, backlogText)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+	"runtime"
+	"time"
+)
+
+/** How often host load is sampled for --auto-total */
+const AUTO_TOTAL_INTERVAL = 5 * time.Second
+
+var (
+	/** Total limit derived from host */
+	autoTotal      = flag.Bool("auto-total", false, "Derive total limit from host: CPUs times --workers-per-cpu, lowered while load average per CPU is over --auto-total-load or memory is short, never above Total of config. Default: false")
+	workersPerCPU  = flag.Float64("workers-per-cpu", 2, "Workers per CPU --auto-total allows while host is not loaded. Default: 2")
+	autoTotalLoad  = flag.Float64("auto-total-load", 1.5, "Load average per CPU over which --auto-total lowers the limit by a quarter, it grows again below three quarters of it. Default: 1.5")
+	workerMemoryMB = flag.Int("worker-memory-mb", 0, "Memory a worker needs in MB, --auto-total starts no more workers than available memory fits. Default: 0, memory is not considered")
+)
+
+/**
+ * Adjusts total limit to host every AUTO_TOTAL_INTERVAL while --auto-total is set
+ */
+func adjustAutoTotal() {
+	if !*autoTotal {
+		return
+	}
+	warned := false
+	for {
+		load, available, err := hostLoad()
+		if err != nil && !warned {
+			log.Printf("Could not read host load, total limit follows CPU count only: %v", err)
+			warned = true
+		}
+		stateLock.Lock()
+		total := nextAutoTotal(stats.AutoTotal, load, available, err == nil)
+		if total != stats.AutoTotal {
+			log.Printf("Total limit from host is %d (load %.2f, %d MB available)", total, load, available>>20)
+			stats.AutoTotal = total
+		}
+		stateLock.Unlock()
+		time.Sleep(AUTO_TOTAL_INTERVAL)
+	}
+}
+
+/**
+ * Returns total limit for host load, stepping current one down by a quarter while load is high and up by a tenth of
+ * the CPU ceiling while it is low, unchanged in between so the limit does not flap. Caller must hold stateLock
+ */
+func nextAutoTotal(current uint, load float64, available uint64, measured bool) uint {
+	cpus := float64(runtime.NumCPU())
+	ceiling := uint(math.Max(1, math.Round(cpus**workersPerCPU)))
+	if current == 0 || current > ceiling {
+		current = ceiling
+	}
+	if measured {
+		perCPU := load / cpus
+		if perCPU > *autoTotalLoad {
+			current -= uint(math.Max(1, float64(current/4)))
+		} else if perCPU < *autoTotalLoad*3/4 {
+			current += uint(math.Max(1, float64(ceiling)/10))
+		}
+		if *workerMemoryMB > 0 {
+			// Running workers already hold their memory
+			if fits := stats.TotalRunning + uint(available/(uint64(*workerMemoryMB)<<20)); fits < current {
+				current = fits
+			}
+		}
+	}
+	if current > ceiling {
+		current = ceiling
+	}
+	if current < 1 {
+		current = 1
+	}
+	return current
+}
+
+/**
+ * Returns total limit dispatch goes by: Total of config, or host derived one when lower. Caller must hold stateLock
+ */
+func totalLimit() uint {
+	if *autoTotal && stats.AutoTotal > 0 && stats.AutoTotal < limits.Total {
+		return stats.AutoTotal
+	}
+	return limits.Total
+}
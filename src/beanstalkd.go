@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("beanstalkd", func() Broker {
+		return &beanstalkBroker{reserving: make(map[string]*reservingConn)}
+	})
+}
+
+/** Subscribed tube on its (maybe shared) connection, both nil while not connected */
+type Queue struct {
+	conn *beanstalk.Conn
+	tube *beanstalk.Tube
+}
+
+var (
+	/** Tubes connections, guarded by stateLock */
+	connections = make(map[string]Queue)
+
+	errLostReservation = errors.New("job was reserved on broken connection, server releases it")
+)
+
+/**
+ * Beanstalkd backend. Subscribed tubes are polled on pooled connections, see pool.go, and recovered as in recovery.go.
+ * Reserve mode gives each tube a connection of its own, as reservations belong to connection
+ */
+type beanstalkBroker struct {
+	lock      sync.Mutex // Guards reserving map, connections in it are only used by reserver of their tube
+	reserving map[string]*reservingConn
+}
+
+/** Connection jobs of tube are reserved on */
+type reservingConn struct {
+	conn   *beanstalk.Conn
+	server string
+	jobs   int // Reserved jobs not finished yet
+}
+
+/** Reservation of job, valid as long as connection it was made on */
+type beanstalkHandle struct {
+	conn *beanstalk.Conn
+	id   uint64
+}
+
+func (b *beanstalkBroker) Subscribe(tube string) {
+	conn, err := newTubeConn(tube)
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if err == nil {
+		connections[tube] = Queue{conn, &beanstalk.Tube{conn, tube}}
+	} else {
+		// Subscribed anyway, connected in background
+		connections[tube] = Queue{}
+		stats.Degraded[tube] = time.Now().Format(time.RFC3339) + ": not connected: " + err.Error()
+		go connectTube(tube)
+	}
+}
+
+func (b *beanstalkBroker) Unsubscribe(tube string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if queue, subscribed := connections[tube]; subscribed {
+		delete(connections, tube)
+		releaseConn(queue.conn)
+	}
+}
+
+func (b *beanstalkBroker) Stats(tube string) (int, error) {
+	stateLock.Lock()
+	queue := connections[tube]
+	stateLock.Unlock()
+	if queue.tube == nil {
+		return 0, fmt.Errorf("%s is not connected", tube)
+	}
+	loopStage("tube stats", tube, queue.conn)
+	tubeStats, err := queue.tube.Stats()
+	if err != nil {
+		if isConnError(err) {
+			degradeTube(tube, queue.conn, err)
+		}
+		return 0, err
+	}
+	ready, _ := strconv.Atoi(tubeStats["current-jobs-ready"])
+	return ready, nil
+}
+
+/**
+ * Returns age of job beanstalkd would give out next, 0 when none is ready
+ */
+func (b *beanstalkBroker) OldestReady(tube string) (time.Duration, error) {
+	stateLock.Lock()
+	queue := connections[tube]
+	stateLock.Unlock()
+	if queue.tube == nil {
+		return 0, fmt.Errorf("%s is not connected", tube)
+	}
+	id, _, err := queue.tube.PeekReady()
+	if err != nil {
+		if cerr, ok := err.(beanstalk.ConnError); ok && cerr.Err == beanstalk.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	jobStats, err := queue.conn.StatsJob(id)
+	if err != nil {
+		return 0, err
+	}
+	age, _ := strconv.Atoi(jobStats["age"])
+	return time.Duration(age) * time.Second, nil
+}
+
+/**
+ * Reserves job on connection of tube, connecting it first. Connection moves to preferred server once jobs reserved
+ * on current one are finished. Broken connection degrades tube until reconnected, jobs reserved on it are released by server
+ */
+func (b *beanstalkBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	b.lock.Lock()
+	r, has := b.reserving[tube]
+	if !has {
+		r = &reservingConn{}
+		b.reserving[tube] = r
+	}
+	b.lock.Unlock()
+	stateLock.Lock()
+	address := serverFor(tube)
+	stateLock.Unlock()
+	if r.conn != nil && r.server != address && r.jobs == 0 {
+		log.Printf("Moving reserver of %s from %s to %s", tube, r.server, address)
+		r.conn.Close()
+		r.conn = nil
+	}
+	if r.conn == nil {
+		conn, err := dialServer(address)
+		if err != nil {
+			serverFailed(address, err)
+			return nil, err
+		}
+		r.conn, r.server = conn, address
+		tubeRecovered(tube)
+	}
+	tubes := &beanstalk.TubeSet{r.conn, map[string]bool{tube: true, "default": false}}
+	id, body, err := tubes.Reserve(timeout)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, nil
+		}
+		if isConnError(err) {
+			tubeFailed(tube, err)
+			r.conn.Close()
+			r.conn = nil
+		}
+		return nil, err
+	}
+	r.jobs++
+	job := &ReservedJob{Id: strconv.FormatUint(id, 10), Body: body, Priority: DEFAULT_PRIORITY, TTR: DEFAULT_TTR, handle: beanstalkHandle{r.conn, id}}
+	if jobStats, err := r.conn.StatsJob(id); err == nil {
+		if pri, err := strconv.ParseUint(jobStats["pri"], 10, 32); err == nil {
+			job.Priority = uint32(pri)
+		}
+		if ttr, err := strconv.Atoi(jobStats["ttr"]); err == nil && ttr > 0 {
+			job.TTR = time.Duration(ttr) * time.Second
+		}
+	}
+	return job, nil
+}
+
+func (b *beanstalkBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	r := b.reserving[tube]
+	delete(b.reserving, tube)
+	b.lock.Unlock()
+	if r != nil && r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (b *beanstalkBroker) Touch(job *ReservedJob) error {
+	handle, err := b.reservation(job, false)
+	if err != nil {
+		return err
+	}
+	return handle.conn.Touch(handle.id)
+}
+
+func (b *beanstalkBroker) Delete(job *ReservedJob) error {
+	handle, err := b.reservation(job, true)
+	if err != nil {
+		return err
+	}
+	return handle.conn.Delete(handle.id)
+}
+
+func (b *beanstalkBroker) Release(job *ReservedJob) error {
+	handle, err := b.reservation(job, true)
+	if err != nil {
+		return err
+	}
+	return handle.conn.Release(handle.id, job.Priority, 0)
+}
+
+func (b *beanstalkBroker) Bury(job *ReservedJob) error {
+	handle, err := b.reservation(job, true)
+	if err != nil {
+		return err
+	}
+	return handle.conn.Bury(handle.id, job.Priority)
+}
+
+/**
+ * Returns reservation of job while connection it was made on is still in use, counting job finished if asked
+ */
+func (b *beanstalkBroker) reservation(job *ReservedJob, finish bool) (beanstalkHandle, error) {
+	handle := job.handle.(beanstalkHandle)
+	b.lock.Lock()
+	r := b.reserving[job.Tube]
+	b.lock.Unlock()
+	if r == nil {
+		return handle, errLostReservation
+	}
+	if finish {
+		r.jobs--
+	}
+	if r.conn != handle.conn {
+		return handle, errLostReservation
+	}
+	return handle, nil
+}
+
+/**
+ * Publishes job on a connection of its own, so it does not interfere with polling
+ */
+func (b *beanstalkBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	stateLock.Lock()
+	address := serverFor(tube)
+	stateLock.Unlock()
+	conn, err := dialServer(address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	id, err := (&beanstalk.Tube{conn, tube}).Put(body, priority, delay, ttr)
+	return strconv.FormatUint(id, 10), err
+}
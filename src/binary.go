@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/** How worker output that is not text goes into daemon log */
+var logBinary = flag.String("log-binary", "raw", "How worker output that is not UTF-8 text is logged: raw as it is, escape for \\x escapes of bytes that are not text, base64 to log it encoded. Default: raw")
+
+/**
+ * Checks if body is UTF-8 text without control characters other than tab and line breaks, so it can be logged or
+ * passed as JSON string as it is
+ */
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, b := range body {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Returns worker output for daemon log as --log-binary says, text goes as it is
+ */
+func loggableOutput(output []byte) string {
+	if *logBinary == "raw" || isText(output) {
+		return string(output)
+	}
+	if *logBinary == "base64" {
+		return fmt.Sprintf("(%d bytes base64) %s", len(output), base64.StdEncoding.EncodeToString(output))
+	}
+	var escaped strings.Builder
+	for len(output) > 0 {
+		r, size := utf8.DecodeRune(output)
+		if r == utf8.RuneError && size <= 1 || r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0x7f {
+			fmt.Fprintf(&escaped, "\\x%02x", output[0])
+			size = 1
+		} else {
+			escaped.Write(output[:size])
+		}
+		output = output[size:]
+	}
+	return escaped.String()
+}
+
+/**
+ * Returns how many bytes of p fit into room without splitting UTF-8 sequence at the end, moving cut back by up to
+ * 3 bytes, so text output cut at --output-max-size stays text
+ */
+func runeBoundary(p []byte, room int) int {
+	for cut := room; cut > 0 && cut > room-utf8.UTFMax; cut-- {
+		if utf8.RuneStart(p[cut]) {
+			return cut
+		}
+	}
+	return room
+}
+
+/**
+ * Checks if body can be sent as SQS message body, which takes XML characters only
+ */
+func sqsSafe(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, r := range string(body) {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0xfffe || r == 0xffff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Queue backend jobs come from. Scheduler and worker runner only talk to it, so backends are added by implementing it,
+ * in a file of their own calling registerBroker() from init().
+ *
+ * Methods take stateLock themselves when needed, callers must not hold it. Reserve and job operations of a tube are called
+ * from one goroutine at a time, the reserver of the tube. Stats of different tubes are called concurrently.
+ * Connection problems are handled inside: broker reconnects in background and lists affected tubes in Degraded of status meanwhile.
+ */
+type Broker interface {
+	// Starts watching tube, connecting in background when backend is not reachable yet
+	Subscribe(tube string)
+	// Stops watching tube and closes what it used
+	Unsubscribe(tube string)
+	// Returns number of jobs ready in tube
+	Stats(tube string) (int, error)
+	// Waits up to timeout for job of tube, nil job when none came meanwhile
+	Reserve(tube string, timeout time.Duration) (*ReservedJob, error)
+	// Releases what Reserve set up for tube, called once its reserved jobs are finished
+	StopReserving(tube string)
+	// Keeps job reserved while worker runs
+	Touch(job *ReservedJob) error
+	// Removes job after successful run
+	Delete(job *ReservedJob) error
+	// Puts job back for another try
+	Release(job *ReservedJob) error
+	// Sets failed job aside, so it can be replayed
+	Bury(job *ReservedJob) error
+	// Publishes job into tube, returns its id
+	Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error)
+}
+
+var (
+	/** Queue backend to use */
+	brokerName = flag.String("broker", "beanstalkd", "Queue backend jobs come from. Default: beanstalkd")
+
+	/** Available backends by name */
+	brokers = make(map[string]func() Broker)
+
+	/** Backend in use, set up once at startup */
+	broker Broker
+
+	/** Subscribed tubes, guarded by stateLock */
+	subscriptions = make(map[string]bool)
+
+	/** Tubes whose worker is gone, no longer dispatched but subscribed until their running workers exit. Guarded by stateLock */
+	retiring = make(map[string]bool)
+)
+
+/**
+ * Optionally implemented by brokers, so validate can check connectivity
+ */
+type brokerChecker interface {
+	Check() error
+}
+
+/**
+ * Registers queue backend, called from init() of the code implementing it
+ */
+func registerBroker(name string, factory func() Broker) {
+	brokers[name] = factory
+}
+
+/**
+ * Sets up backend chosen with --broker
+ */
+func openBroker() {
+	discoverPlugins()
+	factory, known := brokers[*brokerName]
+	if !known {
+		names := make([]string, 0, len(brokers))
+		for name := range brokers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("Fatal error: unknown --broker '%s', expected one of %s", *brokerName, strings.Join(names, ", "))
+	}
+	broker = factory()
+}
+
+/**
+ * Checks if command tube is read from beanstalkd: always with beanstalkd broker, with other brokers when --connect is given
+ */
+func commandTubes() bool {
+	return *brokerName == "beanstalkd" || *server != flag.Lookup("connect").DefValue
+}
+
+/**
+ * Checks if workerman reserves jobs of tube and hands them to workers. Workers only know to take jobs
+ * from beanstalkd themselves, jobs of other brokers are always handed over. Caller must hold stateLock
+ */
+func reserveMode(tube string) bool {
+	return *brokerName != "beanstalkd" || featureEnabled(tube, "reserve-mode")
+}
+
+/**
+ * Lists tube in Degraded after broker failed to reach its backend, reserving retries. Takes stateLock itself
+ */
+func tubeFailed(tube string, err error) {
+	stateLock.Lock()
+	_, degraded := stats.Degraded[tube]
+	stats.Degraded[tube] = time.Now().Format(time.RFC3339) + ": " + err.Error()
+	stats.LastError = fmt.Sprintf("%s: %v", tube, err)
+	stateLock.Unlock()
+	if !degraded {
+		publishEvent("degraded", tube, err.Error())
+	}
+}
+
+/**
+ * Removes tube from Degraded once broker reaches its backend again. Takes stateLock itself
+ */
+func tubeRecovered(tube string) {
+	stateLock.Lock()
+	_, degraded := stats.Degraded[tube]
+	if degraded {
+		delete(stats.Degraded, tube)
+		stats.TotalRecoveries++
+	}
+	stateLock.Unlock()
+	if degraded {
+		log.Printf("Reconnected %s", tube)
+		publishEvent("recovered", tube, "")
+	}
+}
+
+/**
+ * Jobs of tube broker may hand out before they are finished: tube limit, or minimal workers if that is more.
+ * Takes stateLock itself
+ */
+func prefetchLimit(tube string) int {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	prefetch := int(effectiveConfig(tube).Limit)
+	if int(limits.Min) > prefetch {
+		prefetch = int(limits.Min)
+	}
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	return prefetch
+}
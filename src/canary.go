@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	/** Directory in workers directory keeping stable versions of workers with Canary */
+	CANARY_DIR = ".workerman-canary"
+	/** Canary runs decision is made after when Runs is not set */
+	DEFAULT_CANARY_RUNS = 20
+)
+
+/**
+ * Canary rollout of tube, e.g. {"Percent": 10, "MaxErrorPercent": 5, "Runs": 50}. Once worker file changes, only
+ * Percent of runs start the new version while the rest start the stable one kept aside. After Runs canary runs the
+ * new version becomes stable if at most MaxErrorPercent of them failed, otherwise it is rolled back: every run starts
+ * the stable version until worker file changes again. Applies to workers started per job, not resident or preforked
+ */
+type Canary struct {
+	Percent         float64 // Share of runs starting new version, 0 to 100
+	MaxErrorPercent float64 `json:",omitempty"` // Share of canary runs that may fail for new version to be promoted
+	Runs            uint    `json:",omitempty"` // Canary runs before promoting or rolling back, 20 if 0
+}
+
+/**
+ * Rollout of new worker version, shown in status
+ */
+type CanaryStatus struct {
+	State   string // "testing", "promoted" or "rolled back"
+	Stable  string // Checksum of stable version
+	Canary  string // Checksum of new version
+	Runs    uint64 // Canary runs so far
+	Errors  uint64
+	Started time.Time
+	Decided *time.Time `json:",omitempty"`
+	// Why stable version does not pass integrity check, runs start the new, checked one instead meanwhile
+	Integrity string `json:",omitempty"`
+}
+
+/**
+ * Returns executable worker run is to start: worker file, or stable version while new one is tested or rolled back.
+ * Canary checksum is returned when run starts new version under test, its outcome must be told to canaryOutcome then.
+ * Takes stateLock itself
+ */
+func canaryPath(worker string, config EffectiveConfig) (string, string) {
+	current := "./" + worker
+	if config.Canary == nil || config.features["prefork"] {
+		return current, ""
+	}
+	stable := filepath.Join(CANARY_DIR, worker)
+	integrityLock.Lock()
+	sum, err := workerChecksum(current)
+	stableSum, stableErr := workerChecksum(stable)
+	integrityLock.Unlock()
+	if err != nil {
+		return current, ""
+	}
+	if os.IsNotExist(stableErr) {
+		// First run keeps what is deployed now as stable version
+		if err := keepStable(worker, sum); err != nil {
+			log.Printf("Could not keep stable version of %s for canary: %v", worker, err)
+		}
+		return current, ""
+	}
+	if stableErr != nil || sum == stableSum {
+		return current, ""
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stats.Canaries == nil {
+		stats.Canaries = make(map[string]*CanaryStatus)
+	}
+	status := stats.Canaries[worker]
+	if status == nil || status.Canary != sum || status.Stable != stableSum {
+		status = &CanaryStatus{State: "testing", Stable: stableSum, Canary: sum, Started: time.Now()}
+		if rejected, _ := ioutil.ReadFile(stable + ".rejected"); strings.TrimSpace(string(rejected)) == sum {
+			// Rolled back before restart
+			status.State = "rolled back"
+		} else {
+			log.Printf("Canary of %s started: %.1f%% of runs start new version %.12s", worker, config.Canary.Percent, sum)
+			publishEvent("canary", worker, "started "+sum)
+		}
+		stats.Canaries[worker] = status
+	}
+	if status.State == "testing" && rand.Float64()*100 < config.Canary.Percent {
+		return current, sum
+	}
+	// Stable version is exec'd as well, it must match manifest as worker file must
+	violation := integrityViolation(stable, stable)
+	if violation != status.Integrity {
+		if violation != "" {
+			log.Printf("Stable version of %s fails integrity check, starting new version instead: %s", worker, violation)
+			publishEvent("integrity", worker, "stable version: "+violation)
+		}
+		status.Integrity = violation
+	}
+	if violation != "" {
+		return current, ""
+	}
+	return "./" + stable, ""
+}
+
+/**
+ * Counts outcome of canary run, promoting or rolling back new version once it had its Runs. Takes stateLock itself
+ */
+func canaryOutcome(worker, sum string, config EffectiveConfig, failed bool) {
+	if config.Canary == nil || sum == "" {
+		return
+	}
+	stateLock.Lock()
+	status := stats.Canaries[worker]
+	if status == nil || status.Canary != sum || status.State != "testing" {
+		stateLock.Unlock()
+		return
+	}
+	status.Runs++
+	if failed {
+		status.Errors++
+	}
+	runs := uint64(config.Canary.Runs)
+	if runs == 0 {
+		runs = DEFAULT_CANARY_RUNS
+	}
+	if status.Runs < runs {
+		stateLock.Unlock()
+		return
+	}
+	errorPercent := float64(status.Errors) * 100 / float64(status.Runs)
+	promote := errorPercent <= config.Canary.MaxErrorPercent
+	now := time.Now()
+	status.Decided = &now
+	if promote {
+		status.State = "promoted"
+	} else {
+		status.State = "rolled back"
+	}
+	stateLock.Unlock()
+	message := fmt.Sprintf("%d of %d canary runs failed (%.1f%%, %.1f%% allowed)", status.Errors, status.Runs, errorPercent, config.Canary.MaxErrorPercent)
+	if !promote {
+		log.Printf("Rolled back new version %.12s of %s: %s", sum, worker, message)
+		publishEvent("canary", worker, "rolled back "+sum+": "+message)
+		if err := writeFileAtomic(filepath.Join(CANARY_DIR, worker)+".rejected", []byte(sum+"\n"), 0644); err != nil {
+			log.Printf("Could not record rolled back version of %s: %v", worker, err)
+		}
+		return
+	}
+	if err := keepStable(worker, sum); err != nil {
+		log.Printf("Could not promote new version of %s: %v", worker, err)
+		return
+	}
+	os.Remove(filepath.Join(CANARY_DIR, worker) + ".rejected")
+	log.Printf("Promoted new version %.12s of %s: %s", sum, worker, message)
+	publishEvent("canary", worker, "promoted "+sum+": "+message)
+}
+
+/**
+ * Copies worker file into CANARY_DIR as stable version, if it still has checksum given
+ */
+func keepStable(worker, sum string) error {
+	content, err := ioutil.ReadFile(worker)
+	if err != nil {
+		return err
+	}
+	if checksumOf(content) != sum {
+		return fmt.Errorf("%s changed meanwhile", worker)
+	}
+	if err := os.MkdirAll(CANARY_DIR, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(CANARY_DIR, worker), content, 0755)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Claim check format version, and how long fetching or deleting its object may take */
+const (
+	CLAIM_VERSION = 1
+	CLAIM_TIMEOUT = 5 * time.Minute
+)
+
+var (
+	/** Object storage payloads of claim checks are kept in */
+	claimBuckets  = flag.String("claim-buckets", "", "Comma separated buckets claim check payloads may be fetched from and are deleted in once job succeeds. Default: none, claim checks are passed to workers as they are")
+	claimEndpoint = flag.String("claim-endpoint", "", "S3 compatible endpoint of claim check buckets, e.g. http://minio:9000 for MinIO, with path style addressing. Default: AWS S3")
+	claimRegion   = flag.String("claim-region", "", "AWS region of claim check buckets. Default: from AWS_REGION or AWS config")
+	claimMaxSize  = flag.Int64("claim-max-size", 256<<20, "Largest claim check payload fetched in bytes, jobs with bigger ones are buried, 0 for no limit. Default: 268435456")
+
+	/** Object storage could not be reached, job is released rather than buried */
+	errClaimUnavailable = errors.New("claim check payload unavailable")
+
+	claimLock sync.Mutex
+	s3Client  *s3.Client // Created on first claim check, guarded by claimLock
+)
+
+/**
+ * Reference to job payload kept in object storage, put by producers instead of payload too big for the queue,
+ * see client.PayloadStore
+ */
+type ClaimCheck struct {
+	WorkermanClaim int    // Format version, 1
+	URL            string // s3://bucket/key
+	Size           int64  `json:",omitempty"`
+
+	bucket, key string
+}
+
+/**
+ * Returns claim check body is, nil if it is none or claim checks are not enabled
+ */
+func parseClaim(body []byte) (*ClaimCheck, error) {
+	if *claimBuckets == "" || !bytes.Contains(body, []byte(`"WorkermanClaim"`)) {
+		return nil, nil
+	}
+	var claim ClaimCheck
+	if err := json.Unmarshal(body, &claim); err != nil || claim.WorkermanClaim == 0 {
+		// Not a claim check, just mentions one
+		return nil, nil
+	}
+	if claim.WorkermanClaim != CLAIM_VERSION {
+		return nil, fmt.Errorf("unknown claim check version %d", claim.WorkermanClaim)
+	}
+	location, err := url.Parse(claim.URL)
+	if err != nil || location.Scheme != "s3" || location.Host == "" || len(location.Path) < 2 {
+		return nil, fmt.Errorf("claim check URL %q is not s3://bucket/key", claim.URL)
+	}
+	claim.bucket, claim.key = location.Host, strings.TrimPrefix(location.Path, "/")
+	for _, bucket := range strings.Split(*claimBuckets, ",") {
+		if strings.TrimSpace(bucket) == claim.bucket {
+			return &claim, nil
+		}
+	}
+	return nil, fmt.Errorf("bucket %s is not in --claim-buckets", claim.bucket)
+}
+
+/**
+ * Returns client of object storage, creating it on first use. Takes claimLock itself
+ */
+func claimStore(ctx context.Context) (*s3.Client, error) {
+	claimLock.Lock()
+	defer claimLock.Unlock()
+	if s3Client != nil {
+		return s3Client, nil
+	}
+	var options []func(*config.LoadOptions) error
+	if *claimRegion != "" {
+		options = append(options, config.WithRegion(*claimRegion))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if *claimEndpoint != "" {
+			o.BaseEndpoint = aws.String(*claimEndpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return s3Client, nil
+}
+
+/**
+ * Fetches payload of claim check, failing with errClaimUnavailable when object storage could not be reached
+ */
+func fetchClaim(claim *ClaimCheck) ([]byte, error) {
+	if *claimMaxSize > 0 && claim.Size > *claimMaxSize {
+		return nil, fmt.Errorf("%d bytes is over --claim-max-size", claim.Size)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CLAIM_TIMEOUT)
+	defer cancel()
+	client, err := claimStore(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errClaimUnavailable, err)
+	}
+	object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(claim.bucket), Key: aws.String(claim.key)})
+	if err != nil {
+		var missing *types.NoSuchKey
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s does not exist", claim.URL)
+		}
+		return nil, fmt.Errorf("%w: %v", errClaimUnavailable, err)
+	}
+	defer object.Body.Close()
+	if *claimMaxSize > 0 && object.ContentLength != nil && *object.ContentLength > *claimMaxSize {
+		return nil, fmt.Errorf("%d bytes is over --claim-max-size", *object.ContentLength)
+	}
+	body, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errClaimUnavailable, err)
+	}
+	return body, nil
+}
+
+/**
+ * Replaces claim check of reserved job with payload it refers to, before it is opened for worker. Job whose payload
+ * can not be fetched is buried, or released when object storage could not be reached, true is returned then and
+ * worker must not be started. Job body itself stays the claim check, so released or routed job does
+ */
+func fetchJobPayload(worker string, job *ReservedJob) bool {
+	claim, err := parseClaim(job.Body)
+	if err == nil && claim == nil {
+		return false
+	}
+	var body []byte
+	if err == nil {
+		body, err = fetchClaim(claim)
+	}
+	if err == nil {
+		job.plain, job.claim = body, claim
+		return false
+	}
+	outcome := "bury"
+	if errors.Is(err, errClaimUnavailable) {
+		outcome = "release"
+	}
+	log.Printf("Could not fetch claim check payload of job %s of %s, %s it: %v", job.Id, worker, outcome, err)
+	return rejectJob(worker, job, outcome, "claim: "+err.Error())
+}
+
+/**
+ * Deletes object of claim check once its job is done with
+ */
+func deleteClaim(job *ReservedJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), CLAIM_TIMEOUT)
+	defer cancel()
+	client, err := claimStore(ctx)
+	if err == nil {
+		_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(job.claim.bucket), Key: aws.String(job.claim.key)})
+	}
+	if err != nil {
+		log.Printf("Could not delete %s of job %s of %s: %v", job.claim.URL, job.Id, job.Tube, err)
+	}
+}
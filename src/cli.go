@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Subcommand of the binary, e.g. "workerman status"
+ */
+type Subcommand struct {
+	Name        string
+	Args        string
+	Description string
+	Run         func(name string, args []string) int
+}
+
+var (
+	/** How long client subcommands wait for daemon response */
+	replyTimeout = flag.Duration("reply-timeout", 5*time.Second, "How long to wait for daemon response. Default: 5s")
+
+	subcommands []*Subcommand
+)
+
+func init() {
+	subcommands = []*Subcommand{
+		{"run", "", "Start the daemon (default when no command given)", runDaemon},
+		{"status", "", "Print status of the running daemon", runStatus},
+		{"aggregate", "[instance ...]", "Print status of instances merged by tube, registered or --coordination fleet ones if none given", runAggregate},
+		{"config", "[tube ...]", "Print effective settings of tubes (all if none given)", runConfig},
+		{"set-limit", "[--total N] [--min N] [tube=limit ...]", "Change limits of the running daemon, tenant.*=limit for all tubes of tenant", runSetLimit},
+		{"pause", "[tube ...]", "Stop dispatching workers for tubes (all if none given)", runPause},
+		{"resume", "[tube ...]", "Resume dispatching workers for tubes (all if none given)", runPause},
+		{"drain", "", "Stop dispatching and exit the daemon once running workers finish", runDrain},
+		{"put", "<tube> [--file payload] [--delay 5s] [--priority N] [--ttr 60s]", "Publish a job into subscribed tube, payload is read from stdin if no file given", runPut},
+		{"replay", "<tube> [--count N] [--rate N] [--from tube]", "Kick buried jobs of the tube, or move jobs from another tube into it, at limited rate", runReplay},
+		{"feature", "<name> on|off [tube]", "Toggle experimental behavior for a tube, or for all tubes if none given", runFeature},
+		{"rollback-config", "", "Restore limits and settings from the most recent config backup", runRollbackConfig},
+		{"deploy", "<worker> <tarball|url> [--checksum sha256] [--override reason]", "Write worker from tar archive into workers directory of the daemon and subscribe it", runDeploy},
+		{"sync-workers", "[--override reason]", "Pull git checkout of workers directory of the daemon now, see --workers-git", runSyncWorkers},
+		{"rollback-worker", "<worker>", "Switch worker back to the version its last deploy replaced", runSwitchWorker},
+		{"promote-worker", "<worker>", "Switch worker forward to the version rolled back from", runSwitchWorker},
+		{"validate", "[--offline]", "Check config, workers and connectivity, then exit", runValidate},
+	}
+}
+
+/**
+ * Prints usage with the list of subcommands
+ */
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [command] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, sub := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", sub.Name, sub.Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+/**
+ * Finds subcommand by name
+ */
+func findSubcommand(name string) *Subcommand {
+	for _, sub := range subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+/**
+ * Creates flag set for subcommand which accepts global flags as well
+ */
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] %s %s\n\nOptions:\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+/**
+ * Parses subcommand arguments and applies environment overrides, returns positional arguments
+ *
+ * Flags may follow positional arguments, e.g. "put email --delay 5s".
+ */
+func parseFlagSet(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if args = fs.Args(); len(args) == 0 {
+			break
+		}
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	applyEnvFlags(fs)
+	return positional
+}
+
+/**
+ * Sends command to the running daemon and waits for response
+ *
+ * Control socket is preferred, so commands work even if beanstalkd is down.
+ * Command tube is used when socket is disabled or not available, with response
+ * put into private reply tube, so clients do not steal each other's responses.
+ * With --controller command goes to the instance through controller, even from another host.
+ */
+func sendCommand(cmd WorkerCommand) ([]byte, error) {
+	setTubeNames()
+	cmd.RequestId = newRequestId()
+	if *socketPath != "" && *controller == "" {
+		if sock, sErr := net.DialTimeout("unix", *socketPath, *replyTimeout); sErr == nil {
+			body, err := json.Marshal(cmd)
+			if err != nil {
+				return nil, err
+			}
+			return sendSocketCommand(sock, body)
+		}
+	}
+	return sendTubeCommand(cmd, stats.Instance)
+}
+
+/**
+ * Sends command into command tube of instance and waits for response in private reply tube
+ */
+func sendTubeCommand(cmd WorkerCommand, instance string) ([]byte, error) {
+	commandTube := *commandPrefix + instance
+	// Nobody takes response once command gave up waiting for it
+	cmd.ReplyTo, cmd.ResponseTTL = *responsePrefix+instance+"."+cmd.RequestId, &Duration{*replyTimeout}
+	encoding, err := wireEncoding(*controlEncoding)
+	if err != nil {
+		return nil, err
+	}
+	body, err := encodeCommand(cmd)
+	if err == nil {
+		body, err = encodeWire(encoding, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Daemon would bury it without response
+	if *commandMaxSize > 0 && len(body) > *commandMaxSize {
+		return nil, fmt.Errorf("command is %d bytes, over --command-max-size %d of command tube, use control socket or URL", len(body), *commandMaxSize)
+	}
+	var conn *beanstalk.Conn
+	if *controller != "" {
+		conn, err = dialServer(*controller)
+	} else {
+		conn, err = dialAny()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tube := &beanstalk.Tube{conn, commandTube}
+	if _, err := tube.Put(body, 0, 0, 5*time.Second); err != nil {
+		return nil, fmt.Errorf("could not put command into %s: %v", commandTube, err)
+	}
+	replies := &beanstalk.TubeSet{conn, map[string]bool{cmd.ReplyTo: true, "default": false}}
+	id, response, err := replies.Reserve(*replyTimeout)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("no response in %s within %s, is workerman running?", cmd.ReplyTo, *replyTimeout)
+		}
+		return nil, fmt.Errorf("could not read response from %s: %v", cmd.ReplyTo, err)
+	}
+	conn.Delete(id)
+	if response, err = inflateResponse(response); err != nil {
+		return nil, err
+	}
+	response, _, err = decodeWire(response)
+	return response, err
+}
+
+/**
+ * Generates random id for command correlation
+ */
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/**
+ * Sends command and prints the response, returns exit code
+ */
+func sendAndPrint(cmd WorkerCommand) int {
+	response, err := sendCommand(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var failure CommandError
+	if json.Unmarshal(unwrapResponse(response), &failure) == nil && failure.Error != "" {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", failure.Error)
+		return 1
+	}
+	printJson(unwrapResponse(response))
+	return 0
+}
+
+/**
+ * Strips request id envelope from response, if any
+ */
+func unwrapResponse(response []byte) []byte {
+	var envelope CommandResponse
+	if json.Unmarshal(response, &envelope) == nil && envelope.RequestId != "" {
+		return envelope.Response
+	}
+	return response
+}
+
+/**
+ * Prints JSON indented
+ */
+func printJson(data []byte) {
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		out.Reset()
+		out.Write(data)
+	}
+	fmt.Println(out.String())
+}
+
+func runStatus(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	parseFlagSet(fs, args)
+	return sendAndPrint(WorkerCommand{Command: "getStatus"})
+}
+
+func runConfig(name string, args []string) int {
+	fs := newFlagSet(name, "[tube ...]")
+	options := make(map[string]string)
+	for _, tube := range parseFlagSet(fs, args) {
+		options[tube] = ""
+	}
+	return sendAndPrint(WorkerCommand{Command: "getConfig", Options: options})
+}
+
+func runSetLimit(name string, args []string) int {
+	fs := newFlagSet(name, "[--total N] [--min N] [tube=limit ...]")
+	total := fs.Int("total", -1, "Total number of workers to allow")
+	min := fs.Int("min", -1, "Minimal number of workers to allow for each tube")
+	pairs := parseFlagSet(fs, args)
+	update := &LimitsUpdate{Tubes: make(map[string]int)}
+	if *total >= 0 {
+		update.Total = total
+	}
+	if *min >= 0 {
+		update.Min = min
+	}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid argument '%s', expected tube=limit\n", pair)
+			return 2
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid limit for %s: %s\n", parts[0], parts[1])
+			return 2
+		}
+		// Pattern of all tubes of tenant, e.g. acme.*=20
+		if tenant := strings.TrimSuffix(parts[0], TENANT_SEPARATOR+"*"); tenant != parts[0] {
+			if update.Tenants == nil {
+				update.Tenants = make(map[string]int)
+			}
+			update.Tenants[tenant] = limit
+		} else {
+			update.Tubes[parts[0]] = limit
+		}
+	}
+	if update.Total == nil && update.Min == nil && len(update.Tubes) == 0 && len(update.Tenants) == 0 {
+		fs.Usage()
+		return 2
+	}
+	response, err := sendCommand(WorkerCommand{Command: "setLimits", Limits: update})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var result LimitsUpdateResponse
+	if err := json.Unmarshal(unwrapResponse(response), &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not parse response: %v\n", err)
+		return 1
+	}
+	for _, problem := range result.Errors {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", problem)
+	}
+	if !result.Applied {
+		return 1
+	}
+	printJson(unwrapResponse(response))
+	return 0
+}
+
+func runPause(name string, args []string) int {
+	fs := newFlagSet(name, "[tube ...]")
+	options := make(map[string]string)
+	for _, tube := range parseFlagSet(fs, args) {
+		options[tube] = ""
+	}
+	if len(options) == 0 {
+		options["*"] = ""
+	}
+	return sendAndPrint(WorkerCommand{Command: name, Options: options})
+}
+
+func runPut(name string, args []string) int {
+	fs := newFlagSet(name, "<tube> [--file payload] [--delay 5s] [--priority N] [--ttr 60s]")
+	file := fs.String("file", "", "File with job payload, stdin if not given")
+	delay := fs.Duration("delay", 0, "Delay before job becomes ready")
+	priority := fs.Uint("priority", DEFAULT_PRIORITY, "Job priority, lower is more urgent")
+	ttr := fs.Duration("ttr", DEFAULT_TTR, "Time to run")
+	positional := parseFlagSet(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+	var body []byte
+	var err error
+	if *file != "" {
+		body, err = ioutil.ReadFile(*file)
+	} else {
+		body, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read payload: %v\n", err)
+		return 1
+	}
+	jobPriority := uint32(*priority)
+	job := &JobRequest{positional[0], string(body), &jobPriority, &Duration{*delay}, &Duration{*ttr}, false}
+	if !utf8.Valid(body) {
+		// JSON would replace invalid sequences
+		job.Body, job.Base64 = base64.StdEncoding.EncodeToString(body), true
+	}
+	return sendAndPrint(WorkerCommand{Command: "put", Job: job})
+}
+
+func runReplay(name string, args []string) int {
+	fs := newFlagSet(name, "<tube> [--count N] [--rate N] [--from tube]")
+	count := fs.Uint("count", 0, "Number of jobs to replay, 0 for all")
+	rate := fs.Uint("rate", DEFAULT_REPLAY_RATE, "Jobs to replay per second")
+	from := fs.String("from", "", "Move ready jobs from this tube (e.g. dead letter tube) instead of kicking buried jobs")
+	positional := parseFlagSet(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+	return sendAndPrint(WorkerCommand{Command: "replay", Replay: &ReplayRequest{positional[0], *count, *rate, *from}})
+}
+
+func runFeature(name string, args []string) int {
+	fs := newFlagSet(name, "<name> on|off [tube]")
+	positional := parseFlagSet(fs, args)
+	if len(positional) < 2 || len(positional) > 3 || (positional[1] != "on" && positional[1] != "off") {
+		fs.Usage()
+		return 2
+	}
+	toggle := &FeatureToggle{Feature: positional[0], Enabled: positional[1] == "on"}
+	if len(positional) == 3 {
+		toggle.Tube = positional[2]
+	}
+	return sendAndPrint(WorkerCommand{Command: "setFeature", Feature: toggle})
+}
+
+func runRollbackConfig(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	parseFlagSet(fs, args)
+	return sendAndPrint(WorkerCommand{Command: "rollbackConfig"})
+}
+
+func runDeploy(name string, args []string) int {
+	fs := newFlagSet(name, "<worker> <tarball|url> [--checksum sha256] [--override reason]")
+	checksum := fs.String("checksum", "", "Hex sha256 of tarball, required for URL, computed from local file if not given")
+	override := fs.String("override", "", "Why worker is deployed during freeze window, logged by daemon")
+	positional := parseFlagSet(fs, args)
+	if len(positional) != 2 {
+		fs.Usage()
+		return 2
+	}
+	deploy := &DeployRequest{Worker: positional[0], Checksum: *checksum, Override: *override}
+	if strings.HasPrefix(positional[1], "http://") || strings.HasPrefix(positional[1], "https://") {
+		if *checksum == "" {
+			fmt.Fprintf(os.Stderr, "Error: --checksum is required to deploy from URL\n")
+			return 2
+		}
+		deploy.URL = positional[1]
+	} else {
+		archive, err := ioutil.ReadFile(positional[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read tarball: %v\n", err)
+			return 1
+		}
+		if len(archive) > DEPLOY_MAX_SIZE {
+			fmt.Fprintf(os.Stderr, "Error: tarball is over %d bytes, the most deployWorker takes\n", DEPLOY_MAX_SIZE)
+			return 1
+		}
+		sum := sha256.Sum256(archive)
+		if *checksum == "" {
+			deploy.Checksum = hex.EncodeToString(sum[:])
+		}
+		deploy.Tarball = archive
+	}
+	return sendAndPrint(WorkerCommand{Command: "deployWorker", Deploy: deploy})
+}
+
+func runSyncWorkers(name string, args []string) int {
+	fs := newFlagSet(name, "[--override reason]")
+	override := fs.String("override", "", "Why workers directory is synced during freeze window, logged by daemon")
+	parseFlagSet(fs, args)
+	var options map[string]string
+	if *override != "" {
+		options = map[string]string{"override": *override}
+	}
+	return sendAndPrint(WorkerCommand{Command: "syncWorkers", Options: options})
+}
+
+func runSwitchWorker(name string, args []string) int {
+	fs := newFlagSet(name, "<worker>")
+	positional := parseFlagSet(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+	command := "rollbackWorker"
+	if name == "promote-worker" {
+		command = "promoteWorker"
+	}
+	return sendAndPrint(WorkerCommand{Command: command, Options: map[string]string{positional[0]: ""}})
+}
+
+func runDrain(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	parseFlagSet(fs, args)
+	return sendAndPrint(WorkerCommand{Command: "drain"})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"strconv"
+	"time"
+)
+
+var (
+	/** Leader election over coordination backend */
+	clusterMode = flag.Bool("cluster", false, "Elect a leader among instances sharing --coordination: only it autoscales tubes, the others take its limits. Default: false, each instance autoscales on its own")
+
+	/** Whether this instance leads cluster, guarded by stateLock */
+	leading bool
+
+	/**
+	 * Takes or renews leadership when free or held by this instance, or gives it up, and returns leader with limits it
+	 * published. Leader replaces published limits with its own once it knew it leads before the call, so a new one
+	 * keeps those of its predecessor until it has some. KEYS: leader, limits. ARGV: instance, ttl in ms, 1 to run for
+	 * leadership or 0 to give it up, 1 to publish or 0 not, tube, limit...
+	 */
+	clusterElect = redis.NewScript(2, `
+local leader = redis.call('GET', KEYS[1])
+if not leader and ARGV[3] == '1' then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	leader = ARGV[1]
+elseif leader == ARGV[1] then
+	if ARGV[3] == '1' then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	else
+		redis.call('DEL', KEYS[1])
+		leader = false
+	end
+end
+if leader == ARGV[1] and ARGV[4] == '1' then
+	redis.call('DEL', KEYS[2])
+	if #ARGV > 4 then
+		redis.call('HSET', KEYS[2], unpack(ARGV, 5))
+	end
+end
+return {leader or '', redis.call('HGETALL', KEYS[2])}`)
+)
+
+/**
+ * Starts leader election when --cluster is set
+ */
+func startCluster() {
+	if !*clusterMode {
+		return
+	}
+	if *coordinationURL == "" {
+		log.Fatalf("Fatal error: --cluster needs --coordination")
+	}
+	go runCluster(coordinationPool(), fleetInstance())
+}
+
+/**
+ * Runs for leadership every FLEET_INTERVAL, leadership lapses FLEET_TTL after the leader stops renewing it. Leader
+ * publishes autoscaled limits, followers take them. Leader that can not reach backend steps down before its lease
+ * may be taken, draining one hands leadership over
+ */
+func runCluster(pool *redis.Pool, instance string) {
+	log.Printf("Joining cluster at %s as %s", *coordinationURL, instance)
+	failing := false
+	var renewed time.Time
+	for range time.Tick(FLEET_INTERVAL) {
+		candidate := "1"
+		stateLock.Lock()
+		if stats.Draining {
+			candidate = "0"
+		}
+		publish := "0"
+		if leading {
+			publish = "1"
+		}
+		args := []interface{}{*coordinationPrefix + "leader", *coordinationPrefix + "limits", instance, FLEET_TTL.Milliseconds(), candidate, publish}
+		if leading {
+			for tube, limit := range stats.Autoscaled {
+				args = append(args, tube, limit)
+			}
+		}
+		stateLock.Unlock()
+		conn := pool.Get()
+		values, err := redis.Values(clusterElect.Do(conn, args...))
+		conn.Close()
+		var leader string
+		var published map[string]string
+		if err == nil && len(values) == 2 {
+			if leader, err = redis.String(values[0], nil); err == nil {
+				published, err = redis.StringMap(values[1], nil)
+			}
+		}
+		if err != nil {
+			if !failing {
+				log.Printf("Could not reach cluster, keeping last known limits: %v", err)
+				failing = true
+			}
+			stateLock.Lock()
+			if leading && time.Since(renewed) > FLEET_TTL/2 {
+				log.Printf("Stepping down as cluster leader, lease can not be renewed")
+				leading = false
+				stats.Leader = ""
+			}
+			stateLock.Unlock()
+			continue
+		}
+		if failing {
+			log.Printf("Reaching cluster again")
+			failing = false
+		}
+		stateLock.Lock()
+		if leader == instance {
+			renewed = time.Now()
+			if !leading {
+				log.Printf("Leading cluster, autoscaling tubes")
+			}
+		} else {
+			if leading {
+				log.Printf("No longer leading cluster, leader is %s", leader)
+			}
+			stats.Autoscaled = make(map[string]uint, len(published))
+			for tube, value := range published {
+				if limit, err := strconv.ParseUint(value, 10, 32); err == nil {
+					stats.Autoscaled[tube] = uint(limit)
+				}
+			}
+			stats.Predicted = nil
+		}
+		leading = leader == instance
+		stats.Leader = leader
+		stateLock.Unlock()
+	}
+}
+
+/**
+ * Checks if this instance makes autoscaling decisions: always without --cluster, otherwise while leading. Caller must hold stateLock
+ */
+func decidesScaling() bool {
+	return !*clusterMode || leading
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+var (
+	/** Magic bytes compressed bodies start with */
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	/** Limits of job body decompression and compression of responses */
+	decompressMaxSize = flag.Int("decompress-max-size", 64<<20, "Largest job body decompressed for worker in bytes, jobs inflating beyond it are buried, 0 for no limit. Default: 67108864")
+	compressResponses = flag.Int("compress-responses", 0, "Gzip responses put into response tubes bigger than this many bytes, workerman commands and client library decompress them. Default: 0, responses are not compressed")
+)
+
+/**
+ * Returns how body of tube is compressed: as Compression says, or by magic bytes when it is not set. Empty for body
+ * passed on as it is
+ */
+func payloadCompression(config EffectiveConfig, body []byte) string {
+	switch config.Compression {
+	case "":
+		if bytes.HasPrefix(body, gzipMagic) {
+			return "gzip"
+		}
+		if bytes.HasPrefix(body, zstdMagic) {
+			return "zstd"
+		}
+		return ""
+	case "none":
+		return ""
+	}
+	return config.Compression
+}
+
+/**
+ * Returns body decompressed, failing if it inflates beyond --decompress-max-size
+ */
+func decompress(compression string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	if *decompressMaxSize > 0 {
+		reader = io.LimitReader(reader, int64(*decompressMaxSize)+1)
+	}
+	plain, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if *decompressMaxSize > 0 && len(plain) > *decompressMaxSize {
+		return nil, fmt.Errorf("inflates beyond --decompress-max-size of %d bytes", *decompressMaxSize)
+	}
+	return plain, nil
+}
+
+/**
+ * Decompresses opened body of reserved job for worker, hooks and policy. Job that does not decompress is buried,
+ * true is returned then and worker must not be started. Job body itself stays as it came, so released or routed job does
+ */
+func inflateJobPayload(worker string, config EffectiveConfig, job *ReservedJob) bool {
+	compression := payloadCompression(config, job.plain)
+	if compression == "" {
+		return false
+	}
+	plain, err := decompress(compression, job.plain)
+	if err == nil {
+		job.plain = plain
+		return false
+	}
+	log.Printf("Could not decompress %s payload of job %s of %s, bury it: %v", compression, job.Id, worker, err)
+	return rejectJob(worker, job, "bury", "payload: "+err.Error())
+}
+
+/**
+ * Returns response for response tube, gzipped when bigger than --compress-responses
+ */
+func compressResponse(response []byte) []byte {
+	if *compressResponses <= 0 || len(response) <= *compressResponses {
+		return response
+	}
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	_, err := gz.Write(response)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Could not compress response, sending it as it is: %v", err)
+		return response
+	}
+	return out.Bytes()
+}
+
+/**
+ * Returns response read from response tube, decompressed when daemon gzipped it
+ */
+func inflateResponse(response []byte) ([]byte, error) {
+	if !bytes.HasPrefix(response, gzipMagic) {
+		return response, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(response))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress response: %v", err)
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
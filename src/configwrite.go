@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/** Suffix format of config backups, sorts in chronological order */
+const BACKUP_TIME_FORMAT = "20060102-150405.000000"
+
+var configBackups = flag.Int("config-backups", 5, "Number of previous config file versions to keep. Default: 5")
+
+/**
+ * Writes file atomically: data goes to temporary file in the same directory, which is renamed over target
+ */
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/**
+ * Returns config backups, oldest first
+ */
+func listConfigBackups() []string {
+	backups, _ := filepath.Glob(cfgPath + ".2*")
+	sort.Strings(backups)
+	return backups
+}
+
+/**
+ * Copies current config file into timestamped backup, removes backups above --config-backups
+ */
+func backupConfig() {
+	if *configBackups <= 0 {
+		return
+	}
+	current, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return
+	}
+	backup := cfgPath + "." + time.Now().Format(BACKUP_TIME_FORMAT)
+	if err := writeFileAtomic(backup, current, 0600); err != nil {
+		log.Printf("Error writing config backup %s: %v", backup, err)
+		return
+	}
+	backups := listConfigBackups()
+	for len(backups) > *configBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("Error removing old config backup %s: %v", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+/**
+ * Process rollbackConfig command: restores the most recent backup and removes it,
+ * so repeated rollbacks go further back in history
+ */
+func rollbackConfig() []byte {
+	var response interface{}
+	backups := listConfigBackups()
+	if len(backups) == 0 {
+		response = CommandError{"no config backups to roll back to"}
+	} else {
+		backup := backups[len(backups)-1]
+		restored, err := loadConfig(backup)
+		if err != nil {
+			response = CommandError{fmt.Sprintf("could not read backup %s: %v", backup, err)}
+		} else {
+			limits = restored.Limits
+			tubeDefaults, tubeConfigs = restored.Defaults, restored.Tubes
+			freezeWindows = restored.Freeze
+			log.Printf("Rolled back config to %s", backup)
+			if err := writeConfigFile(); err != nil {
+				response = CommandError{fmt.Sprintf("restored, but could not write config: %v", err)}
+			} else {
+				os.Remove(backup)
+				return getConfig(nil)
+			}
+		}
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"github.com/kr/beanstalk"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	/** Central beanstalkd relaying commands of fleet management tools */
+	controller = flag.String("controller", "", "Beanstalkd address:port to also take commands from and put responses into, for managing many hosts through one server. Default: none")
+
+	/** Connection putting responses into controller, commands are reserved on a connection of their own */
+	controllerConn *beanstalk.Conn
+	controllerLock sync.Mutex
+)
+
+/**
+ * Reserves commands from command tube on --controller and executes them like the ones from local command tube,
+ * reconnecting with backoff when controller is unreachable. Responses go back to controller
+ */
+func relayController() {
+	delay := *reconnectDelay
+	var conn *beanstalk.Conn
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = dialServer(*controller); err != nil {
+				log.Printf("Could not connect to controller %s: %v, retrying in %v", *controller, err, delay)
+				time.Sleep(delay)
+				if delay *= 2; delay > RECONNECT_BACKOFF_MAX {
+					delay = RECONNECT_BACKOFF_MAX
+				}
+				continue
+			}
+			log.Printf("Connected to controller %s, listening on %s", *controller, commandTubeName)
+			delay = *reconnectDelay
+		}
+		commands := &beanstalk.TubeSet{conn, map[string]bool{commandTubeName: true, "default": false}}
+		id, body, err := commands.Reserve(RESERVE_TIMEOUT)
+		if err != nil {
+			if !isTimeout(err) {
+				log.Printf("Controller error: %v", err)
+				if isConnError(err) {
+					conn.Close()
+					conn = nil
+					time.Sleep(delay)
+				}
+			}
+			continue
+		}
+		cmd, rejected := admitCommand("controller command", body)
+		if rejected == "bury" {
+			if err := conn.Bury(id, 0); err != nil {
+				log.Printf("Could not bury controller command %d: %v", id, err)
+			}
+		} else {
+			conn.Delete(id)
+		}
+		if rejected != "" {
+			countRejectedCommand(rejected)
+			continue
+		}
+		pendingCommands.Add(1)
+		go func() {
+			defer pendingCommands.Done()
+			processControllerCommand(cmd)
+		}()
+	}
+}
+
+/**
+ * Executes command taken from controller and puts response into controller's response tube, or reply tube of command
+ */
+func processControllerCommand(cmd WorkerCommand) {
+	if !validReplyTo(cmd) {
+		return
+	}
+	payload := executeCommand(cmd)
+	if payload == nil {
+		return
+	}
+	name := replyTube(cmd, responseTubeName)
+	controllerLock.Lock()
+	defer controllerLock.Unlock()
+	if controllerConn == nil {
+		conn, err := dialServer(*controller)
+		if err != nil {
+			log.Printf("Could not send response to controller %s: %v", *controller, err)
+			return
+		}
+		controllerConn = conn
+	}
+	tube := &beanstalk.Tube{controllerConn, name}
+	if id, err := tube.Put(responseBody(cmd, payload), 0, 0, 5); err == nil {
+		trackResponse(cmd, controllerConn, name, id, true)
+	} else {
+		log.Printf("Could not send response to controller %s: %v", name, err)
+		if isConnError(err) {
+			// Next response connects again
+			controllerConn.Close()
+			controllerConn = nil
+		}
+	}
+}
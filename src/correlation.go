@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+const (
+	/** Environment variable telling worker and hooks correlation id of job */
+	CORRELATION_ENV = "WORKERMAN_CORRELATION_ID"
+	/** Longest correlation id kept in exemplars, OpenMetrics allows 128 characters of exemplar labels */
+	EXEMPLAR_ID_MAX = 128 - len("correlation_id")
+)
+
+var (
+	/** Where producers put correlation id in job payloads */
+	correlationField = flag.String("correlation-field", "correlation_id", "Dotted path of JSON payload field holding correlation id of job, carried into logs, events, hooks, worker environment and metrics exemplars. Empty to disable. Default: correlation_id")
+
+	/** Latest correlated run and error of each tube, guarded by stateLock */
+	runExemplars   = make(map[string]exemplar)
+	errorExemplars = make(map[string]exemplar)
+)
+
+/**
+ * Correlation id counter metric sample is exemplified by
+ */
+type exemplar struct {
+	id   string
+	time time.Time
+}
+
+/**
+ * Returns correlation id in opened payload of reserved job, empty if it has none. Only string and number fields count
+ */
+func (job *ReservedJob) correlationId() string {
+	if job == nil || *correlationField == "" || job.plain == nil {
+		return ""
+	}
+	if job.correlated {
+		return job.correlation
+	}
+	job.correlated = true
+	decoder := json.NewDecoder(bytes.NewReader(job.plain))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if decoder.Decode(&payload) != nil {
+		return ""
+	}
+	switch value, _ := lookupField(payload, *correlationField); id := value.(type) {
+	case string:
+		job.correlation = id
+	case json.Number:
+		job.correlation = id.String()
+	}
+	return job.correlation
+}
+
+/**
+ * Returns correlation id of job for log lines, e.g. " [correlation_id=abc]", empty if it has none
+ */
+func correlationTag(job *ReservedJob) string {
+	if id := job.correlationId(); id != "" {
+		return fmt.Sprintf(" [%s=%s]", *correlationField, id)
+	}
+	return ""
+}
+
+/**
+ * Publishes event of run for reserved job, with its correlation id. Job is nil when worker reserves job itself
+ */
+func publishJobEvent(eventType, worker string, job *ReservedJob, message string) {
+	deliverEvent(Event{Time: time.Now(), Type: eventType, Worker: worker, Message: message, CorrelationId: job.correlationId()})
+}
+
+/**
+ * Remembers correlation id of job run of tube for exemplars of run and error counters. Takes stateLock itself
+ */
+func noteExemplar(tube string, job *ReservedJob, failed bool) {
+	id := job.correlationId()
+	if id == "" {
+		return
+	}
+	if runes := []rune(id); len(runes) > EXEMPLAR_ID_MAX {
+		id = string(runes[:EXEMPLAR_ID_MAX])
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	runExemplars[tube] = exemplar{id, time.Now()}
+	if failed {
+		errorExemplars[tube] = exemplar{id, time.Now()}
+	}
+}
+
+/**
+ * Formats exemplar for OpenMetrics sample line, empty in Prometheus text format or if there is none
+ */
+func (e exemplar) format(openMetrics bool) string {
+	if !openMetrics || e.id == "" {
+		return ""
+	}
+	return fmt.Sprintf(" # {correlation_id=%q} 1 %.3f", e.id, float64(e.time.UnixNano())/1e9)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/** Environment variable marking re-executed processes, value is role: supervisor or worker */
+const SUPERVISED_ENV = "_WORKERMAN_SUPERVISED"
+
+var (
+	pidFile     = flag.String("pidfile", "", "Write process id into this file and refuse to start if it belongs to running process. Default: none")
+	daemonize   = flag.Bool("daemon", false, "Detach from terminal and run under supervisor process restarting daemon if it crashes")
+	logFile     = flag.String("log-file", "", "Log file for --daemon mode. Default: discard output")
+	workersLock *os.File
+)
+
+/**
+ * Handles --daemon and --pidfile before daemon starts.
+ * Returns true with exit code when this process should not run daemon itself
+ */
+func daemonStartup() (bool, int) {
+	if *pidFile != "" {
+		if abs, err := filepath.Abs(*pidFile); err == nil {
+			*pidFile = abs
+		}
+	}
+	switch os.Getenv(SUPERVISED_ENV) {
+	case "supervisor":
+		return true, runSupervisor()
+	case "worker":
+		// Supervisor owns pid file
+		return false, 0
+	}
+	if *daemonize {
+		return true, detach()
+	}
+	if *pidFile != "" && upgradeParent != 0 {
+		// Upgraded process is still running, but pid file is ours now
+		if err := writeFileAtomic(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Printf("Could not write pid file %s: %v", *pidFile, err)
+		}
+	} else if *pidFile != "" {
+		if err := acquirePidFile(); err != nil {
+			log.Printf("Fatal error: %v", err)
+			return true, 1
+		}
+	}
+	return false, 0
+}
+
+/**
+ * Returns process id from pid file if that process is still running
+ */
+func runningPid(path string) int {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0
+	}
+	return pid
+}
+
+/**
+ * Writes own process id into pid file, replacing stale one
+ */
+func acquirePidFile() error {
+	if pid := runningPid(*pidFile); pid != 0 {
+		return fmt.Errorf("already running with pid %d according to %s", pid, *pidFile)
+	}
+	if _, err := os.Stat(*pidFile); err == nil {
+		log.Printf("Removing stale pid file %s", *pidFile)
+	}
+	if err := writeFileAtomic(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("could not write pid file %s: %v", *pidFile, err)
+	}
+	return nil
+}
+
+/**
+ * Removes pid file if it still holds own process id
+ */
+func releasePidFile() {
+	if *pidFile == "" || os.Getenv(SUPERVISED_ENV) == "worker" {
+		return
+	}
+	content, err := ioutil.ReadFile(*pidFile)
+	if err == nil && strings.TrimSpace(string(content)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(*pidFile)
+	}
+}
+
+/**
+ * Locks workers directory, so that two daemons never start workers from the same directory
+ */
+func lockWorkersDir() {
+	if lock, has := inherited["lock"]; has {
+		// Lock is held on behalf of both processes until upgraded one exits
+		workersLock = lock
+		return
+	}
+	dir, err := os.Open(".")
+	if err != nil {
+		log.Fatalf("Fatal error: could not open workers directory: %v", err)
+	}
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Fatalf("Fatal error: another workerman is already running with workers directory %s", *workersPath)
+	}
+	workersLock = dir
+}
+
+/**
+ * Re-executes itself with given role
+ */
+func reexec(role string) *exec.Cmd {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), SUPERVISED_ENV+"="+role)
+	return cmd
+}
+
+/**
+ * Starts supervisor in new session detached from terminal
+ */
+func detach() int {
+	if *pidFile != "" {
+		if pid := runningPid(*pidFile); pid != 0 {
+			log.Printf("Fatal error: already running with pid %d according to %s", pid, *pidFile)
+			return 1
+		}
+	}
+	output, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if *logFile != "" {
+		output, err = os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	}
+	if err != nil {
+		log.Printf("Fatal error: could not open log file: %v", err)
+		return 1
+	}
+	defer output.Close()
+	cmd := reexec("supervisor")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Fatal error: could not start daemon: %v", err)
+		return 1
+	}
+	fmt.Printf("Started with pid %d\n", cmd.Process.Pid)
+	return 0
+}
+
+/**
+ * Runs daemon as child process, restarting it when it crashes. Signals are passed to child
+ */
+func runSupervisor() int {
+	if *pidFile != "" {
+		if err := acquirePidFile(); err != nil {
+			log.Printf("Fatal error: %v", err)
+			return 1
+		}
+		defer releasePidFile()
+	}
+	startReaper()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	stopping := false
+	for {
+		cmd := reexec("worker")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		childDone, err := startChild(cmd)
+		if err != nil {
+			log.Printf("Supervisor could not start daemon: %v", err)
+			return 1
+		}
+		log.Printf("Supervisor started daemon with pid %d", cmd.Process.Pid)
+		done := make(chan error, 1)
+		go func() {
+			err := cmd.Wait()
+			childDone()
+			done <- err
+		}()
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					stopping = true
+				}
+				cmd.Process.Signal(sig)
+			case err = <-done:
+				break wait
+			}
+		}
+		if err == nil {
+			log.Printf("Daemon exited, supervisor exiting")
+			return 0
+		}
+		if stopping {
+			log.Printf("Daemon stopped: %v", err)
+			return 0
+		}
+		log.Printf("Daemon crashed: %v, restarting in %v", err, *reconnectDelay)
+		select {
+		case <-signals:
+			return 0
+		case <-time.After(*reconnectDelay):
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/** Largest tarball and worker file deployWorker takes */
+	DEPLOY_MAX_SIZE = 64 << 20
+	/** Largest deployWorker command control socket, HTTP and gRPC take: base64 of largest tarball and the rest */
+	DEPLOY_MAX_COMMAND = (DEPLOY_MAX_SIZE+2)/3*4 + 64<<10
+	/** How long fetching tarball from URL may take */
+	DEPLOY_FETCH_TIMEOUT = time.Minute
+	/** How long deployWorker waits for watcher to subscribe deployed worker */
+	DEPLOY_SUBSCRIBE_WAIT = 3 * time.Second
+)
+
+var (
+	deployClient = &http.Client{Timeout: DEPLOY_FETCH_TIMEOUT}
+
+	/** One deploy or switch of worker versions at a time */
+	deployLock sync.Mutex
+
+	/** Deployed worker is to be subscribed without waiting for next watcher cycle, guarded by stateLock */
+	watchRequested bool
+)
+
+/**
+ * Worker to deploy with deployWorker command: tar archive, gzipped or not, holding the worker file by its name.
+ * Archive comes in Tarball (base64 in JSON) or is fetched from URL, Checksum is its hex sha256
+ */
+type DeployRequest struct {
+	Worker   string
+	Tarball  []byte `json:",omitempty"`
+	URL      string `json:",omitempty"`
+	Checksum string // "sha256:" prefix is optional
+	Override string `json:",omitempty"` // Why worker is deployed during freeze window, rejected there without it
+}
+
+/**
+ * Response to deployWorker
+ */
+type DeployResponse struct {
+	Worker     string
+	Checksum   string // Hex sha256 of worker file written
+	Replaced   bool   // Worker file was there before, running workers finish with the old one
+	Subscribed bool
+	Reason     string `json:",omitempty"` // Why worker is not subscribed or would not run
+}
+
+/**
+ * Process deployWorker command: verifies archive, writes worker file atomically into workers directory and waits
+ * for it to be subscribed. Takes stateLock itself
+ */
+func deployWorker(req *DeployRequest) []byte {
+	var response interface{}
+	if deployed, err := installWorker(req); err != nil {
+		log.Printf("Could not deploy worker %s: %v", req.Worker, err)
+		response = CommandError{fmt.Sprintf("could not deploy worker %s: %v", req.Worker, err)}
+	} else {
+		log.Printf("Deployed worker %s with checksum %s", req.Worker, deployed.Checksum)
+		publishEvent("deployed", req.Worker, deployed.Checksum)
+		awaitSubscription(deployed)
+		response = deployed
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
+
+/**
+ * Checks request, takes worker file out of verified archive and renames it over worker in workers directory, keeping
+ * the one replaced in VERSIONS_DIR for rollbackWorker
+ */
+func installWorker(req *DeployRequest) (*DeployResponse, error) {
+	if err := checkWorkerName(req.Worker); err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		return nil, errors.New("daemon runs with --dry-run")
+	}
+	if err := checkWorkersWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkFreeze("deploy of "+req.Worker, req.Override); err != nil {
+		return nil, err
+	}
+	want := strings.ToLower(strings.TrimPrefix(req.Checksum, "sha256:"))
+	if len(want) != sha256.Size*2 {
+		return nil, errors.New("Checksum must be hex sha256 of tarball")
+	}
+	archive := req.Tarball
+	if (len(archive) == 0) == (req.URL == "") {
+		return nil, errors.New("either Tarball or URL must be given")
+	}
+	if req.URL != "" {
+		var err error
+		if archive, err = fetchTarball(req.URL); err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("tarball checksum is %x, not %s", sum, want)
+	}
+	content, err := untarWorker(archive, req.Worker)
+	if err != nil {
+		return nil, err
+	}
+	deployLock.Lock()
+	defer deployLock.Unlock()
+	_, statErr := os.Lstat(req.Worker)
+	if err := keepPrevious(req.Worker); err != nil {
+		return nil, fmt.Errorf("could not keep previous version: %v", err)
+	}
+	// Running workers keep executing the file renamed over, the next run gets the new one
+	if err := writeFileAtomic(req.Worker, content, 0755); err != nil {
+		return nil, err
+	}
+	written, err := ioutil.ReadFile(req.Worker)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(written, content) {
+		return nil, errors.New("worker file written does not read back the same")
+	}
+	fileSum := sha256.Sum256(written)
+	return &DeployResponse{Worker: req.Worker, Checksum: hex.EncodeToString(fileSum[:]), Replaced: statErr == nil}, nil
+}
+
+/**
+ * Checks worker name can be file in workers directory and tube name at once
+ */
+func checkWorkerName(worker string) error {
+	if err := checkTubeName(worker); err != nil {
+		return fmt.Errorf("invalid worker name '%s': %v", worker, err)
+	}
+	if strings.Contains(worker, "/") || strings.HasPrefix(worker, ".") {
+		return fmt.Errorf("invalid worker name '%s': it must be a file name", worker)
+	}
+	return nil
+}
+
+/**
+ * Downloads tarball, at most DEPLOY_MAX_SIZE bytes
+ */
+func fetchTarball(url string) ([]byte, error) {
+	resp, err := deployClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	archive, err := ioutil.ReadAll(io.LimitReader(resp.Body, DEPLOY_MAX_SIZE+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", url, err)
+	}
+	if len(archive) > DEPLOY_MAX_SIZE {
+		return nil, fmt.Errorf("tarball at %s is over %d bytes", url, DEPLOY_MAX_SIZE)
+	}
+	return archive, nil
+}
+
+/**
+ * Returns content of worker file in tar archive, gzipped or not. Archive must hold nothing else but directories,
+ * as every file in workers directory is a worker
+ */
+func untarWorker(archive []byte, worker string) ([]byte, error) {
+	var reader io.Reader = bytes.NewReader(archive)
+	if bytes.HasPrefix(archive, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("tarball: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	entries := tar.NewReader(reader)
+	var content []byte
+	for {
+		header, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tarball: %v", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if path.Clean(header.Name) != worker {
+			return nil, fmt.Errorf("tarball holds %s, only worker %s may be in it", header.Name, worker)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("tarball holds %s not as regular file", header.Name)
+		}
+		if header.Size > DEPLOY_MAX_SIZE {
+			return nil, fmt.Errorf("worker %s in tarball is over %d bytes", worker, DEPLOY_MAX_SIZE)
+		}
+		if content, err = ioutil.ReadAll(entries); err != nil {
+			return nil, fmt.Errorf("tarball: %v", err)
+		}
+	}
+	if content == nil {
+		return nil, fmt.Errorf("tarball does not hold worker %s", worker)
+	}
+	return content, nil
+}
+
+/**
+ * Has watcher run on next cycle and waits up to DEPLOY_SUBSCRIBE_WAIT for deployed worker to be subscribed, filling in
+ * why it is not. Takes stateLock itself
+ */
+func awaitSubscription(deployed *DeployResponse) {
+	stateLock.Lock()
+	watchRequested = true
+	stateLock.Unlock()
+	deadline := time.Now().Add(DEPLOY_SUBSCRIBE_WAIT)
+	for {
+		stateLock.Lock()
+		deployed.Subscribed = subscriptions[deployed.Worker]
+		missing, unmatched := stats.Unmatched[deployed.Worker]
+		elsewhere := shardCandidates[deployed.Worker] && !shardServes(deployed.Worker)
+		stateLock.Unlock()
+		switch {
+		case unmatched:
+			deployed.Reason = "host lacks tags " + missing
+		case elsewhere:
+			deployed.Reason = "tube is served by another instance"
+		case !deployed.Subscribed && time.Now().After(deadline):
+			deployed.Reason = "not subscribed yet"
+		}
+		if deployed.Subscribed || deployed.Reason != "" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if violation := integrityViolation(deployed.Worker, "./"+deployed.Worker); violation != "" {
+		deployed.Reason = "refused by integrity check: " + violation
+	}
+}
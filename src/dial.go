@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	/** Encrypt beanstalkd connections */
+	useTLS        = flag.Bool("tls", false, "Connect to beanstalkd over TLS, e.g. through stunnel or TLS terminating proxy in front of it")
+	tlsCA         = flag.String("tls-ca", "", "CA file to verify beanstalkd server certificate. Default: system CAs")
+	tlsCert       = flag.String("tls-cert", "", "Client certificate file for beanstalkd TLS connections")
+	tlsKey        = flag.String("tls-key", "", "Client key file for beanstalkd TLS connections")
+	tlsServerName = flag.String("tls-server-name", "", "Server name expected in beanstalkd certificate. Default: host of server address")
+
+	/** Proxy to reach beanstalkd through */
+	proxyURL = flag.String("proxy", "", "Proxy for beanstalkd connections: socks5://[user:password@]host:port or http://[user:password@]host:port. Default: none")
+
+	tlsConfig     *tls.Config
+	tlsConfigErr  error
+	tlsConfigOnce sync.Once
+)
+
+/**
+ * Builds TLS settings from --tls-ca, --tls-cert and --tls-key once, nil when --tls is off
+ */
+func beanstalkTLSConfig() (*tls.Config, error) {
+	tlsConfigOnce.Do(func() {
+		if !*useTLS {
+			return
+		}
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if *tlsCert != "" || *tlsKey != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				tlsConfigErr = err
+				return
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		if *tlsCA != "" {
+			pem, err := ioutil.ReadFile(*tlsCA)
+			if err != nil {
+				tlsConfigErr = err
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				tlsConfigErr = fmt.Errorf("no certificates found in %s", *tlsCA)
+				return
+			}
+			config.RootCAs = pool
+		}
+		tlsConfig = config
+	})
+	return tlsConfig, tlsConfigErr
+}
+
+/**
+ * Opens network connection to beanstalkd server, through proxy and TLS when configured
+ */
+func dialNet(address string, timeout time.Duration) (net.Conn, error) {
+	config, err := beanstalkTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %v", err)
+	}
+	var conn net.Conn
+	if *proxyURL != "" {
+		conn, err = dialProxy(address, timeout)
+	} else {
+		conn, err = beanstalkDialer(timeout).Dial("tcp", address)
+	}
+	if err != nil || config == nil {
+		return conn, err
+	}
+	config = config.Clone()
+	if config.ServerName = *tlsServerName; config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %v", address, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+/**
+ * Connects to address through --proxy
+ */
+func dialProxy(address string, timeout time.Duration) (net.Conn, error) {
+	proxy, err := url.Parse(*proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", *proxyURL, err)
+	}
+	if proxy.Scheme != "socks5" && proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', expected socks5 or http", proxy.Scheme)
+	}
+	conn, err := beanstalkDialer(timeout).Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy %s: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, proxy.User, address)
+	} else {
+		err = httpConnect(conn, proxy.User, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+/**
+ * Asks SOCKS5 proxy to connect to address, see RFC 1928 and RFC 1929
+ */
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || len(host) > 255 {
+		return fmt.Errorf("invalid address %s", address)
+	}
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return fmt.Errorf("authentication method not accepted")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		auth := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+	request := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("connect to %s failed with code %d", address, header[1])
+	}
+	// Skip bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+/**
+ * Asks HTTP proxy to connect to address with CONNECT method
+ */
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if user != nil {
+		password, _ := user.Password()
+		request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return err
+	}
+	// Beanstalkd never speaks first, so nothing is buffered past the response
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("connect to %s failed: %s", address, response.Status)
+	}
+	return nil
+}
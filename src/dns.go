@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	/** Interval between lookups of server host names */
+	dnsRefresh = flag.Duration("dns-refresh", 30*time.Second, "Interval to re-resolve beanstalkd host names, connections to addresses no longer listed are re-established. Set to TTL of failover record, 0 to disable. Default: 30s")
+)
+
+/**
+ * Re-resolves host names of connected servers periodically and drops connections to addresses the name does not resolve to anymore,
+ * so they are re-established to the new one. New connections resolve the name on every attempt anyway.
+ *
+ * System resolver does not report record TTL, hence --dns-refresh. Connections through --proxy are left alone, proxy resolves names.
+ */
+func refreshDNS() {
+	if *dnsRefresh <= 0 || *proxyURL != "" {
+		return
+	}
+	for {
+		time.Sleep(*dnsRefresh)
+		byHost := make(map[string][]*watchedConn)
+		watchedLock.Lock()
+		for conn := range watchedConns {
+			if host, _, err := net.SplitHostPort(conn.address); err == nil && net.ParseIP(host) == nil {
+				byHost[host] = append(byHost[host], conn)
+			}
+		}
+		watchedLock.Unlock()
+		for host, conns := range byHost {
+			ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				// Keep connections that work, health checks tell if server is gone
+				log.Printf("Could not resolve %s: %v", host, err)
+				continue
+			}
+			current := make(map[string]bool)
+			for _, addr := range addrs {
+				current[addr.IP.String()] = true
+			}
+			for _, conn := range conns {
+				remote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+				if err == nil && !current[remote] {
+					log.Printf("%s does not resolve to %s anymore, reconnecting", host, remote)
+					conn.Close()
+				}
+			}
+		}
+	}
+}
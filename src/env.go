@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ENV_PREFIX = "WORKERMAN_"
+
+/** Global flags given on command line or in environment, not left at their default. Set by applyEnvFlags */
+var givenFlags = make(map[string]bool)
+
+/**
+ * Returns environment variable name for the option, e.g. "connect" => "WORKERMAN_CONNECT"
+ */
+func envName(option string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+/**
+ * Sets global flags not given on command line from WORKERMAN_* environment variables
+ *
+ * Flags may be given either before or after subcommand name, so both flag sets are checked.
+ * Precedence: command line flag > environment > default
+ */
+func applyEnvFlags(fs *flag.FlagSet) {
+	explicit := make(map[string]bool)
+	mark := func(f *flag.Flag) {
+		explicit[f.Name], givenFlags[f.Name] = true, true
+	}
+	flag.Visit(mark)
+	fs.Visit(mark)
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+		if value, has := os.LookupEnv(envName(f.Name)); has {
+			if err := f.Value.Set(value); err != nil {
+				log.Fatalf("Fatal error: invalid value '%s' in %s: %v", value, envName(f.Name), err)
+			}
+			givenFlags[f.Name] = true
+		}
+	})
+}
+
+/**
+ * Overrides limits loaded from config file with WORKERMAN_* environment variables
+ *
+ * WORKERMAN_TOTAL and WORKERMAN_MIN are numbers, WORKERMAN_QUEUES is a list like "email=10,sms=5"
+ * Precedence: environment > config file > default
+ */
+func applyEnvLimits() {
+	if value, has := os.LookupEnv(envName("total")); has {
+		limits.Total = parseEnvLimit(envName("total"), value)
+		log.Printf("Setting total limit to %d from environment", limits.Total)
+	}
+	if value, has := os.LookupEnv(envName("min")); has {
+		limits.Min = parseEnvLimit(envName("min"), value)
+		log.Printf("Setting minimum workers to %d from environment", limits.Min)
+	}
+	if value, has := os.LookupEnv(envName("queues")); has {
+		if limits.Queues == nil {
+			limits.Queues = make(map[string]uint)
+		}
+		for _, pair := range strings.Split(value, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				log.Fatalf("Fatal error: invalid entry '%s' in %s, expected tube=limit", pair, envName("queues"))
+			}
+			limits.Queues[parts[0]] = parseEnvLimit(envName("queues"), parts[1])
+			log.Printf("Setting %s => %s from environment", parts[0], parts[1])
+		}
+	}
+}
+
+func parseEnvLimit(name, value string) uint {
+	intLimit, err := strconv.ParseUint(strings.TrimSpace(value), 10, 0)
+	if err != nil {
+		log.Fatalf("Fatal error: invalid number '%s' in %s: %v", value, name, err)
+	}
+	return uint(intLimit)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/** Events buffered for each listener, events are dropped for slow listeners */
+const EVENTS_BUFFER = 100
+
+/**
+ * Something that happened in the daemon, e.g. worker started or limits changed
+ */
+type Event struct {
+	Time    time.Time
+	Type    string // started, finished, failed, subscribed, unsubscribed, command
+	Worker  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+
+	CorrelationId string `json:",omitempty"` // Of job run is for, see --correlation-field
+}
+
+var (
+	eventsMutex    sync.Mutex
+	eventListeners = make(map[chan Event]bool)
+)
+
+/**
+ * Returns channel receiving all events published from now on
+ */
+func listenEvents() chan Event {
+	listener := make(chan Event, EVENTS_BUFFER)
+	eventsMutex.Lock()
+	eventListeners[listener] = true
+	eventsMutex.Unlock()
+	return listener
+}
+
+/**
+ * Stops delivering events to listener
+ */
+func forgetEvents(listener chan Event) {
+	eventsMutex.Lock()
+	delete(eventListeners, listener)
+	eventsMutex.Unlock()
+}
+
+/**
+ * Publishes event of daemon, see publishJobEvent for events of job runs
+ */
+func publishEvent(eventType, worker, message string) {
+	deliverEvent(Event{Time: time.Now(), Type: eventType, Worker: worker, Message: message})
+}
+
+/**
+ * Delivers event to all listeners without blocking
+ */
+func deliverEvent(event Event) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	for listener := range eventListeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
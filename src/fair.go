@@ -0,0 +1,90 @@
+package main
+
+/** Weight of tubes without one configured */
+const DEFAULT_WEIGHT = 1
+
+/** Tubes left with ready jobs by last dispatch, as capacity was short. Guarded by stateLock */
+var waiting = make(map[string]bool)
+
+/**
+ * Starts workers for polled ready jobs one at a time, each for the tube of most urgent priority that is furthest below
+ * its weighted share of units, so under contention freed capacity is split by Weight instead of going to one tube. Takes stateLock itself
+ */
+func dispatchFair(tubes []string, ready []int) {
+	stateLock.Lock()
+	priorities := make([]uint32, len(tubes))
+	weights := make([]float64, len(tubes))
+	for i, tube := range tubes {
+		config := schedulingConfig(tube)
+		priorities[i], weights[i] = config.Priority, float64(config.Weight)
+	}
+	stateLock.Unlock()
+	held := make([]bool, len(tubes))
+	for {
+		stateLock.Lock()
+		best := -1
+		for i, tube := range tubes {
+			if ready[i] <= 0 || held[i] {
+				continue
+			}
+			if best < 0 || priorities[i] < priorities[best] || priorities[i] == priorities[best] &&
+				float64(stats.Units[tube])/weights[i] < float64(stats.Units[tubes[best]])/weights[best] {
+				best = i
+			}
+		}
+		stateLock.Unlock()
+		if best < 0 {
+			break
+		}
+		if startWorker(tubes[best]) {
+			ready[best]--
+		} else {
+			// Limits hold tube back, its jobs left are waiting
+			held[best] = true
+		}
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for i, tube := range tubes {
+		if ready[i] > 0 {
+			waiting[tube] = true
+		} else {
+			delete(waiting, tube)
+		}
+	}
+}
+
+/**
+ * Sets share attainment of contending tubes in status: units running divided by their weighted share of total limit.
+ * Contending are tubes running workers or waiting for capacity, none while no tube waits or there is nothing to
+ * share. Tubes last polled without ready jobs no longer wait. Caller must hold stateLock
+ */
+func updateShares() {
+	for tube := range waiting {
+		if !subscriptions[tube] || stats.Backlog[tube] == 0 {
+			delete(waiting, tube)
+		}
+	}
+	stats.Shares = nil
+	total := totalLimit()
+	if len(waiting) == 0 || total == 0 {
+		return
+	}
+	weights := make(map[string]float64)
+	var sum float64
+	for tube := range subscriptions {
+		if stats.Running[tube] > 0 || waiting[tube] {
+			weights[tube] = float64(schedulingConfig(tube).Weight)
+			sum += weights[tube]
+		}
+	}
+	if sum == 0 {
+		return
+	}
+	stats.Shares = make(map[string]float64, len(weights))
+	for tube, weight := range weights {
+		if share := float64(total) * weight / sum; share > 0 {
+			stats.Shares[tube] = float64(stats.Units[tube]) / share
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestUpdateShares(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      uint
+		tubes      map[string]string
+		subscribed []string
+		waiting    []string
+		running    map[string]uint
+		units      map[string]uint
+		backlog    map[string]int
+		want       map[string]float64
+		stillWait  []string
+	}{
+		{
+			name:       "nobody waits",
+			total:      10,
+			subscribed: []string{"a", "b"},
+			running:    map[string]uint{"a": 4, "b": 6},
+			units:      map[string]uint{"a": 4, "b": 6},
+		},
+		{
+			name:       "equal weights",
+			total:      10,
+			subscribed: []string{"a", "b", "idle"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 8, "b": 2},
+			units:      map[string]uint{"a": 8, "b": 2},
+			backlog:    map[string]int{"b": 3},
+			want:       map[string]float64{"a": 1.6, "b": 0.4},
+			stillWait:  []string{"b"},
+		},
+		{
+			name:       "weighted",
+			total:      12,
+			tubes:      map[string]string{"a": `{"Weight": 3}`},
+			subscribed: []string{"a", "b"},
+			waiting:    []string{"a"},
+			running:    map[string]uint{"a": 6, "b": 6},
+			units:      map[string]uint{"a": 6, "b": 6},
+			backlog:    map[string]int{"a": 5},
+			want:       map[string]float64{"a": 6.0 / 9, "b": 2},
+			stillWait:  []string{"a"},
+		},
+		{
+			name:       "units of costly workers",
+			total:      12,
+			tubes:      map[string]string{"a": `{"Cost": 3}`},
+			subscribed: []string{"a", "b"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 2, "b": 6},
+			units:      map[string]uint{"a": 6, "b": 6},
+			backlog:    map[string]int{"b": 1},
+			want:       map[string]float64{"a": 1, "b": 1},
+			stillWait:  []string{"b"},
+		},
+		{
+			name:       "waiting without workers",
+			total:      4,
+			subscribed: []string{"a", "b"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 4},
+			units:      map[string]uint{"a": 4},
+			backlog:    map[string]int{"b": 1},
+			want:       map[string]float64{"a": 2, "b": 0},
+			stillWait:  []string{"b"},
+		},
+		{
+			name:       "waiting tube unsubscribed",
+			total:      10,
+			subscribed: []string{"a"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 4},
+			units:      map[string]uint{"a": 4},
+			backlog:    map[string]int{"b": 3},
+		},
+		{
+			name:       "waiting tube drained",
+			total:      10,
+			subscribed: []string{"a", "b"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 4},
+			units:      map[string]uint{"a": 4},
+			backlog:    map[string]int{"b": 0},
+		},
+		{
+			name:       "no total limit",
+			subscribed: []string{"a", "b"},
+			waiting:    []string{"b"},
+			running:    map[string]uint{"a": 4},
+			units:      map[string]uint{"a": 4},
+			backlog:    map[string]int{"b": 3},
+			stillWait:  []string{"b"},
+		},
+	}
+	savedStats, savedLimits, savedWaiting, savedSubscriptions := stats, limits, waiting, subscriptions
+	defer func() {
+		stats, limits, waiting, subscriptions = savedStats, savedLimits, savedWaiting, savedSubscriptions
+	}()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setTubeConfig(t, "", test.tubes, nil)()
+			limits = Limits{Total: test.total}
+			stats = Stats{Running: test.running, Units: test.units, Backlog: test.backlog}
+			subscriptions, waiting = make(map[string]bool), make(map[string]bool)
+			for _, tube := range test.subscribed {
+				subscriptions[tube] = true
+			}
+			for _, tube := range test.waiting {
+				waiting[tube] = true
+			}
+			updateShares()
+			if len(stats.Shares) != len(test.want) || test.want == nil && stats.Shares != nil {
+				t.Fatalf("got shares %v, want %v", stats.Shares, test.want)
+			}
+			for tube, share := range test.want {
+				if got, has := stats.Shares[tube]; !has || math.Abs(got-share) > 1e-9 {
+					t.Errorf("share of %s is %v, want %v", tube, got, share)
+				}
+			}
+			var stillWait []string
+			for tube := range waiting {
+				stillWait = append(stillWait, tube)
+			}
+			sort.Strings(stillWait)
+			if !reflect.DeepEqual(stillWait, test.stillWait) {
+				t.Errorf("tubes %v wait, want %v", stillWait, test.stillWait)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+/**
+ * Runtime feature toggle for a tube, or for all tubes when Tube is empty
+ */
+type FeatureToggle struct {
+	Feature string
+	Tube    string `json:",omitempty"`
+	Enabled bool
+}
+
+/** Experimental behaviors which can be enabled per tube, name => description */
+var knownFeatures = make(map[string]string)
+
+/**
+ * Registers experimental behavior, called from init() of the code implementing it
+ */
+func registerFeature(name, description string) {
+	knownFeatures[name] = description
+}
+
+/**
+ * Resolves features enabled for a tube from defaults and tube settings
+ *
+ * Features are listed by name, "-name" in tube settings disables feature enabled in defaults.
+ */
+func mergeFeatures(config *EffectiveConfig, layer string, features []string) {
+	for _, feature := range features {
+		if strings.HasPrefix(feature, "-") {
+			delete(config.features, feature[1:])
+			config.source("Features."+feature[1:], layer)
+		} else {
+			config.features[feature] = true
+			config.source("Features."+feature, layer)
+		}
+	}
+	config.Features = make([]string, 0, len(config.features))
+	for feature := range config.features {
+		config.Features = append(config.Features, feature)
+	}
+	sort.Strings(config.Features)
+}
+
+/**
+ * Checks if experimental behavior is enabled for a tube
+ */
+func featureEnabled(tube, feature string) bool {
+	return schedulingConfig(tube).features[feature]
+}
+
+/**
+ * Removes feature from list, both enabled and disabled entries
+ */
+func withoutFeature(features []string, feature string) []string {
+	var result []string
+	for _, entry := range features {
+		if entry != feature && entry != "-"+feature {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+/**
+ * Process setFeature command, change is written to config file
+ */
+func setFeature(toggle *FeatureToggle) []byte {
+	var response interface{}
+	if _, known := knownFeatures[toggle.Feature]; !known {
+		response = CommandError{fmt.Sprintf("unknown feature '%s'", toggle.Feature)}
+	} else if toggle.Tube != "" && !subscriptions[toggle.Tube] {
+		response = CommandError{fmt.Sprintf("tube '%s' is not subscribed", toggle.Tube)}
+	} else {
+		target := tubeDefaults
+		if toggle.Tube != "" {
+			if tubeConfigs[toggle.Tube] == nil {
+				tubeConfigs[toggle.Tube] = &TubeConfig{}
+			}
+			target = tubeConfigs[toggle.Tube]
+		} else if target == nil {
+			tubeDefaults = &TubeConfig{}
+			target = tubeDefaults
+		}
+		target.Features = withoutFeature(target.Features, toggle.Feature)
+		if toggle.Enabled {
+			target.Features = append(target.Features, toggle.Feature)
+		} else if toggle.Tube != "" {
+			target.Features = append(target.Features, "-"+toggle.Feature)
+		}
+		scope := toggle.Tube
+		if scope == "" {
+			scope = "all tubes"
+		}
+		log.Printf("Feature %s set to %v for %s", toggle.Feature, toggle.Enabled, scope)
+		writeConfig()
+		options := make(map[string]string)
+		if toggle.Tube != "" {
+			options[toggle.Tube] = ""
+		}
+		return getConfig(options)
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
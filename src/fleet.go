@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+/** How often instances publish running workers to coordination backend, and how long published counts live */
+const (
+	FLEET_INTERVAL = time.Second
+	FLEET_TTL      = 5 * FLEET_INTERVAL
+)
+
+var (
+	/** Coordination backend instances share GlobalLimit of tubes through */
+	coordinationURL    = flag.String("coordination", "", "Redis URL instances serving the same tubes share running workers through, for GlobalLimit of tubes, e.g. redis://10.0.0.5:6379/0. Default: none, limits are per host")
+	coordinationPrefix = flag.String("coordination-prefix", "workerman:fleet:", "Prefix of coordination keys, instances with the same prefix form a fleet. Default: workerman:fleet:")
+
+	/** Workers running on other instances of fleet by tube, guarded by stateLock */
+	fleetRunning = make(map[string]uint)
+
+	/**
+	 * Replaces running counts of this instance and returns sums of the others as tube, count pairs. Instances whose
+	 * counts expired are forgotten. KEYS[1] is set of instances, ARGV: prefix, instance, ttl in ms, tube, count...
+	 */
+	fleetSync = redis.NewScript(1, `
+local own = ARGV[1] .. 'running:' .. ARGV[2]
+redis.call('DEL', own)
+if #ARGV > 3 then
+	redis.call('HSET', own, unpack(ARGV, 4))
+	redis.call('PEXPIRE', own, ARGV[3])
+	redis.call('SADD', KEYS[1], ARGV[2])
+end
+local totals, result = {}, {}
+for _, instance in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	if instance ~= ARGV[2] then
+		local counts = redis.call('HGETALL', ARGV[1] .. 'running:' .. instance)
+		if #counts == 0 then
+			redis.call('SREM', KEYS[1], instance)
+		end
+		for i = 1, #counts, 2 do
+			totals[counts[i]] = (totals[counts[i]] or 0) + tonumber(counts[i + 1])
+		end
+	end
+end
+for tube, count in pairs(totals) do
+	table.insert(result, tube)
+	table.insert(result, count)
+end
+return result`)
+)
+
+/**
+ * Publishes running workers of this instance every FLEET_INTERVAL and takes in those of the rest of fleet, so GlobalLimit
+ * of tube holds over all instances. Limits are cooperative: starts made on several instances within one interval may
+ * exceed it briefly. While backend can not be reached, last known counts are used
+ */
+func syncFleet() {
+	if *coordinationURL == "" {
+		return
+	}
+	pool, instance := coordinationPool(), fleetInstance()
+	log.Printf("Sharing running workers with fleet at %s as %s", *coordinationURL, instance)
+	failing := false
+	for range time.Tick(FLEET_INTERVAL) {
+		args := []interface{}{*coordinationPrefix + "instances", *coordinationPrefix, instance, FLEET_TTL.Milliseconds()}
+		stateLock.Lock()
+		for tube, running := range stats.Running {
+			if running > 0 {
+				args = append(args, tube, running)
+			}
+		}
+		stateLock.Unlock()
+		conn := pool.Get()
+		values, err := redis.Values(fleetSync.Do(conn, args...))
+		conn.Close()
+		if err != nil {
+			if !failing {
+				log.Printf("Could not sync with fleet, going by last known counts: %v", err)
+				failing = true
+			}
+			continue
+		}
+		if failing {
+			log.Printf("Syncing with fleet again")
+			failing = false
+		}
+		others := make(map[string]uint, len(values)/2)
+		for i := 0; i+1 < len(values); i += 2 {
+			tube, _ := redis.String(values[i], nil)
+			count, _ := redis.Int(values[i+1], nil)
+			others[tube] = uint(count)
+		}
+		stateLock.Lock()
+		fleetRunning = others
+		stats.Fleet = nil
+		for tube, count := range others {
+			if schedulingConfig(tube).GlobalLimit > 0 {
+				if stats.Fleet == nil {
+					stats.Fleet = make(map[string]uint)
+				}
+				stats.Fleet[tube] = count
+			}
+		}
+		stateLock.Unlock()
+	}
+}
+
+/**
+ * Returns connections to coordination backend
+ */
+func coordinationPool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(*coordinationURL, redis.DialConnectTimeout(DIAL_TIMEOUT), redis.DialReadTimeout(DIAL_TIMEOUT), redis.DialWriteTimeout(DIAL_TIMEOUT))
+		},
+		MaxIdle: 1,
+	}
+}
+
+/**
+ * Returns id of this instance within fleet, unique even for instances of the same name on one host. Takes stateLock itself
+ */
+func fleetInstance() string {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return stats.Instance + ":" + strconv.Itoa(os.Getpid())
+}
+
+/**
+ * Checks if GlobalLimit of tube allows another worker, counting ones running on other instances. Caller must hold stateLock
+ */
+func fleetAllows(tube string, config EffectiveConfig) bool {
+	return config.GlobalLimit == 0 || stats.Running[tube]+fleetRunning[tube] < config.GlobalLimit
+}
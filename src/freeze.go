@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Freeze windows of config file, guarded by stateLock */
+var freezeWindows []FreezeWindow
+
+/**
+ * Time deployWorker and syncWorkers are rejected in, e.g. {"From": "Fri 18:00", "To": "Mon 08:00"}. From and To are
+ * both weekly ("Fri 18:00"), daily ("18:00") or dated ("2026-12-24 00:00"); weekly and daily windows wrap around
+ * when To comes before From
+ */
+type FreezeWindow struct {
+	From   string
+	To     string
+	Zone   string `json:",omitempty"` // IANA time zone of From and To, e.g. "Europe/Berlin", local time if empty
+	Reason string `json:",omitempty"` // Told to whoever tries to deploy
+}
+
+/**
+ * Checks if worker files may be replaced by action now: outside freeze windows, or inside one with reason to override
+ * it. Rejections and overrides are logged and published as events. Takes stateLock itself
+ */
+func checkFreeze(action, override string) error {
+	stateLock.Lock()
+	window := activeFreeze(time.Now())
+	stateLock.Unlock()
+	if window == "" {
+		return nil
+	}
+	if override == "" {
+		log.Printf("Rejected %s during freeze window %s", action, window)
+		publishEvent("frozen", "", action+" rejected during "+window)
+		return fmt.Errorf("deployments are frozen: %s, give Override with a reason to deploy anyway", window)
+	}
+	log.Printf("Freeze window %s overridden for %s: %s", window, action, override)
+	publishEvent("override", "", action+" during "+window+": "+override)
+	return nil
+}
+
+/**
+ * Returns description of freeze window now falls in, empty if none. Windows that can not be parsed freeze all the
+ * time, so a typo does not open a freeze. Caller must hold stateLock
+ */
+func activeFreeze(now time.Time) string {
+	for i, window := range freezeWindows {
+		active, err := window.contains(now)
+		if err != nil {
+			return fmt.Sprintf("freeze window %d is invalid (%v)", i, err)
+		}
+		if active {
+			return window.String()
+		}
+	}
+	return ""
+}
+
+/**
+ * Checks if time falls in window
+ */
+func (w FreezeWindow) contains(now time.Time) (bool, error) {
+	location := time.Local
+	if w.Zone != "" {
+		var err error
+		if location, err = time.LoadLocation(w.Zone); err != nil {
+			return false, err
+		}
+	}
+	now = now.In(location)
+	if strings.Contains(w.From, "-") || strings.Contains(w.To, "-") {
+		from, err := time.ParseInLocation("2006-01-02 15:04", w.From, location)
+		if err != nil {
+			return false, err
+		}
+		to, err := time.ParseInLocation("2006-01-02 15:04", w.To, location)
+		if err != nil {
+			return false, err
+		}
+		return !now.Before(from) && now.Before(to), nil
+	}
+	from, fromWeekly, err := parseFreezeTime(w.From)
+	if err != nil {
+		return false, err
+	}
+	to, toWeekly, err := parseFreezeTime(w.To)
+	if err != nil {
+		return false, err
+	}
+	if fromWeekly != toWeekly {
+		return false, errors.New("From and To must both have a weekday or none")
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if fromWeekly {
+		minute += int(now.Weekday()) * 24 * 60
+	}
+	if from <= to {
+		return minute >= from && minute < to, nil
+	}
+	return minute >= from || minute < to, nil
+}
+
+/**
+ * Parses "Fri 18:00" into minutes since Sunday midnight or "18:00" into minutes since midnight, telling which it was
+ */
+func parseFreezeTime(value string) (int, bool, error) {
+	fields := strings.Fields(value)
+	clock := value
+	day := -1
+	if len(fields) == 2 {
+		for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+			if strings.EqualFold(fields[0], weekday.String()[:3]) || strings.EqualFold(fields[0], weekday.String()) {
+				day = int(weekday)
+			}
+		}
+		if day < 0 {
+			return 0, false, fmt.Errorf("unknown weekday in '%s'", value)
+		}
+		clock = fields[1]
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("'%s' is no time like Fri 18:00, 18:00 or 2026-12-24 18:00", value)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, false, fmt.Errorf("invalid hour in '%s'", value)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, false, fmt.Errorf("invalid minute in '%s'", value)
+	}
+	if day < 0 {
+		return hour*60 + minute, false, nil
+	}
+	return (day*24+hour)*60 + minute, true, nil
+}
+
+/**
+ * Describes window for logs and errors
+ */
+func (w FreezeWindow) String() string {
+	description := w.From + " - " + w.To
+	if w.Zone != "" {
+		description += " " + w.Zone
+	}
+	if w.Reason != "" {
+		description += " (" + w.Reason + ")"
+	}
+	return description
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFreezeTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		minutes int
+		weekly  bool
+		err     bool
+	}{
+		{"00:00", 0, false, false},
+		{"18:30", 18*60 + 30, false, false},
+		{"23:59", 23*60 + 59, false, false},
+		{"Sun 00:00", 0, true, false},
+		{"Fri 18:00", (5*24 + 18) * 60, true, false},
+		{"friday 18:00", (5*24 + 18) * 60, true, false},
+		{"SAT 23:59", (6*24+23)*60 + 59, true, false},
+		{"Fry 18:00", 0, false, true},
+		{"24:00", 0, false, true},
+		{"18:60", 0, false, true},
+		{"18", 0, false, true},
+		{"18:00:00", 0, false, true},
+		{"", 0, false, true},
+	}
+	for _, test := range tests {
+		minutes, weekly, err := parseFreezeTime(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseFreezeTime(%q) = %d, %v, want error", test.value, minutes, weekly)
+			}
+			continue
+		}
+		if err != nil || minutes != test.minutes || weekly != test.weekly {
+			t.Errorf("parseFreezeTime(%q) = %d, %v, %v, want %d, %v", test.value, minutes, weekly, err, test.minutes, test.weekly)
+		}
+	}
+}
+
+func TestFreezeWindowContains(t *testing.T) {
+	weekend := FreezeWindow{From: "Fri 18:00", To: "Mon 08:00", Zone: "UTC"}
+	midweek := FreezeWindow{From: "Tue 09:00", To: "Thu 17:00", Zone: "UTC"}
+	night := FreezeWindow{From: "18:00", To: "08:00", Zone: "UTC"}
+	lunch := FreezeWindow{From: "12:00", To: "13:00", Zone: "UTC"}
+	holidays := FreezeWindow{From: "2026-12-24 00:00", To: "2027-01-02 00:00", Zone: "UTC"}
+	berlin := FreezeWindow{From: "18:00", To: "08:00", Zone: "Europe/Berlin"}
+	// 2026-10-14 is a Wednesday
+	tests := []struct {
+		name   string
+		window FreezeWindow
+		now    string
+		want   bool
+	}{
+		{"weekly before start", weekend, "2026-10-16T17:59:00Z", false},
+		{"weekly at start", weekend, "2026-10-16T18:00:00Z", true},
+		{"weekly over saturday", weekend, "2026-10-17T12:00:00Z", true},
+		{"weekly over sunday midnight", weekend, "2026-10-18T00:00:00Z", true},
+		{"weekly before end", weekend, "2026-10-19T07:59:00Z", true},
+		{"weekly at end", weekend, "2026-10-19T08:00:00Z", false},
+		{"weekly midweek outside", weekend, "2026-10-14T12:00:00Z", false},
+		{"weekly without wrap inside", midweek, "2026-10-14T12:00:00Z", true},
+		{"weekly without wrap outside", midweek, "2026-10-16T12:00:00Z", false},
+		{"daily before midnight", night, "2026-10-14T23:00:00Z", true},
+		{"daily after midnight", night, "2026-10-14T03:00:00Z", true},
+		{"daily at end", night, "2026-10-14T08:00:00Z", false},
+		{"daily during day", night, "2026-10-14T12:00:00Z", false},
+		{"daily without wrap inside", lunch, "2026-10-14T12:30:00Z", true},
+		{"daily without wrap outside", lunch, "2026-10-14T13:00:00Z", false},
+		{"dated before", holidays, "2026-12-23T23:59:00Z", false},
+		{"dated inside", holidays, "2026-12-31T12:00:00Z", true},
+		{"dated at end", holidays, "2027-01-02T00:00:00Z", false},
+		{"zone applied", berlin, "2026-10-14T16:30:00Z", true},
+		{"zone applied outside", berlin, "2026-10-14T15:30:00Z", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := test.window.contains(now)
+			if err != nil {
+				t.Fatalf("%s contains %s: %v", test.window, test.now, err)
+			}
+			if got != test.want {
+				t.Errorf("%s contains %s = %v, want %v", test.window, test.now, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFreezeWindowContainsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		window FreezeWindow
+	}{
+		{"weekly and daily", FreezeWindow{From: "Fri 18:00", To: "08:00"}},
+		{"unknown zone", FreezeWindow{From: "18:00", To: "08:00", Zone: "Mars/Olympus"}},
+		{"bad date", FreezeWindow{From: "2026-12-24", To: "2027-01-02 00:00"}},
+		{"bad time", FreezeWindow{From: "6pm", To: "08:00"}},
+	}
+	for _, test := range tests {
+		if _, err := test.window.contains(time.Now()); err == nil {
+			t.Errorf("%s: %s accepted", test.name, test.window)
+		}
+	}
+}
+
+func TestActiveFreeze(t *testing.T) {
+	saved := freezeWindows
+	defer func() { freezeWindows = saved }()
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		windows []FreezeWindow
+		want    string
+	}{
+		{"no windows", nil, ""},
+		{"outside", []FreezeWindow{{From: "Mon 08:00", To: "Fri 18:00", Zone: "UTC"}}, ""},
+		{"inside", []FreezeWindow{{From: "Fri 18:00", To: "Mon 08:00", Zone: "UTC", Reason: "weekend"}},
+			"Fri 18:00 - Mon 08:00 UTC (weekend)"},
+		{"invalid freezes", []FreezeWindow{{From: "Mon 08:00", To: "Fri 18:00", Zone: "UTC"}, {From: "Fri 18:00", To: "08:00"}},
+			"freeze window 1 is invalid"},
+	}
+	for _, test := range tests {
+		freezeWindows = test.windows
+		got := activeFreeze(now)
+		if (test.want == "") != (got == "") || !strings.HasPrefix(got, test.want) {
+			t.Errorf("%s: activeFreeze = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
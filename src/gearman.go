@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Gearman binary protocol packet types used, see http://gearman.org/protocol/ */
+const (
+	GEARMAN_CAN_DO            = 1
+	GEARMAN_PRE_SLEEP         = 4
+	GEARMAN_NOOP              = 6
+	GEARMAN_JOB_CREATED       = 8
+	GEARMAN_NO_JOB            = 10
+	GEARMAN_WORK_COMPLETE     = 13
+	GEARMAN_WORK_FAIL         = 14
+	GEARMAN_ECHO_REQ          = 16
+	GEARMAN_ECHO_RES          = 17
+	GEARMAN_SUBMIT_JOB_BG     = 18
+	GEARMAN_ERROR             = 19
+	GEARMAN_SET_CLIENT_ID     = 22
+	GEARMAN_GRAB_JOB_UNIQ     = 30
+	GEARMAN_JOB_ASSIGN_UNIQ   = 31
+	GEARMAN_SUBMIT_HIGH_BG    = 32
+	GEARMAN_SUBMIT_LOW_BG     = 34
+	GEARMAN_SUBMIT_JOB_EPOCH  = 36
+	GEARMAN_HEADER_SIZE       = 12
+	GEARMAN_MAX_PACKET_LENGTH = 64 << 20
+)
+
+var (
+	gearmanRequest  = []byte("\x00REQ")
+	gearmanResponse = []byte("\x00RES")
+)
+
+func init() {
+	registerBroker("gearman", func() Broker {
+		return &gearmanBroker{workers: make(map[string][]*gearmanConn)}
+	})
+}
+
+var (
+	/** Gearman job servers for gearman broker */
+	gearmanServers = flag.String("gearman", "127.0.0.1:4730", "Gearman job servers for --broker gearman, comma separated host:port, jobs are grabbed from all of them. Default: 127.0.0.1:4730")
+	gearmanPrefix  = flag.String("gearman-prefix", "", "Prefix of function names, tube email is function <prefix>email. Default: none")
+)
+
+/**
+ * Gearman backend for migrating from Gearman job servers: workerman registers as worker of function of each tube
+ * on every server, grabbing jobs and sleeping until server wakes it. Job belongs to connection it was grabbed on,
+ * server gives it to another worker when connection breaks
+ */
+type gearmanBroker struct {
+	lock    sync.Mutex // Guards workers map, connections in it are only used by reserver of their tube
+	workers map[string][]*gearmanConn
+	next    int // Server to grab from first, rotated so all servers get their turn
+}
+
+/** Connection to job server, reads are buffered until whole packet arrived, so interrupted read loses nothing */
+type gearmanConn struct {
+	address string
+	conn    net.Conn
+	pending []byte
+}
+
+/** Job grabbed on connection */
+type gearmanHandle struct {
+	conn   *gearmanConn
+	handle []byte
+}
+
+func gearmanList() []string {
+	return strings.Split(*gearmanServers, ",")
+}
+
+func gearmanPacket(kind uint32, args ...[]byte) []byte {
+	data := bytes.Join(args, []byte{0})
+	packet := make([]byte, GEARMAN_HEADER_SIZE, GEARMAN_HEADER_SIZE+len(data))
+	copy(packet, gearmanRequest)
+	binary.BigEndian.PutUint32(packet[4:], kind)
+	binary.BigEndian.PutUint32(packet[8:], uint32(len(data)))
+	return append(packet, data...)
+}
+
+func gearmanDial(address string) (*gearmanConn, error) {
+	conn, err := net.DialTimeout("tcp", address, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &gearmanConn{address: address, conn: conn}, nil
+}
+
+func (c *gearmanConn) send(kind uint32, args ...[]byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(DIAL_TIMEOUT))
+	_, err := c.conn.Write(gearmanPacket(kind, args...))
+	return err
+}
+
+/**
+ * Reads next response packet until read deadline set by caller, returns its type and arguments.
+ * Data is the last argument, so it is split into given number of arguments at most
+ */
+func (c *gearmanConn) read(args int) (uint32, [][]byte, error) {
+	chunk := make([]byte, 4096)
+	for {
+		if len(c.pending) >= GEARMAN_HEADER_SIZE {
+			if !bytes.Equal(c.pending[:4], gearmanResponse) {
+				return 0, nil, fmt.Errorf("bad response magic from %s", c.address)
+			}
+			size := int(binary.BigEndian.Uint32(c.pending[8:]))
+			if size > GEARMAN_MAX_PACKET_LENGTH {
+				return 0, nil, fmt.Errorf("response of %d bytes from %s is too big", size, c.address)
+			}
+			if len(c.pending) >= GEARMAN_HEADER_SIZE+size {
+				kind := binary.BigEndian.Uint32(c.pending[4:])
+				data := append([]byte(nil), c.pending[GEARMAN_HEADER_SIZE:GEARMAN_HEADER_SIZE+size]...)
+				c.pending = c.pending[GEARMAN_HEADER_SIZE+size:]
+				if kind == GEARMAN_ERROR {
+					parts := bytes.SplitN(data, []byte{0}, 2)
+					return kind, parts, fmt.Errorf("gearman error: %s", bytes.Join(parts, []byte(": ")))
+				}
+				return kind, bytes.SplitN(data, []byte{0}, args), nil
+			}
+		}
+		n, err := c.conn.Read(chunk)
+		c.pending = append(c.pending, chunk[:n]...)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+/**
+ * Connects to job server as worker of function of tube
+ */
+func (b *gearmanBroker) register(address, tube string) (*gearmanConn, error) {
+	c, err := gearmanDial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.send(GEARMAN_SET_CLIENT_ID, []byte(stats.Instance)); err == nil {
+		err = c.send(GEARMAN_CAN_DO, []byte(*gearmanPrefix+tube))
+	}
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+/**
+ * Returns connections of tube to all servers, connecting missing ones. Nil ones could not connect
+ */
+func (b *gearmanBroker) connections(tube string) ([]*gearmanConn, error) {
+	b.lock.Lock()
+	conns, has := b.workers[tube]
+	if !has {
+		conns = make([]*gearmanConn, len(gearmanList()))
+		b.workers[tube] = conns
+	}
+	b.lock.Unlock()
+	var lastErr error
+	connected := 0
+	for i, address := range gearmanList() {
+		if conns[i] == nil {
+			if conns[i], lastErr = b.register(address, tube); lastErr != nil {
+				lastErr = fmt.Errorf("%s: %v", address, lastErr)
+				continue
+			}
+		}
+		connected++
+	}
+	if connected == 0 {
+		return nil, lastErr
+	}
+	return conns, nil
+}
+
+/**
+ * Closes broken connection of tube, jobs grabbed on it go to other workers
+ */
+func (b *gearmanBroker) drop(tube string, c *gearmanConn, err error) {
+	b.lock.Lock()
+	for i, conn := range b.workers[tube] {
+		if conn == c {
+			b.workers[tube][i] = nil
+		}
+	}
+	b.lock.Unlock()
+	c.conn.Close()
+	tubeFailed(tube, fmt.Errorf("%s: %v", c.address, err))
+}
+
+/**
+ * Checks that a job server answers echo
+ */
+func (b *gearmanBroker) Check() error {
+	var err error
+	for _, address := range gearmanList() {
+		var c *gearmanConn
+		if c, err = gearmanDial(address); err != nil {
+			continue
+		}
+		if err = c.send(GEARMAN_ECHO_REQ, []byte("ping")); err == nil {
+			c.conn.SetReadDeadline(time.Now().Add(DIAL_TIMEOUT))
+			var kind uint32
+			if kind, _, err = c.read(1); err == nil && kind != GEARMAN_ECHO_RES {
+				err = fmt.Errorf("unexpected response %d to echo from %s", kind, address)
+			}
+		}
+		c.conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/**
+ * Worker registration is made by reserver, so there is nothing to do until then
+ */
+func (b *gearmanBroker) Subscribe(tube string) {
+}
+
+func (b *gearmanBroker) Unsubscribe(tube string) {
+}
+
+/**
+ * Queued jobs of function not running yet, summed over servers, from text "status" command of administrative protocol
+ */
+func (b *gearmanBroker) Stats(tube string) (int, error) {
+	function := *gearmanPrefix + tube
+	queued := 0
+	for _, address := range gearmanList() {
+		conn, err := net.DialTimeout("tcp", address, DIAL_TIMEOUT)
+		if err != nil {
+			return 0, err
+		}
+		conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+		fmt.Fprintf(conn, "status\n")
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() && scanner.Text() != "." {
+			// function <tab> total <tab> running <tab> available workers
+			fields := strings.Split(scanner.Text(), "\t")
+			if len(fields) >= 3 && fields[0] == function {
+				total, _ := strconv.Atoi(fields[1])
+				running, _ := strconv.Atoi(fields[2])
+				queued += total - running
+			}
+		}
+		err = scanner.Err()
+		conn.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return queued, nil
+}
+
+/**
+ * Grabs job of tube from servers in turn. When none has one, sleeps on all until a server wakes it up or timeout passes
+ */
+func (b *gearmanBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	conns, err := b.connections(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	b.lock.Lock()
+	b.next++
+	first := b.next
+	b.lock.Unlock()
+	for i := range conns {
+		c := conns[(first+i)%len(conns)]
+		if c == nil {
+			continue
+		}
+		job, err := b.grab(c)
+		if err != nil {
+			b.drop(tube, c, err)
+			continue
+		}
+		if job != nil {
+			tubeRecovered(tube)
+			return job, nil
+		}
+	}
+	b.sleep(tube, conns, timeout)
+	return nil, nil
+}
+
+/**
+ * Asks server for job, nil when it has none
+ */
+func (b *gearmanBroker) grab(c *gearmanConn) (*ReservedJob, error) {
+	if err := c.send(GEARMAN_GRAB_JOB_UNIQ); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(DIAL_TIMEOUT))
+	for {
+		kind, args, err := c.read(4)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case GEARMAN_NOOP:
+			// Wake up left from previous sleep
+			continue
+		case GEARMAN_NO_JOB:
+			return nil, nil
+		case GEARMAN_JOB_ASSIGN_UNIQ:
+			if len(args) < 4 {
+				return nil, fmt.Errorf("malformed job assignment from %s", c.address)
+			}
+			// Handle, function, unique id, data
+			return &ReservedJob{Id: string(args[0]), Body: args[3], Priority: DEFAULT_PRIORITY, TTR: DEFAULT_TTR, handle: gearmanHandle{c, args[0]}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected response %d to grab from %s", kind, c.address)
+		}
+	}
+}
+
+/**
+ * Tells servers worker sleeps and waits for NOOP from any of them. Others are interrupted by read deadline,
+ * what they read meanwhile stays buffered
+ */
+func (b *gearmanBroker) sleep(tube string, conns []*gearmanConn, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	type woken struct {
+		conn *gearmanConn
+		err  error
+	}
+	results := make(chan woken, len(conns))
+	sleeping := 0
+	for _, c := range conns {
+		if c == nil {
+			continue
+		}
+		if err := c.send(GEARMAN_PRE_SLEEP); err != nil {
+			b.drop(tube, c, err)
+			continue
+		}
+		c.conn.SetReadDeadline(deadline)
+		sleeping++
+		go func(c *gearmanConn) {
+			kind, _, err := c.read(1)
+			if err == nil && kind != GEARMAN_NOOP {
+				err = fmt.Errorf("unexpected response %d while sleeping from %s", kind, c.address)
+			}
+			results <- woken{c, err}
+		}(c)
+	}
+	if sleeping > 0 {
+		tubeRecovered(tube)
+	}
+	for ; sleeping > 0; sleeping-- {
+		result := <-results
+		var netErr net.Error
+		if result.err != nil && !(errors.As(result.err, &netErr) && netErr.Timeout()) {
+			b.drop(tube, result.conn, result.err)
+		}
+		// One woke up or time is over, interrupt the rest
+		for _, c := range conns {
+			if c != nil {
+				c.conn.SetReadDeadline(time.Now())
+			}
+		}
+	}
+}
+
+/**
+ * Drops connections of tube, jobs still grabbed on them go to other workers
+ */
+func (b *gearmanBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	conns := b.workers[tube]
+	delete(b.workers, tube)
+	b.lock.Unlock()
+	for _, c := range conns {
+		if c != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+/**
+ * Job stays with worker as long as connection is open, there is no time to run to extend
+ */
+func (b *gearmanBroker) Touch(job *ReservedJob) error {
+	return nil
+}
+
+/**
+ * Reports job as complete, worker output is not passed on
+ */
+func (b *gearmanBroker) Delete(job *ReservedJob) error {
+	return b.report(job, GEARMAN_WORK_COMPLETE, []byte{})
+}
+
+/**
+ * Gearman can not put job back: it is submitted again as background job, then reported as failed
+ */
+func (b *gearmanBroker) Release(job *ReservedJob) error {
+	if _, err := b.Put(job.Tube, job.Body, job.Priority, 0, 0); err != nil {
+		return err
+	}
+	return b.Bury(job)
+}
+
+/**
+ * Reports job as failed, server drops it. Client waiting for foreground job is told it failed
+ */
+func (b *gearmanBroker) Bury(job *ReservedJob) error {
+	return b.report(job, GEARMAN_WORK_FAIL)
+}
+
+func (b *gearmanBroker) report(job *ReservedJob, kind uint32, data ...[]byte) error {
+	handle := job.handle.(gearmanHandle)
+	b.lock.Lock()
+	current := false
+	for _, c := range b.workers[job.Tube] {
+		current = current || c == handle.conn
+	}
+	b.lock.Unlock()
+	if !current {
+		return errLostReservation
+	}
+	return handle.conn.send(kind, append([][]byte{handle.handle}, data...)...)
+}
+
+/**
+ * Submits background job to first server accepting it, returns its handle. Priority below or above default
+ * is submitted as high or low one, delay as SUBMIT_JOB_EPOCH which needs gearmand 1.x
+ */
+func (b *gearmanBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	kind, args := uint32(GEARMAN_SUBMIT_JOB_BG), [][]byte{[]byte(*gearmanPrefix + tube), {}}
+	if delay > 0 {
+		kind = GEARMAN_SUBMIT_JOB_EPOCH
+		args = append(args, []byte(strconv.FormatInt(time.Now().Add(delay).Unix(), 10)))
+	} else if priority < DEFAULT_PRIORITY {
+		kind = GEARMAN_SUBMIT_HIGH_BG
+	} else if priority > DEFAULT_PRIORITY {
+		kind = GEARMAN_SUBMIT_LOW_BG
+	}
+	args = append(args, body)
+	var err error
+	for _, address := range gearmanList() {
+		var c *gearmanConn
+		if c, err = gearmanDial(address); err != nil {
+			continue
+		}
+		var handle []byte
+		if err = c.send(kind, args...); err == nil {
+			c.conn.SetReadDeadline(time.Now().Add(DIAL_TIMEOUT))
+			var response uint32
+			var parts [][]byte
+			if response, parts, err = c.read(1); err == nil {
+				if response != GEARMAN_JOB_CREATED {
+					err = fmt.Errorf("unexpected response %d to submit from %s", response, address)
+				} else {
+					handle = parts[0]
+				}
+			}
+		}
+		c.conn.Close()
+		if err == nil {
+			return string(handle), nil
+		}
+	}
+	return "", err
+}
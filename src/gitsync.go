@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** How long one git command of workers sync may take */
+const GIT_SYNC_TIMEOUT = time.Minute
+
+var (
+	/** Workers directory is git checkout following its upstream branch */
+	workersGit         = flag.Bool("workers-git", false, "Workers directory is a git checkout, pulled from upstream of its branch with changed workers replaced atomically. Default: false")
+	workersGitInterval = flag.Duration("workers-git-interval", time.Minute, "How often workers directory is pulled with --workers-git, 0 to pull on syncWorkers command only. Default: 1m")
+
+	/** One sync at a time, interval and commands alike */
+	gitSyncLock sync.Mutex
+)
+
+/**
+ * SyncWorkers request over gRPC
+ */
+type SyncRequest struct {
+	Override string // Why workers directory is synced during freeze window
+}
+
+/**
+ * Git sync of workers directory, shown in status
+ */
+type WorkersSync struct {
+	Commit  string    // Commit workers directory is at
+	Synced  time.Time // Last time upstream was checked
+	Changed []string  `json:",omitempty"` // Files changed by last sync
+	Error   string    `json:",omitempty"` // Why last sync failed
+}
+
+/**
+ * Checks --workers-git can be used, must be called after changing into workers directory
+ */
+func checkWorkersGit() {
+	if !*workersGit {
+		return
+	}
+	if *readOnlyWorkers {
+		log.Fatalf("Fatal error: --workers-git can not be used with --read-only-workers")
+	}
+	if _, err := git("rev-parse", "--abbrev-ref", "@{upstream}"); err != nil {
+		log.Fatalf("Fatal error: workers directory %s is no git checkout with upstream branch: %v", *workersPath, err)
+	}
+}
+
+/**
+ * Syncs workers directory right away, then every --workers-git-interval, except during freeze windows
+ */
+func syncWorkersPeriodically() {
+	if !*workersGit {
+		return
+	}
+	frozen := ""
+	for {
+		stateLock.Lock()
+		window := activeFreeze(time.Now())
+		stateLock.Unlock()
+		if window == "" {
+			syncWorkers()
+		} else if window != frozen {
+			log.Printf("Not syncing workers directory during freeze window %s", window)
+		}
+		frozen = window
+		if *workersGitInterval <= 0 {
+			return
+		}
+		time.Sleep(*workersGitInterval)
+	}
+}
+
+/**
+ * Process syncWorkers command: pulls workers directory and responds with sync status. During freeze window it needs
+ * "override" option with a reason
+ */
+func syncWorkersCommand(options map[string]string) []byte {
+	var response interface{}
+	if !*workersGit {
+		response = CommandError{"workers directory is not synced, see --workers-git"}
+	} else if err := checkFreeze("sync of workers directory", options["override"]); err != nil {
+		response = CommandError{err.Error()}
+	} else {
+		response = syncWorkers()
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
+
+/**
+ * Fetches upstream and brings workers directory to its commit, writing every changed file next to the old one and
+ * renaming it over, so workers are never run half written. Returns status, also kept in WorkersSync of status.
+ * Takes stateLock itself
+ */
+func syncWorkers() WorkersSync {
+	gitSyncLock.Lock()
+	defer gitSyncLock.Unlock()
+	stateLock.Lock()
+	status := WorkersSync{Synced: time.Now()}
+	if stats.WorkersSync != nil {
+		status.Commit = stats.WorkersSync.Commit
+	}
+	stateLock.Unlock()
+	changed, commit, err := pullWorkers()
+	if commit != "" {
+		status.Commit = commit
+	}
+	if err != nil {
+		status.Error = err.Error()
+		log.Printf("Could not sync workers directory: %v", err)
+	} else if len(changed) > 0 {
+		status.Changed = changed
+		log.Printf("Synced workers directory to %s, changed %s", commit, strings.Join(changed, ", "))
+		publishEvent("synced", "", commit)
+	}
+	stateLock.Lock()
+	stats.WorkersSync = &status
+	if len(changed) > 0 {
+		watchRequested = true
+	}
+	stateLock.Unlock()
+	return status
+}
+
+/**
+ * Fetches upstream and applies its changes, returns changed paths and commit workers directory is at
+ */
+func pullWorkers() ([]string, string, error) {
+	head, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := git("fetch", "--quiet"); err != nil {
+		return nil, head, err
+	}
+	target, err := git("rev-parse", "@{upstream}")
+	if err != nil || target == head {
+		return nil, head, err
+	}
+	// Local edits would be overwritten
+	if dirty, err := git("status", "--porcelain", "--untracked-files=no"); err != nil || dirty != "" {
+		if err == nil {
+			err = errors.New("local changes in workers directory, not synced")
+		}
+		return nil, head, err
+	}
+	diff, err := gitOutput("diff", "--name-status", "--no-renames", "-z", head, target)
+	if err != nil {
+		return nil, head, err
+	}
+	fields := strings.Split(strings.TrimSuffix(string(diff), "\x00"), "\x00")
+	var changed []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		if status == "D" {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = checkoutFile(target, path)
+		}
+		if err != nil {
+			return changed, head, fmt.Errorf("%s: %v", path, err)
+		}
+		changed = append(changed, path)
+	}
+	// Files are in place, index and HEAD follow
+	if _, err := git("reset", "--quiet", target); err != nil {
+		return changed, head, err
+	}
+	return changed, target, nil
+}
+
+/**
+ * Writes file of commit atomically, executable if it is in git
+ */
+func checkoutFile(commit, path string) error {
+	entry, err := git("ls-tree", commit, "--", path)
+	if err != nil {
+		return err
+	}
+	// "<mode> <type> <object>\t<path>"
+	info := strings.Fields(entry)
+	if len(info) < 3 || info[1] != "blob" {
+		return fmt.Errorf("not a file in %s", commit)
+	}
+	content, err := gitOutput("cat-file", "blob", info[2])
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if info[0] == "100755" {
+		perm = 0755
+	}
+	if strings.Contains(path, "/") {
+		if err := os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, content, perm)
+}
+
+/**
+ * Runs git in workers directory, returns its output trimmed
+ */
+func git(args ...string) (string, error) {
+	out, err := gitOutput(args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+/**
+ * Runs git in workers directory without prompting for credentials, returns its output
+ */
+func gitOutput(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GIT_SYNC_TIMEOUT)
+	defer cancel()
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	done, err := startChild(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	done()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %s timeout", GIT_SYNC_TIMEOUT)
+	}
+	if message := strings.TrimSpace(stderr.String()); err != nil && message != "" {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, message)
+	} else if err != nil {
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+const GRPC_SERVICE = "workerman.Control"
+
+var (
+	grpcListen   = flag.String("grpc-listen", "", "Address:port for gRPC control API, empty to disable. Default: disabled")
+	grpcCert     = flag.String("grpc-cert", "", "TLS certificate file for gRPC control API")
+	grpcKey      = flag.String("grpc-key", "", "TLS key file for gRPC control API")
+	grpcClientCA = flag.String("grpc-client-ca", "", "CA file to verify gRPC client certificates, enables mutual TLS")
+	grpcToken    = flag.String("grpc-token", "", "Bearer token required from gRPC clients")
+
+	grpcServer *grpc.Server
+
+	grpcListener net.Listener
+)
+
+/**
+ * JSON codec, so gRPC messages are the same JSON documents as in command tube protocol
+ *
+ * Clients select it with "json" content subtype, i.e. application/grpc+json.
+ */
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+/**
+ * Pause, Resume and GetConfig request, no tubes means all tubes
+ */
+type PauseRequest struct {
+	Tubes []string `json:"tubes,omitempty"`
+}
+
+/**
+ * Management service: Status, GetConfig, GetLimits, SetLimits, Pause, Resume, Drain, Put, Replay, SetFeature, RollbackConfig,
+ * DeployWorker, SyncWorkers, RollbackWorker, PromoteWorker and StreamEvents
+ */
+var controlService = grpc.ServiceDesc{
+	ServiceName: GRPC_SERVICE,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("Status", emptyRequest, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "getStatus"}
+		}),
+		unaryMethod("GetLimits", emptyRequest, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "getLimits"}
+		}),
+		unaryMethod("GetConfig", func() interface{} { return new(PauseRequest) }, func(req interface{}) WorkerCommand {
+			options := make(map[string]string)
+			for _, tube := range req.(*PauseRequest).Tubes {
+				options[tube] = ""
+			}
+			return WorkerCommand{Command: "getConfig", Options: options}
+		}),
+		unaryMethod("SetLimits", func() interface{} { return new(LimitsUpdate) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "setLimits", Limits: req.(*LimitsUpdate)}
+		}),
+		unaryMethod("Pause", func() interface{} { return new(PauseRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "pause", Options: pauseOptions(req.(*PauseRequest))}
+		}),
+		unaryMethod("Resume", func() interface{} { return new(PauseRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "resume", Options: pauseOptions(req.(*PauseRequest))}
+		}),
+		unaryMethod("Drain", emptyRequest, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "drain"}
+		}),
+		unaryMethod("Replay", func() interface{} { return new(ReplayRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "replay", Replay: req.(*ReplayRequest)}
+		}),
+		unaryMethod("SetFeature", func() interface{} { return new(FeatureToggle) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "setFeature", Feature: req.(*FeatureToggle)}
+		}),
+		unaryMethod("RollbackConfig", emptyRequest, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "rollbackConfig"}
+		}),
+		unaryMethod("Put", func() interface{} { return new(JobRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "put", Job: req.(*JobRequest)}
+		}),
+		unaryMethod("DeployWorker", func() interface{} { return new(DeployRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "deployWorker", Deploy: req.(*DeployRequest)}
+		}),
+		unaryMethod("SyncWorkers", func() interface{} { return new(SyncRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "syncWorkers", Options: map[string]string{"override": req.(*SyncRequest).Override}}
+		}),
+		unaryMethod("RollbackWorker", func() interface{} { return new(SwitchRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "rollbackWorker", Options: map[string]string{req.(*SwitchRequest).Worker: ""}}
+		}),
+		unaryMethod("PromoteWorker", func() interface{} { return new(SwitchRequest) }, func(req interface{}) WorkerCommand {
+			return WorkerCommand{Command: "promoteWorker", Options: map[string]string{req.(*SwitchRequest).Worker: ""}}
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamEvents", Handler: streamEvents, ServerStreams: true},
+	},
+}
+
+/**
+ * Builds gRPC method executing control command
+ */
+func unaryMethod(name string, newRequest func() interface{}, command func(req interface{}) WorkerCommand) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return grpcExecute(command(req))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPC_SERVICE + "/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+func emptyRequest() interface{} {
+	return new(struct{})
+}
+
+func pauseOptions(req *PauseRequest) map[string]string {
+	options := make(map[string]string)
+	for _, tube := range req.Tubes {
+		options[tube] = ""
+	}
+	if len(options) == 0 {
+		options["*"] = ""
+	}
+	return options
+}
+
+/**
+ * Executes control command, rejected limit changes are reported as InvalidArgument, other failures as FailedPrecondition
+ */
+func grpcExecute(cmd WorkerCommand) (interface{}, error) {
+	pendingCommands.Add(1)
+	defer pendingCommands.Done()
+	payload := executeCommand(cmd)
+	if payload == nil {
+		return nil, status.Errorf(codes.Internal, "command %s failed", cmd.Command)
+	}
+	var failure CommandError
+	if cmd.Limits != nil {
+		var result LimitsUpdateResponse
+		if json.Unmarshal(payload, &result) == nil && !result.Applied {
+			return nil, status.Error(codes.InvalidArgument, strings.Join(result.Errors, "; "))
+		}
+	} else if json.Unmarshal(payload, &failure) == nil && failure.Error != "" {
+		return nil, status.Error(codes.FailedPrecondition, failure.Error)
+	}
+	response := json.RawMessage(payload)
+	return &response, nil
+}
+
+/**
+ * Sends events to client until it disconnects
+ */
+func streamEvents(srv interface{}, stream grpc.ServerStream) error {
+	var req struct{}
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	listener := listenEvents()
+	defer forgetEvents(listener)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-listener:
+			if err := stream.SendMsg(&event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/** Scope each method needs like commandScopes, methods not listed need admin */
+var grpcMethodScopes = map[string]string{
+	"Status": SCOPE_READ, "GetConfig": SCOPE_READ, "GetLimits": SCOPE_READ, "StreamEvents": SCOPE_READ,
+	"Pause": SCOPE_OPERATE, "Resume": SCOPE_OPERATE, "Drain": SCOPE_OPERATE,
+	"SetLimits": SCOPE_CONFIGURE, "SetFeature": SCOPE_CONFIGURE, "RollbackConfig": SCOPE_CONFIGURE,
+}
+
+/**
+ * Checks bearer token or verified client certificate against scope method needs, by the same rules as HTTP
+ *
+ * --grpc-token grants admin scope, tokens and client names from access file grant their own scopes.
+ */
+func grpcAuthorize(ctx context.Context, fullMethod string) error {
+	need, has := grpcMethodScopes[strings.TrimPrefix(fullMethod, "/"+GRPC_SERVICE+"/")]
+	if !has {
+		need = SCOPE_ADMIN
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	authorization := ""
+	for _, value := range md.Get("authorization") {
+		if *grpcToken != "" && subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+*grpcToken)) == 1 {
+			return nil
+		}
+		authorization = value
+	}
+	var chains [][]*x509.Certificate
+	if client, ok := peer.FromContext(ctx); ok {
+		if info, ok := client.AuthInfo.(credentials.TLSInfo); ok {
+			chains = info.State.VerifiedChains
+		}
+	}
+	if *grpcToken != "" && access == nil && len(chains) == 0 {
+		return status.Error(codes.Unauthenticated, "invalid or missing token")
+	}
+	reason, authenticated := authorize(authorization, chains, need)
+	if reason == "" {
+		return nil
+	} else if !authenticated {
+		return status.Error(codes.Unauthenticated, reason)
+	}
+	return status.Error(codes.PermissionDenied, reason)
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcAuthorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuthorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+/**
+ * Builds TLS credentials from --grpc-cert, --grpc-key and --grpc-client-ca
+ */
+func grpcCredentials() (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(*grpcCert, *grpcKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if *grpcClientCA != "" {
+		pem, err := ioutil.ReadFile(*grpcClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *grpcClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(config), nil
+}
+
+/**
+ * Starts gRPC control API, if enabled
+ */
+func listenGrpc() {
+	if *grpcListen == "" {
+		return
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+		grpc.MaxRecvMsgSize(DEPLOY_MAX_COMMAND),
+	}
+	if *grpcCert != "" || *grpcKey != "" {
+		creds, err := grpcCredentials()
+		if err != nil {
+			log.Printf("Warning: gRPC control API disabled, could not load TLS credentials: %v", err)
+			return
+		}
+		options = append(options, grpc.Creds(creds))
+	} else if *grpcToken != "" {
+		log.Printf("Warning: gRPC token is sent in clear text, use --grpc-cert and --grpc-key")
+	}
+	listener := inheritedListener("grpc")
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", *grpcListen); err != nil {
+			log.Printf("Warning: gRPC control API disabled, could not listen on %s: %v", *grpcListen, err)
+			return
+		}
+	}
+	grpcListener = listener
+	grpcServer = grpc.NewServer(options...)
+	grpcServer.RegisterService(&controlService, struct{}{})
+	log.Printf("Listening for gRPC commands on %s", *grpcListen)
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Printf("gRPC control API stopped: %v", err)
+		}
+	}()
+}
+
+/**
+ * Stops gRPC control API
+ */
+func closeGrpc() {
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Environment variables telling hook script what it is called for */
+const (
+	HOOK_ENV          = "WORKERMAN_HOOK"
+	HOOK_RUN_ENV      = "WORKERMAN_RUN"
+	HOOK_DURATION_ENV = "WORKERMAN_DURATION"
+	HOOK_ERROR_ENV    = "WORKERMAN_ERROR"
+)
+
+func init() {
+	registerHook("scripts", scriptHooks{})
+}
+
+var (
+	/** Directory of hook scripts run around workers */
+	hooksPath   = flag.String("hooks", "", "Directory with before, completed and failed hook scripts run around each worker run, <hook>.<tube> overrides <hook> for a tube. Default: none")
+	hookTimeout = flag.Duration("hook-timeout", 10*time.Second, "Hook script is killed after running that long. Default: 10s")
+
+	/** Hooks in order of registration */
+	jobHooks []namedHook
+)
+
+/**
+ * Worker run as hooks see it
+ */
+type HookRun struct {
+	Tube          string
+	Run           uint64
+	JobId         string        // Empty when worker reserves job itself
+	CorrelationId string        `json:",omitempty"` // Of job payload, see --correlation-field
+	Body          []byte        // Job body given to worker on stdin, Before hook may replace it
+	Started       time.Time     // When Before hooks were called
+	Duration      time.Duration // How long worker ran with retries, set for Completed and Failed
+}
+
+/**
+ * Middleware called around each worker run, e.g. for custom logging, metering or payload rewriting.
+ * Before error fails the run without starting worker, like worker failing with it would
+ */
+type JobHook interface {
+	Before(run *HookRun) error
+	Completed(run *HookRun)
+	Failed(run *HookRun, err error)
+}
+
+type namedHook struct {
+	name string
+	hook JobHook
+}
+
+/**
+ * Registers hook called around all worker runs, called from init() of the code implementing it
+ */
+func registerHook(name string, hook JobHook) {
+	jobHooks = append(jobHooks, namedHook{name, hook})
+}
+
+/**
+ * Calls Before of hooks in order, stopping at first error
+ */
+func hooksBefore(run *HookRun) error {
+	run.Started = time.Now()
+	for _, h := range jobHooks {
+		if err := h.hook.Before(run); err != nil {
+			return fmt.Errorf("%s hook: %w", h.name, err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Calls Completed or Failed of hooks in order
+ */
+func hooksAfter(run *HookRun, err error) {
+	run.Duration = time.Since(run.Started)
+	for _, h := range jobHooks {
+		if err == nil {
+			h.hook.Completed(run)
+		} else {
+			h.hook.Failed(run, err)
+		}
+	}
+}
+
+/**
+ * Makes hooks path absolute, must be called before changing working directory
+ */
+func resolveHooksPath() {
+	if *hooksPath == "" {
+		return
+	}
+	if path, err := filepath.Abs(*hooksPath); err == nil {
+		*hooksPath = path
+	}
+}
+
+/**
+ * Runs executables from --hooks directory. Each gets job body on stdin and run details in environment,
+ * output of before hook replaces job body unless empty. Missing scripts are skipped
+ */
+type scriptHooks struct{}
+
+func (scriptHooks) Before(run *HookRun) error {
+	out, err := runHookScript("before", run, nil)
+	if err == nil && len(out) > 0 && run.JobId != "" {
+		run.Body = out
+	}
+	return err
+}
+
+func (scriptHooks) Completed(run *HookRun) {
+	if _, err := runHookScript("completed", run, nil); err != nil {
+		log.Printf("Completed hook of %s:%d failed: %v", run.Tube, run.Run, err)
+	}
+}
+
+func (scriptHooks) Failed(run *HookRun, failure error) {
+	if _, err := runHookScript("failed", run, failure); err != nil {
+		log.Printf("Failed hook of %s:%d failed: %v", run.Tube, run.Run, err)
+	}
+}
+
+/**
+ * Finds script for tube, preferring <hook>.<tube> over <hook>, empty when there is none
+ */
+func hookScript(hook, tube string) string {
+	if *hooksPath == "" {
+		return ""
+	}
+	for _, name := range []string{hook + "." + tube, hook} {
+		path := filepath.Join(*hooksPath, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+/**
+ * Runs hook script with timeout, returns its output. Stderr goes to daemon log
+ */
+func runHookScript(hook string, run *HookRun, failure error) ([]byte, error) {
+	path := hookScript(hook, run.Tube)
+	if path == "" {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(run.Body)
+	cmd.Stdout = &out
+	cmd.Stderr = log.Writer()
+	cmd.Env = append(os.Environ(), HOOK_ENV+"="+hook, JOB_TUBE_ENV+"="+run.Tube, JOB_ID_ENV+"="+run.JobId,
+		HOOK_RUN_ENV+"="+strconv.FormatUint(run.Run, 10), CORRELATION_ENV+"="+run.CorrelationId)
+	if hook != "before" {
+		cmd.Env = append(cmd.Env, HOOK_DURATION_ENV+"="+strconv.FormatFloat(run.Duration.Seconds(), 'f', 3, 64))
+	}
+	if failure != nil {
+		cmd.Env = append(cmd.Env, HOOK_ERROR_ENV+"="+strings.Replace(failure.Error(), "\n", " ", -1))
+	}
+	done, err := startChild(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	done()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %s timeout", *hookTimeout)
+	}
+	return out.Bytes(), err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func hostLoad() (float64, uint64, error) {
+	return 0, 0, errors.New("host load is only read on Linux")
+}
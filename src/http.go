@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+/** Maximum size of HTTP request body */
+const MAX_HTTP_BODY = 1 << 20
+
+var (
+	httpListen   = flag.String("http-listen", "", "Address:port for HTTP control API, empty to disable. Default: disabled")
+	httpCert     = flag.String("http-cert", "", "TLS certificate file for HTTP control API")
+	httpKey      = flag.String("http-key", "", "TLS key file for HTTP control API")
+	httpClientCA = flag.String("http-client-ca", "", "CA file to verify HTTP client certificates, enables mutual TLS")
+
+	httpServer *http.Server
+
+	httpListener net.Listener
+)
+
+/**
+ * Builds HTTP control API routes
+ *
+ * GET /status, GET /config, GET /limits, POST /limits, POST /pause, POST /resume, POST /drain, POST /put, POST /replay, POST /feature,
+ * POST /deploy and POST /command taking WorkerCommand as is. GET /health and GET /ready are open for probes, GET /metrics is read scope.
+ */
+func httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", httpReadiness(false))
+	mux.HandleFunc("/ready", httpReadiness(true))
+	mux.HandleFunc("/metrics", httpMetrics)
+	mux.HandleFunc("/status", httpMethod("GET", func(r *http.Request) (WorkerCommand, error) {
+		return WorkerCommand{Command: "getStatus"}, nil
+	}))
+	mux.HandleFunc("/config", httpMethod("GET", func(r *http.Request) (WorkerCommand, error) {
+		options := make(map[string]string)
+		for _, tube := range r.URL.Query()["tube"] {
+			options[tube] = ""
+		}
+		return WorkerCommand{Command: "getConfig", Options: options}, nil
+	}))
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			httpCommand(w, r, WorkerCommand{Command: "getLimits"})
+			return
+		}
+		httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+			update := &LimitsUpdate{}
+			return WorkerCommand{Command: "setLimits", Limits: update}, decodeBody(r, update)
+		})(w, r)
+	})
+	for _, command := range []string{"pause", "resume"} {
+		command := command
+		mux.HandleFunc("/"+command, httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+			var req PauseRequest
+			err := decodeBody(r, &req)
+			return WorkerCommand{Command: command, Options: pauseOptions(&req)}, err
+		}))
+	}
+	mux.HandleFunc("/drain", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		return WorkerCommand{Command: "drain"}, nil
+	}))
+	mux.HandleFunc("/put", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		job := &JobRequest{}
+		return WorkerCommand{Command: "put", Job: job}, decodeBody(r, job)
+	}))
+	mux.HandleFunc("/replay", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		replay := &ReplayRequest{}
+		return WorkerCommand{Command: "replay", Replay: replay}, decodeBody(r, replay)
+	}))
+	mux.HandleFunc("/feature", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		toggle := &FeatureToggle{}
+		return WorkerCommand{Command: "setFeature", Feature: toggle}, decodeBody(r, toggle)
+	}))
+	mux.HandleFunc("/deploy", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		deploy := &DeployRequest{}
+		return WorkerCommand{Command: "deployWorker", Deploy: deploy}, decodeBodyLimit(r, deploy, DEPLOY_MAX_COMMAND)
+	}))
+	for path, command := range map[string]string{"/rollback": "rollbackWorker", "/promote": "promoteWorker"} {
+		command := command
+		mux.HandleFunc(path, httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+			var req SwitchRequest
+			err := decodeBody(r, &req)
+			return WorkerCommand{Command: command, Options: map[string]string{req.Worker: ""}}, err
+		}))
+	}
+	mux.HandleFunc("/command", httpMethod("POST", func(r *http.Request) (WorkerCommand, error) {
+		var cmd WorkerCommand
+		return cmd, decodeBody(r, &cmd)
+	}))
+	return mux
+}
+
+/**
+ * Decodes JSON request body of at most MAX_HTTP_BODY bytes, empty body is fine
+ */
+func decodeBody(r *http.Request, value interface{}) error {
+	return decodeBodyLimit(r, value, MAX_HTTP_BODY)
+}
+
+/**
+ * Decodes JSON request body of at most limit bytes, empty body is fine
+ */
+func decodeBodyLimit(r *http.Request, value interface{}, limit int64) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, limit))
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	return json.Unmarshal(body, value)
+}
+
+/**
+ * Wraps command builder into handler accepting single HTTP method
+ */
+func httpMethod(method string, build func(r *http.Request) (WorkerCommand, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		cmd, err := build(r)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+			return
+		}
+		httpCommand(w, r, cmd)
+	}
+}
+
+/**
+ * Checks access and executes command
+ */
+func httpCommand(w http.ResponseWriter, r *http.Request, cmd WorkerCommand) {
+	if status, message := httpAuthorize(r, commandScope(cmd.Command)); status != http.StatusOK {
+		httpError(w, status, message)
+		return
+	}
+	pendingCommands.Add(1)
+	payload := executeCommand(cmd)
+	pendingCommands.Done()
+	if payload == nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("Unknown or unsupported command: %s", cmd.Command))
+		return
+	}
+	status := http.StatusOK
+	var failure CommandError
+	if cmd.Limits != nil {
+		var result LimitsUpdateResponse
+		if json.Unmarshal(payload, &result) == nil && !result.Applied {
+			status = http.StatusUnprocessableEntity
+		}
+	} else if json.Unmarshal(payload, &failure) == nil && failure.Error != "" {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(wrapResponse(cmd, payload))
+}
+
+/**
+ * Checks bearer token or client certificate against scope needed, see authorize
+ */
+func httpAuthorize(r *http.Request, need string) (int, string) {
+	var chains [][]*x509.Certificate
+	if r.TLS != nil {
+		chains = r.TLS.VerifiedChains
+	}
+	reason, authenticated := authorize(r.Header.Get("Authorization"), chains, need)
+	if reason == "" {
+		return http.StatusOK, ""
+	} else if !authenticated {
+		return http.StatusUnauthorized, reason
+	}
+	return http.StatusForbidden, reason
+}
+
+/**
+ * Reports readiness without authorization, for load balancer and orchestrator probes.
+ * Health is OK as long as daemon responds, readiness fails with 503 until beanstalkd connections are up
+ */
+func httpReadiness(strict bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stateLock.Lock()
+		ready, reason := stats.Ready, stats.NotReady
+		stateLock.Unlock()
+		status := http.StatusOK
+		if strict && !ready {
+			status = http.StatusServiceUnavailable
+		}
+		payload, _ := json.Marshal(struct {
+			Ready    bool
+			NotReady string `json:",omitempty"`
+		}{ready, reason})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(payload)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, message string) {
+	payload, _ := json.Marshal(CommandError{message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+/**
+ * Starts HTTP control API, if enabled
+ */
+func listenHttp() {
+	if *httpListen == "" {
+		return
+	}
+	server := &http.Server{
+		Handler:      httpHandler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	if *httpCert != "" || *httpKey != "" {
+		cert, err := tls.LoadX509KeyPair(*httpCert, *httpKey)
+		if err != nil {
+			log.Printf("Warning: HTTP control API disabled, could not load TLS certificate: %v", err)
+			return
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if *httpClientCA != "" {
+			pem, err := ioutil.ReadFile(*httpClientCA)
+			pool := x509.NewCertPool()
+			if err != nil || !pool.AppendCertsFromPEM(pem) {
+				log.Printf("Warning: HTTP control API disabled, could not load client CA %s: %v", *httpClientCA, err)
+				return
+			}
+			server.TLSConfig.ClientCAs = pool
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	listener := inheritedListener("http")
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", *httpListen); err != nil {
+			log.Printf("Warning: HTTP control API disabled, could not listen on %s: %v", *httpListen, err)
+			return
+		}
+	}
+	httpServer, httpListener = server, listener
+	log.Printf("Listening for HTTP commands on %s", *httpListen)
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP control API stopped: %v", err)
+		}
+	}()
+}
+
+/**
+ * Stops HTTP control API
+ */
+func closeHttp() {
+	if httpServer != nil {
+		httpServer.Close()
+	}
+}
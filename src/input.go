@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+/** Name temp files of job payloads get, for Input "file" */
+const INPUT_FILE_PATTERN = "workerman-job-*"
+
+/** Payload could not be delivered as Input says, job is buried without running worker */
+var errInvalidInput = errors.New("invalid input")
+
+/**
+ * How payload of reserved job is given to worker process, with temp file to remove once it exits
+ */
+type workerInput struct {
+	args  []string
+	stdin []byte
+	file  string
+}
+
+/**
+ * Returns payload of job delivered as Input of tube says: on stdin as it is ("stdin") or as one line of JSON ("json"),
+ * or in arguments rendered from Args templates with stdin left empty ("args", "file"). Payload fields take part in
+ * templates as {{.user_id}}, {{file}} is path of temp file holding payload, passed last when no template mentions it.
+ * Caller must call cleanup once worker exits
+ */
+func prepareInput(config EffectiveConfig, body []byte) (*workerInput, error) {
+	input := &workerInput{args: []string{""}}
+	switch config.Input {
+	case "", "stdin":
+		input.stdin = body
+		return input, nil
+	case "json":
+		line, err := jsonLine(body)
+		input.stdin = line
+		return input, err
+	}
+	data := templateData(body)
+	funcs := template.FuncMap{
+		"file": func() (string, error) { return input.tempFile(body) },
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}
+	input.args = nil
+	for i, arg := range config.Args {
+		tmpl, err := template.New(fmt.Sprintf("Args[%d]", i)).Funcs(funcs).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			input.cleanup()
+			return nil, err
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, data); err != nil {
+			input.cleanup()
+			return nil, err
+		}
+		input.args = append(input.args, out.String())
+	}
+	if config.Input == "file" && input.file == "" {
+		path, err := input.tempFile(body)
+		if err != nil {
+			return nil, err
+		}
+		input.args = append(input.args, path)
+	}
+	return input, nil
+}
+
+/**
+ * Checks that Args templates parse
+ */
+func checkArgs(args []string) error {
+	funcs := template.FuncMap{"file": func() string { return "" }, "json": func(interface{}) string { return "" }}
+	for i, arg := range args {
+		if _, err := template.New(fmt.Sprintf("Args[%d]", i)).Funcs(funcs).Parse(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Returns payload as compact JSON ending with new line, text payload that is no JSON becomes JSON string
+ */
+func jsonLine(body []byte) ([]byte, error) {
+	var line bytes.Buffer
+	if json.Valid(body) {
+		if err := json.Compact(&line, body); err != nil {
+			return nil, err
+		}
+	} else if !utf8.Valid(body) {
+		return nil, fmt.Errorf("payload is binary, it can not be passed as JSON")
+	} else {
+		encoded, err := json.Marshal(string(body))
+		if err != nil {
+			return nil, err
+		}
+		line.Write(encoded)
+	}
+	line.WriteByte('\n')
+	return line.Bytes(), nil
+}
+
+/**
+ * Returns decoded payload for templates, numbers kept as they were written. Payload that is no JSON is its text
+ */
+func templateData(body []byte) interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var data interface{}
+	if decoder.Decode(&data) != nil {
+		return string(body)
+	}
+	return data
+}
+
+/**
+ * Writes payload into temp file readable by worker only, once per run
+ */
+func (input *workerInput) tempFile(body []byte) (string, error) {
+	if input.file != "" {
+		return input.file, nil
+	}
+	file, err := ioutil.TempFile("", INPUT_FILE_PATTERN)
+	if err != nil {
+		return "", fmt.Errorf("could not create payload file: %v", err)
+	}
+	input.file = file.Name()
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		input.cleanup()
+		return "", fmt.Errorf("could not write payload file: %v", err)
+	}
+	return input.file, nil
+}
+
+/**
+ * Removes temp file of payload, if any
+ */
+func (input *workerInput) cleanup() {
+	if input.file != "" {
+		os.Remove(input.file)
+		input.file = ""
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Most command sources rate is tracked for, sources beyond it share one limit */
+const COMMAND_SOURCES_MAX = 1024
+
+var (
+	/** Limits on commands taken from command tube and controller */
+	commandMaxSize = flag.Int("command-max-size", 64*1024, "Largest command job accepted in bytes, bigger ones are buried, 0 for no limit. Default: 65536")
+	commandRate    = flag.Float64("command-rate", 20, "Commands per second processed from each source, key of access file or else command tube and controller, ones over it are dropped. 0 for no limit. Default: 20")
+	commandBurst   = flag.Int("command-burst", 40, "Commands a source may send at once before --command-rate applies. Default: 40")
+
+	commandBuckets     = make(map[string]*commandBucket) // By source, guarded by commandBucketsLock
+	commandBucketsLock sync.Mutex
+)
+
+/** Token bucket of command source */
+type commandBucket struct {
+	tokens  float64
+	updated time.Time
+	dropped uint
+	logged  time.Time
+}
+
+/**
+ * Checks command job taken from command tube or controller: size, signature and schema, then rate of its source.
+ * Returns command and empty outcome when it is to be processed, otherwise what to do with the job: "bury" malformed
+ * and rejected ones to be inspected, "drop" ones over rate
+ */
+func admitCommand(from string, body []byte) (WorkerCommand, string) {
+	if *commandMaxSize > 0 && len(body) > *commandMaxSize {
+		log.Printf("Rejected %s: %d bytes is over --command-max-size, burying it", from, len(body))
+		return WorkerCommand{}, "bury"
+	}
+	body, encoding, err := decodeWire(body)
+	var cmd WorkerCommand
+	if err == nil {
+		cmd, err = decodeCommand(body)
+		cmd.encoding = encoding
+	}
+	if err == nil {
+		err = validateCommand(cmd)
+	}
+	if err != nil {
+		log.Printf("Rejected %s: %v, burying it", from, err)
+		return cmd, "bury"
+	}
+	if !allowCommand(commandSource(from, cmd)) {
+		return cmd, "drop"
+	}
+	return cmd, ""
+}
+
+/**
+ * Counts command job not processed in status. Takes stateLock itself
+ */
+func countRejectedCommand(outcome string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	switch outcome {
+	case "bury":
+		stats.BuriedCommands++
+	case "drop":
+		stats.DroppedCommands++
+	}
+}
+
+/**
+ * Decodes JSON of command tube, refusing anything after the value. Fields commands do not have are logged and
+ * ignored, so commands of newer clients still work
+ */
+func unmarshalCommand(data []byte, v interface{}) error {
+	err := decodeCommandJSON(data, v, true)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		log.Printf("Ignoring %s of command", strings.TrimPrefix(err.Error(), "json: "))
+		err = decodeCommandJSON(data, v, false)
+	}
+	return err
+}
+
+func decodeCommandJSON(data []byte, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("data after command")
+	}
+	return nil
+}
+
+/**
+ * Checks command has what its name needs, as a schema would: known name, payload of setLimits, put, replay,
+ * setFeature, deployWorker, rollbackWorker and promoteWorker, and valid tube names
+ */
+func validateCommand(cmd WorkerCommand) error {
+	var tubes []string
+	switch cmd.Command {
+	case "":
+		return errors.New("command has no name")
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Command)
+	case "getLimits", "getStatus", "getConfig", "pause", "resume", "drain", "rollbackConfig", "syncWorkers":
+	case "setLimits":
+		if cmd.Limits == nil && cmd.Options == nil {
+			return errors.New("setLimits needs Limits or Options")
+		}
+		if cmd.Limits != nil {
+			for tube := range cmd.Limits.Tubes {
+				tubes = append(tubes, tube)
+			}
+		}
+	case "put":
+		if cmd.Job == nil {
+			return errors.New("put needs Job")
+		}
+		tubes = append(tubes, cmd.Job.Tube)
+	case "replay":
+		if cmd.Replay == nil {
+			return errors.New("replay needs Replay")
+		}
+		tubes = append(tubes, cmd.Replay.Tube)
+		if cmd.Replay.From != "" {
+			tubes = append(tubes, cmd.Replay.From)
+		}
+	case "setFeature":
+		if cmd.Feature == nil || cmd.Feature.Feature == "" {
+			return errors.New("setFeature needs Feature")
+		}
+		if cmd.Feature.Tube != "" {
+			tubes = append(tubes, cmd.Feature.Tube)
+		}
+	case "deployWorker":
+		if cmd.Deploy == nil {
+			return errors.New("deployWorker needs Deploy")
+		}
+		tubes = append(tubes, cmd.Deploy.Worker)
+	case "rollbackWorker", "promoteWorker":
+		if len(cmd.Options) != 1 {
+			return fmt.Errorf("%s needs one worker in Options", cmd.Command)
+		}
+		for worker := range cmd.Options {
+			tubes = append(tubes, worker)
+		}
+	}
+	if cmd.ReplyTo != "" {
+		tubes = append(tubes, cmd.ReplyTo)
+	}
+	for _, tube := range tubes {
+		if err := checkTubeName(tube); err != nil {
+			return fmt.Errorf("%s has invalid tube name %q: %v", cmd.Command, tube, err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Returns who sent command as far as daemon can tell without trusting the sender: key of access file it was signed
+ * with, else where it came from. Reply tube is chosen by the sender and new for each CLI call, so it does not count
+ */
+func commandSource(from string, cmd WorkerCommand) string {
+	if cmd.keyId != "" {
+		return "key " + cmd.keyId
+	}
+	return from
+}
+
+/**
+ * Takes token from bucket of source, false when it has none left. Drops are logged once a second per source
+ */
+func allowCommand(source string) bool {
+	if *commandRate <= 0 {
+		return true
+	}
+	commandBucketsLock.Lock()
+	defer commandBucketsLock.Unlock()
+	now := time.Now()
+	burst := float64(*commandBurst)
+	bucket := commandBuckets[source]
+	if bucket == nil {
+		if len(commandBuckets) >= COMMAND_SOURCES_MAX {
+			// Full buckets are not needed, refill would leave them so anyway
+			for name, idle := range commandBuckets {
+				if idle.tokens+now.Sub(idle.updated).Seconds()**commandRate >= burst {
+					delete(commandBuckets, name)
+				}
+			}
+		}
+		if len(commandBuckets) >= COMMAND_SOURCES_MAX {
+			source = "other sources"
+		}
+		if bucket = commandBuckets[source]; bucket == nil {
+			bucket = &commandBucket{tokens: burst, updated: now}
+			commandBuckets[source] = bucket
+		}
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()**commandRate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+	bucket.dropped++
+	if now.Sub(bucket.logged) >= time.Second {
+		log.Printf("Dropped %d command(s) from %s over --command-rate", bucket.dropped, source)
+		bucket.dropped, bucket.logged = 0, now
+	}
+	return false
+}
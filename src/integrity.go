@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Manifest and worker files are checked for changes at most that often */
+const INTEGRITY_RECHECK = time.Second
+
+var (
+	/** Checksum manifest workers must match to be run */
+	integrityManifest = flag.String("integrity-manifest", "", "Manifest of worker checksums in sha256sum format, workers missing from it or not matching it are not run. Default: none")
+	integrityKey      = flag.String("integrity-key", "", "PEM Ed25519 public key of deploy key manifest must be signed with, signature in <manifest>.sig. Default: none, manifest is not verified")
+
+	integrityLock sync.Mutex
+	manifestState struct {
+		checked time.Time
+		version string            // As of fileVersion, empty when not known
+		sums    map[string]string // Worker => hex sha256
+		err     error
+	} // Guarded by integrityLock
+	workerSums = make(map[string]*workerSum) // By worker file path, guarded by integrityLock
+)
+
+/** Checksum of worker file as of its fileVersion */
+type workerSum struct {
+	checked time.Time
+	version string // Empty when not known, file is hashed again then
+	sum     string
+	err     error
+}
+
+/**
+ * Makes manifest and key paths absolute, must be called before changing working directory
+ */
+func resolveIntegrityPaths() {
+	for _, path := range []*string{integrityManifest, integrityKey} {
+		if *path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(*path); err == nil {
+			*path = abs
+		}
+	}
+}
+
+/**
+ * Returns why worker at path must not run, empty if it may or there is no manifest. Takes integrityLock itself
+ */
+func integrityViolation(worker, path string) string {
+	if *integrityManifest == "" {
+		return ""
+	}
+	integrityLock.Lock()
+	defer integrityLock.Unlock()
+	sums, err := manifestSums()
+	if err != nil {
+		return "manifest: " + err.Error()
+	}
+	want, listed := sums[worker]
+	if !listed {
+		return "not in manifest"
+	}
+	sum, err := workerChecksum(path)
+	if err != nil {
+		return err.Error()
+	}
+	if sum != want {
+		return "checksum does not match manifest"
+	}
+	return ""
+}
+
+/**
+ * Checks integrity of worker and records violation in status, alerting when it is new. Caller must hold stateLock
+ */
+func checkIntegrity(worker string) bool {
+	violation := integrityViolation(worker, "./"+worker)
+	if violation == stats.Integrity[worker] {
+		return violation == ""
+	}
+	if violation == "" {
+		delete(stats.Integrity, worker)
+		log.Printf("Worker %s passes integrity check again", worker)
+		return true
+	}
+	if stats.Integrity == nil {
+		stats.Integrity = make(map[string]string)
+	}
+	stats.Integrity[worker] = violation
+	log.Printf("Refusing to run %s: %s", worker, violation)
+	publishEvent("integrity", worker, violation)
+	return false
+}
+
+/**
+ * Returns checksums from manifest, reading it again when it changed and verifying its signature.
+ * Caller must hold integrityLock
+ */
+func manifestSums() (map[string]string, error) {
+	if time.Since(manifestState.checked) < INTEGRITY_RECHECK {
+		return manifestState.sums, manifestState.err
+	}
+	manifestState.checked = time.Now()
+	info, err := os.Stat(*integrityManifest)
+	if err != nil {
+		manifestState.version, manifestState.sums, manifestState.err = "", nil, err
+		return nil, err
+	}
+	version := fileVersion(info)
+	if version != "" && version == manifestState.version {
+		return manifestState.sums, manifestState.err
+	}
+	manifestState.version = version
+	manifestState.sums, manifestState.err = readManifest()
+	if manifestState.err != nil {
+		log.Printf("Integrity manifest %s is not valid, no worker is run: %v", *integrityManifest, manifestState.err)
+	} else {
+		log.Printf("Loaded integrity manifest %s with %d worker(s)", *integrityManifest, len(manifestState.sums))
+	}
+	return manifestState.sums, manifestState.err
+}
+
+/**
+ * Reads manifest lines "<sha256>  <worker>" as written by sha256sum, after verifying signature with --integrity-key
+ */
+func readManifest() (map[string]string, error) {
+	data, err := ioutil.ReadFile(*integrityManifest)
+	if err != nil {
+		return nil, err
+	}
+	if *integrityKey != "" {
+		if err := verifyManifest(data); err != nil {
+			return nil, err
+		}
+	}
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("line %d is not <sha256> <worker>", line)
+		}
+		// Binary mode marker and directory of sha256sum run from above workers directory, stable canary versions
+		// are listed by their path in workers directory
+		file := strings.TrimPrefix(fields[1], "*")
+		name := filepath.Base(file)
+		if filepath.Base(filepath.Dir(file)) == CANARY_DIR {
+			name = filepath.Join(CANARY_DIR, name)
+		}
+		sums[name] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+/**
+ * Verifies Ed25519 signature of manifest from <manifest>.sig, raw or base64 encoded
+ */
+func verifyManifest(data []byte) error {
+	keyData, err := ioutil.ReadFile(*integrityKey)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return fmt.Errorf("%s is not a PEM public key", *integrityKey)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s is not an Ed25519 key", *integrityKey)
+	}
+	signature, err := ioutil.ReadFile(*integrityManifest + ".sig")
+	if err != nil {
+		return fmt.Errorf("manifest is not signed: %v", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		if signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err != nil {
+			return errors.New("signature is neither raw nor base64")
+		}
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return errors.New("signature does not match deploy key")
+	}
+	return nil
+}
+
+/**
+ * Returns sha256 of worker file, hashing it again only when its inode or change time changed: size and modification
+ * time are kept by a swapped file copied with them. Caller must hold integrityLock
+ */
+func workerChecksum(path string) (string, error) {
+	cached, has := workerSums[path]
+	if has && time.Since(cached.checked) < INTEGRITY_RECHECK {
+		return cached.sum, cached.err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	version := fileVersion(info)
+	if has && cached.err == nil && version != "" && cached.version == version {
+		cached.checked = time.Now()
+		return cached.sum, nil
+	}
+	sum := &workerSum{checked: time.Now(), version: version}
+	file, err := os.Open(path)
+	if err == nil {
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		sum.sum = hex.EncodeToString(hash.Sum(nil))
+	}
+	sum.err = err
+	workerSums[path] = sum
+	return sum.sum, sum.err
+}
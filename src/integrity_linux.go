@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+/**
+ * Returns what tells a version of file apart: device, inode and change time, which unlike modification time can not
+ * be set back, so a file swapped or rewritten in place gets a new one. Empty when not known
+ */
+func fileVersion(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(stat.Dev, ":", stat.Ino, ":", stat.Ctim.Sec, ".", stat.Ctim.Nsec, ":", info.Size())
+}
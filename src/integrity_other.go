@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+/**
+ * Change time is not read on this system, empty version has files hashed again on every check
+ */
+func fileVersion(info os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("nats", func() Broker {
+		return &natsBroker{consumers: make(map[string]*natsConsumer)}
+	})
+}
+
+var (
+	/** NATS server and JetStream names for nats broker */
+	natsURL           = flag.String("nats", "nats://127.0.0.1:4222", "NATS server URLs for --broker nats, comma separated, tls:// for TLS. Default: nats://127.0.0.1:4222")
+	natsStream        = flag.String("nats-stream", "WORKERMAN", "JetStream stream holding jobs, created as work queue when missing. Default: WORKERMAN")
+	natsSubjectPrefix = flag.String("nats-subject-prefix", "workerman.", "Prefix of subjects, jobs of tube email are published to <prefix>email. Default: workerman.")
+	natsDurable       = flag.String("nats-durable", "workerman", "Prefix of durable consumer names, instances using the same share jobs of tube. Default: workerman")
+	natsAckWait       = flag.Duration("nats-ack-wait", DEFAULT_TTR, "Time to run: job not acked or touched for that long is delivered again. Default: 1m")
+)
+
+/**
+ * NATS JetStream backend. Tubes are subjects of one stream, each read by durable pull consumer of its own with explicit ack.
+ * Max deliver of consumer follows Retry of tube, so jobs released or left by gone instance are not delivered forever
+ */
+type natsBroker struct {
+	lock      sync.Mutex // Guards connection and consumers
+	conn      *nats.Conn
+	js        jetstream.JetStream
+	consumers map[string]*natsConsumer
+}
+
+/** Durable consumer of tube with max deliver it was set up with */
+type natsConsumer struct {
+	consumer   jetstream.Consumer
+	maxDeliver int
+}
+
+/**
+ * Returns JetStream context, connecting and creating stream when needed. Caller must hold b.lock
+ */
+func (b *natsBroker) connection(ctx context.Context) (jetstream.JetStream, error) {
+	if b.conn != nil && !b.conn.IsClosed() {
+		return b.js, nil
+	}
+	conn, err := nats.Connect(*natsURL, nats.Name("workerman "+stats.Instance), nats.Timeout(DIAL_TIMEOUT), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err == nil {
+		if _, err = js.Stream(ctx, *natsStream); errors.Is(err, jetstream.ErrStreamNotFound) {
+			_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+				Name:      *natsStream,
+				Subjects:  []string{*natsSubjectPrefix + ">"},
+				Retention: jetstream.WorkQueuePolicy,
+				Storage:   jetstream.FileStorage,
+			})
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.conn, b.js = conn, js
+	// Consumers of previous connection are set up again
+	b.consumers = make(map[string]*natsConsumer)
+	return js, nil
+}
+
+/**
+ * Durable name of tube consumer, without characters NATS does not allow in names
+ */
+func natsDurableName(tube string) string {
+	return *natsDurable + "_" + strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(tube)
+}
+
+/**
+ * Max deliver of tube: first delivery and one per retry. Takes stateLock itself
+ */
+func natsMaxDeliver(tube string) int {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return int(effectiveConfig(tube).Retry) + 1
+}
+
+/**
+ * Returns consumer of tube, creating or updating it when max deliver changed
+ */
+func (b *natsBroker) consumer(tube string) (jetstream.Consumer, error) {
+	maxDeliver := natsMaxDeliver(tube)
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	js, err := b.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c, has := b.consumers[tube]; has && c.maxDeliver == maxDeliver {
+		return c.consumer, nil
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, *natsStream, jetstream.ConsumerConfig{
+		Durable:       natsDurableName(tube),
+		FilterSubject: *natsSubjectPrefix + tube,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       *natsAckWait,
+		MaxDeliver:    maxDeliver,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.consumers[tube] = &natsConsumer{consumer, maxDeliver}
+	return consumer, nil
+}
+
+func (b *natsBroker) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	js, err := b.connection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = js.AccountInfo(ctx)
+	return err
+}
+
+func (b *natsBroker) Subscribe(tube string) {
+	if _, err := b.consumer(tube); err != nil {
+		tubeFailed(tube, fmt.Errorf("not connected: %v", err))
+	}
+}
+
+/**
+ * Durable consumer stays on server, keeping its position for when tube is subscribed again
+ */
+func (b *natsBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	delete(b.consumers, tube)
+	b.lock.Unlock()
+}
+
+/**
+ * Jobs of tube not yet delivered by its consumer
+ */
+func (b *natsBroker) Stats(tube string) (int, error) {
+	consumer, err := b.consumer(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.NumPending), nil
+}
+
+/**
+ * Pulls one job of tube, waiting up to timeout
+ */
+func (b *natsBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	consumer, err := b.consumer(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	batch, err := consumer.Fetch(1, jetstream.FetchMaxWait(timeout))
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	var message jetstream.Msg
+	for delivered := range batch.Messages() {
+		message = delivered
+	}
+	if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, jetstream.ErrNoMessages) {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	if message == nil {
+		return nil, nil
+	}
+	job := &ReservedJob{Body: message.Data(), Priority: DEFAULT_PRIORITY, TTR: *natsAckWait, handle: message}
+	if metadata, err := message.Metadata(); err == nil {
+		job.Id = strconv.FormatUint(metadata.Sequence.Stream, 10)
+	}
+	if pri, err := strconv.ParseUint(message.Headers().Get("Workerman-Priority"), 10, 32); err == nil {
+		job.Priority = uint32(pri)
+	}
+	return job, nil
+}
+
+func (b *natsBroker) StopReserving(tube string) {
+}
+
+/**
+ * Tells server job is in progress, which restarts its ack wait
+ */
+func (b *natsBroker) Touch(job *ReservedJob) error {
+	return job.handle.(jetstream.Msg).InProgress()
+}
+
+func (b *natsBroker) Delete(job *ReservedJob) error {
+	return job.handle.(jetstream.Msg).Ack()
+}
+
+/**
+ * Delivers job again, unless max deliver of tube is reached
+ */
+func (b *natsBroker) Release(job *ReservedJob) error {
+	return job.handle.(jetstream.Msg).Nak()
+}
+
+/**
+ * Terminates job, it is not delivered again. Server publishes MSG_TERMINATED advisory about it
+ */
+func (b *natsBroker) Bury(job *ReservedJob) error {
+	return job.handle.(jetstream.Msg).Term()
+}
+
+/**
+ * Publishes job to subject of tube, returns its stream sequence. JetStream has no delayed delivery,
+ * time to run is --nats-ack-wait for all jobs
+ */
+func (b *natsBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if delay > 0 {
+		return "", fmt.Errorf("delay is not supported by nats broker")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	b.lock.Lock()
+	js, err := b.connection(ctx)
+	b.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	message := &nats.Msg{Subject: *natsSubjectPrefix + tube, Data: body, Header: nats.Header{}}
+	message.Header.Set("Workerman-Priority", strconv.FormatUint(uint64(priority), 10))
+	ack, err := js.PublishMsg(ctx, message)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(ack.Sequence, 10), nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Fetched messages kept while their partitions are busy, fetching pauses when there are that many */
+const KAFKA_MAX_HELD = 100
+
+func init() {
+	registerBroker("kafka", func() Broker {
+		return &kafkaBroker{consumers: make(map[string]*kafkaConsumer)}
+	})
+}
+
+var (
+	/** Kafka cluster for kafka broker */
+	kafkaBrokers     = flag.String("kafka", "127.0.0.1:9092", "Kafka bootstrap brokers for --broker kafka, comma separated host:port. Default: 127.0.0.1:9092")
+	kafkaGroup       = flag.String("kafka-group", "workerman", "Kafka consumer group, instances in the same group share partitions of topic. Default: workerman")
+	kafkaPrefix      = flag.String("kafka-prefix", "", "Prefix of topic names, tube email is topic <prefix>email. Default: none")
+	kafkaDeadLetter  = flag.String("kafka-dead-letter", ".dead", "Suffix of topic failed jobs are copied into, empty to skip them. Default: .dead")
+	kafkaConcurrency = flag.Int("kafka-partition-concurrency", 1, "Jobs of one partition run at the same time, 1 keeps order of partition. Default: 1")
+)
+
+/**
+ * Kafka backend. Each tube is a topic read by consumer group --kafka-group. Offset of a partition is committed only
+ * up to the oldest job not finished yet, so jobs of failed or gone instance are read again by the one taking over
+ */
+type kafkaBroker struct {
+	lock      sync.Mutex // Guards consumers and writer
+	consumers map[string]*kafkaConsumer
+	writer    *kafka.Writer
+}
+
+/**
+ * Group member reading topic of tube. Used by reserver of tube only, apart from errors reported by reader
+ */
+type kafkaConsumer struct {
+	reader     *kafka.Reader
+	partitions map[int]*kafkaPartition
+	held       []*kafkaJob // Fetched, waiting for their partition
+	retry      []*kafkaJob // Released, to be handed out again
+	errorLock  sync.Mutex  // Guards errors and lastError, set by reader goroutines
+	errors     int
+	lastError  string
+}
+
+/** Jobs of partition not committed yet, in offset order */
+type kafkaPartition struct {
+	running     int
+	outstanding []*kafkaJob
+}
+
+/** Message handed to worker, handle of reserved job */
+type kafkaJob struct {
+	message   kafka.Message
+	partition *kafkaPartition
+	done      bool
+}
+
+func (b *kafkaBroker) brokers() []string {
+	return strings.Split(*kafkaBrokers, ",")
+}
+
+func (b *kafkaBroker) topic(tube string) string {
+	return *kafkaPrefix + tube
+}
+
+/**
+ * Checks that a bootstrap broker is reachable
+ */
+func (b *kafkaBroker) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	dialer := &kafka.Dialer{Timeout: DIAL_TIMEOUT}
+	var err error
+	for _, address := range b.brokers() {
+		var conn *kafka.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", address); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return err
+}
+
+/**
+ * Group membership is set up by reserver, so there is nothing to do until then
+ */
+func (b *kafkaBroker) Subscribe(tube string) {
+}
+
+func (b *kafkaBroker) Unsubscribe(tube string) {
+}
+
+/**
+ * Lag of this member: jobs in its partitions not read yet. Only known while reserving
+ */
+func (b *kafkaBroker) Stats(tube string) (int, error) {
+	b.lock.Lock()
+	consumer := b.consumers[tube]
+	b.lock.Unlock()
+	if consumer == nil {
+		return 0, fmt.Errorf("%s is not being consumed", tube)
+	}
+	return int(consumer.reader.Stats().Lag), nil
+}
+
+/**
+ * Returns consumer of tube, joining the group first time
+ */
+func (b *kafkaBroker) consumer(tube string) *kafkaConsumer {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if consumer, has := b.consumers[tube]; has {
+		return consumer
+	}
+	consumer := &kafkaConsumer{partitions: make(map[int]*kafkaPartition)}
+	consumer.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  b.brokers(),
+		GroupID:  *kafkaGroup,
+		Topic:    b.topic(tube),
+		MinBytes: 1,
+		MaxBytes: 10e6,
+		MaxWait:  RESERVE_TIMEOUT,
+		Dialer:   &kafka.Dialer{Timeout: DIAL_TIMEOUT},
+		// Reader reconnects by itself, errors only tell tube is degraded
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			consumer.errorLock.Lock()
+			consumer.errors++
+			consumer.lastError = fmt.Sprintf(format, args...)
+			consumer.errorLock.Unlock()
+		}),
+	})
+	b.consumers[tube] = consumer
+	return consumer
+}
+
+/**
+ * Hands out released job or fetched one whose partition has room, fetching next message otherwise.
+ * Message of busy partition is held, until there are KAFKA_MAX_HELD of them
+ */
+func (b *kafkaBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	consumer := b.consumer(tube)
+	if job := consumer.next(&consumer.retry); job != nil {
+		return job.reserved(), nil
+	}
+	if job := consumer.next(&consumer.held); job != nil {
+		return job.reserved(), nil
+	}
+	if len(consumer.held) >= KAFKA_MAX_HELD {
+		time.Sleep(*interval)
+		return nil, nil
+	}
+	consumer.errorLock.Lock()
+	errorsBefore := consumer.errors
+	consumer.errorLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	message, err := consumer.reader.FetchMessage(ctx)
+	cancel()
+	consumer.errorLock.Lock()
+	failed, lastError := consumer.errors != errorsBefore, consumer.lastError
+	consumer.errorLock.Unlock()
+	if errors.Is(err, context.DeadlineExceeded) {
+		if failed {
+			err = errors.New(lastError)
+			tubeFailed(tube, err)
+			return nil, err
+		}
+		tubeRecovered(tube)
+		return nil, nil
+	} else if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	job := consumer.track(message)
+	if job.partition.running < *kafkaConcurrency {
+		job.partition.running++
+		return job.reserved(), nil
+	}
+	consumer.held = append(consumer.held, job)
+	return nil, nil
+}
+
+/**
+ * Adds fetched message to its partition. Offset not past the last one means partition was assigned again
+ * after rebalance, reading from committed offset: jobs still waiting are dropped, they come again, and
+ * running ones are finished on partition state of their own
+ */
+func (c *kafkaConsumer) track(message kafka.Message) *kafkaJob {
+	partition := c.partitions[message.Partition]
+	if partition != nil && len(partition.outstanding) > 0 && partition.outstanding[len(partition.outstanding)-1].message.Offset >= message.Offset {
+		c.held = dropPartition(c.held, partition)
+		c.retry = dropPartition(c.retry, partition)
+		partition = nil
+	}
+	if partition == nil {
+		partition = &kafkaPartition{}
+		c.partitions[message.Partition] = partition
+	}
+	job := &kafkaJob{message: message, partition: partition}
+	partition.outstanding = append(partition.outstanding, job)
+	return job
+}
+
+func dropPartition(jobs []*kafkaJob, partition *kafkaPartition) []*kafkaJob {
+	kept := jobs[:0]
+	for _, job := range jobs {
+		if job.partition != partition {
+			kept = append(kept, job)
+		}
+	}
+	return kept
+}
+
+/**
+ * Takes first job of list whose partition has room
+ */
+func (c *kafkaConsumer) next(jobs *[]*kafkaJob) *kafkaJob {
+	for i, job := range *jobs {
+		if job.partition.running < *kafkaConcurrency {
+			job.partition.running++
+			*jobs = append((*jobs)[:i], (*jobs)[i+1:]...)
+			return job
+		}
+	}
+	return nil
+}
+
+func (job *kafkaJob) reserved() *ReservedJob {
+	reserved := &ReservedJob{
+		Id:       fmt.Sprintf("%d:%d", job.message.Partition, job.message.Offset),
+		Body:     job.message.Value,
+		Priority: DEFAULT_PRIORITY,
+		TTR:      DEFAULT_TTR,
+		handle:   job,
+	}
+	for _, header := range job.message.Headers {
+		if header.Key == "priority" {
+			if pri, err := strconv.ParseUint(string(header.Value), 10, 32); err == nil {
+				reserved.Priority = uint32(pri)
+			}
+		}
+	}
+	return reserved
+}
+
+/**
+ * Leaves the group, uncommitted jobs go to the member taking over partitions
+ */
+func (b *kafkaBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	consumer := b.consumers[tube]
+	delete(b.consumers, tube)
+	b.lock.Unlock()
+	if consumer != nil {
+		consumer.reader.Close()
+	}
+}
+
+/**
+ * Group membership is kept alive by reader, there is no time to run to extend
+ */
+func (b *kafkaBroker) Touch(job *ReservedJob) error {
+	return nil
+}
+
+/**
+ * Marks job done and commits offset past finished jobs at the start of its partition
+ */
+func (b *kafkaBroker) Delete(job *ReservedJob) error {
+	handle := job.handle.(*kafkaJob)
+	partition := handle.partition
+	partition.running--
+	handle.done = true
+	var last *kafkaJob
+	for len(partition.outstanding) > 0 && partition.outstanding[0].done {
+		last = partition.outstanding[0]
+		partition.outstanding = partition.outstanding[1:]
+	}
+	if last == nil {
+		return nil
+	}
+	b.lock.Lock()
+	consumer := b.consumers[job.Tube]
+	b.lock.Unlock()
+	if consumer == nil {
+		return errLostReservation
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	return consumer.reader.CommitMessages(ctx, last.message)
+}
+
+/**
+ * Hands job out again, its offset stays uncommitted meanwhile. Job of partition assigned again is read again anyway
+ */
+func (b *kafkaBroker) Release(job *ReservedJob) error {
+	handle := job.handle.(*kafkaJob)
+	handle.partition.running--
+	b.lock.Lock()
+	consumer := b.consumers[job.Tube]
+	b.lock.Unlock()
+	if consumer == nil {
+		return errLostReservation
+	}
+	if consumer.partitions[handle.message.Partition] == handle.partition {
+		consumer.retry = append(consumer.retry, handle)
+	}
+	return nil
+}
+
+/**
+ * Copies job into dead letter topic, then commits it like successful one. Job is released when copying fails
+ */
+func (b *kafkaBroker) Bury(job *ReservedJob) error {
+	if *kafkaDeadLetter != "" {
+		handle := job.handle.(*kafkaJob)
+		if err := b.write(b.topic(job.Tube)+*kafkaDeadLetter, handle.message.Key, job.Body, job.Priority); err != nil {
+			b.Release(job)
+			return err
+		}
+	}
+	return b.Delete(job)
+}
+
+/**
+ * Publishes job into topic of tube. Kafka has no delayed delivery, time to run does not apply.
+ * Offset is not known to writer, empty id is returned
+ */
+func (b *kafkaBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if delay > 0 {
+		return "", fmt.Errorf("delay is not supported by kafka broker")
+	}
+	return "", b.write(b.topic(tube), nil, body, priority)
+}
+
+func (b *kafkaBroker) write(topic string, key, body []byte, priority uint32) error {
+	b.lock.Lock()
+	if b.writer == nil {
+		b.writer = &kafka.Writer{Addr: kafka.TCP(b.brokers()...), Balancer: &kafka.Hash{}, RequiredAcks: kafka.RequireAll}
+	}
+	writer := b.writer
+	b.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	return writer.WriteMessages(ctx, kafka.Message{
+		Topic:   topic,
+		Key:     key,
+		Value:   body,
+		Headers: []kafka.Header{{Key: "priority", Value: []byte(strconv.FormatUint(uint64(priority), 10))}},
+	})
+}
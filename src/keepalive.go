@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"github.com/kr/beanstalk"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	/** TCP keepalive of beanstalkd connections */
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 30*time.Second, "Period of TCP keepalive probes on beanstalkd connections, 0 to disable. Default: 30s")
+
+	/** Application level pings of beanstalkd connections */
+	pingInterval = flag.Duration("ping-interval", 30*time.Second, "Send stats to beanstalkd connection without response for that long, 0 to disable. Default: 30s")
+	pingTimeout  = flag.Duration("ping-timeout", 10*time.Second, "Drop beanstalkd connection not answering ping in time, so it is re-established. Default: 10s")
+
+	/** Open beanstalkd connections */
+	watchedConns = make(map[*watchedConn]bool)
+	watchedLock  sync.Mutex
+)
+
+/**
+ * Network connection remembering when it last received data
+ */
+type watchedConn struct {
+	net.Conn
+	address   string // Server address as configured, host name included
+	lastRead  int64  // Unix nanoseconds, accessed atomically
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+/**
+ * Returns dialer with TCP keepalive from --tcp-keepalive
+ */
+func beanstalkDialer(timeout time.Duration) *net.Dialer {
+	keepAlive := *tcpKeepAlive
+	if keepAlive <= 0 {
+		keepAlive = -1
+	}
+	return &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+}
+
+func newWatchedConn(conn net.Conn, address string) *watchedConn {
+	watched := &watchedConn{Conn: conn, address: address, closed: make(chan struct{})}
+	watched.touch()
+	watchedLock.Lock()
+	watchedConns[watched] = true
+	watchedLock.Unlock()
+	return watched
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		watchedLock.Lock()
+		delete(watchedConns, c)
+		watchedLock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *watchedConn) touch() {
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+}
+
+func (c *watchedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+/**
+ * Pings connection silent for --ping-interval until it is closed. Connection not answering within --ping-timeout is closed,
+ * so operations stuck on half-open connection fail and usual recovery re-establishes it
+ */
+func (c *watchedConn) watch(conn *beanstalk.Conn) {
+	if *pingInterval <= 0 {
+		return
+	}
+	for {
+		wait := *pingInterval - c.idle()
+		if wait > 0 {
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		// Pings are pipelined behind operations in progress, e.g. reserve with timeout, they delay answer a bit
+		answered := make(chan error, 1)
+		go func() {
+			_, err := conn.Stats()
+			answered <- err
+		}()
+		select {
+		case <-c.closed:
+			return
+		case err := <-answered:
+			if err != nil {
+				// Whoever uses connection gets the same error and recovers it
+				log.Printf("Ping of %s failed: %v", c.address, err)
+				return
+			}
+			c.touch()
+		case <-time.After(*pingTimeout):
+			log.Printf("Connection to %s did not answer ping in %v, dropping it", c.address, *pingTimeout)
+			c.Close()
+			return
+		}
+	}
+}
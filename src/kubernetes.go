@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/** Address HTTP API with probes and metrics listens on in --kubernetes mode, unless --http-listen is given */
+const KUBERNETES_HTTP_LISTEN = ":8080"
+
+var (
+	/** Operation as Kubernetes Deployment */
+	kubernetesMode = flag.Bool("kubernetes", false, "Run as Kubernetes Deployment: SIGTERM drains within --drain-timeout, /ready follows broker connections and drain, HTTP API with probes and /metrics on "+KUBERNETES_HTTP_LISTEN+" unless --http-listen given, no user switching or privilege restriction, securityContext of pod does that. Default: false")
+	drainTimeout   = flag.Duration("drain-timeout", 25*time.Second, "How long drain on SIGTERM waits for running workers in --kubernetes mode, keep below terminationGracePeriodSeconds of pod. Default: 25s")
+
+	/** When drain started by SIGTERM stops waiting for running workers, guarded by stateLock */
+	drainDeadline time.Time
+)
+
+/**
+ * Checks options against --kubernetes mode and applies its defaults. Must be called before privileges are restricted
+ */
+func prepareKubernetes() {
+	if !*kubernetesMode {
+		return
+	}
+	conflicts := map[string]bool{"user": *runAs != "", "daemon": *daemonize, "capabilities": givenFlags["capabilities"], "read-only-workers": *readOnlyWorkers}
+	for name, set := range conflicts {
+		if set {
+			log.Fatalf("Fatal error: --%s can not be used with --kubernetes, set securityContext of pod instead", name)
+		}
+	}
+	if *httpListen == "" {
+		*httpListen = KUBERNETES_HTTP_LISTEN
+	}
+}
+
+/**
+ * Drains on SIGTERM in --kubernetes mode. Main loop exits once running workers finish or --drain-timeout passes,
+ * workers still running then are left to be killed with the pod, their jobs come back after time to run
+ */
+func drainOnSignal() {
+	if !*kubernetesMode {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		log.Printf("Got SIGTERM, draining for up to %v", *drainTimeout)
+		drainDeadline = time.Now().Add(*drainTimeout)
+		if !stats.Draining {
+			drain()
+		}
+	}()
+}
+
+/**
+ * Checks if drain started by SIGTERM has waited long enough for running workers. Caller must hold stateLock
+ */
+func drainExpired() bool {
+	return stats.Draining && !drainDeadline.IsZero() && time.Now().After(drainDeadline)
+}
@@ -4,10 +4,115 @@
  * It looks into worker directory and subscribes for tubes by worker name.
  * When there is a job available, it spawns parallel process to execute worker related to tube.
  *
+ * Usage: workerman [options] [command] [arguments]
+ *
+ * Commands:
+ * run -- Start the daemon. This is the default when no command given.
+ * status -- Print status of the running daemon.
+ * aggregate [instance ...] -- Print status of instances merged by tube, registered or --coordination fleet ones if none given.
+ * config [tube ...] -- Print effective settings of tubes and where they come from.
+ * set-limit [--total N] [--min N] [tube=limit ...] -- Change limits of the running daemon, tenant.*=limit for tenants.
+ * pause [tube ...], resume [tube ...] -- Stop/resume dispatching workers for tubes, all if none given.
+ * drain -- Stop dispatching and exit the daemon once running workers finish.
+ * put <tube> [--file payload] [--delay 5s] [--priority N] [--ttr 60s] -- Publish a job into subscribed tube.
+ * replay <tube> [--count N] [--rate N] [--from tube] -- Kick buried jobs, or move jobs from dead letter tube, in batches.
+ * feature <name> on|off [tube] -- Toggle experimental behavior for a tube, or for all tubes.
+ * rollback-config -- Restore limits and settings from the most recent config backup.
+ * deploy <worker> <tarball|url> [--checksum sha256] [--override reason] -- Write worker from tarball into workers directory and subscribe it.
+ * sync-workers [--override reason] -- Pull git checkout of workers directory now, see --workers-git.
+ * rollback-worker <worker>, promote-worker <worker> -- Switch worker to version replaced by last deploy and back.
+ * validate [--offline] -- Check config, workers and beanstalkd connectivity, then exit.
+ *
  * Command line arguments available:
- * --connect <addr:port> -- Beanstalkd server address and port to connect to. Default is 0.0.0.0:11300
+ * --broker <name> -- Queue backend: beanstalkd, redis, amqp, sqs, kafka, nats, nsq, pubsub, postgres, gearman, mqtt, servicebus or memory. Default is beanstalkd
+ * --redis <url>, --redis-prefix <prefix>, --redis-group <name>, --redis-claim-after <duration> -- Settings of redis broker
+ * --amqp <url>, --amqp-prefix <prefix>, --amqp-dead-letter <exchange> -- Settings of amqp broker
+ * --sqs-region <region>, --sqs-endpoint <url>, --sqs-prefix <prefix>, --sqs-visibility <duration> -- Settings of sqs broker
+ * --kafka <addr:port>[,...], --kafka-group <name>, --kafka-prefix <prefix>, --kafka-dead-letter <suffix>, --kafka-partition-concurrency <n> -- Settings of kafka broker
+ * --nats <url>, --nats-stream <name>, --nats-subject-prefix <prefix>, --nats-durable <prefix>, --nats-ack-wait <duration> -- Settings of nats broker
+ * --nsq-lookupd <addr:port>[,...], --nsqd <addr:port>[,...], --nsq-prefix <prefix>, --nsq-channel <name>, --nsq-msg-timeout <duration>, --nsq-max-attempts <n> -- Settings of nsq broker
+ * --pubsub-project <id>, --pubsub-prefix <prefix>, --pubsub-dead-letter <topic>, --pubsub-max-attempts <n>, --pubsub-max-extension <duration> -- Settings of pubsub broker
+ * --postgres <url>, --postgres-table <name> -- Settings of postgres broker
+ * --gearman <addr:port>[,...], --gearman-prefix <prefix> -- Settings of gearman broker
+ * --mqtt <url>, --mqtt-client-id <id>, --mqtt-prefix <prefix>, --mqtt-share <group>, --mqtt-dead-letter <suffix> -- Settings of mqtt broker
+ * --servicebus <connection string>, --servicebus-prefix <prefix>, --servicebus-subscription <name> -- Settings of servicebus broker
+ * --connect <addr:port>[,...] -- Beanstalkd server address and port to connect to, backups after primary. Default is 0.0.0.0:11300
+ * --health-interval <duration> -- Interval between health checks of beanstalkd servers. Default is 5s
+ * --dns-refresh <duration> -- Interval to re-resolve server host names, reconnecting when address changed. Default is 30s
+ * --tls, --tls-ca <file>, --tls-cert <file>, --tls-key <file>, --tls-server-name <name> -- Connect to beanstalkd over TLS
+ * --proxy <url> -- Connect to beanstalkd through socks5:// or http:// proxy
  * --workers <path> -- Path to directory containing worker scripts
- * --user username -- User name to switch account. Works only if run as root.
+ * --workers-git, --workers-git-interval <duration> -- Workers directory is git checkout pulled from its upstream. Default interval is 1m
+ * --artifact-manifest <file>, --artifact-store <url>, --artifact-cache <dir> -- Fetch workers by name and version from s3:// or https:// store
+ * --user username -- User name to switch account, with its primary and supplementary groups. Works only if run as root.
+ * --no-new-privs -- Set no_new_privs for daemon and workers. Default is true
+ * --capabilities <list> -- Linux capabilities kept when run as root, all others are dropped, empty to drop all. Default is to drop them only with --user
+ * --read-only-workers -- Bind workers directory read-only in mount namespace of daemon and workers, needs root.
+ * --worker-env <list> -- Daemon environment variables passed to workers, "*" for all. Default is PATH,HOME,USER,LOGNAME,LANG,LC_ALL,TZ,TMPDIR
+ * --umask <octal> -- Umask workers are started with. Default is umask of daemon
+ * --instance-name <name> -- Name to use in control tube names instead of host name.
+ * --controller <addr:port> -- Central beanstalkd to also take commands from. Client commands given it go to --instance-name through it.
+ * --command-key <file>, --command-max-age <duration> -- Shared key commands from tubes must be HMAC signed with, and how far off their timestamp may be. Default is none, 1m
+ * --command-key-id <id> -- Key of access file client commands are signed with, instead of daemon command key
+ * --command-max-size <bytes>, --command-rate <n>, --command-burst <n> -- Command jobs larger are buried, commands per second and burst of each source. Default are 65536, 20 and 40
+ * --interval <duration> -- Interval between queue checks. Default is 10ms
+ * --idle-backoff <duration> -- Longest interval between checks of tube without ready jobs. Default is 1s
+ * --poll-concurrency <n> -- Number of tubes whose stats are requested at once. Default is 8
+ * --auto-total -- Derive total limit from CPUs, load average and free memory, capped by Total. Default is off
+ * --workers-per-cpu <n>, --auto-total-load <n>, --worker-memory-mb <n> -- Tune --auto-total. Default are 2, 1.5 and 0 (memory not considered)
+ * --history-file <file> -- Load history Predict of Autoscale goes by. Default is <binary>.history.json
+ * --coordination <url>, --coordination-prefix <prefix> -- Redis instances share running workers through for GlobalLimit. Default are none and workerman:fleet:
+ * --register <url>, --register-prefix <prefix> -- Register instance in Consul or etcd, e.g. consul://127.0.0.1:8500. Default are none and /workerman/instances/
+ * --kubernetes, --drain-timeout <duration> -- Run as Kubernetes Deployment, SIGTERM drains for that long. Default are off and 25s
+ * --tags <tag,...> -- Tags of host, tubes are subscribed only if it has all tags in their Requires. Default is none
+ * --tenants -- Treat part of tube names before first dot as tenant, for tenant limits, pause and status. Default is off
+ * --cluster -- Elect leader among instances sharing --coordination, only it autoscales tubes. Default is off
+ * --shard-replicas -- Serve each tube on at most this many instances sharing --coordination. Default is 0, all of them
+ * --max-spawns <n>, --spawn-burst <n> -- Workers started per second over all tubes, and at once. Default are no limit and 10
+ * --output-max-size <bytes>, --output-spill-dir <dir> -- Worker output kept in memory, rest goes to file in that directory. Default are 1048576 and system temp directory
+ * --output-spill-max-size <bytes>, --output-spill-keep <count> -- Output written to one spill file and spill files kept. Default are 67108864 and 100
+ * --log-binary raw|escape|base64 -- How worker output that is not text is logged. Default is raw
+ * --reconnect-delay <duration> -- Delay after failed attempt to connect to beanstalkd. Default is 5s
+ * --tcp-keepalive <duration> -- Period of TCP keepalive probes on beanstalkd connections. Default is 30s
+ * --ping-interval <duration>, --ping-timeout <duration> -- Ping idle beanstalkd connections, drop ones not answering. Default are 30s and 10s
+ * --pool-size <n> -- Number of connections shared by tubes, 0 for a connection per tube. Default is 4
+ * --command-prefix <prefix>, --response-prefix <prefix> -- Control tube name prefixes. Default are "Worker-to." and "Worker-from."
+ * --response-ttl <duration>, --response-max-size <bytes> -- Stale responses are deleted after, bigger ones replaced by error. Default are 1h and no limit
+ * --reply-tubes -- Answer commands with RequestId in per-request tubes instead of response tube. Disabled by default
+ * --default-queue-limit <n> -- Limit for tubes having no limit configured. Default is 5
+ * --dry-run -- Poll queues and log which workers would be started, without starting them.
+ * --hooks <path>, --hook-timeout <duration> -- Directory of before, completed and failed scripts run around worker runs, killed after timeout. Default is none, 10s
+ * --plugins <path> -- Directory of broker-<name>, hook-<name> and notifier-<name> plugin executables serving gRPC. Default is none
+ * --policy <file> -- Starlark script with can_run, on_job and on_failure policy functions. Default is none
+ * --integrity-manifest <file>, --integrity-key <file> -- Checksums workers must match, and Ed25519 key manifest must be signed with. Default is none
+ * --payload-keys <file>, --payload-kms-region <region> -- Shared keys and KMS region encrypted job bodies are opened with. Default is none
+ * --decompress-max-size <bytes> -- Largest decompressed job body, jobs inflating beyond it are buried. Default is 67108864
+ * --compress-responses <bytes> -- Gzip responses put into response tubes bigger than this. Default is 0, not compressed
+ * --control-encoding json|msgpack|protobuf -- Encoding of commands sent through command tubes by client commands. Default is json
+ * --claim-buckets <bucket,...> -- Buckets claim check payloads are fetched from and deleted in after success. Default is none
+ * --claim-endpoint <url>, --claim-region <region>, --claim-max-size <bytes> -- S3 compatible endpoint, region and largest payload. Default is AWS S3 and 268435456
+ * --correlation-field <path> -- Payload field holding correlation id carried into logs, events, hooks and exemplars. Default is correlation_id
+ * --config-backups <n> -- Number of previous config file versions to keep. Default is 5
+ * --pidfile <path> -- Write process id into file, refuse to start if already running. Disabled by default
+ * --daemon, --log-file <path> -- Detach and run under supervisor restarting crashed daemon, logging into file
+ * --orphans adopt|kill|ignore -- What to do with workers left running by crashed instance. Default is adopt
+ * --subreaper -- Reap processes orphaned by workers, implied when running as PID 1
+ * --stall-timeout <duration> -- Drop stuck tube connection, or exit with code 3, when main loop is stuck that long. Default is 1m
+ * --socket <path> -- Control socket path, empty to disable. Default is executable path + ".sock"
+ * --worker-socket <path> -- Socket accepting put commands only, passed to workers as WORKERMAN_SOCKET. Default is none, workers get no socket
+ * --grpc-listen <addr:port> -- Address for gRPC control API. Disabled by default
+ * --grpc-cert <file>, --grpc-key <file>, --grpc-client-ca <file> -- TLS settings for gRPC control API
+ * --grpc-token <token> -- Bearer token required from gRPC clients
+ * --http-listen <addr:port> -- Address for HTTP control API. Disabled by default
+ * --http-cert <file>, --http-key <file>, --http-client-ca <file> -- TLS settings for HTTP control API
+ * --access-file <file> -- Control API tokens, client certificate names and command signing keys with their scopes
+ * --reply-timeout <duration> -- How long client commands wait for daemon response. Default is 5s
+ *
+ * Every option can also be set with WORKERMAN_* environment variable (e.g. WORKERMAN_CONNECT),
+ * as well as limits: WORKERMAN_TOTAL, WORKERMAN_MIN and WORKERMAN_QUEUES ("tube=limit,...").
+ * Precedence: command line flag > environment > config file > default.
+ *
+ * Send SIGUSR2 for hot upgrade: new binary takes over control socket and listeners, old process exits once its workers finish.
  *
  * @author Dmitry Vovk <dmitry.vovk@gmail.com>
  * @package Марк Абрамович Воркерман
@@ -17,8 +122,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/kr/beanstalk"
 	"io/ioutil"
 	"log"
@@ -27,32 +135,113 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type WorkerCommand struct {
-	Command string
-	Options map[string]string
+	Command     string
+	Options     map[string]string // Legacy setLimits options with "*" and "-" keys
+	Limits      *LimitsUpdate     // Typed setLimits payload
+	Job         *JobRequest       // Job to publish with put command
+	Replay      *ReplayRequest    // Jobs to replay with replay command
+	Feature     *FeatureToggle    // Feature to toggle with setFeature command
+	Deploy      *DeployRequest    `json:",omitempty"` // Worker to write into workers directory with deployWorker command
+	RequestId   string            // Optional, echoed in response
+	ReplyTo     string            // Optional tube to put response into instead of response tube
+	ResponseTTL *Duration         `json:",omitempty"` // Response is deleted if nobody takes it in time, shorter than --response-ttl
+	Timestamp   int64             `json:",omitempty"` // Unix time command was signed at, see --command-key
+	Nonce       string            `json:",omitempty"` // Random value of signed command, rejected if seen again
+
+	keyId    string // Key of access file command was signed with, set by decodeCommand
+	encoding byte   // Header byte of encoding command came in, response is sent the same, 0 for JSON
+}
+
+/**
+ * Typed setLimits payload, e.g. {"total": 100, "min": 5, "tubes": {"email": 10}, "tenants": {"acme": 20}}
+ * Fields left out are not changed.
+ */
+type LimitsUpdate struct {
+	Total   *int           `json:"total,omitempty"`
+	Min     *int           `json:"min,omitempty"`
+	Tubes   map[string]int `json:"tubes,omitempty"`
+	Tenants map[string]int `json:"tenants,omitempty"` // Workers over all tubes of tenant, see --tenants
+}
+
+/**
+ * Response to typed setLimits, limits are changed only if there are no errors
+ */
+type LimitsUpdateResponse struct {
+	Applied bool
+	Errors  []string
+	Limits  *Limits
+}
+
+/**
+ * Response envelope for commands having RequestId
+ */
+type CommandResponse struct {
+	RequestId string
+	Response  json.RawMessage
 }
 
 type Limits struct {
-	Total  uint
-	Min    uint
-	Queues map[string]uint
+	Total   uint
+	Min     uint
+	Queues  map[string]uint
+	Tenants map[string]uint `json:",omitempty"` // Workers over all tubes of tenant, see --tenants
 }
 
 type Stats struct {
+	Instance        string // Instance name used in control tube names
 	TotalRuns       uint64 // Workers total runs counter
 	TotalCycles     uint64 // Number of cycles
-	TotalRecoveries uint64 // Number of job reserve error recoveries
-	LastError       string
+	TotalRecoveries uint64 // Number of broken connections recovered
+	LastError       string            // Last connection error
+	Degraded        map[string]string // Tubes being reconnected, with time and error
+	Integrity       map[string]string `json:",omitempty"` // Workers refused by integrity check, with why
+	Tags            []string          `json:",omitempty"` // Tags of host, see --tags
+	Unmatched       map[string]string `json:",omitempty"` // Tubes not subscribed, with tags they require host lacks
+	Servers         map[string]*ServerStatus
+	Ready           bool   // Command connection and all tube connections are up
+	NotReady        string `json:",omitempty"` // Why it is not ready
 	Runs            map[string]uint64 // Count runs for each worker
 	Errors          map[string]uint64 // Worker errors count (non zero return codes)
 	Running         map[string]uint   // Now running count
 	TotalRunning    uint
+	Backlog         map[string]int // Ready jobs of tubes when last polled
+	Units           map[string]uint // Resource units of running workers, see Cost of tube
+	TotalUnits      uint            // Counted against total limit
+	AutoTotal       uint `json:",omitempty"` // Total limit derived from host, see --auto-total
+	Autoscaled      map[string]uint `json:",omitempty"` // Limits raised by Autoscale of tube
+	Predicted       map[string]uint `json:",omitempty"` // Workers predicted for autoscaled tubes with Predict
+	Shares          map[string]float64 `json:",omitempty"` // Running workers per weighted share of contending tubes, 1 is fair
+	Fleet           map[string]uint `json:",omitempty"` // Workers of tubes with GlobalLimit running on other instances
+	Mirrored        map[string]uint64 `json:",omitempty"` // Jobs copied into Shadow tubes, by tube they came from
+	Invalid         map[string][]InvalidJob `json:",omitempty"` // Latest jobs buried for not matching Schema, by tube
+	RuleHits        map[string][]uint64 `json:",omitempty"` // Jobs each of Rules of tube applied to
+	Migrated        map[string]uint64 `json:",omitempty"` // Jobs upgraded by migration scripts, by tube
+	WorkersSync     *WorkersSync `json:",omitempty"` // Commit workers directory is at, see --workers-git
+	Artifacts       map[string]*ArtifactStatus `json:",omitempty"` // Workers of --artifact-manifest, by name
+	Canaries        map[string]*CanaryStatus `json:",omitempty"` // Rollouts of new worker versions, by tube with Canary
+	Tenants         map[string]*TenantStatus `json:",omitempty"` // Tubes rolled up by tenant, see --tenants
+	Leader          string `json:",omitempty"` // Instance leading cluster, see --cluster
+	Shards          map[string][]string `json:",omitempty"` // Instances serving each tube, see --shard-replicas
+	Resident        map[string]uint // Running resident worker instances
+	TotalResident   uint
+	Prefork         map[string]uint `json:",omitempty"` // Warm prefork processes, idle or running a job
+	Stalls          uint64 // Times main loop got stuck, see --stall-timeout
+	LastStall       string
+	BuriedCommands  uint64 // Command jobs buried as oversized, malformed or not authentic
+	DroppedCommands uint64 // Command jobs dropped over --command-rate
+	Paused          map[string]bool // Tubes not dispatched, "*" for all
+	Draining        bool            // Exit once running workers finish
+	DryRun          bool            // Workers are not started, only logged
+	Replays         map[string]*ReplayStatus
 	Limits          *Limits
 }
 
@@ -62,35 +251,43 @@ type Sync struct {
 	Error bool
 }
 
-type Queue struct {
-	conn *beanstalk.Conn
-	tube *beanstalk.Tube
-}
-
 var (
-	/** Address and port of Beanstalkd server */
-	server = flag.String("connect", "0.0.0.0:11300", "Address:port of beanstalkd server. Default: 0.0.0.0:11300")
+	/** Address and port of Beanstalkd server, or comma separated primary and backups */
+	server = flag.String("connect", "0.0.0.0:11300", "Address:port of beanstalkd server, or comma separated list with primary first and backups after it. Default: 0.0.0.0:11300")
 
 	/** Directory containing executable workers */
 	workersPath = flag.String("workers", "workers", "Directory path with worker scripts. Default: workers")
 
 	runAs = flag.String("user", "", "Specify user account name to use")
 
+	/** Only log what would be dispatched */
+	dryRun = flag.Bool("dry-run", false, "Poll queues and log which workers would be started, without starting them")
+
+	/** Ready jobs count last logged in dry run mode */
+	dryRunReady = make(map[string]int)
+
+	/** Name used in control tube names instead of host name */
+	instanceName = flag.String("instance-name", "", "Instance name to use in control tube names. Default: host name")
+
 	myDir string
 	cfgPath string
 
-	/** Interval in milliseconds between queue check */
-	interval time.Duration = 10
+	/** Interval between queue check */
+	interval = flag.Duration("interval", DEFAULT_INTERVAL, "Interval between queue checks. Default: 10ms")
 
 	/** Delay after failed attempt to (re)connect to beanstalkd */
-	reconnectDelay time.Duration = 5000
+	reconnectDelay = flag.Duration("reconnect-delay", DEFAULT_RECONNECT_DELAY, "Delay after failed attempt to connect to beanstalkd. Default: 5s")
+
+	/** Command and response tube name prefixes */
+	commandPrefix  = flag.String("command-prefix", INPUT_PREFIX, "Command tube name prefix. Default: "+INPUT_PREFIX)
+	responsePrefix = flag.String("response-prefix", OUTPUT_PREFIX, "Response tube name prefix. Default: "+OUTPUT_PREFIX)
+
+	/** Limit for newly subscribed tubes */
+	defaultQueueLimit = flag.Uint("default-queue-limit", DEFAULT_QUEUE_LIMIT, "Limit for tubes having no limit configured. Default: 5")
 
 	/** Control tube connection */
 	commandConn *beanstalk.Conn
 
-	/** Tubes connections */
-	connections map[string]Queue
-
 	commandTubeName, responseTubeName string
 
 	responseTube *beanstalk.Tube
@@ -101,15 +298,37 @@ var (
 
 	stats Stats
 
-	statsChannel chan Sync
+	/**
+	 * Guards stats, limits, tube settings and connections map, which are shared by main loop,
+	 * worker runners and command handlers. Functions reading or changing them expect caller to hold it,
+	 * unless stated otherwise
+	 */
+	stateLock sync.Mutex
+
+	/** Run counter updates of finished workers, applied by collectStats so worker runners do not wait for stateLock */
+	statsChannel = make(chan Sync, STATS_BUFFER)
+
+	/** Serializes use of command connection by main loop and command handlers */
+	commandLock sync.Mutex
+
+	/** Commands which do not change anything */
+	readOnlyCommands = map[string]bool{"getLimits": true, "getStatus": true, "getConfig": true}
+
+	/** Commands replacing worker files, they take stateLock themselves */
+	workerCommands = map[string]bool{"deployWorker": true, "syncWorkers": true, "rollbackWorker": true, "promoteWorker": true}
+
+	/** Commands being processed, waited for before exit */
+	pendingCommands sync.WaitGroup
 )
 
 const (
-	INPUT_PREFIX        = "Worker-to."
-	OUTPUT_PREFIX       = "Worker-from."
-	DEFAULT_QUEUE_LIMIT = 5
-	WORKERS_MAX         = 100 // Maximum number of workers to run
-	WORKERS_MIN         = 5   // Minimal number of workers to allow
+	INPUT_PREFIX            = "Worker-to."
+	OUTPUT_PREFIX           = "Worker-from."
+	DEFAULT_QUEUE_LIMIT     = 5
+	DEFAULT_INTERVAL        = 10 * time.Millisecond
+	DEFAULT_RECONNECT_DELAY = 5 * time.Second
+	WORKERS_MAX             = 100 // Maximum number of workers to run
+	WORKERS_MIN             = 5   // Minimal number of workers to allow
 )
 
 func (l *Limits) Json() ([]byte, error) {
@@ -121,47 +340,207 @@ func (l *Limits) PrettyJson() ([]byte, error) {
 }
 
 /**
- * Process to run worker and collect output
+ * Process to run worker and collect output. Job is given when reserved by workerman in reserve mode
  */
-func workerRunner(worker string) {
+func workerRunner(worker string, job *ReservedJob) {
 	var hasError bool = false
-	statsChannel <- Sync{Worker: worker, Count: 1, Error: hasError}
-	log.Printf("Starting %s:%d\n", worker, stats.Runs[worker])
-	var out bytes.Buffer
-	cmd := exec.Command("./"+worker, "")
-	cmd.Stdout = &out
-	error := cmd.Run()
+	stateLock.Lock()
+	run := stats.Runs[worker]
+	config := effectiveConfig(worker)
+	shadowOf := shadowSource(worker)
+	stateLock.Unlock()
+	if job != nil && (fetchJobPayload(worker, job) || openJobPayload(worker, job) || inflateJobPayload(worker, config, job) || migrateJobPayload(worker, config, job) || applyJobRules(worker, config, job) || rejectInvalidJob(worker, config, job) || applyJobPolicy(worker, job)) {
+		return
+	}
+	// Copy refers to the same claim check object, it is left to lifecycle rules of bucket
+	if job != nil && mirrorJob(worker, config, job) {
+		job.claim = nil
+	}
+	// Worker under test gets one go at mirrored job, whose claim check object the original has
+	if shadowOf != "" {
+		config.Retry = 0
+		if job != nil {
+			job.claim = nil
+		}
+	}
+	log.Printf("Starting %s:%d%s\n", worker, run, correlationTag(job))
+	publishJobEvent("started", worker, job, "")
+	hookRun := &HookRun{Tube: worker, Run: run}
+	if job != nil {
+		hookRun.JobId, hookRun.Body, hookRun.CorrelationId = job.Id, job.plain, job.correlationId()
+	}
+	error := hooksBefore(hookRun)
+	input := &workerInput{args: []string{""}}
+	if error == nil && job != nil {
+		if input, error = prepareInput(config, hookRun.Body); error != nil {
+			error = fmt.Errorf("%w: %v", errInvalidInput, error)
+		} else {
+			defer input.cleanup()
+		}
+	}
+	path, canary := "./"+worker, ""
+	if error == nil {
+		path, canary = canaryPath(worker, config)
+	}
+	for attempt := uint(0); error == nil && attempt <= config.Retry; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying %s:%d, attempt %d of %d", worker, run, attempt, config.Retry)
+		}
+		error = runWorkerProcess(worker, run, config, job, input, path)
+		if error == nil || strings.Contains(error.Error(), "no such file") {
+			break
+		}
+	}
 	if error != nil {
-		if strings.Contains(error.Error(), "no such file") {
-			// Worker file is removed, unsubscribe
-			delete(connections, worker)
-			log.Printf("Unsubscribed %s", worker)
+		if strings.Contains(error.Error(), "no such file") && !errors.Is(error, errInvalidInput) {
+			// Worker file is removed, watcher unsubscribes once other runs exit and job is released
+			canary = ""
+			stateLock.Lock()
+			retireTube(worker)
+			stateLock.Unlock()
 		} else {
 			hasError = true
-			log.Printf("Worker %s:%d returned an error: %s", worker, stats.Runs[worker], error)
+			log.Printf("Worker %s:%d returned an error: %s%s", worker, run, error, correlationTag(job))
+		}
+	}
+	if hasError {
+		if shadowOf == "" {
+			hooksAfter(hookRun, error)
+		}
+		publishJobEvent("failed", worker, job, error.Error())
+	} else {
+		if error == nil && shadowOf == "" {
+			hooksAfter(hookRun, nil)
+		}
+		publishJobEvent("finished", worker, job, "")
+	}
+	noteExemplar(worker, job, hasError)
+	canaryOutcome(worker, canary, config, hasError)
+	if job != nil {
+		outcome := "release"
+		if error == nil || shadowOf != "" {
+			// Results of shadow worker are discarded
+			outcome = "delete"
+		} else if hasError && !retryLater(error) {
+			outcome = "bury"
+		}
+		if hasError && shadowOf == "" {
+			outcome = policyFailure(job, error, outcome)
 		}
+		job.finish(outcome)
+	}
+	updateStats(Sync{Worker: worker, Count: -1, Error: hasError})
+}
+
+/**
+ * Finishes reserved job as outcome says without starting worker for it, taking back run counted for it. Reason of
+ * failure is published as failed event and counted as error, empty reason means job was handled. Returns true
+ * for pre-run filters to return
+ */
+func rejectJob(worker string, job *ReservedJob, outcome, reason string) bool {
+	if reason != "" {
+		publishJobEvent("failed", worker, job, reason)
+	}
+	job.finish(outcome)
+	updateStats(Sync{Worker: worker, Count: -1, Error: reason != ""})
+	return true
+}
+
+/**
+ * Runs worker process once with configured timeout and environment, logs its output.
+ * Body of reserved job, as hooks left it, is passed as Input says and job kept reserved while worker runs.
+ * Path is executable to start, worker file or its stable version while Canary tests new one
+ */
+func runWorkerProcess(worker string, run uint64, config EffectiveConfig, job *ReservedJob, input *workerInput, path string) error {
+	if config.features["prefork"] {
+		return runPreforked(worker, run, config, job, input.stdin)
+	}
+	out := &outputCapture{worker: worker}
+	ctx := context.Background()
+	if config.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout.Duration)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, path, input.args...)
+	cmd.Stdout = out
+	umask, err := parseUmask(config.Umask)
+	if err != nil {
+		return err
+	}
+	if cmd.Env, err = workerProcessEnv(worker, config); err != nil {
+		return err
+	}
+	if job != nil {
+		cmd.Stdin = bytes.NewReader(input.stdin)
+		cmd.Env = append(cmd.Env, JOB_ID_ENV+"="+job.Id, JOB_TUBE_ENV+"="+worker, CORRELATION_ENV+"="+job.correlationId())
+		touching := make(chan struct{})
+		defer close(touching)
+		go job.keepAlive(touching)
+	}
+	done, err := startChildUmask(cmd, umask)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	done()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %s timeout", config.Timeout)
 	}
 	// Log output if any
-	if out.Len() > 0 {
-		log.Printf("Worker %s:%d output: %s", worker, stats.Runs[worker], out.String())
+	if output := out.finish(); output != "" {
+		log.Printf("Worker %s:%d output%s: %s", worker, run, correlationTag(job), output)
 	}
-	statsChannel <- Sync{Worker: worker, Count: -1, Error: hasError}
+	return err
 }
 
 /**
- * Try to connect to beanstalkd until successfully connected
+ * Returns environment of worker process started for jobs: configured one, secrets and put-only worker socket
  */
-func connect() *beanstalk.Conn {
-	for {
-		log.Printf("Connecting to %s...", *server)
-		beanstalk, err := beanstalk.Dial("tcp", *server)
+func workerProcessEnv(worker string, config EffectiveConfig) ([]string, error) {
+	env := append(workerEnv(config), WORKER_ENV+"="+worker)
+	if len(config.Secrets) > 0 {
+		secrets, err := secretEnv(config.Secrets)
 		if err != nil {
-			log.Printf("Could not connect: %v", err)
-			time.Sleep(reconnectDelay * time.Millisecond)
-			continue
+			return nil, err
 		}
-		log.Printf("Connected!")
-		return beanstalk
+		env = append(env, secrets...)
+	}
+	if *workerSocketPath != "" {
+		// Lets worker put follow-up jobs with "workerman put" into this daemon, put being all that socket accepts
+		env = append(env, envName("socket")+"="+*workerSocketPath)
+	}
+	return env, nil
+}
+
+/**
+ * Counts worker as running and starts it, unless a command paused it or limits changed since the check.
+ * Counting before start keeps next cycle from exceeding limits. Takes stateLock itself
+ */
+func startWorker(worker string) bool {
+	stateLock.Lock()
+	if !canRunWorker(worker) {
+		stateLock.Unlock()
+		return false
+	}
+	countRun(worker)
+	stateLock.Unlock()
+	takeSpawn()
+	go workerRunner(worker, nil)
+	return true
+}
+
+/**
+ * Logs worker that would have been started in dry run mode, when ready jobs count changes
+ */
+func simulateWorker(worker string, readyJobsCount int) {
+	if dryRunReady[worker] == readyJobsCount {
+		return
+	}
+	dryRunReady[worker] = readyJobsCount
+	if readyJobsCount > 0 {
+		log.Printf("Dry run: would have started worker %s for %d job(s)", worker, readyJobsCount)
+	} else {
+		log.Printf("Dry run: no jobs for %s", worker)
 	}
 }
 
@@ -169,29 +548,71 @@ func connect() *beanstalk.Conn {
  * Looks for workers in specified directory
  */
 func listWorkers() []string {
-	tubes, err := filepath.Glob("*")
+	files, err := filepath.Glob("*")
 	if err != nil {
 		log.Fatal(err)
 	}
+	var tubes []string
+	for _, file := range files {
+		if !notWorker(file) {
+			tubes = append(tubes, file)
+		}
+	}
 	return tubes
 }
 
 /**
- * Watches for changes in workers, and subscribes on the fly
+ * Checks if file in workers directory is no worker: one being deployed by writeFileAtomic, stable versions kept
+ * for Canary, inactive versions kept for rollbackWorker, or with --workers-git the repository and its settings, like .gitignore
+ */
+func notWorker(file string) bool {
+	return strings.HasPrefix(file, ".") && strings.Contains(file, ".tmp") || *workersGit && strings.HasPrefix(file, ".git") || file == CANARY_DIR || file == VERSIONS_DIR
+}
+
+/**
+ * Watches for changes in workers, and subscribes on the fly. Takes stateLock itself
  */
 func watcher() {
-	// Collect available workers
-	workerFiles := listWorkers()
+	// Collect available workers, leaving out ones requiring tags host lacks and ones assigned to other instances
+	var workerFiles []string
 	newWorkerFiles := make(map[string]bool)
-	for _, worker := range workerFiles {
-		newWorkerFiles[worker] = true
+	listed := make(map[string]bool)
+	stateLock.Lock()
+	shardCandidates = make(map[string]bool)
+	for _, worker := range listWorkers() {
+		listed[worker] = true
+		if !tagsMatch(worker) {
+			continue
+		}
+		shardCandidates[worker] = true
+		if shardServes(worker) {
+			workerFiles = append(workerFiles, worker)
+			newWorkerFiles[worker] = true
+		}
 	}
+	for tube := range stats.Unmatched {
+		if !listed[tube] {
+			delete(stats.Unmatched, tube)
+		}
+	}
+	stateLock.Unlock()
 	// Check if we have subscribed already
 	for _, tube := range workerFiles {
+		stateLock.Lock()
+		ok := subscriptions[tube]
+		if !ok && retiring[tube] {
+			// Worker came back before the last run of the old one exited, broker subscription is still there
+			delete(retiring, tube)
+			subscriptions[tube] = true
+			ok = true
+			log.Printf("Worker %s is back, keeping subscription", tube)
+		}
+		stateLock.Unlock()
 		// No, we have not
-		if _, ok := connections[tube]; !ok {
-			conn := connect()
-			connections[tube] = Queue{conn, &beanstalk.Tube{conn, tube}}
+		if !ok {
+			broker.Subscribe(tube)
+			stateLock.Lock()
+			subscriptions[tube] = true
 			// No previous worker runs, add counters
 			if _, ok := stats.Runs[tube]; !ok {
 				stats.Runs[tube] = 0
@@ -199,42 +620,243 @@ func watcher() {
 			if _, ok := stats.Running[tube]; !ok {
 				stats.Running[tube] = 0
 			}
-			if _, ok := limits.Queues[tube]; !ok {
-				limits.Queues[tube] = DEFAULT_QUEUE_LIMIT
-			}
+			stateLock.Unlock()
 			log.Printf("Subscribed to %s", tube)
+			publishEvent("subscribed", tube, "")
 		}
 	}
 	// Check if we need to unsubscribe
-	for tube, _ := range connections {
+	stateLock.Lock()
+	var removed []string
+	for tube := range subscriptions {
 		if _, ok := newWorkerFiles[tube]; !ok {
-			delete(connections, tube)
+			retireTube(tube)
+		}
+	}
+	for tube := range retiring {
+		if stats.Running[tube] == 0 {
+			delete(retiring, tube)
 			delete(stats.Running, tube)
-			log.Printf("Unsubscribed %s", tube)
+			delete(stats.Backlog, tube)
+			delete(stats.Degraded, tube)
+			removed = append(removed, tube)
+		}
+	}
+	stateLock.Unlock()
+	for _, tube := range removed {
+		broker.Unsubscribe(tube)
+		log.Printf("Unsubscribed %s", tube)
+		publishEvent("unsubscribed", tube, "")
+	}
+}
+
+/**
+ * Stops dispatching workers of tube whose worker is gone. Running workers finish with the version they started, their
+ * jobs are settled through broker subscription, watcher unsubscribes once the last one exits. Caller must hold stateLock
+ */
+func retireTube(tube string) {
+	if !subscriptions[tube] {
+		return
+	}
+	delete(subscriptions, tube)
+	retiring[tube] = true
+	if running := stats.Running[tube]; running > 0 {
+		log.Printf("Retiring %s, unsubscribing once %d running worker(s) exit", tube, running)
+		publishEvent("retiring", tube, fmt.Sprintf("%d running", running))
+	}
+}
+
+/**
+ * Takes command from command tube if there is one, and processes it in background
+ */
+func reserveCommand() {
+	stateLock.Lock()
+	due := pollDue(commandTubeName, time.Now())
+	stateLock.Unlock()
+	if !due {
+		return
+	}
+	commandLock.Lock()
+	if commandReconnecting {
+		commandLock.Unlock()
+		return
+	}
+	conn := commandConn
+	loopStage("command reserve", "", conn)
+	id, body, errCommandReserve := commandTube.Reserve(0)
+	var cmd WorkerCommand
+	var rejected string
+	if errCommandReserve == nil {
+		cmd, rejected = admitCommand("command", body)
+		if rejected == "bury" {
+			if err := commandConn.Bury(id, 0); err != nil {
+				log.Printf("Could not bury command %d: %v", id, err)
+			}
+		} else {
+			commandConn.Delete(id)
+		}
+	}
+	commandLock.Unlock()
+	if rejected != "" {
+		countRejectedCommand(rejected)
+	}
+	if errCommandReserve == nil || isTimeout(errCommandReserve) {
+		stateLock.Lock()
+		pollResult(commandTubeName, errCommandReserve == nil, time.Now())
+		stateLock.Unlock()
+	}
+	// Process command
+	if errCommandReserve == nil {
+		if rejected == "" {
+			pendingCommands.Add(1)
+			go func() {
+				defer pendingCommands.Done()
+				processCommand(cmd)
+			}()
+		}
+	} else {
+		// Timeout error is ok, other is not
+		if !isTimeout(errCommandReserve) {
+			log.Printf("Command error: %v", errCommandReserve)
+			if isConnError(errCommandReserve) {
+				recoverCommandConn(conn, errCommandReserve)
+			}
 		}
 	}
 }
 
 /**
- * Process command received
+ * Process command received from command tube
  */
 func processCommand(cmd WorkerCommand) {
+	if !validReplyTo(cmd) {
+		return
+	}
+	payload := executeCommand(cmd)
+	if payload == nil {
+		return
+	}
+	// Connection may have been replaced while command was executed
+	commandLock.Lock()
+	conn, tube := commandConn, responseTube
+	if name := replyTube(cmd, responseTubeName); name != responseTubeName {
+		tube = &beanstalk.Tube{commandConn, name}
+	}
+	id, err := tube.Put(responseBody(cmd, payload), 0, 0, 5)
+	commandLock.Unlock()
+	if err == nil {
+		trackResponse(cmd, conn, tube.Name, id, false)
+	}
+	if err != nil {
+		log.Printf("Could not send response to %s: %v", tube.Name, err)
+		if isConnError(err) {
+			recoverCommandConn(conn, err)
+		}
+	}
+}
+
+/**
+ * Checks reply tube name of command, if it has one. It must be under --response-prefix, so commands can not have
+ * responses put into job tubes, where workers would take them as jobs
+ */
+func validReplyTo(cmd WorkerCommand) bool {
+	if cmd.ReplyTo != "" {
+		if err := checkTubeName(cmd.ReplyTo); err != nil {
+			log.Printf("Ignoring command %s with invalid reply tube '%s': %v", cmd.Command, cmd.ReplyTo, err)
+			return false
+		}
+		if !strings.HasPrefix(cmd.ReplyTo, *responsePrefix) {
+			log.Printf("Ignoring command %s with reply tube '%s' not starting with %s", cmd.Command, cmd.ReplyTo, *responsePrefix)
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Wraps response payload into envelope with request id, if command has one
+ */
+func wrapResponse(cmd WorkerCommand, payload []byte) []byte {
+	if cmd.RequestId == "" {
+		return payload
+	}
+	response, err := json.Marshal(CommandResponse{cmd.RequestId, payload})
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return payload
+	}
+	return response
+}
+
+/**
+ * Executes command and returns response payload, nil if there is nothing to respond. Takes stateLock itself
+ */
+func executeCommand(cmd WorkerCommand) []byte {
 	var payload []byte
+	if cmd.Command != "put" && !workerCommands[cmd.Command] {
+		// Commands only touch memory and config file, except put, which talks to beanstalkd, and commands
+		// replacing worker files, which may fetch or pull them and wait for them to be subscribed
+		stateLock.Lock()
+		defer stateLock.Unlock()
+	}
 	switch cmd.Command {
 	default:
 		log.Printf("Unknown or unsupported command: %s", cmd.Command)
-		return
+		return nil
 	case "getLimits":
 		payload = getLimits()
 	case "getStatus":
 		payload = getStatus()
+	case "getConfig":
+		payload = getConfig(cmd.Options)
 	case "setLimits":
-		payload = setLimits(cmd.Options)
-		writeConfig()
+		if cmd.Limits != nil {
+			payload = updateLimits(*cmd.Limits)
+		} else {
+			payload = setLimits(cmd.Options)
+			writeConfig()
+		}
+	case "pause":
+		payload = pauseTubes(cmd.Options, true)
+	case "resume":
+		payload = pauseTubes(cmd.Options, false)
+	case "drain":
+		payload = drain()
+	case "put":
+		if cmd.Job == nil {
+			log.Printf("Command put without job")
+			return nil
+		}
+		payload = putJob(cmd.Job)
+	case "replay":
+		if cmd.Replay == nil {
+			log.Printf("Command replay without request")
+			return nil
+		}
+		payload = replayJobs(cmd.Replay)
+	case "setFeature":
+		if cmd.Feature == nil {
+			log.Printf("Command setFeature without feature")
+			return nil
+		}
+		payload = setFeature(cmd.Feature)
+	case "rollbackConfig":
+		payload = rollbackConfig()
+	case "deployWorker":
+		if cmd.Deploy == nil {
+			log.Printf("Command deployWorker without worker")
+			return nil
+		}
+		payload = deployWorker(cmd.Deploy)
+	case "syncWorkers":
+		payload = syncWorkersCommand(cmd.Options)
+	case "rollbackWorker", "promoteWorker":
+		payload = switchWorkerCommand(cmd.Command, cmd.Options)
 	}
-	if payload != nil {
-		responseTube.Put(payload, 0, 0, 5)
+	if !readOnlyCommands[cmd.Command] {
+		publishEvent("command", "", cmd.Command)
 	}
+	return payload
 }
 
 /**
@@ -250,7 +872,7 @@ func getLimits() []byte {
 }
 
 /**
- * Returns JSON encoded statistics
+ * Returns JSON encoded statistics, a consistent snapshot as long as stateLock is held
  */
 func getStatus() []byte {
 	response, err := json.Marshal(stats)
@@ -266,7 +888,7 @@ func getStatus() []byte {
  */
 func setLimits(options map[string]string) []byte {
 	for key, value := range options {
-		if _, has := limits.Queues[key]; has {
+		if subscriptions[key] {
 			intLimit, err := strconv.Atoi(value)
 			if err == nil {
 				limits.Queues[key] = uint(intLimit)
@@ -284,6 +906,11 @@ func setLimits(options map[string]string) []byte {
 				limits.Min = uint(intLimit)
 				log.Printf("Setting minimum workers to %s", value)
 			}
+		} else if tenant := tenantPattern(key); tenant != "" {
+			intLimit, err := strconv.Atoi(value)
+			if err == nil {
+				setTenantLimit(tenant, uint(intLimit))
+			}
 		} else {
 			log.Printf("Skipping '%s', not subscribed", key)
 		}
@@ -292,52 +919,219 @@ func setLimits(options map[string]string) []byte {
 }
 
 /**
- * Checks if worker can be run
+ * Process typed setLimits command
+ *
+ * Update is validated as a whole and either applied completely or rejected with errors.
  */
-func canRunWorker(worker string) bool {
-	// Always run at least limits.Min workers
-	if stats.Running[worker] < limits.Min {
-		return true
-	}
-	// See if total limit allows
-	if stats.TotalRunning < limits.Total {
-		// Do we have limit set for the worker?
-		if limit, has := limits.Queues[worker]; !has {
-			return true
+func updateLimits(update LimitsUpdate) []byte {
+	var errs []string
+	total, min := int(limits.Total), int(limits.Min)
+	if update.Total != nil {
+		if total = *update.Total; total < 0 {
+			errs = append(errs, fmt.Sprintf("total: negative limit %d", total))
+		}
+	}
+	if update.Min != nil {
+		if min = *update.Min; min < 0 {
+			errs = append(errs, fmt.Sprintf("min: negative limit %d", min))
+		}
+	}
+	if min > total {
+		errs = append(errs, fmt.Sprintf("min: %d is greater than total %d", min, total))
+	}
+	for tube, limit := range update.Tubes {
+		if !subscriptions[tube] {
+			errs = append(errs, fmt.Sprintf("tubes.%s: not subscribed", tube))
+		} else if limit < 0 {
+			errs = append(errs, fmt.Sprintf("tubes.%s: negative limit %d", tube, limit))
+		}
+	}
+	for tenant, limit := range update.Tenants {
+		if !*tenantsEnabled {
+			errs = append(errs, fmt.Sprintf("tenants.%s: tenants are not enabled, see --tenants", tenant))
+		} else if tenant == "" || strings.Contains(tenant, TENANT_SEPARATOR) {
+			errs = append(errs, fmt.Sprintf("tenants.%s: invalid tenant name", tenant))
+		} else if limit < 0 {
+			errs = append(errs, fmt.Sprintf("tenants.%s: negative limit %d", tenant, limit))
+		}
+	}
+	response := LimitsUpdateResponse{Errors: errs, Limits: &limits}
+	if len(errs) == 0 {
+		limits.Total, limits.Min = uint(total), uint(min)
+		for tube, limit := range update.Tubes {
+			limits.Queues[tube] = uint(limit)
+			log.Printf("Setting %s => %d", tube, limit)
+		}
+		for tenant, limit := range update.Tenants {
+			setTenantLimit(tenant, uint(limit))
+		}
+		log.Printf("Limits set to total %d, minimum %d", total, min)
+		response.Applied = true
+		writeConfig()
+	} else {
+		log.Printf("Rejected setLimits: %s", strings.Join(errs, "; "))
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode limits: %v", err)
+		return nil
+	}
+	return payload
+}
+
+/**
+ * Process pause and resume commands, "*" key stands for all tubes
+ */
+func pauseTubes(options map[string]string, pause bool) []byte {
+	for tube := range options {
+		if !subscriptions[tube] && tube != "*" && tenantPattern(tube) == "" {
+			log.Printf("Skipping '%s', not subscribed", tube)
+			continue
+		}
+		if pause {
+			stats.Paused[tube] = true
+			log.Printf("Paused %s", tube)
+		} else if tube == "*" {
+			stats.Paused = make(map[string]bool)
+			log.Printf("Resumed all tubes")
 		} else {
-			return limit > stats.Running[worker]
+			delete(stats.Paused, tube)
+			log.Printf("Resumed %s", tube)
+		}
+	}
+	return getStatus()
+}
+
+/**
+ * Process drain command
+ */
+func drain() []byte {
+	stats.Draining = true
+	log.Printf("Draining, will exit once %d running worker(s) finish", stats.TotalRunning)
+	return getStatus()
+}
+
+/**
+ * Returns subscribed workers ordered by priority, then by name
+ */
+func dispatchOrder() []string {
+	workers := make([]string, 0, len(subscriptions))
+	priorities := make(map[string]uint32, len(subscriptions))
+	for worker := range subscriptions {
+		workers = append(workers, worker)
+		priorities[worker] = schedulingConfig(worker).Priority
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		if priorities[workers[i]] != priorities[workers[j]] {
+			return priorities[workers[i]] < priorities[workers[j]]
 		}
+		return workers[i] < workers[j]
+	})
+	return workers
+}
+
+/**
+ * Checks if worker can be run
+ */
+func canRunWorker(worker string) bool {
+	// Connection is being recovered
+	if _, degraded := stats.Degraded[worker]; degraded {
+		return false
+	}
+	return hasCapacity(worker)
+}
+
+/**
+ * Checks if pause, drain and limits allow another worker, whatever the state of its connection is
+ */
+func hasCapacity(worker string) bool {
+	// Nothing is started while paused or draining
+	if stats.Draining || stats.Paused["*"] || stats.Paused[worker] {
+		return false
+	}
+	config := schedulingConfig(worker)
+	// Resident workers take jobs themselves
+	if config.Resident > 0 {
+		return false
+	}
+	limit := config.Limit
+	// Always run at least limits.Min workers, otherwise see if total limit, in units of cost, allows
+	if stats.Running[worker] >= limits.Min && (stats.TotalUnits+config.Cost > totalLimit() || limit <= stats.Running[worker]) {
+		return false
 	}
-	return false
+	// Other instances of fleet may run the rest of global limit
+	if !fleetAllows(worker, config) {
+		return false
+	}
+	// Tenant may be paused or run its limit on other tubes
+	if !tenantAllows(worker) {
+		return false
+	}
+	// Workers are not started faster than --max-spawns
+	if !spawnAllowed() {
+		return false
+	}
+	// Modified or unlisted worker is never started
+	if !checkIntegrity(worker) {
+		return false
+	}
+	// Policy script may still hold it back
+	return policyCanRun(worker, stats.Running[worker], limit)
+}
+
+/**
+ * Reads and parses config file
+ */
+func loadConfig(path string) (ConfigFile, error) {
+	var tempConfig ConfigFile
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tempConfig, err
+	}
+	if jsErr := json.Unmarshal(file, &tempConfig); jsErr != nil {
+		return tempConfig, fmt.Errorf("could not parse: %v", jsErr)
+	}
+	if tempConfig.Queues == nil {
+		tempConfig.Queues = make(map[string]uint)
+	}
+	if tempConfig.Tubes == nil {
+		tempConfig.Tubes = make(map[string]*TubeConfig)
+	}
+	return tempConfig, nil
 }
 
 func readConfig() {
-	file, err := ioutil.ReadFile(cfgPath)
+	tempConfig, err := loadConfig(cfgPath)
 	if err != nil {
 		log.Printf("Notice: could not read config file: %s", err)
 		return
 	}
-	var tempLimits Limits
-	jsErr := json.Unmarshal(file, &tempLimits)
-	if jsErr != nil {
-		log.Printf("Warning: could not parse config file: %s", jsErr)
-		return
-	}
-	limits = tempLimits
+	limits = tempConfig.Limits
+	tubeDefaults, tubeConfigs = tempConfig.Defaults, tempConfig.Tubes
+	freezeWindows = tempConfig.Freeze
 	log.Printf("Loaded config: %s", getLimits())
 }
 
+/**
+ * Writes out config file, keeping previous version as backup
+ */
 func writeConfig() {
 	log.Printf("Writing out config file %s", cfgPath)
-	cfg, encErr := limits.PrettyJson()
-	if encErr != nil {
-		log.Printf("Error encoding limits: %v", encErr)
-		return
+	backupConfig()
+	if err := writeConfigFile(); err != nil {
+		log.Printf("Error writing config %s: %v", cfgPath, err)
 	}
-	writeErr := ioutil.WriteFile(cfgPath, cfg, 0600)
-	if writeErr != nil {
-		log.Printf("Error writing config %s: %v", cfgPath, writeErr)
+}
+
+/**
+ * Writes out config file atomically, so it is never left half written
+ */
+func writeConfigFile() error {
+	cfg, encErr := json.MarshalIndent(ConfigFile{limits, tubeDefaults, tubeConfigs, freezeWindows}, "", "  ")
+	if encErr != nil {
+		return encErr
 	}
+	return writeFileAtomic(cfgPath, cfg, 0600)
 }
 
 /**
@@ -350,9 +1144,7 @@ func switchUser() {
 		if userAccount.Uid == "0" {
 			if *runAs != "" {
 				if runAsUser, lErr := user.Lookup(*runAs); lErr == nil {
-					uid, _ := strconv.Atoi(runAsUser.Uid)
-					sErr := syscall.Setuid(uid)
-					if sErr != nil {
+					if sErr := dropPrivileges(runAsUser); sErr != nil {
 						log.Fatalf("Fatal error: could not switch to user %s: %v", *runAs, sErr)
 					}
 					log.Printf("Switched to run as user '%s'", runAsUser.Username)
@@ -373,122 +1165,340 @@ func switchUser() {
 }
 
 /**
- * Collect stats from running goroutines
+ * Switches groups, then user of all threads to account, and checks root can not be regained. Groups go first,
+ * as changing them needs root. Must be called before any connection is made or worker started
  */
-func statisticsCollector() {
-	var m Sync
-	for {
-		m = <- statsChannel
-		if _, has := stats.Runs[m.Worker]; has {
-			if m.Error {
-				stats.Errors[m.Worker]++
-			}
-			if m.Count == 1 {
-				stats.TotalRuns += 1
-				stats.Runs[m.Worker] += 1
-				stats.Running[m.Worker] += 1
-				stats.TotalRunning += 1
-			} else {
-				stats.Running[m.Worker] -= 1
-				stats.TotalRunning -= 1
-			}
-		} else {
-			log.Printf("Do not have %s in stats", m.Worker)
+func dropPrivileges(account *user.User) error {
+	uid, uErr := strconv.Atoi(account.Uid)
+	gid, gErr := strconv.Atoi(account.Gid)
+	if uErr != nil || gErr != nil {
+		return fmt.Errorf("invalid uid %s or gid %s", account.Uid, account.Gid)
+	}
+	groupIds, err := account.GroupIds()
+	if err != nil {
+		return fmt.Errorf("could not get groups: %v", err)
+	}
+	groups := []int{gid}
+	for _, groupId := range groupIds {
+		if group, err := strconv.Atoi(groupId); err == nil && group != gid {
+			groups = append(groups, group)
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	// Real, effective and saved ids are all changed by privileged setuid, so none of them may give root back
+	if syscall.Getuid() != uid || syscall.Geteuid() != uid || syscall.Getgid() != gid || syscall.Getegid() != gid {
+		return fmt.Errorf("ids are %d/%d:%d/%d after switch", syscall.Getuid(), syscall.Geteuid(), syscall.Getgid(), syscall.Getegid())
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("root privileges could be regained")
+	}
+	return nil
+}
+
+/** Run counter updates queued for collectStats before worker runners wait */
+const STATS_BUFFER = 1024
+
+/**
+ * Queues run counter update of worker that finished (Count -1) for collectStats. Does not take stateLock, which
+ * dispatch, policy scripts and config writes hold, so it blocks only while STATS_BUFFER updates are pending
+ */
+func updateStats(m Sync) {
+	statsChannel <- m
+}
+
+/**
+ * Applies queued run counter updates, all pending ones under one stateLock. Runs for the life of the daemon
+ */
+func collectStats() {
+	for m := range statsChannel {
+		stateLock.Lock()
+		applyStats(m)
+		for pending := len(statsChannel); pending > 0; pending-- {
+			applyStats(<-statsChannel)
+		}
+		stateLock.Unlock()
+	}
+}
+
+/**
+ * Updates run counters when worker starts (Count 1) or finishes (Count -1). Caller must hold stateLock
+ */
+func applyStats(m Sync) {
+	if _, has := stats.Runs[m.Worker]; !has {
+		log.Printf("Do not have %s in stats", m.Worker)
+		return
+	}
+	if m.Error {
+		stats.Errors[m.Worker]++
+	}
+	if m.Count == 1 {
+		countRun(m.Worker)
+	} else {
+		removeUnits(m.Worker)
+		stats.Running[m.Worker] -= 1
+		stats.TotalRunning -= 1
+	}
+}
+
+/**
+ * Counts worker as started and running. Caller must hold stateLock, in the same critical section capacity was
+ * checked in, or two starts could both pass the check
+ */
+func countRun(worker string) {
+	stats.TotalRuns += 1
+	stats.Runs[worker] += 1
+	stats.Running[worker] += 1
+	stats.TotalRunning += 1
+	addUnits(worker)
+}
+
+/**
+ * Derives command and response tube names from instance name, which is host name unless overridden
+ */
+func setTubeNames() string {
+	name := *instanceName
+	if name == "" {
+		hostName, errHost := os.Hostname()
+		if errHost != nil {
+			log.Fatalf("Error getting host name: %v", errHost)
 		}
+		name = hostName
 	}
+	commandTubeName = *commandPrefix + name
+	responseTubeName = *responsePrefix + name
+	stats.Instance = name
+	return name
 }
 
 /**
  * Main entry point
  */
 func main() {
-	// Use all available CPUs
-	runtime.GOMAXPROCS(runtime.NumCPU())
 	// Parse command line arguments
+	flag.Usage = usage
 	flag.Parse()
-	switchUser()
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	subcommand := findSubcommand(name)
+	if subcommand == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(subcommand.Run(name, args))
+}
+
+/**
+ * Runs the daemon
+ */
+func runDaemon(name string, args []string) int {
+	parseFlagSet(newFlagSet(name, ""), args)
+	prepareKubernetes()
+	// Pod securityContext restricts privileges in Kubernetes
+	if !*kubernetesMode {
+		restrictPrivileges()
+	}
+	loadInherited()
+	if handled, code := daemonStartup(); handled {
+		return code
+	}
+	defer releasePidFile()
+	if *orphans != "adopt" && *orphans != "kill" && *orphans != "ignore" {
+		log.Fatalf("Fatal error: invalid --orphans '%s', expected adopt, kill or ignore", *orphans)
+	}
+	startReaper()
+	// Use all available CPUs
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	if !*kubernetesMode {
+		switchUser()
+	}
 	_myDir, wErr := os.Getwd()
 	if wErr != nil {
 		log.Fatalf("Error getting current working directory: %v", wErr)
 	}
 	myDir = _myDir
 	cfgPath = os.Args[0] + ".json"
+	resolveSocketPath()
+	resolveHooksPath()
+	resolveIntegrityPaths()
+	resolveArtifactPaths()
+	resolveOutputSpillDir()
+	loadHistory()
+	if _, err := loadCommandKey(); err != nil {
+		log.Fatalf("Fatal error: %v", err)
+	}
+	if err := loadPolicy(); err != nil {
+		log.Fatalf("Fatal error: could not load policy %s: %v", *policyPath, err)
+	}
+	if err := loadPayloadKeys(); err != nil {
+		log.Fatalf("Fatal error: could not load payload keys: %v", err)
+	}
 	// Get hostname
-	hostName, errHost := os.Hostname()
-	if errHost != nil {
-		log.Fatalf("Error getting host name: %v", errHost)
-	}
-	log.Printf("Hostname is '%s'", hostName)
-	commandTubeName = INPUT_PREFIX + hostName
-	responseTubeName = OUTPUT_PREFIX + hostName
-	statsChannel = make(chan Sync)
+	instance := setTubeNames()
+	log.Printf("Instance name is '%s'", instance)
 	// Create worker command queue connection
-	commandConn = connect()
+	if _, err := beanstalkTLSConfig(); err != nil {
+		log.Fatalf("Fatal error: invalid TLS settings: %v", err)
+	}
+	initServers()
+	openBroker()
+	defer stopPlugins()
 	// Create map for running worker counts
 	stats.Running = make(map[string]uint)
+	stats.Units = make(map[string]uint)
+	stats.Backlog = make(map[string]int)
+	stats.Resident = make(map[string]uint)
+	stats.Degraded = make(map[string]string)
 	stats.Runs = make(map[string]uint64)
 	stats.Errors = make(map[string]uint64)
+	stats.Paused = make(map[string]bool)
+	stats.Replays = make(map[string]*ReplayStatus)
+	stats.DryRun = *dryRun
+	go collectStats()
+	stats.Tags = hostTags()
+	if *dryRun {
+		log.Printf("Dry run: workers will not be started")
+	}
 	stats.Limits = &limits
 	limits.Total = WORKERS_MAX
 	limits.Min = WORKERS_MIN
 	limits.Queues = make(map[string]uint)
 	// Pick up previous settings if exist
 	readConfig()
+	applyEnvLimits()
 	// Go to workers dir
 	errDir := os.Chdir(*workersPath)
 	if errDir != nil {
 		log.Fatalf("Error changing to workers directory: %v", errDir)
 	}
-	// Prepare connection pool
-	connections = make(map[string]Queue)
-	// Create response tube
-	responseTube = &beanstalk.Tube{commandConn, responseTubeName}
-	// Prepare command tube
-	commandTube = &beanstalk.TubeSet{commandConn, make(map[string]bool)}
-	commandTube.Name[commandTubeName] = true
-	commandTube.Name["default"] = false
-	log.Printf("Subscribed to command queue %s", commandTubeName)
-	go statisticsCollector()
+	if !*dryRun {
+		lockWorkersDir()
+	}
+	checkWorkersGit()
+	noteReadOnlyWorkers()
+	// Beanstalkd may come up later, connections are retried in background meanwhile
+	// Keys of signed commands come from access file
+	readAccessConfig()
+	if commandTubes() {
+		startCommandConn()
+	}
+	if *controller != "" {
+		go relayController()
+	}
+	listenControlSocket()
+	defer closeControlSocket()
+	listenGrpc()
+	defer closeGrpc()
+	listenHttp()
+	defer closeHttp()
+	initSystemd()
+	sdNotify("READY=1")
+	drainOnSignal()
+	go stallWatchdog()
+	go checkServers()
+	go refreshDNS()
+	go adjustAutoTotal()
+	go autoscaleTubes()
+	go syncFleet()
+	go sweepResponses()
+	go syncWorkersPeriodically()
+	go syncArtifacts()
+	startCluster()
+	startSharding()
+	defer startRegistration()()
+	// Subscribe before looking for workers left behind by previous instance
+	watcher()
+	completeUpgrade()
+	handleOrphans()
+	listenUpgrade()
 	// Wait for jobs. No fatals behind this point!
+	var cycle uint64
 	for {
+		// Exit when drained
+		stateLock.Lock()
+		drained := stats.Draining && stats.TotalRunning == 0 && stats.TotalResident == 0
+		expired, running := drainExpired(), stats.TotalRunning
+		reading := !handedOver
+		rewatch := watchRequested
+		watchRequested = false
+		stateLock.Unlock()
+		if drained || expired {
+			sdNotify("STOPPING=1")
+			pendingCommands.Wait()
+			if drained {
+				log.Printf("Drained, exiting")
+			} else {
+				log.Printf("Drain timed out with %d worker(s) running, exiting", running)
+			}
+			return 0
+		}
+		systemdTick()
 		// Check for available workers once in a while
-		if stats.TotalCycles%5 == 0 {
+		if cycle%5 == 0 || rewatch {
+			loopStage("watcher", "", nil)
 			watcher()
+			superviseResidents()
+			supervisePreforks()
+			superviseReservers()
+			rebalanceServers()
 		}
-		// Is there command available?
-		id, body, errCommandReserve := commandTube.Reserve(0)
-		// Process command
-		if errCommandReserve == nil {
-			commandConn.Delete(id)
-			var cmd WorkerCommand
-			errDecode := json.Unmarshal(body, &cmd)
-			if errDecode == nil {
-				go processCommand(cmd)
-			} else {
-				log.Printf("Could not parse command: %v", body)
-			}
-		} else {
-			// Timeout error is ok, other is not
-			if !strings.Contains(errCommandReserve.Error(), "timeout") {
-				log.Printf("Command error: %v", errCommandReserve)
+		// After upgrade, new process reads commands
+		if reading && commandTubes() {
+			reserveCommand()
+		}
+		// Loop over queues, most urgent first, only reading stats of tubes whose worker can be run:
+		// paused tubes and ones at their limit are skipped, all of them while total limit is reached
+		stateLock.Lock()
+		var runnable []string
+		now := time.Now()
+		var order []string
+		if stats.TotalUnits < totalLimit() || limits.Min > 0 {
+			order = dispatchOrder()
+		}
+		for _, worker := range order {
+			// Reservers dispatch their tubes themselves, idle tubes are checked less often
+			if _, reserving := reservers[worker]; !reserving && (*dryRun || !reserveMode(worker)) && pollDue(worker, now) && canRunWorker(worker) {
+				runnable = append(runnable, worker)
 			}
 		}
-		// Loop over queues
-		for worker, conn := range connections {
-			// Only read stats if worker can be run
-			if canRunWorker(worker) {
-				tubeStats, errStats := conn.tube.Stats()
-				if errStats == nil {
-					// ... and when there are jobs
-					readyJobsCount, _ := strconv.Atoi(tubeStats["current-jobs-ready"])
-					if readyJobsCount > 0 {
-						go workerRunner(worker)
-					}
+		stateLock.Unlock()
+		polled := pollStats(runnable)
+		ready := make([]int, len(runnable))
+		for i, worker := range runnable {
+			readyJobsCount, errStats := polled[i].ready, polled[i].err
+			if errStats == nil {
+				// ... and when there are jobs
+				stateLock.Lock()
+				pollResult(worker, readyJobsCount > 0, time.Now())
+				stats.Backlog[worker] = readyJobsCount
+				stateLock.Unlock()
+				if *dryRun {
+					simulateWorker(worker, readyJobsCount)
+				} else {
+					ready[i] = readyJobsCount
 				}
 			}
 		}
+		// A worker for each ready job, as limits allow, shared by weight when they do not allow all
+		dispatchFair(runnable, ready)
+		stateLock.Lock()
+		updateReadiness()
+		updateShares()
+		updateTenants()
 		stats.TotalCycles++
+		cycle = stats.TotalCycles
+		stateLock.Unlock()
 		// Be polite to system
-		time.Sleep(interval * time.Millisecond)
+		time.Sleep(*interval)
 	}
 }
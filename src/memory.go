@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("memory", func() Broker {
+		return &memoryBroker{tubes: make(map[string]*memoryTube)}
+	})
+}
+
+/**
+ * In-process backend for tests and local development: jobs live in memory of the daemon and are lost when it exits.
+ * Jobs are put with `put` command, so workers run end to end without any queue server. Behaves like beanstalkd:
+ * priority order, delay, time to run after which reserved job is ready again, and burying
+ */
+type memoryBroker struct {
+	lock   sync.Mutex // Guards tubes and jobs in them
+	tubes  map[string]*memoryTube
+	nextId uint64
+}
+
+/** Jobs of tube by id, in any state */
+type memoryTube struct {
+	jobs   map[uint64]*memoryJob
+	wakeup chan struct{} // Signalled when job gets ready
+}
+
+type memoryJob struct {
+	id       uint64
+	body     []byte
+	priority uint32
+	ttr      time.Duration
+	state    string    // "ready", "delayed", "reserved" or "buried"
+	until    time.Time // When delayed job gets ready, or reserved one runs out of time to run
+	put      time.Time
+}
+
+/**
+ * Returns tube, creating it first time. Caller must hold b.lock
+ */
+func (b *memoryBroker) tube(name string) *memoryTube {
+	tube, has := b.tubes[name]
+	if !has {
+		tube = &memoryTube{jobs: make(map[uint64]*memoryJob), wakeup: make(chan struct{}, 1)}
+		b.tubes[name] = tube
+	}
+	return tube
+}
+
+/**
+ * Makes due delayed jobs and reserved ones out of time to run ready, returns next ready job by priority, then id
+ */
+func (t *memoryTube) next(now time.Time) *memoryJob {
+	var next *memoryJob
+	for _, job := range t.jobs {
+		if (job.state == "delayed" || job.state == "reserved") && !job.until.After(now) {
+			job.state = "ready"
+		}
+		if job.state == "ready" && (next == nil || job.priority < next.priority || job.priority == next.priority && job.id < next.id) {
+			next = job
+		}
+	}
+	return next
+}
+
+/**
+ * Earliest time delayed or reserved job of tube changes state, zero when there is none
+ */
+func (t *memoryTube) nextChange() time.Time {
+	var earliest time.Time
+	for _, job := range t.jobs {
+		if (job.state == "delayed" || job.state == "reserved") && (earliest.IsZero() || job.until.Before(earliest)) {
+			earliest = job.until
+		}
+	}
+	return earliest
+}
+
+func (t *memoryTube) notify() {
+	select {
+	case t.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * Always reachable
+ */
+func (b *memoryBroker) Check() error {
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(tube string) {
+}
+
+/**
+ * Jobs are kept, subscribing again picks them up
+ */
+func (b *memoryBroker) Unsubscribe(tube string) {
+}
+
+func (b *memoryBroker) Stats(name string) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tube := b.tube(name)
+	tube.next(time.Now())
+	var ready int
+	for _, job := range tube.jobs {
+		if job.state == "ready" {
+			ready++
+		}
+	}
+	return ready, nil
+}
+
+/**
+ * Returns age of next ready job, 0 when there is none
+ */
+func (b *memoryBroker) OldestReady(name string) (time.Duration, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	if job := b.tube(name).next(now); job != nil {
+		return now.Sub(job.put), nil
+	}
+	return 0, nil
+}
+
+/**
+ * Reserves next ready job, waiting up to timeout for one to be put, released or get due
+ */
+func (b *memoryBroker) Reserve(name string, timeout time.Duration) (*ReservedJob, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		now := time.Now()
+		b.lock.Lock()
+		tube := b.tube(name)
+		if job := tube.next(now); job != nil {
+			job.state, job.until = "reserved", now.Add(job.ttr)
+			b.lock.Unlock()
+			return &ReservedJob{Id: strconv.FormatUint(job.id, 10), Body: job.body, Priority: job.priority, TTR: job.ttr, handle: job.id}, nil
+		}
+		wait := deadline
+		if change := tube.nextChange(); !change.IsZero() && change.Before(wait) {
+			wait = change
+		}
+		b.lock.Unlock()
+		if !now.Before(deadline) {
+			return nil, nil
+		}
+		timer := time.NewTimer(wait.Sub(now))
+		select {
+		case <-tube.wakeup:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (b *memoryBroker) StopReserving(tube string) {
+}
+
+/**
+ * Finds job reserved by ReservedJob and applies change to it. Takes b.lock itself
+ */
+func (b *memoryBroker) reserved(job *ReservedJob, change func(tube *memoryTube, reserved *memoryJob)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tube := b.tube(job.Tube)
+	reserved, has := tube.jobs[job.handle.(uint64)]
+	if !has || reserved.state != "reserved" {
+		return errLostReservation
+	}
+	change(tube, reserved)
+	return nil
+}
+
+func (b *memoryBroker) Touch(job *ReservedJob) error {
+	return b.reserved(job, func(tube *memoryTube, reserved *memoryJob) {
+		reserved.until = time.Now().Add(reserved.ttr)
+	})
+}
+
+func (b *memoryBroker) Delete(job *ReservedJob) error {
+	return b.reserved(job, func(tube *memoryTube, reserved *memoryJob) {
+		delete(tube.jobs, reserved.id)
+	})
+}
+
+func (b *memoryBroker) Release(job *ReservedJob) error {
+	return b.reserved(job, func(tube *memoryTube, reserved *memoryJob) {
+		reserved.state = "ready"
+		tube.notify()
+	})
+}
+
+/**
+ * Buried jobs are kept until daemon exits, they are not replayed
+ */
+func (b *memoryBroker) Bury(job *ReservedJob) error {
+	return b.reserved(job, func(tube *memoryTube, reserved *memoryJob) {
+		reserved.state = "buried"
+	})
+}
+
+func (b *memoryBroker) Put(name string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if ttr < time.Second {
+		ttr = time.Second
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nextId++
+	job := &memoryJob{id: b.nextId, body: body, priority: priority, ttr: ttr, state: "ready", put: time.Now()}
+	if delay > 0 {
+		job.state, job.until = "delayed", time.Now().Add(delay)
+	}
+	tube := b.tube(name)
+	tube.jobs[job.id] = job
+	tube.notify()
+	return strconv.FormatUint(job.id, 10), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/**
+ * Serves queue depth and workers in Prometheus text format, for HPA through Prometheus adapter and KEDA scalers.
+ * Ready jobs are read from broker at scrape time, tubes it can not tell are left out. Scrapers accepting OpenMetrics
+ * get it instead, with correlation ids of latest runs as exemplars of run and error counters
+ */
+func httpMetrics(w http.ResponseWriter, r *http.Request) {
+	if status, message := httpAuthorize(r, SCOPE_READ); status != http.StatusOK {
+		httpError(w, status, message)
+		return
+	}
+	stateLock.Lock()
+	tubes := make([]string, 0, len(subscriptions))
+	for tube := range subscriptions {
+		tubes = append(tubes, tube)
+	}
+	sort.Strings(tubes)
+	running := make([]uint, len(tubes))
+	limit := make([]uint, len(tubes))
+	runs, errors := make([]uint64, len(tubes)), make([]uint64, len(tubes))
+	runExemplar, errorExemplar := make([]exemplar, len(tubes)), make([]exemplar, len(tubes))
+	for i, tube := range tubes {
+		running[i], limit[i] = stats.Running[tube], schedulingConfig(tube).Limit
+		runs[i], errors[i] = stats.Runs[tube], stats.Errors[tube]
+		runExemplar[i], errorExemplar[i] = runExemplars[tube], errorExemplars[tube]
+	}
+	totalRunning, total, ready, draining := stats.TotalRunning, totalLimit(), stats.Ready, stats.Draining
+	stateLock.Unlock()
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	var out bytes.Buffer
+	gauge := func(name, help string) {
+		fmt.Fprintf(&out, "# HELP workerman_%s %s\n# TYPE workerman_%s gauge\n", name, help, name)
+	}
+	counter := func(name, help string) {
+		// OpenMetrics names counter family without _total suffix of its samples
+		if !openMetrics {
+			name += "_total"
+		}
+		fmt.Fprintf(&out, "# HELP workerman_%s %s\n# TYPE workerman_%s counter\n", name, help, name)
+	}
+	gauge("tube_ready_jobs", "Ready jobs waiting in tube.")
+	for _, tube := range tubes {
+		if jobs, err := broker.Stats(tube); err == nil {
+			fmt.Fprintf(&out, "workerman_tube_ready_jobs{tube=%q} %d\n", tube, jobs)
+		}
+	}
+	gauge("tube_running_workers", "Workers running for tube.")
+	for i, tube := range tubes {
+		fmt.Fprintf(&out, "workerman_tube_running_workers{tube=%q} %d\n", tube, running[i])
+	}
+	gauge("tube_limit", "Workers tube is allowed.")
+	for i, tube := range tubes {
+		fmt.Fprintf(&out, "workerman_tube_limit{tube=%q} %d\n", tube, limit[i])
+	}
+	counter("tube_runs", "Worker runs of tube since start.")
+	for i, tube := range tubes {
+		fmt.Fprintf(&out, "workerman_tube_runs_total{tube=%q} %d%s\n", tube, runs[i], runExemplar[i].format(openMetrics))
+	}
+	counter("tube_errors", "Failed worker runs of tube since start.")
+	for i, tube := range tubes {
+		fmt.Fprintf(&out, "workerman_tube_errors_total{tube=%q} %d%s\n", tube, errors[i], errorExemplar[i].format(openMetrics))
+	}
+	gauge("running_workers", "Workers running over all tubes.")
+	fmt.Fprintf(&out, "workerman_running_workers %d\n", totalRunning)
+	gauge("total_limit", "Units of workers allowed over all tubes.")
+	fmt.Fprintf(&out, "workerman_total_limit %d\n", total)
+	gauge("ready", "1 while broker connections are up.")
+	fmt.Fprintf(&out, "workerman_ready %d\n", boolMetric(ready))
+	gauge("draining", "1 while draining.")
+	fmt.Fprintf(&out, "workerman_draining %d\n", boolMetric(draining))
+	if openMetrics {
+		out.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		w.Write(out.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
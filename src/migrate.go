@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	/** Environment variables telling migration script which upgrade it is run for */
+	MIGRATE_FROM_ENV = "WORKERMAN_MIGRATE_FROM"
+	MIGRATE_TO_ENV   = "WORKERMAN_MIGRATE_TO"
+	/** Payload field holding version when Field is not set */
+	DEFAULT_VERSION_FIELD = "version"
+)
+
+/**
+ * Payload versions of tube, e.g. {"Current": 3}. Reserved payloads of older versions are upgraded one version at a
+ * time by scripts named after version they upgrade from, e.g. migrations/email/1 and migrations/email/2
+ */
+type Migration struct {
+	Field   string `json:",omitempty"` // Dotted path of payload field holding version, "version" if empty
+	Current int    // Version worker takes, payloads without version field are version 1
+	Scripts string `json:",omitempty"` // Directory of migration scripts next to config file, "migrations/<tube>" if empty
+}
+
+/**
+ * Returns payload field of version and absolute directory of migration scripts of tube
+ */
+func migrationPaths(tube string, migration *Migration) (string, string) {
+	field, scripts := migration.Field, migration.Scripts
+	if field == "" {
+		field = DEFAULT_VERSION_FIELD
+	}
+	if scripts == "" {
+		scripts = filepath.Join("migrations", tube)
+	}
+	return field, configRelative(scripts)
+}
+
+/**
+ * Returns version of payload, 1 when it has no version field
+ */
+func payloadVersion(payload map[string]interface{}, field string) (int, error) {
+	value, found := lookupField(payload, field)
+	if !found {
+		return 1, nil
+	}
+	number, isNumber := value.(json.Number)
+	if !isNumber {
+		return 0, fmt.Errorf("version field %s is not a number", field)
+	}
+	version, err := strconv.Atoi(number.String())
+	if err != nil {
+		return 0, fmt.Errorf("version %s is not an integer", number)
+	}
+	return version, nil
+}
+
+/**
+ * Upgrades opened payload of reserved job to Current version of tube, before rules, Schema, policy, hooks and worker
+ * get it. Job whose payload can not be upgraded, or is newer than worker takes, is buried so it can be replayed once
+ * migration or worker is deployed. True is returned then and worker must not be started
+ */
+func migrateJobPayload(worker string, config EffectiveConfig, job *ReservedJob) bool {
+	if config.Migration == nil {
+		return false
+	}
+	from, to, err := migratePayload(worker, config.Migration, job)
+	if err == nil {
+		if from != to {
+			log.Printf("Migrated job %s of %s from version %d to %d%s", job.Id, worker, from, to, correlationTag(job))
+			stateLock.Lock()
+			if stats.Migrated == nil {
+				stats.Migrated = make(map[string]uint64)
+			}
+			stats.Migrated[worker]++
+			stateLock.Unlock()
+		}
+		return false
+	}
+	log.Printf("Could not migrate job %s of %s, bury it: %v", job.Id, worker, err)
+	return rejectJob(worker, job, "bury", "migrate: "+err.Error())
+}
+
+/**
+ * Runs migration scripts on payload of job from its version up to current one, returns both versions
+ */
+func migratePayload(worker string, migration *Migration, job *ReservedJob) (int, int, error) {
+	field, scripts := migrationPaths(worker, migration)
+	payload, err := decodeObject(job.plain)
+	if err != nil {
+		return 0, 0, err
+	}
+	from, err := payloadVersion(payload, field)
+	if err != nil || from == migration.Current {
+		return from, from, err
+	}
+	if from > migration.Current {
+		return from, from, fmt.Errorf("payload version %d is newer than version %d worker takes", from, migration.Current)
+	}
+	body := job.plain
+	for version := from; version < migration.Current; version++ {
+		script := filepath.Join(scripts, strconv.Itoa(version))
+		out, err := runMigrationScript(script, worker, job.Id, version, body)
+		if err != nil {
+			return from, version, fmt.Errorf("migration script %s: %v", script, err)
+		}
+		if payload, err = decodeObject(out); err != nil {
+			return from, version, fmt.Errorf("migration script %s output: %v", script, err)
+		}
+		// Scripts need not bump version themselves
+		setField(payload, field, version+1)
+		if body, err = json.Marshal(payload); err != nil {
+			return from, version, err
+		}
+	}
+	job.plain = body
+	return from, migration.Current, nil
+}
+
+/**
+ * Returns JSON object of payload, numbers kept as they were written
+ */
+func decodeObject(body []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if err := decoder.Decode(&payload); err != nil || payload == nil {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	return payload, nil
+}
+
+/**
+ * Runs migration script with payload on stdin and --hook-timeout, returns upgraded payload it wrote to stdout.
+ * Stderr goes to daemon log
+ */
+func runMigrationScript(script, tube, jobId string, version int, body []byte) ([]byte, error) {
+	if _, err := os.Stat(script); err != nil {
+		return nil, fmt.Errorf("no migration from version %d", version)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &out
+	cmd.Stderr = log.Writer()
+	cmd.Env = append(os.Environ(), JOB_TUBE_ENV+"="+tube, JOB_ID_ENV+"="+jobId,
+		MIGRATE_FROM_ENV+"="+strconv.Itoa(version), MIGRATE_TO_ENV+"="+strconv.Itoa(version+1))
+	done, err := startChild(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	done()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %s timeout", *hookTimeout)
+	}
+	return out.Bytes(), err
+}
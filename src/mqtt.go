@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Jobs are published and subscribed with at least once delivery */
+const MQTT_QOS = 1
+
+func init() {
+	registerBroker("mqtt", func() Broker {
+		return &mqttBroker{tubes: make(map[string]*mqttTube)}
+	})
+}
+
+var (
+	/** MQTT broker settings for mqtt broker */
+	mqttURL        = flag.String("mqtt", "tcp://127.0.0.1:1883", "MQTT broker URL for --broker mqtt, tcp://, ssl:// or ws://, with user and password if needed. Default: tcp://127.0.0.1:1883")
+	mqttClientId   = flag.String("mqtt-client-id", "", "Client id of persistent session, must differ between instances. Default: workerman-<instance name>")
+	mqttPrefix     = flag.String("mqtt-prefix", "", "Prefix of topics, tube email is topic <prefix>email. Default: none")
+	mqttShare      = flag.String("mqtt-share", "", "Shared subscription group, instances in the same group share jobs instead of each getting all of them. Default: none")
+	mqttDeadLetter = flag.String("mqtt-dead-letter", "/dead", "Suffix of topic failed jobs are published to, empty to drop them. Default: /dead")
+)
+
+/**
+ * MQTT backend for IoT-style job sources. One client with persistent session subscribes to topic of each tube with QoS 1,
+ * so messages published while workerman was offline are delivered once it connects again. Messages are acked (PUBACK)
+ * only after worker finished, unacked ones are delivered again in next session
+ */
+type mqttBroker struct {
+	lock       sync.Mutex // Guards client and tubes
+	client     mqtt.Client
+	tubes      map[string]*mqttTube
+	subscribed map[string]bool // Topics subscribed in this process, session keeps them on broker too
+}
+
+/** Messages of tube topic waiting for reserver, handlers block until it takes them */
+type mqttTube struct {
+	messages chan mqtt.Message
+	removed  chan struct{} // Closed when tube is unsubscribed, messages are left unacked
+}
+
+func mqttWait(token mqtt.Token, action string) error {
+	if !token.WaitTimeout(DIAL_TIMEOUT) {
+		return fmt.Errorf("%s timed out", action)
+	}
+	return token.Error()
+}
+
+/**
+ * Returns client, connecting it first time. Client reconnects by itself after, resuming session. Caller must hold b.lock
+ */
+func (b *mqttBroker) connection() (mqtt.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	clientId := *mqttClientId
+	if clientId == "" {
+		clientId = "workerman-" + stats.Instance
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(*mqttURL).
+		SetClientID(clientId).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetAutoReconnect(true).
+		SetResumeSubs(true).
+		SetConnectTimeout(DIAL_TIMEOUT).
+		SetMaxReconnectInterval(RECONNECT_BACKOFF_MAX).
+		// Messages of session subscriptions may arrive before tubes subscribe again
+		SetDefaultPublishHandler(b.route).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		})
+	client := mqtt.NewClient(options)
+	if err := mqttWait(client.Connect(), "connect"); err != nil {
+		return nil, err
+	}
+	b.client = client
+	b.subscribed = make(map[string]bool)
+	return client, nil
+}
+
+/**
+ * Returns waiting messages of tube, creating it first time. Caller must hold b.lock
+ */
+func (b *mqttBroker) tube(name string) *mqttTube {
+	t, has := b.tubes[name]
+	if !has {
+		t = &mqttTube{messages: make(chan mqtt.Message), removed: make(chan struct{})}
+		b.tubes[name] = t
+	}
+	return t
+}
+
+/**
+ * Hands message over to reserver of its tube. Handlers run in goroutines of their own, so waiting blocks no other tube
+ */
+func (b *mqttBroker) route(client mqtt.Client, message mqtt.Message) {
+	b.lock.Lock()
+	t := b.tube(strings.TrimPrefix(message.Topic(), *mqttPrefix))
+	b.lock.Unlock()
+	select {
+	case t.messages <- message:
+	case <-t.removed:
+	}
+}
+
+func (b *mqttBroker) filter(tube string) string {
+	if *mqttShare != "" {
+		return "$share/" + *mqttShare + "/" + *mqttPrefix + tube
+	}
+	return *mqttPrefix + tube
+}
+
+func (b *mqttBroker) Check() error {
+	b.lock.Lock()
+	client, err := b.connection()
+	b.lock.Unlock()
+	if err == nil && !client.IsConnectionOpen() {
+		err = errors.New("not connected to MQTT broker")
+	}
+	return err
+}
+
+/**
+ * Subscription is made by reserver, so there is nothing to do until then
+ */
+func (b *mqttBroker) Subscribe(tube string) {
+}
+
+/**
+ * Removes subscription from session, so broker stops keeping messages of tube for workerman
+ */
+func (b *mqttBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	client := b.client
+	if t, has := b.tubes[tube]; has {
+		close(t.removed)
+		delete(b.tubes, tube)
+	}
+	delete(b.subscribed, tube)
+	b.lock.Unlock()
+	if client != nil {
+		if err := mqttWait(client.Unsubscribe(b.filter(tube)), "unsubscribe"); err != nil {
+			log.Printf("Could not unsubscribe %s: %v", tube, err)
+		}
+	}
+}
+
+/**
+ * Messages kept for session are not known to subscriber
+ */
+func (b *mqttBroker) Stats(tube string) (int, error) {
+	return 0, fmt.Errorf("messages of %s are not known to mqtt subscriber", tube)
+}
+
+/**
+ * Subscribes to tube topic first time, then waits for message of it
+ */
+func (b *mqttBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	b.lock.Lock()
+	client, err := b.connection()
+	t := b.tube(tube)
+	subscribed := b.subscribed[tube]
+	b.lock.Unlock()
+	if err == nil && !subscribed {
+		if err = mqttWait(client.Subscribe(b.filter(tube), MQTT_QOS, b.route), "subscribe"); err == nil {
+			b.lock.Lock()
+			b.subscribed[tube] = true
+			b.lock.Unlock()
+		}
+	}
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-t.messages:
+		tubeRecovered(tube)
+		return &ReservedJob{Id: strconv.Itoa(int(message.MessageID())), Body: message.Payload(), Priority: DEFAULT_PRIORITY, TTR: DEFAULT_TTR, handle: message}, nil
+	case <-timer.C:
+	}
+	if !client.IsConnectionOpen() {
+		err = errors.New("not connected to MQTT broker, reconnecting")
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	return nil, nil
+}
+
+func (b *mqttBroker) StopReserving(tube string) {
+}
+
+/**
+ * Unacked message stays with session as long as it is connected, there is no time to run to extend
+ */
+func (b *mqttBroker) Touch(job *ReservedJob) error {
+	return nil
+}
+
+func (b *mqttBroker) Delete(job *ReservedJob) error {
+	job.handle.(mqtt.Message).Ack()
+	return nil
+}
+
+/**
+ * MQTT can not put message back without reconnecting: job is published to tube topic again, then acked
+ */
+func (b *mqttBroker) Release(job *ReservedJob) error {
+	if _, err := b.Put(job.Tube, job.Body, job.Priority, 0, 0); err != nil {
+		return err
+	}
+	return b.Delete(job)
+}
+
+/**
+ * Publishes failed job to dead letter topic unless --mqtt-dead-letter is empty, then acks it
+ */
+func (b *mqttBroker) Bury(job *ReservedJob) error {
+	if *mqttDeadLetter != "" {
+		b.lock.Lock()
+		client := b.client
+		b.lock.Unlock()
+		topic := *mqttPrefix + job.Tube + *mqttDeadLetter
+		if err := mqttWait(client.Publish(topic, MQTT_QOS, false, job.Body), "publish to "+topic); err != nil {
+			return err
+		}
+	}
+	return b.Delete(job)
+}
+
+/**
+ * Publishes job to tube topic with QoS 1. MQTT has no delayed delivery, message ids are per session, priority and
+ * time to run are not kept
+ */
+func (b *mqttBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if delay > 0 {
+		return "", fmt.Errorf("delay is not supported by mqtt broker")
+	}
+	b.lock.Lock()
+	client, err := b.connection()
+	b.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return "", mqttWait(client.Publish(*mqttPrefix+tube, MQTT_QOS, false, body), "publish")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/nsqio/go-nsq"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("nsq", func() Broker {
+		return &nsqBroker{consumers: make(map[string]*nsqConsumer)}
+	})
+}
+
+var (
+	/** NSQ daemons for nsq broker */
+	nsqLookupd     = flag.String("nsq-lookupd", "", "nsqlookupd HTTP addresses for --broker nsq to discover nsqd of topics, comma separated. Default: none, use --nsqd")
+	nsqDaemons     = flag.String("nsqd", "127.0.0.1:4150", "nsqd TCP addresses to consume from without lookupd, first one is also published to, comma separated. Default: 127.0.0.1:4150")
+	nsqPrefix      = flag.String("nsq-prefix", "", "Prefix of topic names, tube email is topic <prefix>email. Default: none")
+	nsqChannel     = flag.String("nsq-channel", "", "Channel to consume, instances on the same channel share jobs. Default: name of worker")
+	nsqMsgTimeout  = flag.Duration("nsq-msg-timeout", DEFAULT_TTR, "Time to run: job not finished or touched for that long is delivered again. Default: 1m")
+	nsqMaxAttempts = flag.Uint("nsq-max-attempts", 5, "Deliveries of failing job before it is given up, 0 for no limit. Default: 5")
+)
+
+/**
+ * NSQ backend. Each tube is a topic consumed on channel of its worker, with max in flight following tube limit.
+ * Failed job is requeued with backoff, slowing down consumption of tube, until --nsq-max-attempts
+ */
+type nsqBroker struct {
+	lock      sync.Mutex // Guards consumers and producer
+	consumers map[string]*nsqConsumer
+	producer  *nsq.Producer
+}
+
+/**
+ * Consumer of tube topic. Handler passes messages on to reserver, so they are responded to after worker finishes
+ */
+type nsqConsumer struct {
+	tube        string
+	consumer    *nsq.Consumer
+	messages    chan *nsq.Message
+	stopped     chan struct{}
+	maxInFlight int
+}
+
+func nsqList(addresses string) []string {
+	if addresses == "" {
+		return nil
+	}
+	return strings.Split(addresses, ",")
+}
+
+func nsqConfig() *nsq.Config {
+	config := nsq.NewConfig()
+	config.DialTimeout = DIAL_TIMEOUT
+	config.MsgTimeout = *nsqMsgTimeout
+	config.MaxAttempts = uint16(*nsqMaxAttempts)
+	return config
+}
+
+/**
+ * Returns consumer of tube, connecting one first time
+ */
+func (b *nsqBroker) consumer(tube string) (*nsqConsumer, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, has := b.consumers[tube]; has {
+		return c, nil
+	}
+	channel := *nsqChannel
+	if channel == "" {
+		channel = tube
+	}
+	config := nsqConfig()
+	config.MaxInFlight = prefetchLimit(tube)
+	consumer, err := nsq.NewConsumer(*nsqPrefix+tube, channel, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer.SetLogger(log.New(log.Writer(), "", log.Flags()), nsq.LogLevelWarning)
+	c := &nsqConsumer{tube, consumer, make(chan *nsq.Message), make(chan struct{}), config.MaxInFlight}
+	consumer.AddHandler(c)
+	if lookupd := nsqList(*nsqLookupd); lookupd != nil {
+		err = consumer.ConnectToNSQLookupds(lookupd)
+	} else {
+		err = consumer.ConnectToNSQDs(nsqList(*nsqDaemons))
+	}
+	if err != nil {
+		consumer.Stop()
+		return nil, err
+	}
+	b.consumers[tube] = c
+	return c, nil
+}
+
+/**
+ * Waits for reserver to take message, requeueing it right away when consuming stopped meanwhile
+ */
+func (c *nsqConsumer) HandleMessage(message *nsq.Message) error {
+	message.DisableAutoResponse()
+	select {
+	case c.messages <- message:
+	case <-c.stopped:
+		message.RequeueWithoutBackoff(0)
+	}
+	return nil
+}
+
+/**
+ * Called instead of handler for message delivered more than --nsq-max-attempts times, message is finished after
+ */
+func (c *nsqConsumer) LogFailedMessage(message *nsq.Message) {
+	log.Printf("Giving up job %s of %s after %d attempts", message.ID[:], c.tube, message.Attempts)
+}
+
+/**
+ * Checks nsqd or nsqlookupd is reachable, publishing goes to first --nsqd either way
+ */
+func (b *nsqBroker) Check() error {
+	producer, err := b.publisher()
+	if err != nil {
+		return err
+	}
+	return producer.Ping()
+}
+
+func (b *nsqBroker) publisher() (*nsq.Producer, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.producer == nil {
+		producer, err := nsq.NewProducer(nsqList(*nsqDaemons)[0], nsqConfig())
+		if err != nil {
+			return nil, err
+		}
+		producer.SetLogger(log.New(log.Writer(), "", log.Flags()), nsq.LogLevelWarning)
+		b.producer = producer
+	}
+	return b.producer, nil
+}
+
+/**
+ * Consumer is set up by reserver, so there is nothing to do until then
+ */
+func (b *nsqBroker) Subscribe(tube string) {
+}
+
+func (b *nsqBroker) Unsubscribe(tube string) {
+}
+
+/**
+ * Depth of topic is only known to nsqd, see its HTTP /stats
+ */
+func (b *nsqBroker) Stats(tube string) (int, error) {
+	return 0, fmt.Errorf("depth of %s is not known to nsq consumer", tube)
+}
+
+/**
+ * Waits for message handed over by consumer of tube. Max in flight is changed along with tube limit. Without lookupd
+ * tube is degraded while consumer has no nsqd connection, connecting to --nsqd again; lookupd discovery reconnects by itself
+ */
+func (b *nsqBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	c, err := b.consumer(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	if maxInFlight := prefetchLimit(tube); maxInFlight != c.maxInFlight {
+		c.consumer.ChangeMaxInFlight(maxInFlight)
+		c.maxInFlight = maxInFlight
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-c.messages:
+		tubeRecovered(tube)
+		return &ReservedJob{Id: string(message.ID[:]), Body: message.Body, Priority: DEFAULT_PRIORITY, TTR: *nsqMsgTimeout, handle: message}, nil
+	case <-timer.C:
+	}
+	// With lookupd, no connection may just mean no nsqd has the topic yet
+	if c.consumer.Stats().Connections > 0 || nsqList(*nsqLookupd) != nil {
+		tubeRecovered(tube)
+		return nil, nil
+	}
+	err = fmt.Errorf("no nsqd connection for topic %s", *nsqPrefix+tube)
+	if connectErr := c.consumer.ConnectToNSQDs(nsqList(*nsqDaemons)); connectErr != nil && connectErr != nsq.ErrAlreadyConnected {
+		err = connectErr
+	}
+	tubeFailed(tube, err)
+	return nil, err
+}
+
+/**
+ * Closes consumer, messages not taken by reserver yet are requeued
+ */
+func (b *nsqBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	c := b.consumers[tube]
+	delete(b.consumers, tube)
+	b.lock.Unlock()
+	if c != nil {
+		close(c.stopped)
+		c.consumer.Stop()
+		<-c.consumer.StopChan
+	}
+}
+
+func (b *nsqBroker) Touch(job *ReservedJob) error {
+	job.handle.(*nsq.Message).Touch()
+	return nil
+}
+
+func (b *nsqBroker) Delete(job *ReservedJob) error {
+	job.handle.(*nsq.Message).Finish()
+	return nil
+}
+
+/**
+ * Requeues job with delay growing with attempts, without backing off consumption of tube
+ */
+func (b *nsqBroker) Release(job *ReservedJob) error {
+	job.handle.(*nsq.Message).RequeueWithoutBackoff(-1)
+	return nil
+}
+
+/**
+ * NSQ has nowhere to set failed job aside: it is requeued with delay growing with attempts, and consumer backs off
+ * tube meanwhile. Job delivered more than --nsq-max-attempts times is given up
+ */
+func (b *nsqBroker) Bury(job *ReservedJob) error {
+	job.handle.(*nsq.Message).Requeue(-1)
+	return nil
+}
+
+/**
+ * Publishes job to topic of tube on first --nsqd. NSQ returns no id, nor keeps priority and time to run
+ */
+func (b *nsqBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	producer, err := b.publisher()
+	if err != nil {
+		return "", err
+	}
+	if delay > 0 {
+		return "", producer.DeferredPublish(*nsqPrefix+tube, delay, body)
+	}
+	return "", producer.Publish(*nsqPrefix+tube, body)
+}
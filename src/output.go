@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	/** Bound of worker output held in memory */
+	outputMaxSize  = flag.Int("output-max-size", 1024*1024, "Worker output kept in memory and logged in bytes, rest is written to a file in --output-spill-dir. 0 for no limit. Default: 1048576")
+	outputSpillDir = flag.String("output-spill-dir", "", "Directory output beyond --output-max-size is written to, file is named in daemon log. Default: system temp directory")
+
+	/** Bounds of spill files, so a runaway worker can not fill the disk either */
+	outputSpillMaxSize = flag.Int64("output-spill-max-size", 64<<20, "Worker output written to spill file in bytes, rest is counted as lost. 0 for no limit. Default: 67108864")
+	outputSpillKeep    = flag.Int("output-spill-keep", 100, "Spill files kept in --output-spill-dir, oldest ones are removed when another is created. 0 keeps all. Default: 100")
+
+	/** One removal of old spill files at a time */
+	spillLock sync.Mutex
+)
+
+/**
+ * Captures worker output: first --output-max-size bytes in memory, the rest in spill file created on first byte beyond.
+ * Writes never fail, so worker is not affected by problems with spill file
+ */
+type outputCapture struct {
+	worker  string
+	buffer  bytes.Buffer
+	spill   *os.File
+	spilled int64
+	lost    int64 // Bytes that could not be written to spill file
+	full    bool  // Rest goes to spill file, so output stays in order
+}
+
+/**
+ * Makes spill directory absolute, must be called before changing working directory
+ */
+func resolveOutputSpillDir() {
+	if *outputSpillDir == "" {
+		return
+	}
+	if abs, err := filepath.Abs(*outputSpillDir); err == nil {
+		*outputSpillDir = abs
+	}
+}
+
+func (c *outputCapture) Write(p []byte) (int, error) {
+	written := len(p)
+	if room := *outputMaxSize - c.buffer.Len(); !c.full && (*outputMaxSize <= 0 || room >= len(p)) {
+		c.buffer.Write(p)
+		return written, nil
+	} else if !c.full {
+		cut := runeBoundary(p, room)
+		c.buffer.Write(p[:cut])
+		p, c.full = p[cut:], true
+	}
+	if c.spill == nil && c.lost == 0 {
+		removeOldSpills()
+		file, err := ioutil.TempFile(*outputSpillDir, "workerman-"+strings.Replace(c.worker, "/", "_", -1)+"-*.out")
+		if err != nil {
+			log.Printf("Could not create spill file for output of %s: %v", c.worker, err)
+		}
+		c.spill = file
+	}
+	if c.spill == nil {
+		c.lost += int64(len(p))
+		return written, nil
+	}
+	if room := *outputSpillMaxSize - c.spilled; *outputSpillMaxSize > 0 && room < int64(len(p)) {
+		if room < 0 {
+			room = 0
+		}
+		c.lost += int64(len(p)) - room
+		p = p[:room]
+	}
+	n, err := c.spill.Write(p)
+	c.spilled += int64(n)
+	if err != nil {
+		c.lost += int64(len(p) - n)
+	}
+	return written, nil
+}
+
+/**
+ * Removes oldest spill files of workers, leaving room for one more within --output-spill-keep
+ */
+func removeOldSpills() {
+	if *outputSpillKeep <= 0 {
+		return
+	}
+	spillLock.Lock()
+	defer spillLock.Unlock()
+	dir := *outputSpillDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "workerman-*.out"))
+	if len(paths) < *outputSpillKeep {
+		return
+	}
+	modified := make(map[string]int64, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime().UnixNano()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modified[paths[i]] < modified[paths[j]] })
+	for _, path := range paths[:len(paths)-*outputSpillKeep+1] {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove old spill file %s: %v", path, err)
+		}
+	}
+}
+
+/**
+ * Closes spill file and returns output for log, with where the rest of it went
+ */
+func (c *outputCapture) finish() string {
+	text := loggableOutput(c.buffer.Bytes())
+	if c.spill != nil {
+		c.spill.Close()
+		text += fmt.Sprintf("... (%d more bytes in %s)", c.spilled, c.spill.Name())
+	}
+	if c.lost > 0 {
+		text += fmt.Sprintf("... (%d bytes lost)", c.lost)
+	}
+	return text
+}
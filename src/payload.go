@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+/** Envelope format version, and how many KMS-unwrapped data keys are kept */
+const (
+	PAYLOAD_ENVELOPE_VERSION = 1
+	PAYLOAD_DATA_KEYS_MAX    = 256
+)
+
+var (
+	/** Keys encrypted job bodies are opened with */
+	payloadKeysFile  = flag.String("payload-keys", "", "JSON file of shared payload keys by id, base64 encoded 32 bytes each, e.g. {\"2026-10\": \"...\"}. Default: none")
+	payloadKMSRegion = flag.String("payload-kms-region", "", "AWS region of KMS keys data keys of payloads are wrapped with. Default: from AWS_REGION or AWS config")
+
+	payloadKeys map[string][]byte
+
+	/** KMS could not unwrap data key, job is released rather than buried */
+	errDataKeyUnavailable = errors.New("data key unavailable")
+
+	payloadLock sync.Mutex
+	dataKeys    = make(map[string][]byte) // Unwrapped data keys by wrapped key, guarded by payloadLock
+	kmsClient   *kms.Client               // Created on first wrapped data key, guarded by payloadLock
+)
+
+/**
+ * Encrypted job body as producers put it, see client.EncryptPayload. Body is sealed with AES-256-GCM and KeyId as
+ * additional data, either with shared key KeyId of --payload-keys or with DataKey, which KMS key KeyId wraps
+ */
+type PayloadEnvelope struct {
+	WorkermanEnvelope int    // Format version, 1
+	KeyId             string // Shared key id, or KMS key id or ARN when DataKey is set
+	DataKey           []byte `json:",omitempty"` // Data key encrypted by KMS
+	Nonce             []byte
+	Ciphertext        []byte
+}
+
+/**
+ * Loads shared payload keys, if configured. Must be called before changing working directory
+ */
+func loadPayloadKeys() error {
+	if *payloadKeysFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*payloadKeysFile)
+	if err != nil {
+		return err
+	}
+	var encoded map[string]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("could not parse %s: %v", *payloadKeysFile, err)
+	}
+	payloadKeys = make(map[string][]byte, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("payload key %s is not base64 encoded 32 bytes", id)
+		}
+		payloadKeys[id] = key
+	}
+	log.Printf("Loaded %d payload key(s) from %s", len(payloadKeys), *payloadKeysFile)
+	return nil
+}
+
+/**
+ * Returns body for worker: opened envelope, or body as is when it is not encrypted
+ */
+func openPayload(body []byte) ([]byte, error) {
+	if !bytes.Contains(body, []byte(`"WorkermanEnvelope"`)) {
+		return body, nil
+	}
+	var envelope PayloadEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.WorkermanEnvelope == 0 {
+		// Not an envelope, just mentions one
+		return body, nil
+	}
+	if envelope.WorkermanEnvelope != PAYLOAD_ENVELOPE_VERSION {
+		return nil, fmt.Errorf("unknown envelope version %d", envelope.WorkermanEnvelope)
+	}
+	var key []byte
+	if envelope.DataKey != nil {
+		var err error
+		if key, err = unwrapDataKey(envelope.KeyId, envelope.DataKey); err != nil {
+			return nil, fmt.Errorf("%w: could not unwrap with %s: %v", errDataKeyUnavailable, envelope.KeyId, err)
+		}
+	} else if key = payloadKeys[envelope.KeyId]; key == nil {
+		return nil, fmt.Errorf("unknown payload key %s", envelope.KeyId)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plain, err := gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, []byte(envelope.KeyId))
+	if err != nil {
+		return nil, errors.New("payload does not decrypt with its key")
+	}
+	return plain, nil
+}
+
+/**
+ * Decrypts data key with KMS, reusing keys unwrapped before so jobs sharing a data key cost one KMS call
+ */
+func unwrapDataKey(keyId string, wrapped []byte) ([]byte, error) {
+	cacheKey := keyId + ":" + string(wrapped)
+	payloadLock.Lock()
+	key, has := dataKeys[cacheKey]
+	client := kmsClient
+	payloadLock.Unlock()
+	if has {
+		return key, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	if client == nil {
+		var options []func(*config.LoadOptions) error
+		if *payloadKMSRegion != "" {
+			options = append(options, config.WithRegion(*payloadKMSRegion))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("could not load AWS config: %v", err)
+		}
+		client = kms.NewFromConfig(cfg)
+		payloadLock.Lock()
+		kmsClient = client
+		payloadLock.Unlock()
+	}
+	output, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrapped, KeyId: aws.String(keyId)})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Plaintext) != 32 {
+		return nil, errors.New("data key is not 32 bytes")
+	}
+	payloadLock.Lock()
+	if len(dataKeys) >= PAYLOAD_DATA_KEYS_MAX {
+		// Producers rotate data keys, so old ones are dropped wholesale rather than tracked
+		dataKeys = make(map[string][]byte)
+	}
+	dataKeys[cacheKey] = output.Plaintext
+	payloadLock.Unlock()
+	return output.Plaintext, nil
+}
+
+/**
+ * Opens encrypted body of reserved job, or payload fetched for its claim check, for worker, hooks and policy. Job that
+ * can not be opened is buried, or released when KMS could not be reached, true is returned then and worker must not be
+ * started. Job body itself stays encrypted, so released or routed job does
+ */
+func openJobPayload(worker string, job *ReservedJob) bool {
+	body := job.Body
+	if job.plain != nil {
+		body = job.plain
+	}
+	plain, err := openPayload(body)
+	if err == nil {
+		job.plain = plain
+		return false
+	}
+	outcome := "bury"
+	if errors.Is(err, errDataKeyUnavailable) {
+		outcome = "release"
+	}
+	log.Printf("Could not open payload of job %s of %s, %s it: %v", job.Id, worker, outcome, err)
+	return rejectJob(worker, job, outcome, "payload: "+err.Error())
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/** Environment variable plugins check to know they are started by workerman, like go-plugin magic cookie */
+	PLUGIN_COOKIE_ENV = "WORKERMAN_PLUGIN"
+	PLUGIN_COOKIE     = "workerman-plugin-v1"
+	/** Version of handshake and services, first field of handshake line */
+	PLUGIN_PROTOCOL_VERSION = "1"
+	/** How long plugin may take to print handshake, or to exit after its stdin is closed */
+	PLUGIN_START_TIMEOUT    = 10 * time.Second
+	PLUGIN_STOP_TIMEOUT     = time.Second
+	PLUGIN_BROKER_SERVICE   = "workerman.Broker"
+	PLUGIN_HOOK_SERVICE     = "workerman.Hook"
+	PLUGIN_NOTIFIER_SERVICE = "workerman.Notifier"
+)
+
+var (
+	/** Directory of plugin executables */
+	pluginsPath = flag.String("plugins", "", "Directory with plugin executables, broker-<name> adds --broker <name>, hook-<name> adds job hook, notifier-<name> gets daemon events. Default: none")
+
+	/** Plugin could not be started or reached, job is released rather than failed */
+	errPluginUnavailable = errors.New("plugin unavailable")
+
+	/** Discovered plugins by file name */
+	plugins     = make(map[string]*plugin)
+	pluginsOnce sync.Once
+)
+
+/**
+ * Plugin process serving gRPC, with JSON codec like control API, on address it printed in handshake.
+ * Started on first call and again on call after it exited
+ */
+type plugin struct {
+	name   string
+	kind   string // "broker", "hook" or "notifier"
+	path   string
+	lock   sync.Mutex // Guards process state below
+	conn   *grpc.ClientConn
+	stdin  io.WriteCloser
+	cmd    *exec.Cmd
+	exited chan struct{} // Closed when running process exits
+}
+
+/** Job as it goes between workerman and broker plugin */
+type PluginJob struct {
+	Tube     string
+	Id       string   `json:",omitempty"`
+	Body     []byte   `json:",omitempty"`
+	Priority uint32   `json:",omitempty"`
+	TTR      Duration `json:",omitempty"`
+	Delay    Duration `json:",omitempty"` // Put only
+	Handle   string   `json:",omitempty"` // Reservation as plugin keeps it, given back with job operations
+}
+
+/** Reserve request, and Stats response in Ready */
+type PluginTube struct {
+	Tube    string
+	Timeout Duration `json:",omitempty"`
+	Ready   int      `json:",omitempty"`
+}
+
+/** Reserve response, no job when timeout passed */
+type PluginReserved struct {
+	Job *PluginJob `json:",omitempty"`
+}
+
+/** Failed call of hook plugin */
+type PluginFailure struct {
+	Run   *HookRun
+	Error string
+}
+
+/**
+ * Finds plugins in --plugins directory once, registering brokers, hooks and notifiers they provide. Path is made absolute,
+ * so it must be called before changing working directory
+ */
+func discoverPlugins() {
+	pluginsOnce.Do(func() {
+		if *pluginsPath == "" {
+			return
+		}
+		dir, err := filepath.Abs(*pluginsPath)
+		if err != nil {
+			dir = *pluginsPath
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("Could not read plugins directory: %v", err)
+			return
+		}
+		for _, file := range files {
+			parts := strings.SplitN(file.Name(), "-", 2)
+			if file.IsDir() || len(parts) != 2 || parts[1] == "" || file.Mode()&0111 == 0 {
+				continue
+			}
+			p := &plugin{name: parts[1], kind: parts[0], path: filepath.Join(dir, file.Name())}
+			switch p.kind {
+			case "broker":
+				if _, builtin := brokers[p.name]; builtin {
+					log.Printf("Plugin %s skipped, broker %s is built in", file.Name(), p.name)
+					continue
+				}
+				registerBroker(p.name, func() Broker {
+					return &pluginBroker{p}
+				})
+			case "hook":
+				registerHook("plugin "+p.name, &pluginHook{p})
+			case "notifier":
+				go p.notify(listenEvents())
+			default:
+				continue
+			}
+			plugins[file.Name()] = p
+			log.Printf("Found %s plugin %s", p.kind, p.name)
+		}
+	})
+}
+
+/**
+ * Stops plugin processes: closes their stdin, kills ones still running after PLUGIN_STOP_TIMEOUT
+ */
+func stopPlugins() {
+	for _, p := range plugins {
+		p.lock.Lock()
+		if p.cmd != nil {
+			p.stdin.Close()
+			select {
+			case <-p.exited:
+			case <-time.After(PLUGIN_STOP_TIMEOUT):
+				p.cmd.Process.Kill()
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+/**
+ * Returns connection to plugin, starting it when not running. Caller must hold p.lock
+ */
+func (p *plugin) client() (*grpc.ClientConn, error) {
+	if p.conn != nil {
+		select {
+		case <-p.exited:
+			p.conn.Close()
+			p.stdin.Close()
+			p.conn, p.cmd = nil, nil
+		default:
+			return p.conn, nil
+		}
+	}
+	cmd := exec.Command(p.path)
+	cmd.Env = append(os.Environ(), PLUGIN_COOKIE_ENV+"="+PLUGIN_COOKIE)
+	cmd.Stderr = log.Writer()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	done, err := startChild(cmd)
+	if err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		done()
+		log.Printf("Plugin %s-%s exited: %v", p.kind, p.name, err)
+		close(exited)
+	}()
+	address, err := p.handshake(bufio.NewReader(stdout), exited)
+	var conn *grpc.ClientConn
+	if err == nil {
+		conn, err = grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.CallContentSubtype("json")))
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return nil, fmt.Errorf("plugin %s-%s: %v", p.kind, p.name, err)
+	}
+	p.conn, p.stdin, p.cmd, p.exited = conn, stdin, cmd, exited
+	return conn, nil
+}
+
+/**
+ * Reads handshake line "1|<kind>|unix|<socket path>|grpc" or "1|<kind>|tcp|<addr:port>|grpc" plugin prints first,
+ * returns gRPC target. Rest of output goes to log
+ */
+func (p *plugin) handshake(stdout *bufio.Reader, exited chan struct{}) (string, error) {
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := stdout.ReadString('\n')
+		lines <- strings.TrimSpace(line)
+		for {
+			line, err := stdout.ReadString('\n')
+			if line != "" {
+				log.Printf("Plugin %s-%s: %s", p.kind, p.name, strings.TrimRight(line, "\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var line string
+	select {
+	case line = <-lines:
+	case <-exited:
+		return "", errors.New("exited before handshake")
+	case <-time.After(PLUGIN_START_TIMEOUT):
+		return "", fmt.Errorf("no handshake within %s", PLUGIN_START_TIMEOUT)
+	}
+	fields := strings.Split(line, "|")
+	if len(fields) != 5 || fields[0] != PLUGIN_PROTOCOL_VERSION || fields[1] != p.kind || fields[4] != "grpc" {
+		return "", fmt.Errorf("unexpected handshake '%s', expected '%s|%s|unix|<path>|grpc'", line, PLUGIN_PROTOCOL_VERSION, p.kind)
+	}
+	switch fields[2] {
+	case "unix":
+		return "unix://" + fields[3], nil
+	case "tcp":
+		return fields[3], nil
+	}
+	return "", fmt.Errorf("unsupported network '%s' in handshake", fields[2])
+}
+
+/**
+ * Calls method of plugin service, waiting up to DIAL_TIMEOUT after given wait
+ */
+func (p *plugin) invoke(method string, wait time.Duration, request, response interface{}) error {
+	p.lock.Lock()
+	conn, err := p.client()
+	p.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPluginUnavailable, err)
+	}
+	service := PLUGIN_BROKER_SERVICE
+	switch p.kind {
+	case "hook":
+		service = PLUGIN_HOOK_SERVICE
+	case "notifier":
+		service = PLUGIN_NOTIFIER_SERVICE
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait+DIAL_TIMEOUT)
+	defer cancel()
+	if response == nil {
+		response = &struct{}{}
+	}
+	err = conn.Invoke(ctx, "/"+service+"/"+method, request, response)
+	if status.Code(err) == codes.Unavailable {
+		return fmt.Errorf("%w: %v", errPluginUnavailable, err)
+	}
+	return err
+}
+
+/**
+ * Calls Notify of notifier plugin with each event deliverEvent publishes, events are dropped while it falls behind,
+ * like for other listeners. Failures are logged once until plugin takes events again
+ */
+func (p *plugin) notify(events chan Event) {
+	failing := false
+	for event := range events {
+		err := p.invoke("Notify", 0, &event, nil)
+		if err != nil && !failing {
+			log.Printf("Could not notify plugin %s-%s of events: %v", p.kind, p.name, err)
+		} else if err == nil && failing {
+			log.Printf("Notifying plugin %s-%s of events again", p.kind, p.name)
+		}
+		failing = err != nil
+	}
+}
+
+/**
+ * Broker provided by plugin, each Broker method is a call of workerman.Broker service
+ */
+type pluginBroker struct {
+	plugin *plugin
+}
+
+func (b *pluginBroker) Check() error {
+	return b.plugin.invoke("Check", 0, &struct{}{}, nil)
+}
+
+func (b *pluginBroker) Subscribe(tube string) {
+	if err := b.plugin.invoke("Subscribe", 0, &PluginTube{Tube: tube}, nil); err != nil {
+		tubeFailed(tube, err)
+	}
+}
+
+func (b *pluginBroker) Unsubscribe(tube string) {
+	if err := b.plugin.invoke("Unsubscribe", 0, &PluginTube{Tube: tube}, nil); err != nil {
+		log.Printf("Could not unsubscribe %s: %v", tube, err)
+	}
+}
+
+func (b *pluginBroker) Stats(tube string) (int, error) {
+	var response PluginTube
+	if err := b.plugin.invoke("Stats", 0, &PluginTube{Tube: tube}, &response); err != nil {
+		tubeFailed(tube, err)
+		return 0, err
+	}
+	return response.Ready, nil
+}
+
+func (b *pluginBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	var response PluginReserved
+	if err := b.plugin.invoke("Reserve", timeout, &PluginTube{Tube: tube, Timeout: Duration{timeout}}, &response); err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	if response.Job == nil {
+		return nil, nil
+	}
+	job := response.Job
+	if job.TTR.Duration <= 0 {
+		job.TTR.Duration = DEFAULT_TTR
+	}
+	return &ReservedJob{Id: job.Id, Body: job.Body, Priority: job.Priority, TTR: job.TTR.Duration, handle: job.Handle}, nil
+}
+
+func (b *pluginBroker) StopReserving(tube string) {
+	if err := b.plugin.invoke("StopReserving", 0, &PluginTube{Tube: tube}, nil); err != nil {
+		log.Printf("Could not stop reserving %s: %v", tube, err)
+	}
+}
+
+/**
+ * Calls job operation, NotFound status means reservation is lost
+ */
+func (b *pluginBroker) operation(method string, job *ReservedJob) error {
+	err := b.plugin.invoke(method, 0, &PluginJob{Tube: job.Tube, Id: job.Id, Handle: job.handle.(string)}, nil)
+	if status.Code(err) == codes.NotFound {
+		return errLostReservation
+	}
+	return err
+}
+
+func (b *pluginBroker) Touch(job *ReservedJob) error {
+	return b.operation("Touch", job)
+}
+
+func (b *pluginBroker) Delete(job *ReservedJob) error {
+	return b.operation("Delete", job)
+}
+
+func (b *pluginBroker) Release(job *ReservedJob) error {
+	return b.operation("Release", job)
+}
+
+func (b *pluginBroker) Bury(job *ReservedJob) error {
+	return b.operation("Bury", job)
+}
+
+func (b *pluginBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	var response PluginJob
+	err := b.plugin.invoke("Put", 0, &PluginJob{Tube: tube, Body: body, Priority: priority, TTR: Duration{ttr}, Delay: Duration{delay}}, &response)
+	return response.Id, err
+}
+
+/**
+ * Job hook provided by plugin, methods it does not implement are skipped
+ */
+type pluginHook struct {
+	plugin *plugin
+}
+
+/**
+ * Body of run returned by plugin replaces job body, unless empty
+ */
+func (h *pluginHook) Before(run *HookRun) error {
+	var response HookRun
+	err := h.plugin.invoke("Before", 0, run, &response)
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err == nil && len(response.Body) > 0 && run.JobId != "" {
+		run.Body = response.Body
+	}
+	return err
+}
+
+func (h *pluginHook) Completed(run *HookRun) {
+	if err := h.plugin.invoke("Completed", 0, run, nil); err != nil && status.Code(err) != codes.Unimplemented {
+		log.Printf("Completed hook of %s:%d failed: %v", run.Tube, run.Run, err)
+	}
+}
+
+func (h *pluginHook) Failed(run *HookRun, failure error) {
+	if err := h.plugin.invoke("Failed", 0, &PluginFailure{run, failure.Error()}, nil); err != nil && status.Code(err) != codes.Unimplemented {
+		log.Printf("Failed hook of %s:%d failed: %v", run.Tube, run.Run, err)
+	}
+}
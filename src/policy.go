@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+/** Policy call is stopped after that many steps, so a runaway loop can not stall dispatch */
+const POLICY_MAX_STEPS = 100000
+
+var (
+	/** Starlark script with dispatch, routing and failure policy */
+	policyPath = flag.String("policy", "", "Starlark script defining can_run, on_job and on_failure policy functions, any may be left out. Default: none")
+
+	/** Globals of loaded policy script, frozen so calls may run concurrently */
+	policyGlobals starlark.StringDict
+
+	policyLock   sync.Mutex
+	policyErrors = make(map[string]string) // Last error of each policy function, guarded by policyLock
+)
+
+/**
+ * Loads and runs policy script once, keeping functions it defines. Must be called before changing working directory
+ */
+func loadPolicy() error {
+	if *policyPath == "" {
+		return nil
+	}
+	globals, err := starlark.ExecFile(policyThread("load"), *policyPath, nil, starlark.StringDict{"json": json.Module})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"can_run", "on_job", "on_failure"} {
+		if fn, has := globals[name]; has {
+			if _, callable := fn.(starlark.Callable); !callable {
+				return fmt.Errorf("%s is %s, not a function", name, fn.Type())
+			}
+		}
+	}
+	policyGlobals = globals
+	return nil
+}
+
+func policyThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{Name: name, Print: func(_ *starlark.Thread, msg string) {
+		log.Printf("Policy %s: %s", name, msg)
+	}}
+	thread.SetMaxExecutionSteps(POLICY_MAX_STEPS)
+	return thread
+}
+
+/**
+ * Calls policy function if script defines it. Errors are logged once until they change or the function succeeds,
+ * false is returned then, so callers fall back to what they would do without policy
+ */
+func callPolicy(function string, args ...starlark.Value) (starlark.Value, bool) {
+	fn, has := policyGlobals[function]
+	if !has {
+		return nil, false
+	}
+	result, err := starlark.Call(policyThread(function), fn, args, nil)
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	if err != nil {
+		if policyErrors[function] != err.Error() {
+			policyErrors[function] = err.Error()
+			log.Printf("Policy %s failed, ignoring it: %v", function, err)
+		}
+		return nil, false
+	}
+	delete(policyErrors, function)
+	return result, true
+}
+
+/**
+ * Job as policy functions see it, body as string so scripts can json.decode it, opened if it was encrypted
+ */
+func policyJobValue(job *ReservedJob) starlark.Value {
+	body := job.Body
+	if job.plain != nil {
+		body = job.plain
+	}
+	value := starlark.NewDict(4)
+	value.SetKey(starlark.String("id"), starlark.String(job.Id))
+	value.SetKey(starlark.String("tube"), starlark.String(job.Tube))
+	value.SetKey(starlark.String("body"), starlark.String(body))
+	value.SetKey(starlark.String("priority"), starlark.MakeInt64(int64(job.Priority)))
+	return value
+}
+
+/**
+ * Asks can_run(tube, running, limit) if another worker of tube may start now that limits allow it.
+ * Called under stateLock, so script must stay quick
+ */
+func policyCanRun(tube string, running, limit uint) bool {
+	result, ok := callPolicy("can_run", starlark.String(tube), starlark.MakeUint(running), starlark.MakeUint(limit))
+	return !ok || bool(result.Truth())
+}
+
+/**
+ * Asks on_job(job) what to do with reserved job: None or True runs it, False or "skip" deletes it unrun,
+ * "bury" and "release" hand it back, "route:<tube>" puts it into another tube and deletes it here
+ */
+func policyJob(job *ReservedJob) string {
+	result, ok := callPolicy("on_job", policyJobValue(job))
+	if !ok {
+		return "run"
+	}
+	switch value := result.(type) {
+	case starlark.NoneType:
+		return "run"
+	case starlark.Bool:
+		if value {
+			return "run"
+		}
+		return "skip"
+	case starlark.String:
+		action := string(value)
+		if action == "run" || action == "skip" || action == "bury" || action == "release" ||
+			strings.HasPrefix(action, "route:") && len(action) > len("route:") {
+			return action
+		}
+	}
+	log.Printf("Policy on_job returned %s for job %s of %s, running it", result, job.Id, job.Tube)
+	return "run"
+}
+
+/**
+ * Handles reserved job as on_job policy says, unless it says to run it. Returns true when job is done with,
+ * worker must not be started for it then
+ */
+func applyJobPolicy(worker string, job *ReservedJob) bool {
+	action := policyJob(job)
+	switch {
+	case action == "run":
+		return false
+	case strings.HasPrefix(action, "route:"):
+		target := strings.TrimPrefix(action, "route:")
+		if err := checkRouteTarget(worker, target); err != nil {
+			log.Printf("Policy can not route job %s of %s to %s: %v, bury it", job.Id, worker, target, err)
+			return rejectJob(worker, job, "bury", fmt.Sprintf("policy: can not route to %s: %v", target, err))
+		}
+		id, err := broker.Put(target, job.Body, job.Priority, 0, job.TTR)
+		if err != nil {
+			log.Printf("Could not route job %s of %s to %s: %v", job.Id, worker, target, err)
+			return rejectJob(worker, job, "release", "")
+		}
+		log.Printf("Policy routed job %s of %s to %s as %s", job.Id, worker, target, id)
+		// Routed claim check still refers to its object
+		job.claim = nil
+		return rejectJob(worker, job, "delete", "")
+	case action == "skip":
+		log.Printf("Policy skipped job %s of %s", job.Id, worker)
+		return rejectJob(worker, job, "delete", "")
+	default:
+		log.Printf("Policy asked to %s job %s of %s", action, job.Id, worker)
+		return rejectJob(worker, job, action, "")
+	}
+}
+
+/**
+ * Checks tube on_job routes job of worker to is one put could publish into: valid name, subscribed, and with
+ * --tenants of the same tenant, so a policy can not move jobs between tenants
+ */
+func checkRouteTarget(worker, target string) error {
+	if err := checkTubeName(target); err != nil {
+		return err
+	}
+	if tenantOf(target) != tenantOf(worker) {
+		return fmt.Errorf("tube is not of tenant '%s'", tenantOf(worker))
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !subscriptions[target] {
+		return fmt.Errorf("tube '%s' is not subscribed", target)
+	}
+	return nil
+}
+
+/**
+ * Asks on_failure(job, error, exit_code) how to finish failed job: "bury", "release" or "delete".
+ * Exit code is -1 when worker did not exit by itself. Returns outcome unchanged when script has no say
+ */
+func policyFailure(job *ReservedJob, failure error, outcome string) string {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	var preforkErr *preforkError
+	if errors.As(failure, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if errors.As(failure, &preforkErr) {
+		exitCode = preforkErr.exit
+	}
+	result, ok := callPolicy("on_failure", policyJobValue(job), starlark.String(failure.Error()), starlark.MakeInt(exitCode))
+	if !ok {
+		return outcome
+	}
+	if action, isString := starlark.AsString(result); isString && (action == "bury" || action == "release" || action == "delete") {
+		return action
+	} else if result != starlark.None {
+		log.Printf("Policy on_failure returned %s for job %s of %s, ignoring it", result, job.Id, job.Tube)
+	}
+	return outcome
+}
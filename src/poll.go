@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+/** Polling backoff of idle tube */
+type pollState struct {
+	delay time.Duration
+	next  time.Time
+}
+
+var (
+	/** Longest interval between checks of idle tube */
+	idleBackoff = flag.Duration("idle-backoff", time.Second, "Longest interval between checks of tube without ready jobs, doubled from --interval while it stays idle. 0 disables backoff. Default: 1s")
+	/** Tube stats requested at once */
+	pollConcurrency = flag.Int("poll-concurrency", 8, "Number of tubes whose stats are requested at once each cycle, 1 polls them one by one. Default: 8")
+
+	/** Backoff of polled tubes, command tube included. Guarded by stateLock */
+	polling = make(map[string]*pollState)
+)
+
+/**
+ * Checks if tube is to be polled in this cycle
+ */
+func pollDue(tube string, now time.Time) bool {
+	state, has := polling[tube]
+	return !has || !now.Before(state.next)
+}
+
+/**
+ * Records poll result: idle tube is polled less and less often up to --idle-backoff, activity snaps it back
+ */
+func pollResult(tube string, active bool, now time.Time) {
+	if active || *idleBackoff <= 0 {
+		delete(polling, tube)
+		return
+	}
+	state, has := polling[tube]
+	if !has {
+		state = &pollState{delay: *interval}
+		if state.delay <= 0 {
+			state.delay = DEFAULT_INTERVAL
+		}
+		polling[tube] = state
+	} else if state.delay *= 2; state.delay > *idleBackoff {
+		state.delay = *idleBackoff
+	}
+	state.next = now.Add(state.delay + pollStagger(tube, state.delay))
+}
+
+/**
+ * Returns offset of tube within delay, up to a quarter of it, so that tubes which went idle together
+ * do not keep being polled in the same cycle. Fixed per tube, so schedules stay spread
+ */
+func pollStagger(tube string, delay time.Duration) time.Duration {
+	spread := delay / 4
+	if spread <= 0 {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(tube))
+	return time.Duration(hash.Sum32()) % spread
+}
+
+/** Ready jobs count of polled tube, or why it could not be read */
+type tubeStats struct {
+	ready int
+	err   error
+}
+
+/**
+ * Reads ready jobs count of tubes, up to --poll-concurrency at once. Results are in order of tubes,
+ * so callers still act on them most urgent first
+ */
+func pollStats(tubes []string) []tubeStats {
+	results := make([]tubeStats, len(tubes))
+	parallel := *pollConcurrency
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	var wait sync.WaitGroup
+	for i, tube := range tubes {
+		slots <- struct{}{}
+		wait.Add(1)
+		go func(i int, tube string) {
+			defer wait.Done()
+			defer func() { <-slots }()
+			loopStage("tube stats", tube, nil)
+			// Broker takes care of broken connections
+			results[i].ready, results[i].err = broker.Stats(tube)
+			pollFinished(tube)
+		}(i, tube)
+	}
+	wait.Wait()
+	return results
+}
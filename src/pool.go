@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"github.com/kr/beanstalk"
+)
+
+var (
+	/** Number of connections shared by tubes, per server */
+	poolSize = flag.Int("pool-size", 4, "Number of beanstalkd connections shared by subscribed tubes, per server, 0 for a connection per tube. Default: 4")
+
+	/** Pooled connections by server, guarded by stateLock */
+	pool = make(map[string][]*beanstalk.Conn)
+
+	/** Server of each tube connection, guarded by stateLock */
+	connServer = make(map[*beanstalk.Conn]string)
+)
+
+/**
+ * Returns connection to server for tube: least used pooled one, or new one while pool is not full.
+ * Tries to connect once. Takes stateLock itself
+ *
+ * Tube stats are requested by tube name, so tubes share connection without use/watch switching.
+ */
+func tubeConnOn(address string) (*beanstalk.Conn, error) {
+	stateLock.Lock()
+	if conn := pooledConn(address); conn != nil {
+		stateLock.Unlock()
+		return conn, nil
+	}
+	stateLock.Unlock()
+	conn, err := dialServer(address)
+	if err != nil {
+		return nil, err
+	}
+	stateLock.Lock()
+	addConn(conn, address)
+	stateLock.Unlock()
+	return conn, nil
+}
+
+/**
+ * Returns pooled connection to server with fewest tubes, nil while pool is not full. Caller must hold stateLock
+ */
+func pooledConn(address string) *beanstalk.Conn {
+	if *poolSize <= 0 || len(pool[address]) < *poolSize {
+		return nil
+	}
+	used := make(map[*beanstalk.Conn]int)
+	for _, queue := range connections {
+		used[queue.conn]++
+	}
+	best := pool[address][0]
+	for _, conn := range pool[address][1:] {
+		if used[conn] < used[best] {
+			best = conn
+		}
+	}
+	return best
+}
+
+/**
+ * Records new tube connection, pooling it unless pool is disabled. Caller must hold stateLock
+ */
+func addConn(conn *beanstalk.Conn, address string) {
+	connServer[conn] = address
+	if *poolSize > 0 {
+		pool[address] = append(pool[address], conn)
+	}
+}
+
+/**
+ * Forgets connection, removing it from pool. Caller must hold stateLock
+ */
+func dropConn(conn *beanstalk.Conn) {
+	address := connServer[conn]
+	delete(connServer, conn)
+	for i, candidate := range pool[address] {
+		if candidate == conn {
+			pool[address] = append(pool[address][:i:i], pool[address][i+1:]...)
+			break
+		}
+	}
+	if len(pool[address]) == 0 {
+		delete(pool, address)
+	}
+}
+
+/**
+ * Closes connection no tube uses anymore, pool gets new one when needed. Caller must hold stateLock
+ */
+func releaseConn(conn *beanstalk.Conn) {
+	if conn != nil && len(tubesOf(conn)) == 0 && !recovering[conn] {
+		dropConn(conn)
+		conn.Close()
+	}
+}
+
+/**
+ * Returns tubes sharing connection, caller must hold stateLock
+ */
+func tubesOf(conn *beanstalk.Conn) []string {
+	var tubes []string
+	for tube, queue := range connections {
+		if queue.conn == conn {
+			tubes = append(tubes, tube)
+		}
+	}
+	return tubes
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/** Table of jobs with index and insert trigger notifying reservers, %[1]s is table, %[2]s, %[3]s and %[4]s names derived from it */
+const POSTGRES_SCHEMA = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	tube text NOT NULL,
+	body bytea NOT NULL,
+	priority bigint NOT NULL DEFAULT 1024,
+	ttr integer NOT NULL DEFAULT 60,
+	run_at timestamptz NOT NULL DEFAULT now(),
+	buried boolean NOT NULL DEFAULT false,
+	reservation text,
+	reserved_until timestamptz,
+	attempts integer NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (tube, priority, id) WHERE NOT buried;
+CREATE OR REPLACE FUNCTION %[3]s() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	PERFORM pg_notify(TG_TABLE_NAME, NEW.tube);
+	RETURN NULL;
+END $$;
+CREATE OR REPLACE TRIGGER %[4]s AFTER INSERT ON %[1]s FOR EACH ROW EXECUTE FUNCTION %[3]s();
+`
+
+func init() {
+	registerBroker("postgres", func() Broker {
+		return &postgresBroker{wakeups: make(map[string]chan struct{})}
+	})
+}
+
+var (
+	/** PostgreSQL database for postgres broker */
+	postgresURL   = flag.String("postgres", "postgres://localhost/workerman?sslmode=disable", "PostgreSQL connection URL or key=value string for --broker postgres. Default: postgres://localhost/workerman?sslmode=disable")
+	postgresTable = flag.String("postgres-table", "workerman_jobs", "Table of jobs, created when missing, also the channel inserts are notified on. Default: workerman_jobs")
+)
+
+/**
+ * PostgreSQL backend: jobs are rows of one table, reserved by leasing them with SELECT ... FOR UPDATE SKIP LOCKED,
+ * so instances never take the same job. Lease runs out after time to run of job unless touched, like in beanstalkd.
+ * Reservers wait for NOTIFY sent by insert trigger instead of polling
+ */
+type postgresBroker struct {
+	lock     sync.Mutex // Guards db, listener and wakeups
+	db       *sql.DB
+	listener *pq.Listener
+	wakeups  map[string]chan struct{} // Notified tubes by name
+}
+
+/** Lease of job row, valid while reservation column still holds it */
+type postgresHandle struct {
+	id          int64
+	reservation string
+}
+
+func (b *postgresBroker) table() string {
+	return pq.QuoteIdentifier(*postgresTable)
+}
+
+/**
+ * Returns database, opening it, creating schema and starting listener first time. Caller must hold b.lock
+ */
+func (b *postgresBroker) database() (*sql.DB, error) {
+	if b.db != nil {
+		return b.db, nil
+	}
+	db, err := sql.Open("postgres", *postgresURL)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.setup(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	b.listener = pq.NewListener(*postgresURL, time.Second, RECONNECT_BACKOFF_MAX, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres listener: %v", err)
+		}
+	})
+	if err = b.listener.Listen(*postgresTable); err != nil && err != pq.ErrChannelAlreadyOpen {
+		log.Printf("Could not listen on %s, polling only: %v", *postgresTable, err)
+	}
+	go b.dispatch(b.listener)
+	b.db = db
+	return db, nil
+}
+
+/**
+ * Creates schema unless it exists, under advisory lock so instances starting together do not race
+ */
+func (b *postgresBroker) setup(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", *postgresTable); err != nil {
+		return err
+	}
+	schema := fmt.Sprintf(POSTGRES_SCHEMA, b.table(), pq.QuoteIdentifier(*postgresTable+"_ready"),
+		pq.QuoteIdentifier(*postgresTable+"_notify"), pq.QuoteIdentifier(*postgresTable+"_inserted"))
+	if _, err = tx.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("could not create table %s: %v", *postgresTable, err)
+	}
+	return tx.Commit()
+}
+
+/**
+ * Wakes reserver of notified tube. Notification lost while listener reconnected wakes all of them
+ */
+func (b *postgresBroker) dispatch(listener *pq.Listener) {
+	for notification := range listener.Notify {
+		b.lock.Lock()
+		for tube, wakeup := range b.wakeups {
+			if notification == nil || notification.Extra == tube {
+				select {
+				case wakeup <- struct{}{}:
+				default:
+				}
+			}
+		}
+		b.lock.Unlock()
+	}
+}
+
+/**
+ * Returns database and wakeup channel of tube
+ */
+func (b *postgresBroker) tube(tube string) (*sql.DB, chan struct{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	db, err := b.database()
+	if err != nil {
+		return nil, nil, err
+	}
+	wakeup, has := b.wakeups[tube]
+	if !has {
+		wakeup = make(chan struct{}, 1)
+		b.wakeups[tube] = wakeup
+	}
+	return db, wakeup, nil
+}
+
+func (b *postgresBroker) Check() error {
+	b.lock.Lock()
+	db, err := b.database()
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+func (b *postgresBroker) Subscribe(tube string) {
+	if _, _, err := b.tube(tube); err != nil {
+		tubeFailed(tube, fmt.Errorf("not connected: %v", err))
+	}
+}
+
+func (b *postgresBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	delete(b.wakeups, tube)
+	b.lock.Unlock()
+}
+
+/**
+ * Jobs of tube due and not leased
+ */
+func (b *postgresBroker) Stats(tube string) (int, error) {
+	db, _, err := b.tube(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	var ready int
+	err = db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE tube = $1 AND NOT buried AND run_at <= now()
+		AND (reserved_until IS NULL OR reserved_until < now())`, b.table()), tube).Scan(&ready)
+	if err != nil {
+		tubeFailed(tube, err)
+	}
+	return ready, err
+}
+
+/**
+ * Leases next due job of tube, in priority order. When there is none, waits for notification up to timeout and tries again
+ */
+func (b *postgresBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	db, wakeup, err := b.tube(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	job, err := b.lease(db, tube)
+	if err == nil && job == nil {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-wakeup:
+		case <-timer.C:
+		}
+		timer.Stop()
+		job, err = b.lease(db, tube)
+	}
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	return job, nil
+}
+
+/**
+ * Leases one job, job whose lease ran out is taken over as beanstalkd does after time to run
+ */
+func (b *postgresBroker) lease(db *sql.DB, tube string) (*ReservedJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	reservation := stats.Instance + ":" + newRequestId()
+	var id, priority int64
+	var ttr int
+	var body []byte
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`UPDATE %[1]s SET reservation = $2, reserved_until = now() + ttr * interval '1 second', attempts = attempts + 1
+		WHERE id = (SELECT id FROM %[1]s WHERE tube = $1 AND NOT buried AND run_at <= now() AND (reserved_until IS NULL OR reserved_until < now())
+			ORDER BY priority, id LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, body, priority, ttr`, b.table()), tube, reservation).Scan(&id, &body, &priority, &ttr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &ReservedJob{
+		Id:       strconv.FormatInt(id, 10),
+		Body:     body,
+		Priority: uint32(priority),
+		TTR:      time.Duration(ttr) * time.Second,
+		handle:   postgresHandle{id, reservation},
+	}, nil
+}
+
+func (b *postgresBroker) StopReserving(tube string) {
+}
+
+/**
+ * Runs statement on leased job, failing when lease was taken over meanwhile
+ */
+func (b *postgresBroker) update(job *ReservedJob, statement string) error {
+	handle := job.handle.(postgresHandle)
+	b.lock.Lock()
+	db := b.db
+	b.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	result, err := db.ExecContext(ctx, fmt.Sprintf(statement, b.table()), handle.id, handle.reservation)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errLostReservation
+	}
+	return nil
+}
+
+/**
+ * Extends lease of job by its time to run from now
+ */
+func (b *postgresBroker) Touch(job *ReservedJob) error {
+	return b.update(job, "UPDATE %s SET reserved_until = now() + ttr * interval '1 second' WHERE id = $1 AND reservation = $2")
+}
+
+func (b *postgresBroker) Delete(job *ReservedJob) error {
+	return b.update(job, "DELETE FROM %s WHERE id = $1 AND reservation = $2")
+}
+
+/**
+ * Ends lease of job and notifies reservers, it is due again right away
+ */
+func (b *postgresBroker) Release(job *ReservedJob) error {
+	if err := b.update(job, "UPDATE %s SET reservation = NULL, reserved_until = NULL WHERE id = $1 AND reservation = $2"); err != nil {
+		return err
+	}
+	b.notify(job.Tube)
+	return nil
+}
+
+/**
+ * Keeps failed job in table with buried flag set, it is not reserved until flag is cleared
+ */
+func (b *postgresBroker) Bury(job *ReservedJob) error {
+	return b.update(job, "UPDATE %s SET buried = true, reservation = NULL, reserved_until = NULL WHERE id = $1 AND reservation = $2")
+}
+
+func (b *postgresBroker) notify(tube string) {
+	b.lock.Lock()
+	db := b.db
+	b.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "SELECT pg_notify($1, $2)", *postgresTable, tube); err != nil {
+		log.Printf("Could not notify %s: %v", tube, err)
+	}
+}
+
+/**
+ * Inserts job, insert trigger notifies reservers. Delayed job is due after delay, reservers find it on their next look
+ */
+func (b *postgresBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	b.lock.Lock()
+	db, err := b.database()
+	b.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if ttr < time.Second {
+		ttr = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	var id int64
+	err = db.QueryRowContext(ctx, fmt.Sprintf(`INSERT INTO %s (tube, body, priority, ttr, run_at)
+		VALUES ($1, $2, $3, $4, now() + $5 * interval '1 millisecond') RETURNING id`, b.table()),
+		tube, body, int64(priority), int(ttr/time.Second), int64(delay/time.Millisecond)).Scan(&id)
+	return strconv.FormatInt(id, 10), err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/** Hours of week load is averaged for, weight of latest week and weeks needed before a slot is trusted */
+const (
+	PREDICT_SLOTS       = 7 * 24
+	PREDICT_WEIGHT      = 0.3
+	PREDICT_MIN_SAMPLES = 2
+	/** Hour observed for less than that is not averaged in */
+	PREDICT_MIN_OBSERVED = 10 * time.Minute
+)
+
+var (
+	historyFile = flag.String("history-file", "", "File load history of autoscaled tubes is kept in, for Predict of Autoscale. Default: <binary>.history.json")
+
+	/** Load history, guarded by historyLock */
+	history     = LoadHistory{Current: make(map[string]*HourLoad), Tubes: make(map[string]*TubeHistory)}
+	historyLock sync.Mutex
+)
+
+/**
+ * Workers autoscaled tubes wanted, by hour of week, as kept in --history-file
+ */
+type LoadHistory struct {
+	Hour    int64                   // Unix hour Current is collected for
+	Current map[string]*HourLoad    // Load of tubes so far this hour
+	Tubes   map[string]*TubeHistory // Averages of past hours
+}
+
+/** Load of tube observed during an hour */
+type HourLoad struct {
+	WorkerSeconds float64 // Sum of workers wanted times seconds they were
+	Seconds       float64 // Time observed
+}
+
+/** Moving averages of workers wanted per hour of week, Sunday 0:00 first */
+type TubeHistory struct {
+	Load    [PREDICT_SLOTS]float64
+	Samples [PREDICT_SLOTS]uint // Weeks averaged into each slot
+}
+
+/**
+ * Reads load history, must be called before changing working directory
+ */
+func loadHistory() {
+	if *historyFile == "" {
+		*historyFile = os.Args[0] + ".history.json"
+	}
+	if abs, err := filepath.Abs(*historyFile); err == nil {
+		*historyFile = abs
+	}
+	data, err := ioutil.ReadFile(*historyFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &history)
+	}
+	if err != nil {
+		log.Printf("Could not read load history %s, starting anew: %v", *historyFile, err)
+		history = LoadHistory{}
+	}
+	if history.Current == nil {
+		history.Current = make(map[string]*HourLoad)
+	}
+	if history.Tubes == nil {
+		history.Tubes = make(map[string]*TubeHistory)
+	}
+}
+
+/**
+ * Hour of week of time, slot of TubeHistory
+ */
+func historySlot(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+/**
+ * Records workers tube wanted over period just passed. Takes historyLock itself
+ */
+func recordLoad(tube string, workers float64, period time.Duration) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	now := time.Now()
+	if hour := now.Unix() / 3600; hour != history.Hour {
+		foldHistory()
+		history.Hour = hour
+	}
+	load := history.Current[tube]
+	if load == nil {
+		load = &HourLoad{}
+		history.Current[tube] = load
+	}
+	load.WorkerSeconds += workers * period.Seconds()
+	load.Seconds += period.Seconds()
+}
+
+/**
+ * Averages load of hour that ended into its slot and writes history out. Caller must hold historyLock
+ */
+func foldHistory() {
+	if history.Hour == 0 {
+		return
+	}
+	slot := historySlot(time.Unix(history.Hour*3600, 0))
+	for tube, load := range history.Current {
+		if load.Seconds < PREDICT_MIN_OBSERVED.Seconds() {
+			continue
+		}
+		past := history.Tubes[tube]
+		if past == nil {
+			past = &TubeHistory{}
+			history.Tubes[tube] = past
+		}
+		average := load.WorkerSeconds / load.Seconds
+		if past.Samples[slot] == 0 {
+			past.Load[slot] = average
+		} else {
+			past.Load[slot] += (average - past.Load[slot]) * PREDICT_WEIGHT
+		}
+		past.Samples[slot]++
+	}
+	history.Current = make(map[string]*HourLoad)
+	data, err := json.Marshal(history)
+	if err == nil {
+		err = writeFileAtomic(*historyFile, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Error writing load history %s: %v", *historyFile, err)
+	}
+}
+
+/**
+ * Returns workers tube is predicted to want this hour or the next, whichever is more, so limit is raised ahead
+ * of recurring peaks. 0 when history of those hours is too short. Takes historyLock itself
+ */
+func predictedLoad(tube string) uint {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	past := history.Tubes[tube]
+	if past == nil {
+		return 0
+	}
+	var predicted float64
+	now := time.Now()
+	for _, slot := range []int{historySlot(now), historySlot(now.Add(time.Hour))} {
+		if past.Samples[slot] >= PREDICT_MIN_SAMPLES && past.Load[slot] > predicted {
+			predicted = past.Load[slot]
+		}
+	}
+	return uint(math.Ceil(predicted))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	/** Tells worker it is preforked, value is file descriptor it writes results to */
+	PREFORK_ENV = "WORKERMAN_PREFORK"
+	/** Result pipe of preforked worker, stdout stays for output */
+	PREFORK_RESULT_FD = 3
+	/** No warm process is started for that long after one failed to start or exited while idle */
+	PREFORK_BACKOFF = time.Second
+)
+
+func init() {
+	registerFeature("prefork", "Keep warm worker processes, as many as tube limit, and pass them jobs over pipes instead of starting worker per job")
+}
+
+/**
+ * Job header written to stdin of preforked worker as JSON line, followed by Size bytes of job body
+ */
+type PreforkJob struct {
+	JobId string `json:",omitempty"` // Empty when worker reserves job itself
+	Tube  string
+	Run   uint64
+	Size  int
+
+	CorrelationId string `json:",omitempty"` // See --correlation-field
+}
+
+/**
+ * Result preforked worker writes as JSON line into PREFORK_RESULT_FD after each job
+ */
+type PreforkResult struct {
+	Exit  int    // Exit code worker would have had: 0 on success, EXIT_RETRY to release job
+	Error string `json:",omitempty"`
+}
+
+/** Job failure preforked worker reported */
+type preforkError struct {
+	exit    int
+	message string
+}
+
+func (e *preforkError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("exit status %d", e.exit)
+	}
+	return fmt.Sprintf("exit status %d: %s", e.exit, e.message)
+}
+
+/** Warm worker process */
+type preforkProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	results chan PreforkResult // Closed when worker closes result pipe
+	exited  chan struct{}      // Closed once process is waited for
+	err     error              // How process exited, set before exited is closed
+	key     string             // Worker file and settings process was started with
+}
+
+/** Warm processes of tube. Total counts busy and starting ones as well as idle */
+type preforkPool struct {
+	idle    []*preforkProcess
+	total   int
+	retryAt time.Time
+}
+
+var (
+	preforkPools = make(map[string]*preforkPool) // By tube, guarded by preforkLock
+	preforkLock  sync.Mutex
+)
+
+/**
+ * Starts warm processes up to limit of tubes with prefork feature and stops idle ones beyond it.
+ * Paused, draining and unsubscribed tubes keep none. Takes stateLock and preforkLock itself
+ */
+func supervisePreforks() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	preforkLock.Lock()
+	defer preforkLock.Unlock()
+	tubes := make(map[string]bool)
+	for tube := range subscriptions {
+		tubes[tube] = true
+	}
+	for tube := range preforkPools {
+		tubes[tube] = true
+	}
+	for tube := range tubes {
+		config := effectiveConfig(tube)
+		var want int
+		if subscriptions[tube] && config.features["prefork"] && !*dryRun && !stats.Draining && !stats.Paused["*"] && !stats.Paused[tube] {
+			want = int(config.Limit)
+		}
+		pool := preforkPools[tube]
+		if pool == nil && want == 0 {
+			continue
+		}
+		pool = preforkPoolOf(tube)
+		for ; pool.total < want && time.Now().After(pool.retryAt); pool.total++ {
+			go warmPrefork(tube, config)
+		}
+		for pool.total > want && len(pool.idle) > 0 {
+			stopPrefork(pool.idle[len(pool.idle)-1])
+			pool.idle = pool.idle[:len(pool.idle)-1]
+			pool.total--
+		}
+		if pool.total == 0 {
+			delete(preforkPools, tube)
+			delete(stats.Prefork, tube)
+		} else {
+			if stats.Prefork == nil {
+				stats.Prefork = make(map[string]uint)
+			}
+			stats.Prefork[tube] = uint(pool.total)
+		}
+	}
+}
+
+/**
+ * Returns pool of tube, creating it. Caller must hold preforkLock
+ */
+func preforkPoolOf(tube string) *preforkPool {
+	pool := preforkPools[tube]
+	if pool == nil {
+		pool = &preforkPool{}
+		preforkPools[tube] = pool
+	}
+	return pool
+}
+
+/**
+ * Starts process counted in pool already and adds it to idle ones. Takes preforkLock itself
+ */
+func warmPrefork(worker string, config EffectiveConfig) {
+	process, err := startPrefork(worker, config)
+	preforkLock.Lock()
+	defer preforkLock.Unlock()
+	pool := preforkPoolOf(worker)
+	if err != nil {
+		log.Printf("Could not start prefork %s: %v", worker, err)
+		pool.total--
+		pool.retryAt = time.Now().Add(PREFORK_BACKOFF)
+		return
+	}
+	pool.idle = append(pool.idle, process)
+}
+
+/**
+ * Identifies what warm process is started with: version of worker file and environment settings.
+ * Processes started with other ones are replaced, so that deploys and config changes reach preforked workers
+ */
+func preforkKey(worker string, config EffectiveConfig) string {
+	info, err := os.Stat("./" + worker)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(info.Size(), info.ModTime().UnixNano(), config.Env, config.Secrets, config.InheritEnv, config.Umask)
+}
+
+/**
+ * Starts warm worker process with pipes for jobs and results, logging its output line by line
+ */
+func startPrefork(worker string, config EffectiveConfig) (*preforkProcess, error) {
+	umask, err := parseUmask(config.Umask)
+	if err != nil {
+		return nil, err
+	}
+	if violation := integrityViolation(worker, "./"+worker); violation != "" {
+		return nil, fmt.Errorf("refused by integrity check: %s", violation)
+	}
+	cmd := exec.Command("./"+worker, "")
+	if cmd.Env, err = workerProcessEnv(worker, config); err != nil {
+		return nil, err
+	}
+	cmd.Env = append(cmd.Env, PREFORK_ENV+"="+strconv.Itoa(PREFORK_RESULT_FD))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	resultsRead, resultsWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{resultsWrite}
+	done, err := startChildUmask(cmd, umask)
+	resultsWrite.Close()
+	if err != nil {
+		resultsRead.Close()
+		return nil, err
+	}
+	process := &preforkProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		results: make(chan PreforkResult),
+		exited:  make(chan struct{}),
+		key:     preforkKey(worker, config),
+	}
+	pid := cmd.Process.Pid
+	go func() {
+		defer close(process.results)
+		defer resultsRead.Close()
+		lines := bufio.NewScanner(resultsRead)
+		for lines.Scan() {
+			var result PreforkResult
+			if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+				result = PreforkResult{Exit: 1, Error: "invalid result " + strconv.Quote(lines.Text())}
+			}
+			select {
+			case process.results <- result:
+			case <-process.exited:
+				return
+			}
+		}
+	}()
+	go func() {
+		lines := bufio.NewScanner(stdout)
+		lines.Buffer(make([]byte, 4096), MAX_RESIDENT_LINE)
+		for lines.Scan() {
+			log.Printf("Worker %s (prefork %d) output: %s", worker, pid, loggableOutput(lines.Bytes()))
+		}
+		io.Copy(ioutil.Discard, stdout)
+		// Wait closes stdout, so only after it is read
+		process.err = cmd.Wait()
+		done()
+		close(process.exited)
+		dropIdlePrefork(worker, process)
+	}()
+	log.Printf("Started prefork %s (%d)", worker, pid)
+	return process, nil
+}
+
+/**
+ * Removes process that exited from idle ones of its tube, if it is there. Takes preforkLock itself
+ */
+func dropIdlePrefork(worker string, process *preforkProcess) {
+	preforkLock.Lock()
+	defer preforkLock.Unlock()
+	pool := preforkPools[worker]
+	if pool == nil {
+		return
+	}
+	for i, idle := range pool.idle {
+		if idle == process {
+			log.Printf("Prefork %s (%d) exited while idle: %v", worker, process.cmd.Process.Pid, process.err)
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			pool.total--
+			pool.retryAt = time.Now().Add(PREFORK_BACKOFF)
+			return
+		}
+	}
+}
+
+/**
+ * Closes stdin of warm process, which it is to take for exit, and kills it if it does not exit in time
+ */
+func stopPrefork(process *preforkProcess) {
+	process.stdin.Close()
+	go func() {
+		select {
+		case <-process.exited:
+		case <-time.After(RESIDENT_STOP_TIMEOUT):
+			process.cmd.Process.Kill()
+		}
+	}()
+}
+
+/**
+ * Takes idle warm process of tube started with current worker file and settings, or starts one.
+ * Takes preforkLock itself
+ */
+func checkoutPrefork(worker string, config EffectiveConfig) (*preforkProcess, error) {
+	key := preforkKey(worker, config)
+	preforkLock.Lock()
+	pool := preforkPoolOf(worker)
+	for len(pool.idle) > 0 {
+		process := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if process.key == key {
+			preforkLock.Unlock()
+			return process, nil
+		}
+		// Worker was deployed again or its settings changed
+		pool.total--
+		stopPrefork(process)
+	}
+	pool.total++
+	preforkLock.Unlock()
+	process, err := startPrefork(worker, config)
+	if err != nil {
+		preforkLock.Lock()
+		pool.total--
+		preforkLock.Unlock()
+		return nil, err
+	}
+	return process, nil
+}
+
+/**
+ * Returns process to idle ones after job, or drops it when it exited or misbehaved. Takes preforkLock itself
+ */
+func checkinPrefork(worker string, process *preforkProcess, healthy bool) {
+	preforkLock.Lock()
+	defer preforkLock.Unlock()
+	pool := preforkPoolOf(worker)
+	select {
+	case <-process.exited:
+		healthy = false
+	default:
+	}
+	if healthy {
+		pool.idle = append(pool.idle, process)
+		return
+	}
+	pool.total--
+	stopPrefork(process)
+}
+
+/**
+ * Passes job to warm process of tube and waits for its result, killing it after configured timeout.
+ * Body of reserved job is passed after the header and job kept reserved meanwhile
+ */
+func runPreforked(worker string, run uint64, config EffectiveConfig, job *ReservedJob, body []byte) error {
+	process, err := checkoutPrefork(worker, config)
+	if err != nil {
+		return err
+	}
+	header := PreforkJob{Tube: worker, Run: run, Size: len(body)}
+	if job != nil {
+		header.JobId, header.CorrelationId = job.Id, job.correlationId()
+		touching := make(chan struct{})
+		defer close(touching)
+		go job.keepAlive(touching)
+	}
+	frame, err := json.Marshal(header)
+	if err != nil {
+		checkinPrefork(worker, process, true)
+		return err
+	}
+	// Write blocks while worker has not read body yet, so it must not hold up timeout
+	written := make(chan error, 1)
+	go func() {
+		_, err := process.stdin.Write(append(append(frame, '\n'), body...))
+		written <- err
+	}()
+	var timeout <-chan time.Time
+	if config.Timeout.Duration > 0 {
+		timer := time.NewTimer(config.Timeout.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result, ok := <-process.results:
+		if !ok {
+			<-process.exited
+			checkinPrefork(worker, process, false)
+			return fmt.Errorf("prefork exited during job: %w", process.err)
+		}
+		// Worker answering without reading whole body is out of step with the protocol
+		healthy := false
+		select {
+		case err := <-written:
+			healthy = err == nil
+		case <-time.After(time.Second):
+		}
+		checkinPrefork(worker, process, healthy)
+		if result.Exit != 0 {
+			return &preforkError{result.Exit, result.Error}
+		}
+		return nil
+	case <-timeout:
+		process.cmd.Process.Kill()
+		<-process.exited
+		checkinPrefork(worker, process, false)
+		return fmt.Errorf("killed after %s timeout", config.Timeout)
+	}
+}
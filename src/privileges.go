@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/** Environment variable telling re-executed daemon its privileges are restricted already */
+const RESTRICTED_ENV = "_WORKERMAN_RESTRICTED"
+
+var (
+	/** Privilege restriction settings, applied to daemon and inherited by workers */
+	noNewPrivs   = flag.Bool("no-new-privs", true, "Set no_new_privs, so neither daemon nor workers gain privileges from setuid or file capability binaries. Default: true")
+	capabilities = flag.String("capabilities", "", "Comma separated Linux capabilities kept when run as root, e.g. CAP_NET_BIND_SERVICE for workers binding low ports, all others are dropped, empty to drop all. Default: not given, capabilities are dropped only with --user")
+
+	/** Workers see workers directory read-only, so a compromised one can not change the others */
+	readOnlyWorkers = flag.Bool("read-only-workers", false, "Bind workers directory read-only in a mount namespace of daemon and workers, needs root. Linux only. Default: false")
+
+	/** Linux capability names by number, from linux/capability.h */
+	capabilityNames = []string{
+		"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID", "CAP_KILL", "CAP_SETGID",
+		"CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN",
+		"CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+		"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE", "CAP_SYS_RESOURCE", "CAP_SYS_TIME",
+		"CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+		"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ",
+		"CAP_PERFMON", "CAP_BPF", "CAP_CHECKPOINT_RESTORE",
+	}
+)
+
+/**
+ * Tells deployWorker, rollbackWorker and promoteWorker are rejected with --read-only-workers
+ */
+func noteReadOnlyWorkers() {
+	if *readOnlyWorkers {
+		log.Printf("Workers directory is read-only with --read-only-workers, deployWorker, rollbackWorker and promoteWorker are rejected")
+	}
+}
+
+/**
+ * Checks worker files can be changed, daemon's own view of workers directory is read-only with --read-only-workers
+ */
+func checkWorkersWritable() error {
+	if *readOnlyWorkers {
+		return errors.New("workers directory is read-only with --read-only-workers")
+	}
+	return nil
+}
+
+/**
+ * Parses --capabilities into capability numbers to keep, names may leave out CAP_ prefix
+ */
+func keptCapabilities() (map[int]bool, error) {
+	kept := make(map[int]bool)
+	for _, name := range strings.Split(*capabilities, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		found := false
+		for number, known := range capabilityNames {
+			if known == name {
+				kept[number], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown capability %s", name)
+		}
+	}
+	return kept, nil
+}
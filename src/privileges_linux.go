@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/** prctl options and capability numbers from linux/prctl.h and linux/capability.h */
+const (
+	PR_CAPBSET_DROP     = 24
+	PR_SET_NO_NEW_PRIVS = 38
+	PR_GET_NO_NEW_PRIVS = 39
+	CAP_SETGID          = 6
+	CAP_SETUID          = 7
+)
+
+/** Flags of workers directory mount kept when remounting it read-only, statfs and mount values differ for relatime only */
+const (
+	ST_RDONLY     = 1
+	ST_RELATIME   = 4096
+	READONLY_KEPT = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME
+)
+
+/**
+ * Sets no_new_privs, drops capabilities not kept from bounding set of this thread and, with --read-only-workers, moves
+ * it to mount namespace with workers directory read-only, then executes daemon again from it. All are per thread, and
+ * execve leaves only the calling thread, so all threads of the new image and every worker started from them have them.
+ * Root gets only capabilities of bounding set on execve, they are dropped when --capabilities or --user is given.
+ * Re-executed daemon checks the restrictions took effect. Must be called first thing, before inherited files are used
+ * or anything is connected
+ */
+func restrictPrivileges() {
+	if os.Getenv(RESTRICTED_ENV) != "" {
+		os.Unsetenv(RESTRICTED_ENV)
+		checkPrivileges()
+		return
+	}
+	kept, err := keptCapabilities()
+	if err != nil {
+		log.Fatalf("Fatal error: invalid --capabilities: %v", err)
+	}
+	// Only root has capabilities to drop, others lose them with execve anyway. Root daemon run as is keeps them unless
+	// told which to keep, as its workers may rely on them
+	root := syscall.Geteuid() == 0
+	dropCapabilities := root && (givenFlags["capabilities"] || *runAs != "")
+	bindWorkers := *readOnlyWorkers && !readOnlyDir(*workersPath)
+	if bindWorkers && !root {
+		log.Printf("Warning: --read-only-workers needs daemon started as root, workers directory stays writable")
+		bindWorkers = false
+	}
+	if !*noNewPrivs && !dropCapabilities && !bindWorkers {
+		return
+	}
+	if *runAs != "" {
+		// Needed to switch user, which clears all capabilities then
+		kept[CAP_SETGID], kept[CAP_SETUID] = true, true
+	}
+	runtime.LockOSThread()
+	if bindWorkers {
+		if err := bindReadOnly(*workersPath); err != nil {
+			log.Fatalf("Fatal error: could not make workers directory read-only: %v", err)
+		}
+	}
+	if *noNewPrivs {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+			log.Fatalf("Fatal error: could not set no_new_privs: %v", errno)
+		}
+	}
+	if dropCapabilities {
+		for number := 0; number <= lastCapability(); number++ {
+			if kept[number] {
+				continue
+			}
+			if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_CAPBSET_DROP, uintptr(number), 0); errno == syscall.EINVAL {
+				break
+			} else if errno != 0 {
+				log.Fatalf("Fatal error: could not drop capability %d: %v", number, errno)
+			}
+		}
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(executable, os.Args, append(os.Environ(), RESTRICTED_ENV+"=1"))
+	}
+	log.Fatalf("Fatal error: could not execute again with restricted privileges: %v", err)
+}
+
+/**
+ * Binds workers directory read-only over itself in a new mount namespace of this thread, which daemon executed from
+ * it and every worker inherit. Mounts are made private first, not to change them for the rest of the system
+ */
+func bindReadOnly(path string) error {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return err
+	}
+	// Remount replaces flags, keep the ones of original mount
+	flags := uintptr(stat.Flags) & READONLY_KEPT
+	if stat.Flags&ST_RELATIME != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("could not create mount namespace: %v", err)
+	}
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("could not make mounts private: %v", err)
+	}
+	if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not bind %s: %v", dir, err)
+	}
+	if err := syscall.Mount("", dir, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+		return fmt.Errorf("could not remount %s read-only: %v", dir, err)
+	}
+	return nil
+}
+
+/**
+ * Tells whether directory is on a read-only mount, e.g. bound so by daemon this one was upgraded from
+ */
+func readOnlyDir(path string) bool {
+	var stat syscall.Statfs_t
+	return syscall.Statfs(path, &stat) == nil && stat.Flags&ST_RDONLY != 0
+}
+
+/**
+ * Highest capability number kernel knows
+ */
+func lastCapability() int {
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if last, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return last
+		}
+	}
+	return len(capabilityNames) - 1
+}
+
+/**
+ * Verifies no_new_privs is set and logs capabilities left in bounding set
+ */
+func checkPrivileges() {
+	if *noNewPrivs {
+		if set, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_GET_NO_NEW_PRIVS, 0, 0); errno != 0 || set != 1 {
+			log.Fatalf("Fatal error: no_new_privs is not set after restricting privileges")
+		}
+	}
+	if *readOnlyWorkers && readOnlyDir(*workersPath) {
+		log.Printf("Workers directory %s is read-only for daemon and workers", *workersPath)
+	}
+	if syscall.Geteuid() != 0 {
+		return
+	}
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		log.Printf("Could not read capabilities: %v", err)
+		return
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapBnd:") {
+			continue
+		}
+		bounding, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapBnd:")), 16, 64)
+		if err != nil {
+			break
+		}
+		var names []string
+		for number, name := range capabilityNames {
+			if bounding&(1<<uint(number)) != 0 {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			names = append(names, "none")
+		}
+		log.Printf("Capability bounding set: %s", strings.Join(names, ", "))
+	}
+}
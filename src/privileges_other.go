@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "log"
+
+/**
+ * Capabilities, no_new_privs and mount namespaces are Linux only, workers run with privileges of the daemon
+ */
+func restrictPrivileges() {
+	if givenFlags["capabilities"] {
+		log.Printf("Warning: --capabilities is only supported on Linux")
+	}
+	if *readOnlyWorkers {
+		log.Printf("Warning: --read-only-workers is only supported on Linux, workers directory stays writable")
+	}
+}
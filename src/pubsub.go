@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("pubsub", func() Broker {
+		return &pubsubBroker{consumers: make(map[string]*pubsubConsumer), topics: make(map[string]*pubsub.Topic)}
+	})
+}
+
+var (
+	/** Google Cloud Pub/Sub settings for pubsub broker, credentials come from GOOGLE_APPLICATION_CREDENTIALS or metadata server */
+	pubsubProject      = flag.String("pubsub-project", pubsub.DetectProjectID, "Google Cloud project of topics and subscriptions for --broker pubsub. Default: detected from credentials")
+	pubsubPrefix       = flag.String("pubsub-prefix", "", "Prefix of topic and subscription names, tube email is subscription <prefix>email. Default: none")
+	pubsubDeadLetter   = flag.String("pubsub-dead-letter", "", "Topic failed jobs are forwarded to after --pubsub-max-attempts deliveries, set on subscriptions. Default: none, keep subscription policy")
+	pubsubMaxAttempts  = flag.Int("pubsub-max-attempts", 5, "Deliveries of failing job before it is forwarded to --pubsub-dead-letter, 5 to 100. Default: 5")
+	pubsubMaxExtension = flag.Duration("pubsub-max-extension", time.Hour, "Longest time ack deadline of running job is extended, it is delivered again after. Default: 1h")
+)
+
+/**
+ * Google Cloud Pub/Sub backend. Each tube is a subscription received with streaming pull, outstanding messages limited
+ * by tube limit. Client library extends ack deadlines of outstanding messages, so jobs stay leased while workers run
+ */
+type pubsubBroker struct {
+	lock      sync.Mutex // Guards client, consumers and topics
+	client    *pubsub.Client
+	consumers map[string]*pubsubConsumer
+	topics    map[string]*pubsub.Topic // Publishers by tube
+}
+
+/**
+ * Streaming pull of tube subscription. Callback passes messages on to reserver, which acks them after worker finishes
+ */
+type pubsubConsumer struct {
+	cancel      context.CancelFunc
+	messages    chan *pubsub.Message
+	done        chan struct{} // Closed when receiving stopped, err tells why
+	err         error
+	outstanding int
+	running     int // Jobs not finished yet, used by reserver only
+}
+
+/** Message handed to worker along with streaming pull it came from */
+type pubsubHandle struct {
+	consumer *pubsubConsumer
+	message  *pubsub.Message
+}
+
+/**
+ * Returns client, creating it first time. Caller must hold b.lock
+ */
+func (b *pubsubBroker) connection() (*pubsub.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	client, err := pubsub.NewClient(context.Background(), *pubsubProject)
+	if err != nil {
+		return nil, err
+	}
+	b.client = client
+	return client, nil
+}
+
+func (b *pubsubBroker) Check() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, err := b.connection()
+	return err
+}
+
+/**
+ * Sets dead letter policy of subscription when --pubsub-dead-letter is given
+ */
+func (b *pubsubBroker) Subscribe(tube string) {
+	b.lock.Lock()
+	client, err := b.connection()
+	b.lock.Unlock()
+	if err == nil && *pubsubDeadLetter != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+		defer cancel()
+		_, err = client.Subscription(*pubsubPrefix+tube).Update(ctx, pubsub.SubscriptionConfigToUpdate{
+			DeadLetterPolicy: &pubsub.DeadLetterPolicy{
+				DeadLetterTopic:     fmt.Sprintf("projects/%s/topics/%s", client.Project(), *pubsubDeadLetter),
+				MaxDeliveryAttempts: *pubsubMaxAttempts,
+			},
+		})
+	}
+	if err != nil {
+		tubeFailed(tube, fmt.Errorf("not connected: %v", err))
+	}
+}
+
+func (b *pubsubBroker) Unsubscribe(tube string) {
+}
+
+/**
+ * Backlog of subscription is only reported by Cloud Monitoring
+ */
+func (b *pubsubBroker) Stats(tube string) (int, error) {
+	return 0, fmt.Errorf("backlog of %s is not known to pubsub subscriber", tube)
+}
+
+/**
+ * Starts streaming pull of tube subscription with given limit of outstanding messages
+ */
+func (b *pubsubBroker) receive(tube string, outstanding int) (*pubsubConsumer, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	client, err := b.connection()
+	if err != nil {
+		return nil, err
+	}
+	subscription := client.Subscription(*pubsubPrefix + tube)
+	subscription.ReceiveSettings.MaxOutstandingMessages = outstanding
+	subscription.ReceiveSettings.MaxExtension = *pubsubMaxExtension
+	subscription.ReceiveSettings.NumGoroutines = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &pubsubConsumer{cancel: cancel, messages: make(chan *pubsub.Message), done: make(chan struct{}), outstanding: outstanding}
+	go func() {
+		// Returns on cancel, or on error client does not retry by itself
+		c.err = subscription.Receive(ctx, func(ctx context.Context, message *pubsub.Message) {
+			select {
+			case c.messages <- message:
+			case <-ctx.Done():
+				message.Nack()
+			}
+		})
+		close(c.done)
+	}()
+	b.consumers[tube] = c
+	return c, nil
+}
+
+/**
+ * Waits for message of tube. Limit of outstanding messages applies to new streaming pull only, so it is restarted
+ * when tube limit changed, once its jobs are finished
+ */
+func (b *pubsubBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	outstanding := prefetchLimit(tube)
+	b.lock.Lock()
+	c := b.consumers[tube]
+	b.lock.Unlock()
+	if c != nil && c.outstanding != outstanding && c.running == 0 {
+		b.StopReserving(tube)
+		c = nil
+	}
+	if c == nil {
+		var err error
+		if c, err = b.receive(tube, outstanding); err != nil {
+			tubeFailed(tube, err)
+			return nil, err
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-c.messages:
+		tubeRecovered(tube)
+		c.running++
+		job := &ReservedJob{Id: message.ID, Body: message.Data, Priority: DEFAULT_PRIORITY, TTR: DEFAULT_TTR, handle: pubsubHandle{c, message}}
+		if pri, err := strconv.ParseUint(message.Attributes["priority"], 10, 32); err == nil {
+			job.Priority = uint32(pri)
+		}
+		return job, nil
+	case <-c.done:
+		b.lock.Lock()
+		delete(b.consumers, tube)
+		b.lock.Unlock()
+		err := c.err
+		if err == nil {
+			err = errors.New("streaming pull stopped")
+		}
+		tubeFailed(tube, err)
+		return nil, err
+	case <-timer.C:
+		tubeRecovered(tube)
+		return nil, nil
+	}
+}
+
+/**
+ * Stops streaming pull of tube, messages not taken by reserver yet are nacked
+ */
+func (b *pubsubBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	c := b.consumers[tube]
+	delete(b.consumers, tube)
+	b.lock.Unlock()
+	if c != nil {
+		c.cancel()
+		<-c.done
+	}
+}
+
+/**
+ * Client library extends ack deadline by itself, up to --pubsub-max-extension
+ */
+func (b *pubsubBroker) Touch(job *ReservedJob) error {
+	return nil
+}
+
+func (b *pubsubBroker) Delete(job *ReservedJob) error {
+	b.finish(job).Ack()
+	return nil
+}
+
+/**
+ * Nacks job, so it is delivered again right away
+ */
+func (b *pubsubBroker) Release(job *ReservedJob) error {
+	b.finish(job).Nack()
+	return nil
+}
+
+/**
+ * Nacks job like release, subscription with dead letter policy forwards it to dead letter topic after max delivery attempts
+ */
+func (b *pubsubBroker) Bury(job *ReservedJob) error {
+	b.finish(job).Nack()
+	return nil
+}
+
+func (b *pubsubBroker) finish(job *ReservedJob) *pubsub.Message {
+	handle := job.handle.(pubsubHandle)
+	handle.consumer.running--
+	return handle.message
+}
+
+/**
+ * Publishes job to topic of tube, returns its message id. Pub/Sub has no delayed delivery, time to run does not apply
+ */
+func (b *pubsubBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if delay > 0 {
+		return "", fmt.Errorf("delay is not supported by pubsub broker")
+	}
+	b.lock.Lock()
+	client, err := b.connection()
+	topic := b.topics[tube]
+	if err == nil && topic == nil {
+		topic = client.Topic(*pubsubPrefix + tube)
+		b.topics[tube] = topic
+	}
+	b.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	result := topic.Publish(ctx, &pubsub.Message{Data: body, Attributes: map[string]string{"priority": strconv.FormatUint(uint64(priority), 10)}})
+	return result.Get(ctx)
+}
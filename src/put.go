@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+/** Time to run for jobs put without one */
+const DEFAULT_TTR = 60 * time.Second
+
+/**
+ * Job to publish with put command, e.g. {"Tube": "email", "Body": "{...}", "Delay": "5s"}
+ */
+type JobRequest struct {
+	Tube     string
+	Body     string
+	Priority *uint32   `json:",omitempty"` // Default is 1024
+	Delay    *Duration `json:",omitempty"`
+	TTR      *Duration `json:",omitempty"` // Default is 60s
+	Base64   bool      `json:",omitempty"` // Body is base64 of binary one, JSON strings carry UTF-8 text only
+}
+
+type JobResponse struct {
+	Id   uint64
+	Ref  string `json:",omitempty"` // Id given by broker, when it is not a number
+	Tube string
+}
+
+/**
+ * Process put command: publishes job into subscribed tube. Takes stateLock itself
+ */
+func putJob(req *JobRequest) []byte {
+	var response interface{}
+	stateLock.Lock()
+	subscribed := subscriptions[req.Tube]
+	stateLock.Unlock()
+	if !subscribed {
+		response = CommandError{fmt.Sprintf("tube '%s' is not subscribed", req.Tube)}
+	} else if id, err := publishJob(req); err != nil {
+		log.Printf("Could not put job into %s: %v", req.Tube, err)
+		response = CommandError{fmt.Sprintf("could not put job into %s: %v", req.Tube, err)}
+	} else {
+		log.Printf("Put job %s into %s", id, req.Tube)
+		// Do not wait for idle backoff to notice it
+		stateLock.Lock()
+		delete(polling, req.Tube)
+		stateLock.Unlock()
+		if number, err := strconv.ParseUint(id, 10, 64); err == nil {
+			response = JobResponse{number, "", req.Tube}
+		} else {
+			response = JobResponse{0, id, req.Tube}
+		}
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
+
+func publishJob(req *JobRequest) (string, error) {
+	priority, delay, ttr := uint32(DEFAULT_PRIORITY), time.Duration(0), DEFAULT_TTR
+	if req.Priority != nil {
+		priority = *req.Priority
+	}
+	if req.Delay != nil {
+		delay = req.Delay.Duration
+	}
+	if req.TTR != nil {
+		ttr = req.TTR.Duration
+	}
+	body := []byte(req.Body)
+	if req.Base64 {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(req.Body); err != nil {
+			return "", fmt.Errorf("body is not base64: %v", err)
+		}
+	}
+	return broker.Put(req.Tube, body, priority, delay, ttr)
+}
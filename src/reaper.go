@@ -0,0 +1,267 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	/** Environment variable marking worker processes with their tube name, to recognize them after crash */
+	WORKER_ENV = "_WORKERMAN_WORKER"
+	/** How long killed orphan gets to exit before SIGKILL */
+	ORPHAN_KILL_TIMEOUT = 10 * time.Second
+	/** How often adopted orphans are checked for exit */
+	ORPHAN_POLL_INTERVAL = time.Second
+)
+
+var (
+	subreaper = flag.Bool("subreaper", false, "Become child subreaper, so processes orphaned by workers are reaped by workerman. Implied when running as PID 1")
+	orphans   = flag.String("orphans", "adopt", "What to do with workers left running by previous crashed instance: adopt, kill or ignore. Default: adopt")
+
+	/** Children started by workerman itself, reaped by their owners. Reaper never touches them */
+	ownChildren     = make(map[int]bool)
+	ownChildrenLock sync.Mutex
+)
+
+/**
+ * Starts command as own child, so reaper leaves it alone. Returned function is to be called after Wait
+ */
+func startChild(cmd *exec.Cmd) (func(), error) {
+	return startChildUmask(cmd, -1)
+}
+
+/**
+ * Starts command as own child with umask, -1 to keep umask of daemon. Umask is process wide, so it is only
+ * changed for the fork, under ownChildrenLock
+ */
+func startChildUmask(cmd *exec.Cmd, umask int) (func(), error) {
+	ownChildrenLock.Lock()
+	defer ownChildrenLock.Unlock()
+	if umask >= 0 {
+		defer syscall.Umask(syscall.Umask(umask))
+	}
+	if err := cmd.Start(); err != nil {
+		return func() {}, err
+	}
+	pid := cmd.Process.Pid
+	ownChildren[pid] = true
+	return func() {
+		ownChildrenLock.Lock()
+		delete(ownChildren, pid)
+		ownChildrenLock.Unlock()
+	}, nil
+}
+
+/**
+ * Reaps orphaned processes when running as PID 1 or subreaper, where they are reparented to workerman
+ */
+func startReaper() {
+	if os.Getpid() != 1 && !*subreaper {
+		return
+	}
+	if os.Getpid() != 1 {
+		if err := setSubreaper(); err != nil {
+			log.Printf("Could not become child subreaper: %v", err)
+			return
+		}
+	}
+	log.Printf("Reaping orphaned processes")
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGCHLD)
+	go func() {
+		for range signals {
+			reapOrphans()
+		}
+	}()
+}
+
+/**
+ * Waits for exited children, other than the ones started by workerman
+ */
+func reapOrphans() {
+	ownChildrenLock.Lock()
+	defer ownChildrenLock.Unlock()
+	for _, pid := range childPids(os.Getpid()) {
+		if ownChildren[pid] {
+			continue
+		}
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid {
+			log.Printf("Reaped orphaned process %d, exit status %d", pid, status.ExitStatus())
+		}
+	}
+}
+
+/**
+ * Process details from /proc/<pid>/stat
+ */
+type procInfo struct {
+	ppid    int
+	started uint64 // Start time since boot, tells reused pid apart
+	zombie  bool
+}
+
+/**
+ * Reads process details from /proc
+ */
+func procStat(pid int) (procInfo, bool) {
+	var info procInfo
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return info, false
+	}
+	// Command name may contain spaces, fields are counted after it
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return info, false
+	}
+	info.zombie = fields[0] == "Z"
+	info.ppid, _ = strconv.Atoi(fields[1])
+	info.started, _ = strconv.ParseUint(fields[19], 10, 64)
+	return info, true
+}
+
+/**
+ * Returns process ids found in /proc
+ */
+func listPids() []int {
+	entries, _ := filepath.Glob("/proc/[0-9]*")
+	pids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(filepath.Base(entry)); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+/**
+ * Returns process ids of children of given process
+ */
+func childPids(parent int) []int {
+	var children []int
+	for _, pid := range listPids() {
+		if info, ok := procStat(pid); ok && info.ppid == parent {
+			children = append(children, pid)
+		}
+	}
+	return children
+}
+
+/**
+ * Returns tube of worker process started from given workers directory, empty if process is not such worker
+ */
+func orphanTube(pid int, workersDir string) (tube string, resident bool) {
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err != nil || cwd != workersDir {
+		return "", false
+	}
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range strings.Split(string(environ), "\x00") {
+		if strings.HasPrefix(entry, WORKER_ENV+"=") {
+			tube = strings.TrimPrefix(entry, WORKER_ENV+"=")
+		} else if strings.HasPrefix(entry, RESIDENT_ENV+"=") {
+			resident = true
+		}
+	}
+	return tube, resident
+}
+
+/**
+ * Finds workers left running by previous instance and adopts or kills them, according to --orphans.
+ * Either way they are counted as running until they exit, so limits reflect reality. Takes stateLock itself
+ */
+func handleOrphans() {
+	if *orphans == "ignore" {
+		return
+	}
+	workersDir, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	type orphan struct {
+		tube     string
+		pid      int
+		started  uint64
+		resident bool
+	}
+	// Find all before killing any, so that children of killed workers are not mistaken for workers
+	var found []orphan
+	for _, pid := range listPids() {
+		info, ok := procStat(pid)
+		// Workers of upgraded process are handed over by completeUpgrade
+		if !ok || info.zombie || info.ppid == os.Getpid() || pid == os.Getpid() || (upgradeParent != 0 && info.ppid == upgradeParent) {
+			continue
+		}
+		tube, resident := orphanTube(pid, workersDir)
+		// Processes started by worker inherit its marker, only worker itself is counted
+		if parent, _ := orphanTube(info.ppid, workersDir); tube != "" && parent == "" {
+			found = append(found, orphan{tube, pid, info.started, resident})
+		}
+	}
+	for _, o := range found {
+		// Resident workers are started afresh by supervisor, so old ones never stay
+		adoptWorker(o.tube, o.pid, o.started, *orphans == "kill" || o.resident)
+	}
+}
+
+/**
+ * Counts worker process not started by this instance as running until it exits, optionally killing it.
+ * Takes stateLock itself
+ */
+func adoptWorker(tube string, pid int, started uint64, kill bool) {
+	stateLock.Lock()
+	subscribed := subscriptions[tube]
+	if subscribed {
+		stats.Running[tube]++
+		stats.TotalRunning++
+		addUnits(tube)
+	}
+	stateLock.Unlock()
+	if !subscribed {
+		log.Printf("Found orphaned worker %s with pid %d, but it is not subscribed", tube, pid)
+		return
+	}
+	if kill {
+		log.Printf("Killing orphaned worker %s with pid %d", tube, pid)
+		publishEvent("killed", tube, fmt.Sprintf("orphaned pid %d", pid))
+		syscall.Kill(pid, syscall.SIGTERM)
+	} else {
+		log.Printf("Adopted orphaned worker %s with pid %d", tube, pid)
+		publishEvent("adopted", tube, fmt.Sprintf("orphaned pid %d", pid))
+	}
+	go watchOrphan(tube, pid, started, kill)
+}
+
+/**
+ * Waits for orphaned worker to exit, then stops counting it as running
+ */
+func watchOrphan(tube string, pid int, started uint64, kill bool) {
+	deadline := time.Now().Add(ORPHAN_KILL_TIMEOUT)
+	for {
+		// Same pid with different start time is another process
+		if info, ok := procStat(pid); !ok || info.zombie || info.started != started {
+			break
+		}
+		if kill && time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(ORPHAN_POLL_INTERVAL)
+	}
+	log.Printf("Orphaned worker %s with pid %d exited", tube, pid)
+	updateStats(Sync{Worker: tube, Count: -1})
+}
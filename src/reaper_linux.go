@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+/** prctl option from linux/prctl.h */
+const PR_SET_CHILD_SUBREAPER = 36
+
+/**
+ * Makes orphaned descendants get reparented to this process instead of init
+ */
+func setSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_CHILD_SUBREAPER, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func setSubreaper() error {
+	return errors.New("child subreaper is only supported on Linux")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"strings"
+	"time"
+)
+
+/** Longest delay between reconnect attempts, delay starts at --reconnect-delay and doubles */
+const RECONNECT_BACKOFF_MAX = time.Minute
+
+var (
+	/** Set while command connection is being replaced, guarded by commandLock */
+	commandReconnecting bool
+
+	/** Server of command connection, guarded by commandLock */
+	commandServer string
+
+	/** Set while there is no working command connection, guarded by stateLock */
+	commandDown bool
+
+	/** Tube connections being replaced, guarded by stateLock */
+	recovering = make(map[*beanstalk.Conn]bool)
+)
+
+/**
+ * Sets up command and response tubes on command connection, caller must hold commandLock once daemon runs
+ */
+func useCommandConn(conn *beanstalk.Conn, address string) {
+	commandConn = conn
+	commandServer = address
+	// Create response tube
+	responseTube = &beanstalk.Tube{conn, responseTubeName}
+	// Prepare command tube
+	commandTube = &beanstalk.TubeSet{conn, make(map[string]bool)}
+	commandTube.Name[commandTubeName] = true
+	commandTube.Name["default"] = false
+}
+
+/**
+ * Connects command connection, or leaves it to background retries when server is not available
+ */
+func startCommandConn() {
+	stateLock.Lock()
+	address := activeServer()
+	stateLock.Unlock()
+	log.Printf("Connecting to %s...", address)
+	conn, err := dialServer(address)
+	if err != nil {
+		serverFailed(address, err)
+		log.Printf("Could not connect: %v, retrying in background", err)
+		stateLock.Lock()
+		stats.LastError = fmt.Sprintf("command connection: %v", err)
+		commandDown = true
+		stateLock.Unlock()
+		commandLock.Lock()
+		commandReconnecting = true
+		commandLock.Unlock()
+		go reconnectCommand()
+		return
+	}
+	commandLock.Lock()
+	useCommandConn(conn, address)
+	commandLock.Unlock()
+	log.Printf("Subscribed to command queue %s", commandTubeName)
+}
+
+/**
+ * Replaces broken command connection in background, retrying with backoff. Commands are not read meanwhile
+ */
+func recoverCommandConn(broken *beanstalk.Conn, err error) {
+	commandLock.Lock()
+	if commandReconnecting || commandConn != broken {
+		commandLock.Unlock()
+		return
+	}
+	commandReconnecting = true
+	commandLock.Unlock()
+	stateLock.Lock()
+	stats.LastError = fmt.Sprintf("command connection: %v", err)
+	commandDown = true
+	stateLock.Unlock()
+	log.Printf("Command connection is broken: %v, reconnecting", err)
+	publishEvent("degraded", "", "command connection: "+err.Error())
+	broken.Close()
+	go reconnectCommand()
+}
+
+/**
+ * Connects command connection, retrying with backoff
+ */
+func reconnectCommand() {
+	delay := *reconnectDelay
+	for {
+		stateLock.Lock()
+		address := activeServer()
+		stateLock.Unlock()
+		conn, err := dialServer(address)
+		if err == nil {
+			commandLock.Lock()
+			useCommandConn(conn, address)
+			commandReconnecting = false
+			commandLock.Unlock()
+			break
+		}
+		serverFailed(address, err)
+		log.Printf("Could not reconnect command connection to %s: %v, retrying in %v", address, err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > RECONNECT_BACKOFF_MAX {
+			delay = RECONNECT_BACKOFF_MAX
+		}
+	}
+	stateLock.Lock()
+	stats.TotalRecoveries++
+	commandDown = false
+	stateLock.Unlock()
+	log.Printf("Connected command connection, listening on %s", commandTubeName)
+	publishEvent("recovered", "", "command connection")
+}
+
+/**
+ * Checks if reserve found no job. Error text does not tell, as reserve-with-timeout command name is in every error
+ */
+func isTimeout(err error) bool {
+	if connErr, ok := err.(beanstalk.ConnError); ok {
+		err = connErr.Err
+	}
+	return err == beanstalk.ErrTimeout
+}
+
+/**
+ * Tells broken connection from error reported by beanstalkd, e.g. NOT_FOUND for tube nobody has used yet
+ */
+func isConnError(err error) bool {
+	if connErr, ok := err.(beanstalk.ConnError); ok {
+		err = connErr.Err
+	}
+	switch err {
+	case beanstalk.ErrBadFormat, beanstalk.ErrBuried, beanstalk.ErrDeadline, beanstalk.ErrDraining,
+		beanstalk.ErrInternal, beanstalk.ErrJobTooBig, beanstalk.ErrNoCRLF, beanstalk.ErrNotFound,
+		beanstalk.ErrNotIgnored, beanstalk.ErrOOM, beanstalk.ErrTimeout, beanstalk.ErrUnknown:
+		return false
+	}
+	return true
+}
+
+/**
+ * Marks tubes sharing broken connection degraded and reconnects it in background, unless that is in progress already.
+ * Degraded tubes are not dispatched. Takes stateLock itself
+ */
+func degradeTube(tube string, conn *beanstalk.Conn, err error) {
+	stateLock.Lock()
+	var broken []string
+	for _, shared := range tubesOf(conn) {
+		// Tube may have been given the connection after it broke
+		if _, degraded := stats.Degraded[shared]; !degraded {
+			stats.Degraded[shared] = time.Now().Format(time.RFC3339) + ": " + err.Error()
+			broken = append(broken, shared)
+		}
+	}
+	if len(broken) > 0 {
+		stats.LastError = fmt.Sprintf("%s: %v", tube, err)
+	}
+	started := recovering[conn]
+	recovering[conn] = true
+	stateLock.Unlock()
+	for _, shared := range broken {
+		log.Printf("Connection of %s is broken: %v, reconnecting", shared, err)
+		publishEvent("degraded", shared, err.Error())
+	}
+	if !started {
+		go recoverConn(conn)
+	}
+}
+
+/**
+ * Replaces broken connection of tubes with a new one, retrying with backoff until connected or no tube uses it.
+ * New connection goes to server of the tubes, so backup takes over when their server is down
+ */
+func recoverConn(broken *beanstalk.Conn) {
+	broken.Close()
+	delay := *reconnectDelay
+	for {
+		stateLock.Lock()
+		tubes := tubesOf(broken)
+		address := connServer[broken]
+		if len(tubes) > 0 {
+			address = serverFor(tubes[0])
+		}
+		stateLock.Unlock()
+		conn, err := dialServer(address)
+		if err != nil {
+			serverFailed(address, err)
+		}
+		stateLock.Lock()
+		tubes = tubesOf(broken)
+		if err == nil || len(tubes) == 0 {
+			delete(recovering, broken)
+			dropConn(broken)
+			if err == nil {
+				for _, tube := range tubes {
+					connections[tube] = Queue{conn, &beanstalk.Tube{conn, tube}}
+					delete(stats.Degraded, tube)
+				}
+				if len(tubes) > 0 {
+					addConn(conn, address)
+					stats.TotalRecoveries++
+				} else {
+					conn.Close()
+				}
+			}
+			stateLock.Unlock()
+			for _, tube := range tubes {
+				log.Printf("Reconnected %s to %s", tube, address)
+				publishEvent("recovered", tube, address)
+			}
+			return
+		}
+		stateLock.Unlock()
+		log.Printf("Could not reconnect %s to %s: %v, retrying in %v", strings.Join(tubes, ", "), address, err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > RECONNECT_BACKOFF_MAX {
+			delay = RECONNECT_BACKOFF_MAX
+		}
+	}
+}
+
+/**
+ * Returns connection for newly subscribed tube without waiting for server known to be down. Takes stateLock itself
+ */
+func newTubeConn(tube string) (*beanstalk.Conn, error) {
+	stateLock.Lock()
+	address := serverFor(tube)
+	healthy := serverHealthy(address)
+	stateLock.Unlock()
+	if !healthy {
+		return nil, fmt.Errorf("server %s is down", address)
+	}
+	conn, err := tubeConnOn(address)
+	if err != nil {
+		serverFailed(address, err)
+	}
+	return conn, err
+}
+
+/**
+ * Connects tube subscribed while its server was not available, retrying with backoff until connected or unsubscribed
+ */
+func connectTube(tube string) {
+	delay := *reconnectDelay
+	for {
+		time.Sleep(delay)
+		stateLock.Lock()
+		queue, subscribed := connections[tube]
+		address := serverFor(tube)
+		stateLock.Unlock()
+		if !subscribed || queue.conn != nil {
+			return
+		}
+		conn, err := tubeConnOn(address)
+		if err == nil {
+			stateLock.Lock()
+			queue, subscribed = connections[tube]
+			connected := subscribed && queue.conn == nil
+			if connected {
+				connections[tube] = Queue{conn, &beanstalk.Tube{conn, tube}}
+				delete(stats.Degraded, tube)
+			} else {
+				releaseConn(conn)
+			}
+			stateLock.Unlock()
+			if connected {
+				log.Printf("Connected %s to %s", tube, address)
+				publishEvent("recovered", tube, address)
+			}
+			return
+		}
+		serverFailed(address, err)
+		log.Printf("Could not connect %s to %s: %v, retrying in %v", tube, address, err, delay)
+		if delay *= 2; delay > RECONNECT_BACKOFF_MAX {
+			delay = RECONNECT_BACKOFF_MAX
+		}
+	}
+}
+
+/**
+ * Updates Ready in status: command connection and all tube connections are up. Caller must hold stateLock
+ */
+func updateReadiness() {
+	stats.Ready, stats.NotReady = true, ""
+	if commandDown {
+		stats.Ready, stats.NotReady = false, "command connection is down"
+	} else if len(stats.Degraded) > 0 {
+		stats.Ready, stats.NotReady = false, fmt.Sprintf("%d tube(s) not connected", len(stats.Degraded))
+	} else if *kubernetesMode && stats.Draining {
+		// Pod is on its way out
+		stats.Ready, stats.NotReady = false, "draining"
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("redis", func() Broker {
+		return &redisBroker{
+			pool: &redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return redis.DialURL(*redisURL, redis.DialConnectTimeout(DIAL_TIMEOUT), redis.DialReadTimeout(DIAL_TIMEOUT), redis.DialWriteTimeout(DIAL_TIMEOUT))
+				},
+				TestOnBorrow: func(conn redis.Conn, since time.Time) error {
+					if time.Since(since) < time.Minute {
+						return nil
+					}
+					_, err := conn.Do("PING")
+					return err
+				},
+				MaxIdle:     16,
+				IdleTimeout: 5 * time.Minute,
+			},
+			consumer: stats.Instance,
+			groups:   make(map[string]bool),
+		}
+	})
+}
+
+var (
+	/** Redis server for redis broker */
+	redisURL    = flag.String("redis", "redis://127.0.0.1:6379/0", "Redis URL for --broker redis, rediss:// for TLS, e.g. redis://:password@host:6379/0. Default: redis://127.0.0.1:6379/0")
+	redisPrefix = flag.String("redis-prefix", "workerman:", "Prefix of Redis keys of tubes. Default: workerman:")
+	redisGroup  = flag.String("redis-group", "workerman", "Redis consumer group, instances in the same group share jobs of tube. Default: workerman")
+	redisClaim  = flag.Duration("redis-claim-after", DEFAULT_TTR, "Time to run of Redis jobs: job not touched for that long is taken over by another consumer. Default: 1m")
+
+	/** Moves due delayed jobs into stream, members are "priority:nonce:body" */
+	redisPromote = redis.NewScript(2, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, member in ipairs(due) do
+	local pri, body = string.match(member, '^(%d+):[^:]*:(.*)$')
+	if pri then
+		redis.call('XADD', KEYS[1], '*', 'body', body, 'pri', pri)
+	end
+	redis.call('ZREM', KEYS[2], member)
+end
+return #due`)
+)
+
+/**
+ * Redis backend on Streams with consumer group. Each tube is a stream, instances read it as consumers named by instance name,
+ * so jobs pending on a consumer that went away are taken over after --redis-claim-after.
+ * Delayed jobs wait in sorted set "<tube>:delayed", buried ones go to stream "<tube>:buried". Priority is kept, but not ordered by
+ */
+type redisBroker struct {
+	pool     *redis.Pool
+	consumer string
+	lock     sync.Mutex
+	groups   map[string]bool // Tubes whose consumer group exists, guarded by lock
+}
+
+func (b *redisBroker) key(tube string) string {
+	return *redisPrefix + tube
+}
+
+func (b *redisBroker) Check() error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+/**
+ * Creates consumer group of tube, reading jobs put before it existed too. Reserver retries when Redis is down
+ */
+func (b *redisBroker) Subscribe(tube string) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if err := b.setup(conn, tube); err != nil {
+		tubeFailed(tube, fmt.Errorf("not connected: %v", err))
+	}
+}
+
+func (b *redisBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	delete(b.groups, tube)
+	b.lock.Unlock()
+}
+
+func (b *redisBroker) setup(conn redis.Conn, tube string) error {
+	b.lock.Lock()
+	done := b.groups[tube]
+	b.lock.Unlock()
+	if done {
+		return nil
+	}
+	_, err := conn.Do("XGROUP", "CREATE", b.key(tube), *redisGroup, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	b.lock.Lock()
+	b.groups[tube] = true
+	b.lock.Unlock()
+	return nil
+}
+
+/**
+ * Records failure: network errors degrade tube, missing group is created again on next reserve
+ */
+func (b *redisBroker) failed(tube string, err error) error {
+	if _, reply := err.(redis.Error); !reply {
+		tubeFailed(tube, err)
+	} else if strings.HasPrefix(err.Error(), "NOGROUP") {
+		b.lock.Lock()
+		delete(b.groups, tube)
+		b.lock.Unlock()
+	}
+	return err
+}
+
+/**
+ * Jobs in stream not yet delivered, and not pending on any consumer
+ */
+func (b *redisBroker) Stats(tube string) (int, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	length, err := redis.Int(conn.Do("XLEN", b.key(tube)))
+	if err != nil {
+		return 0, b.failed(tube, err)
+	}
+	summary, err := redis.Values(conn.Do("XPENDING", b.key(tube), *redisGroup))
+	if err != nil {
+		return 0, b.failed(tube, err)
+	}
+	var pending int
+	if len(summary) > 0 {
+		pending, _ = redis.Int(summary[0], nil)
+	}
+	return length - pending, nil
+}
+
+/**
+ * Takes over job left by another consumer if there is one, reads next job otherwise. Due delayed jobs are moved into stream first
+ */
+func (b *redisBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	key := b.key(tube)
+	if err := b.setup(conn, tube); err != nil {
+		return nil, b.failed(tube, err)
+	}
+	if _, err := redisPromote.Do(conn, key, key+":delayed", time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+		return nil, b.failed(tube, err)
+	}
+	claimed, err := redis.Values(conn.Do("XAUTOCLAIM", key, *redisGroup, b.consumer, int64(*redisClaim/time.Millisecond), "0-0", "COUNT", 1))
+	if err != nil {
+		return nil, b.failed(tube, err)
+	}
+	tubeRecovered(tube)
+	if len(claimed) > 1 {
+		if entries, _ := redis.Values(claimed[1], nil); len(entries) > 0 {
+			if job := redisJob(entries[0]); job != nil {
+				return job, nil
+			}
+		}
+	}
+	reply, err := redis.Values(redis.DoWithTimeout(conn, timeout+DIAL_TIMEOUT, "XREADGROUP", "GROUP", *redisGroup, b.consumer,
+		"COUNT", 1, "BLOCK", int64(timeout/time.Millisecond), "STREAMS", key, ">"))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, b.failed(tube, err)
+	}
+	// One stream with one entry: [[key, [[id, [field, value, ...]]]]]
+	for _, stream := range reply {
+		parts, _ := redis.Values(stream, nil)
+		if len(parts) < 2 {
+			continue
+		}
+		if entries, _ := redis.Values(parts[1], nil); len(entries) > 0 {
+			if job := redisJob(entries[0]); job != nil {
+				return job, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * Converts stream entry to job, nil for entry deleted meanwhile
+ */
+func redisJob(entry interface{}) *ReservedJob {
+	parts, err := redis.Values(entry, nil)
+	if err != nil || len(parts) < 2 {
+		return nil
+	}
+	id, _ := redis.String(parts[0], nil)
+	fields, _ := redis.Values(parts[1], nil)
+	job := &ReservedJob{Id: id, Priority: DEFAULT_PRIORITY, TTR: *redisClaim}
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := redis.String(fields[i], nil)
+		value, _ := redis.Bytes(fields[i+1], nil)
+		switch name {
+		case "body":
+			job.Body = value
+		case "pri":
+			if pri, err := strconv.ParseUint(string(value), 10, 32); err == nil {
+				job.Priority = uint32(pri)
+			}
+		}
+	}
+	return job
+}
+
+func (b *redisBroker) StopReserving(tube string) {
+}
+
+/**
+ * Claims job again for this consumer, which resets its idle time
+ */
+func (b *redisBroker) Touch(job *ReservedJob) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XCLAIM", b.key(job.Tube), *redisGroup, b.consumer, 0, job.Id, "JUSTID")
+	return err
+}
+
+func (b *redisBroker) Delete(job *ReservedJob) error {
+	return b.finish(job, "")
+}
+
+/**
+ * Adds job to the end of stream again
+ */
+func (b *redisBroker) Release(job *ReservedJob) error {
+	return b.finish(job, b.key(job.Tube))
+}
+
+func (b *redisBroker) Bury(job *ReservedJob) error {
+	return b.finish(job, b.key(job.Tube)+":buried")
+}
+
+/**
+ * Acknowledges and removes job, copying it into given stream first, in one transaction
+ */
+func (b *redisBroker) finish(job *ReservedJob, copyTo string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	key := b.key(job.Tube)
+	conn.Send("MULTI")
+	if copyTo != "" {
+		conn.Send("XADD", copyTo, "*", "body", job.Body, "pri", job.Priority)
+	}
+	conn.Send("XACK", key, *redisGroup, job.Id)
+	conn.Send("XDEL", key, job.Id)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+/**
+ * Adds job to stream of tube, delayed one to sorted set moved into stream when due. Time to run is --redis-claim-after for all jobs.
+ * Delayed job has no id until it is due, empty one is returned
+ */
+func (b *redisBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+	if delay > 0 {
+		due := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+		member := append([]byte(fmt.Sprintf("%d:%s:", priority, newRequestId())), body...)
+		_, err := conn.Do("ZADD", b.key(tube)+":delayed", due, member)
+		return "", err
+	}
+	return redis.String(conn.Do("XADD", b.key(tube), "*", "body", body, "pri", priority))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/** Time registration lives without being refreshed, it is refreshed three times within */
+const REGISTER_TTL = 30 * time.Second
+
+var (
+	/** Service registry instance announces itself in */
+	registerURL    = flag.String("register", "", "Service registry to register instance in, consul://host:8500 or etcd://host:2379, https with consul+https or etcd+https. Default: none")
+	registerPrefix = flag.String("register-prefix", "/workerman/instances/", "Key prefix of etcd registrations, Consul registers service workerman. Default: /workerman/instances/")
+
+	registryClient = &http.Client{Timeout: DIAL_TIMEOUT}
+)
+
+/**
+ * What registry knows of instance
+ */
+type Registration struct {
+	Instance string   // Name used in control tube names
+	Host     string   // Host name
+	Pid      int      // Process id
+	Tubes    []string // Subscribed tubes
+	Tags     []string `json:",omitempty"` // Tags of host, see --tags
+	Version  string   // Build version of binary
+	Ready    bool     // Command connection and all tube connections are up
+	NotReady string   `json:",omitempty"`
+	HTTP     string   `json:",omitempty"` // Address of HTTP control API, see --http-listen
+}
+
+/**
+ * Service registry backend
+ */
+type registry interface {
+	/** Registers instance or refreshes its registration, changed tells the record differs from last one sent */
+	register(record *Registration, changed bool) error
+	deregister() error
+	/** Returns names of registered instances */
+	instances() ([]string, error)
+}
+
+/**
+ * Registers instance with --register and keeps the registration fresh until shutdown. Returns function deregistering it,
+ * drained daemon calls it on exit, SIGTERM and SIGINT deregister before they take effect. After upgrade, new process
+ * keeps the registration
+ */
+func startRegistration() func() {
+	if *registerURL == "" {
+		return func() {}
+	}
+	backend, err := newRegistry(*registerURL)
+	if err != nil {
+		log.Fatalf("Fatal error: %v", err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go keepRegistered(backend, done, stopped)
+	deregister := func() {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		close(done)
+		<-stopped
+		stateLock.Lock()
+		upgraded := handedOver
+		stateLock.Unlock()
+		// After upgrade, registration belongs to the new process
+		if upgraded {
+			return
+		}
+		if err := backend.deregister(); err != nil {
+			log.Printf("Could not deregister from %s: %v", *registerURL, err)
+		} else {
+			log.Printf("Deregistered from %s", *registerURL)
+		}
+	}
+	stopping := []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	if *kubernetesMode {
+		// SIGTERM drains there, deregistered on exit
+		stopping = stopping[1:]
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stopping...)
+	go func() {
+		sig := <-signals
+		deregister()
+		// Signal takes effect as it would have without registration
+		signal.Reset(stopping...)
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	}()
+	return deregister
+}
+
+/**
+ * Creates registry backend of URL
+ */
+func newRegistry(address string) (registry, error) {
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid --register %s, expected e.g. consul://127.0.0.1:8500", address)
+	}
+	kind, scheme := parsed.Scheme, "http"
+	if strings.HasSuffix(kind, "+https") {
+		kind, scheme = strings.TrimSuffix(kind, "+https"), "https"
+	}
+	base := scheme + "://" + parsed.Host
+	switch kind {
+	case "consul":
+		return &consulRegistry{base: base, token: os.Getenv("CONSUL_HTTP_TOKEN")}, nil
+	case "etcd":
+		return &etcdRegistry{base: base}, nil
+	}
+	return nil, fmt.Errorf("unknown registry %s in --register, expected consul or etcd", kind)
+}
+
+/**
+ * Refreshes registration every third of REGISTER_TTL, at once when subscribed tubes or readiness change, until done
+ * or handed over
+ */
+func keepRegistered(backend registry, done, stopped chan struct{}) {
+	defer close(stopped)
+	var last *Registration
+	failing := false
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var refreshed time.Time
+	for {
+		stateLock.Lock()
+		upgraded := handedOver
+		stateLock.Unlock()
+		if upgraded {
+			return
+		}
+		record := currentRegistration()
+		changed := last == nil || !reflect.DeepEqual(record, last)
+		if changed || time.Since(refreshed) >= REGISTER_TTL/3 {
+			if err := backend.register(record, changed); err != nil {
+				if !failing {
+					log.Printf("Could not register with %s: %v", *registerURL, err)
+					failing = true
+				}
+				// Sent again in full once registry is back
+				last = nil
+			} else {
+				if last == nil {
+					log.Printf("Registered with %s as %s", *registerURL, record.Instance)
+				}
+				last, refreshed, failing = record, time.Now(), false
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+ * Returns registration record of instance as it is now. Takes stateLock itself
+ */
+func currentRegistration() *Registration {
+	host, _ := os.Hostname()
+	record := &Registration{Host: host, Pid: os.Getpid(), Tags: hostTags(), Version: buildVersion(), HTTP: *httpListen}
+	stateLock.Lock()
+	record.Instance, record.Ready, record.NotReady = stats.Instance, stats.Ready, stats.NotReady
+	for tube := range subscriptions {
+		record.Tubes = append(record.Tubes, tube)
+	}
+	stateLock.Unlock()
+	sort.Strings(record.Tubes)
+	return record
+}
+
+/**
+ * Returns module version binary was built as, "devel" for builds from source tree
+ */
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+/**
+ * Sends JSON request to registry and decodes JSON response into result, when given
+ */
+func registryRequest(method, address, token string, body, result interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, address, &payload)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("X-Consul-Token", token)
+	}
+	response, err := registryClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %s", response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+/**
+ * Registers instance as service workerman with local Consul agent, with TTL check passing while instance is ready
+ */
+type consulRegistry struct {
+	base, token string
+	id          string
+}
+
+func (c *consulRegistry) register(record *Registration, changed bool) error {
+	c.id = "workerman-" + record.Instance
+	status, note := "passing", "ready"
+	if !record.Ready {
+		status, note = "critical", record.NotReady
+	}
+	if changed {
+		service := map[string]interface{}{
+			"ID":   c.id,
+			"Name": "workerman",
+			"Tags": record.Tubes, // Meta values are too short for many tubes
+			"Meta": map[string]string{
+				"instance": record.Instance,
+				"host":     record.Host,
+				"version":  record.Version,
+				"http":     record.HTTP,
+				"tags":     strings.Join(record.Tags, ","),
+			},
+			"Check": map[string]interface{}{
+				"CheckID": c.id,
+				"Name":    "workerman ready",
+				"TTL":     REGISTER_TTL.String(),
+				"Status":  status,
+				// Instances that died without deregistering are removed in the end
+				"DeregisterCriticalServiceAfter": (10 * REGISTER_TTL).String(),
+			},
+		}
+		if err := registryRequest("PUT", c.base+"/v1/agent/service/register", c.token, service, nil); err != nil {
+			return err
+		}
+	}
+	update := map[string]string{"Status": status, "Output": note}
+	return registryRequest("PUT", c.base+"/v1/agent/check/update/"+url.PathEscape(c.id), c.token, update, nil)
+}
+
+func (c *consulRegistry) instances() ([]string, error) {
+	var services []struct {
+		ServiceMeta map[string]string
+	}
+	if err := registryRequest("GET", c.base+"/v1/catalog/service/workerman", c.token, nil, &services); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, service := range services {
+		if name := service.ServiceMeta["instance"]; name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (c *consulRegistry) deregister() error {
+	if c.id == "" {
+		return nil
+	}
+	return registryRequest("PUT", c.base+"/v1/agent/service/deregister/"+url.PathEscape(c.id), c.token, nil, nil)
+}
+
+/**
+ * Keeps record of instance under --register-prefix in etcd through its JSON gateway, bound to lease of REGISTER_TTL
+ */
+type etcdRegistry struct {
+	base  string
+	lease string
+}
+
+func (e *etcdRegistry) register(record *Registration, changed bool) error {
+	if e.lease != "" {
+		var alive struct {
+			Result struct {
+				TTL string
+			}
+		}
+		err := registryRequest("POST", e.base+"/v3/lease/keepalive", "", map[string]string{"ID": e.lease}, &alive)
+		if err != nil || alive.Result.TTL == "" || alive.Result.TTL == "0" {
+			// Lease expired while registry was away, record goes under new one
+			e.lease = ""
+		} else if !changed {
+			return nil
+		}
+	}
+	if e.lease == "" {
+		var granted struct {
+			ID    string
+			Error string `json:"error"`
+		}
+		ttl := int(REGISTER_TTL.Seconds())
+		if err := registryRequest("POST", e.base+"/v3/lease/grant", "", map[string]int{"TTL": ttl}, &granted); err != nil {
+			return err
+		}
+		if granted.ID == "" {
+			return fmt.Errorf("no lease granted: %s", granted.Error)
+		}
+		e.lease = granted.ID
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	put := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(*registerPrefix + record.Instance)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": e.lease,
+	}
+	return registryRequest("POST", e.base+"/v3/kv/put", "", put, nil)
+}
+
+func (e *etcdRegistry) deregister() error {
+	if e.lease == "" {
+		return nil
+	}
+	// Key goes with its lease
+	return registryRequest("POST", e.base+"/v3/lease/revoke", "", map[string]string{"ID": e.lease}, nil)
+}
+
+func (e *etcdRegistry) instances() ([]string, error) {
+	prefix := []byte(*registerPrefix)
+	// Range of prefix ends before its last byte increased, "\x00" ends with all keys
+	end := []byte{0}
+	if len(prefix) > 0 {
+		end = append([]byte{}, prefix...)
+		end[len(end)-1]++
+	}
+	query := map[string]string{
+		"key":       base64.StdEncoding.EncodeToString(prefix),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+	var found struct {
+		Kvs []struct {
+			Value []byte // Base64 in JSON
+		}
+	}
+	if err := registryRequest("POST", e.base+"/v3/kv/range", "", query, &found); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, kv := range found.Kvs {
+		var record Registration
+		if json.Unmarshal(kv.Value, &record) == nil && record.Instance != "" {
+			names = append(names, record.Instance)
+		}
+	}
+	return names, nil
+}
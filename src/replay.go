@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"strconv"
+	"time"
+)
+
+/** Jobs replayed per second if no rate given */
+const DEFAULT_REPLAY_RATE = 10
+
+/**
+ * Replay request: kick buried jobs of the tube, or move ready jobs from another (dead letter) tube into it
+ */
+type ReplayRequest struct {
+	Tube  string
+	Count uint   // Jobs to replay, 0 for all
+	Rate  uint   // Jobs per second, default 10
+	From  string `json:",omitempty"` // Tube to move jobs from instead of kicking buried ones
+}
+
+/**
+ * Replay progress, shown in status
+ */
+type ReplayStatus struct {
+	From     string `json:",omitempty"`
+	Count    uint
+	Replayed uint
+	Started  time.Time
+	Done     bool
+	Error    string `json:",omitempty"`
+}
+
+/**
+ * Process replay command: starts replaying in background and returns its status
+ */
+func replayJobs(req *ReplayRequest) []byte {
+	var response interface{}
+	if *brokerName != "beanstalkd" {
+		response = CommandError{fmt.Sprintf("replay is not supported by %s broker", *brokerName)}
+	} else if !subscriptions[req.Tube] {
+		response = CommandError{fmt.Sprintf("tube '%s' is not subscribed", req.Tube)}
+	} else if current, has := stats.Replays[req.Tube]; has && !current.Done {
+		response = CommandError{fmt.Sprintf("tube '%s' is being replayed already", req.Tube)}
+	} else if req.From != "" && checkTubeName(req.From) != nil {
+		response = CommandError{fmt.Sprintf("invalid tube name '%s': %v", req.From, checkTubeName(req.From))}
+	} else if req.From != "" && serverFor(req.From) != serverFor(req.Tube) {
+		response = CommandError{fmt.Sprintf("tubes '%s' and '%s' are on different servers", req.From, req.Tube)}
+	} else {
+		if req.Rate == 0 {
+			req.Rate = DEFAULT_REPLAY_RATE
+		}
+		progress := &ReplayStatus{From: req.From, Count: req.Count, Started: time.Now()}
+		stats.Replays[req.Tube] = progress
+		go replayer(*req, progress, serverFor(req.Tube))
+		response = progress
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
+
+/**
+ * Replays jobs in batches of Rate jobs once a second, until Count reached or nothing left.
+ * Progress is shared with status, so it is only changed under stateLock
+ */
+func replayer(req ReplayRequest, progress *ReplayStatus, address string) {
+	source := "buried jobs"
+	if req.From != "" {
+		source = req.From
+	}
+	log.Printf("Replaying %s into %s at %d job(s)/s", source, req.Tube, req.Rate)
+	publishEvent("replay", req.Tube, "started from "+source)
+	conn, err := dialServer(address)
+	if err == nil {
+		defer conn.Close()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			batch := req.Rate
+			if req.Count > 0 && req.Count-progress.Replayed < batch {
+				batch = req.Count - progress.Replayed
+			}
+			var moved uint
+			if req.From != "" {
+				moved, err = moveJobs(conn, req.From, req.Tube, batch)
+			} else {
+				moved, err = kickBuried(conn, req.Tube, batch)
+			}
+			stateLock.Lock()
+			progress.Replayed += moved
+			stateLock.Unlock()
+			if err != nil || moved < batch || (req.Count > 0 && progress.Replayed >= req.Count) {
+				break
+			}
+			<-ticker.C
+		}
+	}
+	stateLock.Lock()
+	if err != nil {
+		progress.Error = err.Error()
+		log.Printf("Replay into %s failed after %d job(s): %v", req.Tube, progress.Replayed, err)
+	} else {
+		log.Printf("Replayed %d job(s) into %s", progress.Replayed, req.Tube)
+	}
+	progress.Done = true
+	stateLock.Unlock()
+	publishEvent("replay", req.Tube, fmt.Sprintf("done, %d job(s) replayed", progress.Replayed))
+}
+
+/**
+ * Kicks up to count buried jobs
+ *
+ * Beanstalkd kicks delayed jobs when there are no buried ones, so kick is bounded by buried count.
+ */
+func kickBuried(conn *beanstalk.Conn, tubeName string, count uint) (uint, error) {
+	tube := &beanstalk.Tube{conn, tubeName}
+	tubeStats, err := tube.Stats()
+	if err != nil {
+		return 0, err
+	}
+	buried, _ := strconv.Atoi(tubeStats["current-jobs-buried"])
+	if uint(buried) < count {
+		count = uint(buried)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	kicked, err := tube.Kick(int(count))
+	return uint(kicked), err
+}
+
+/**
+ * Moves up to count ready jobs from one tube into another, keeping their priority
+ */
+func moveJobs(conn *beanstalk.Conn, from, to string, count uint) (uint, error) {
+	source := &beanstalk.TubeSet{conn, map[string]bool{from: true, "default": false}}
+	target := &beanstalk.Tube{conn, to}
+	var moved uint
+	for moved < count {
+		id, body, err := source.Reserve(0)
+		if err != nil {
+			if isTimeout(err) {
+				return moved, nil
+			}
+			return moved, err
+		}
+		priority := uint32(DEFAULT_PRIORITY)
+		if jobStats, err := conn.StatsJob(id); err == nil {
+			if pri, err := strconv.ParseUint(jobStats["pri"], 10, 32); err == nil {
+				priority = uint32(pri)
+			}
+		}
+		if _, err := target.Put(body, priority, 0, DEFAULT_TTR); err != nil {
+			conn.Release(id, priority, 0)
+			return moved, err
+		}
+		conn.Delete(id)
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	/** How long reserver waits for a job before checking whether it should stop */
+	RESERVE_TIMEOUT = time.Second
+	/** Environment variables telling worker which job it got in reserve mode */
+	JOB_ID_ENV   = "WORKERMAN_JOB_ID"
+	JOB_TUBE_ENV = "WORKERMAN_JOB_TUBE"
+	/** Exit code of worker asking to release job for another try instead of burying it, EX_TEMPFAIL of sysexits.h */
+	EXIT_RETRY = 75
+)
+
+func init() {
+	registerFeature("reserve-mode", "Reserve jobs in workerman and pass them to worker on stdin, instead of polling tube stats and letting worker reserve")
+}
+
+/**
+ * Job reserved by workerman for worker. It is deleted when worker succeeds, buried when it fails
+ */
+type ReservedJob struct {
+	Id       string
+	Tube     string
+	Body     []byte
+	Priority uint32
+	TTR      time.Duration
+	plain    []byte      // Body opened for worker when it was encrypted, see openJobPayload
+	claim    *ClaimCheck // Object body was fetched from, deleted with job, see fetchJobPayload
+	reserver *reserver
+	handle   interface{} // Reservation as broker keeps it
+
+	correlation string // Correlation id of opened payload once correlated, see correlationId
+	correlated  bool
+}
+
+/**
+ * Reserves jobs of one tube from broker and starts worker for each, as long as limits allow
+ */
+type reserver struct {
+	tube string
+	stop chan struct{}
+	// Broker gets reserves and job operations of tube from reserver goroutine only, others queue operations
+	ops     chan func()
+	jobs    sync.WaitGroup
+	stopped bool // Stop requested, guarded by stateLock
+}
+
+/** Reservers per tube, stopped ones until their jobs finish. Guarded by stateLock */
+var reservers = make(map[string]*reserver)
+
+/**
+ * Starts reservers for subscribed tubes in reserve mode, stops the rest. Takes stateLock itself
+ *
+ * In dry run mode jobs are not reserved, those tubes are polled like the others.
+ */
+func superviseReservers() {
+	if *dryRun {
+		return
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for tube := range subscriptions {
+		if _, running := reservers[tube]; !running && reserveMode(tube) {
+			r := &reserver{tube: tube, stop: make(chan struct{}), ops: make(chan func(), 64)}
+			reservers[tube] = r
+			go r.run()
+		}
+	}
+	for tube, r := range reservers {
+		if !r.stopped && (!subscriptions[tube] || !reserveMode(tube)) {
+			close(r.stop)
+			r.stopped = true
+		}
+	}
+}
+
+/**
+ * Reserve loop: waits for capacity, then for a job, retrying with backoff while broker fails. Job reserved while
+ * other starts took the capacity is released back
+ *
+ * Capacity is checked regardless of degraded connection, as reserving is what reconnects it.
+ */
+func (r *reserver) run() {
+	log.Printf("Reserving jobs of %s", r.tube)
+	defer r.close()
+	delay := *reconnectDelay
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		r.runOperations()
+		stateLock.Lock()
+		can := hasCapacity(r.tube)
+		stateLock.Unlock()
+		if !can {
+			r.sleep(*interval)
+			continue
+		}
+		job, err := broker.Reserve(r.tube, RESERVE_TIMEOUT)
+		if err != nil {
+			log.Printf("Could not reserve job of %s: %v, retrying in %v", r.tube, err, delay)
+			r.sleep(delay)
+			if delay *= 2; delay > RECONNECT_BACKOFF_MAX {
+				delay = RECONNECT_BACKOFF_MAX
+			}
+			continue
+		}
+		delay = *reconnectDelay
+		if job == nil {
+			continue
+		}
+		job.Tube, job.reserver = r.tube, r
+		// Limits may have been reached by other starts or changed while waiting for the job
+		stateLock.Lock()
+		can = hasCapacity(r.tube)
+		if can {
+			countRun(r.tube)
+		}
+		stateLock.Unlock()
+		if !can {
+			if err := broker.Release(job); err != nil {
+				log.Printf("Could not release job %s of %s: %v", job.Id, r.tube, err)
+			}
+			r.sleep(*interval)
+			continue
+		}
+		takeSpawn()
+		r.jobs.Add(1)
+		go workerRunner(r.tube, job)
+	}
+}
+
+/**
+ * Sleeps unless stopped meanwhile, running queued job operations
+ */
+func (r *reserver) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case op := <-r.ops:
+			op()
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+/**
+ * Runs job operations queued so far
+ */
+func (r *reserver) runOperations() {
+	for {
+		select {
+		case op := <-r.ops:
+			op()
+		default:
+			return
+		}
+	}
+}
+
+/**
+ * Keeps broker reserving until running workers finish, as closing connection would release their jobs
+ */
+func (r *reserver) close() {
+	log.Printf("Stopped reserving jobs of %s", r.tube)
+	finished := make(chan struct{})
+	go func() {
+		r.jobs.Wait()
+		close(finished)
+	}()
+	for {
+		select {
+		case op := <-r.ops:
+			op()
+		case <-finished:
+			r.runOperations()
+			broker.StopReserving(r.tube)
+			// Tube may get a new reserver now
+			stateLock.Lock()
+			delete(reservers, r.tube)
+			stateLock.Unlock()
+			return
+		}
+	}
+}
+
+/**
+ * Keeps job reserved while worker runs, until done is closed. Touch may wait for reserve in progress,
+ * so it is sent at half of time to run
+ */
+func (job *ReservedJob) keepAlive(done chan struct{}) {
+	period := job.TTR / 2
+	if period < 500*time.Millisecond {
+		period = 500 * time.Millisecond
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			select {
+			case job.reserver.ops <- func() { broker.Touch(job) }:
+			default:
+				// Reserver is busy with plenty of operations, next tick tries again
+			}
+		}
+	}
+}
+
+/**
+ * Deletes job after successful run, buries it after failure so it can be replayed, or releases it back
+ * when worker could not be run at all
+ */
+func (job *ReservedJob) finish(outcome string) {
+	job.reserver.ops <- func() {
+		defer job.reserver.jobs.Done()
+		var err error
+		switch outcome {
+		case "delete":
+			if err = broker.Delete(job); err == nil && job.claim != nil {
+				go deleteClaim(job)
+			}
+		case "bury":
+			err = broker.Bury(job)
+		default:
+			err = broker.Release(job)
+		}
+		if err != nil {
+			log.Printf("Could not %s job %s of %s: %v", outcome, job.Id, job.Tube, err)
+		}
+	}
+}
+
+/**
+ * Checks if worker exited with EXIT_RETRY, or hook plugin or secrets it needs could not be reached
+ */
+func retryLater(err error) bool {
+	var exitErr *exec.ExitError
+	var preforkErr *preforkError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == EXIT_RETRY || errors.As(err, &preforkErr) && preforkErr.exit == EXIT_RETRY ||
+		errors.Is(err, errPluginUnavailable) || errors.Is(err, errSecretUnavailable)
+}
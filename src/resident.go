@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	/** Marks resident worker processes, so that they are not adopted as job workers after crash */
+	RESIDENT_ENV = "_WORKERMAN_RESIDENT"
+	/** Restart delay after resident worker exits, doubled on each quick exit */
+	RESIDENT_BACKOFF_MIN = time.Second
+	/** Longest restart delay, resident worker running that long resets the delay */
+	RESIDENT_BACKOFF_MAX = time.Minute
+	/** How long stopped resident worker gets to exit before SIGKILL */
+	RESIDENT_STOP_TIMEOUT = 10 * time.Second
+	/** Longest output line of resident worker that is logged */
+	MAX_RESIDENT_LINE = 1024 * 1024
+)
+
+/**
+ * Supervised instance of resident worker, closing stop makes it exit
+ */
+type residentInstance struct {
+	stop chan struct{}
+}
+
+/** Running resident worker instances per tube, guarded by stateLock */
+var residents = make(map[string][]*residentInstance)
+
+/**
+ * Starts or stops resident worker instances to match Resident setting of each tube.
+ * Paused, draining and unsubscribed tubes get none. Takes stateLock itself
+ */
+func superviseResidents() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	tubes := make(map[string]bool)
+	for tube := range subscriptions {
+		tubes[tube] = true
+	}
+	for tube := range residents {
+		tubes[tube] = true
+	}
+	for tube := range tubes {
+		var want int
+		if subscriptions[tube] && !stats.Draining && !stats.Paused["*"] && !stats.Paused[tube] {
+			want = int(schedulingConfig(tube).Resident)
+		}
+		current := residents[tube]
+		for len(current) < want {
+			instance := &residentInstance{make(chan struct{})}
+			current = append(current, instance)
+			go runResident(tube, instance)
+		}
+		for len(current) > want {
+			close(current[len(current)-1].stop)
+			current = current[:len(current)-1]
+		}
+		if len(current) > 0 {
+			residents[tube] = current
+		} else {
+			delete(residents, tube)
+		}
+	}
+}
+
+/**
+ * Keeps resident worker running until stopped, restarting it with backoff when it exits
+ */
+func runResident(worker string, instance *residentInstance) {
+	delay := RESIDENT_BACKOFF_MIN
+	for {
+		started := time.Now()
+		err := runResidentProcess(worker, instance)
+		select {
+		case <-instance.stop:
+			return
+		default:
+		}
+		if time.Since(started) >= RESIDENT_BACKOFF_MAX {
+			delay = RESIDENT_BACKOFF_MIN
+		}
+		log.Printf("Resident worker %s exited (%v), restarting in %v", worker, err, delay)
+		publishEvent("restarting", worker, fmt.Sprintf("exited (%v), restarting in %v", err, delay))
+		select {
+		case <-instance.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > RESIDENT_BACKOFF_MAX {
+			delay = RESIDENT_BACKOFF_MAX
+		}
+	}
+}
+
+/**
+ * Runs resident worker process once, logging its output line by line as it comes
+ */
+func runResidentProcess(worker string, instance *residentInstance) error {
+	stateLock.Lock()
+	if !checkIntegrity(worker) {
+		violation := stats.Integrity[worker]
+		stateLock.Unlock()
+		return fmt.Errorf("refused by integrity check: %s", violation)
+	}
+	config := effectiveConfig(worker)
+	stats.Runs[worker]++
+	stats.TotalRuns++
+	stats.Resident[worker]++
+	stats.TotalResident++
+	run := stats.Runs[worker]
+	stateLock.Unlock()
+	log.Printf("Starting resident %s:%d", worker, run)
+	publishEvent("started", worker, "resident")
+	err := superviseProcess(worker, run, config, instance)
+	stateLock.Lock()
+	stats.Resident[worker]--
+	stats.TotalResident--
+	if err != nil {
+		stats.Errors[worker]++
+	}
+	stateLock.Unlock()
+	if err != nil {
+		publishEvent("failed", worker, err.Error())
+	} else {
+		publishEvent("finished", worker, "resident")
+	}
+	return err
+}
+
+/**
+ * Runs process until it exits or instance is stopped, stopping with SIGTERM and then SIGKILL
+ */
+func superviseProcess(worker string, run uint64, config EffectiveConfig, instance *residentInstance) error {
+	cmd := exec.Command("./"+worker, "")
+	umask, err := parseUmask(config.Umask)
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(workerEnv(config), WORKER_ENV+"="+worker, RESIDENT_ENV+"=1")
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	done, err := startChildUmask(cmd, umask)
+	if err != nil {
+		return err
+	}
+	defer done()
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-instance.stop:
+			log.Printf("Stopping resident %s:%d", worker, run)
+			cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-exited:
+			case <-time.After(RESIDENT_STOP_TIMEOUT):
+				cmd.Process.Kill()
+			}
+		case <-exited:
+		}
+	}()
+	lines := bufio.NewScanner(output)
+	lines.Buffer(make([]byte, 4096), MAX_RESIDENT_LINE)
+	for lines.Scan() {
+		log.Printf("Worker %s:%d output: %s", worker, run, loggableOutput(lines.Bytes()))
+	}
+	// Line too long, keep draining so that worker does not block on write
+	io.Copy(ioutil.Discard, output)
+	err = cmd.Wait()
+	close(exited)
+	return err
+}
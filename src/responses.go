@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	/** How often responses are checked for being stale */
+	RESPONSE_SWEEP_INTERVAL = 10 * time.Second
+	/** Responses remembered for deletion at most, oldest are forgotten beyond */
+	RESPONSES_TRACKED = 10000
+)
+
+var (
+	/** Limits of responses put into response and reply tubes */
+	responseTTL     = flag.Duration("response-ttl", time.Hour, "Responses nobody took from response and reply tubes are deleted after this long, commands may ask for shorter with ResponseTTL. 0 to keep them. Default: 1h")
+	responseMaxSize = flag.Int("response-max-size", 0, "Largest response put into response tube in bytes, bigger ones are replaced by error, e.g. 65535 for default max job size of beanstalkd. Default: 0, no limit")
+	replyTubes      = flag.Bool("reply-tubes", false, "Put responses to commands with RequestId and no ReplyTo into per-request tube <response tube>.<RequestId> instead of response tube. Default: false")
+
+	responsesLock sync.Mutex
+	sentResponses []sentResponse // Responses to delete once stale, guarded by responsesLock
+)
+
+/**
+ * Response put into tube, deleted when it is still there at expiry
+ */
+type sentResponse struct {
+	id         uint64
+	tube       string
+	expires    time.Time
+	conn       *beanstalk.Conn // Job ids are per server, response is forgotten once connection is replaced
+	controller bool            // Put through controller connection rather than the command one
+}
+
+/**
+ * Returns response to command for its response tube, in encoding command came in and compressed if big.
+ * Response over --response-max-size is replaced by error saying so
+ */
+func responseBody(cmd WorkerCommand, payload []byte) []byte {
+	body := encodeResponse(cmd, payload)
+	if *responseMaxSize > 0 && len(body) > *responseMaxSize {
+		log.Printf("Response to %s of %d bytes is over --response-max-size, sending error instead", cmd.Command, len(body))
+		failure, _ := json.Marshal(CommandError{fmt.Sprintf("response of %d bytes is over --response-max-size of %d", len(body), *responseMaxSize)})
+		body = encodeResponse(cmd, failure)
+	}
+	return body
+}
+
+/**
+ * Returns tube response to command goes to: its reply tube, per-request one with --reply-tubes, or shared tube given
+ */
+func replyTube(cmd WorkerCommand, shared string) string {
+	if cmd.ReplyTo != "" {
+		return cmd.ReplyTo
+	}
+	if *replyTubes && cmd.RequestId != "" {
+		if name := shared + "." + cmd.RequestId; checkTubeName(name) == nil {
+			return name
+		}
+	}
+	return shared
+}
+
+/**
+ * Remembers response put into tube for deletion after TTL of command, or --response-ttl if command asks for none
+ * or longer. Per-request tube goes away with its last response. Takes responsesLock itself
+ */
+func trackResponse(cmd WorkerCommand, conn *beanstalk.Conn, tube string, id uint64, controller bool) {
+	ttl := *responseTTL
+	if cmd.ResponseTTL != nil && cmd.ResponseTTL.Duration > 0 && (ttl <= 0 || cmd.ResponseTTL.Duration < ttl) {
+		ttl = cmd.ResponseTTL.Duration
+	}
+	if ttl <= 0 {
+		return
+	}
+	responsesLock.Lock()
+	defer responsesLock.Unlock()
+	sentResponses = append(sentResponses, sentResponse{id, tube, time.Now().Add(ttl), conn, controller})
+	if len(sentResponses) > RESPONSES_TRACKED {
+		// Left for good, better than growing without bound when responses come faster than they expire
+		sentResponses = sentResponses[len(sentResponses)-RESPONSES_TRACKED:]
+	}
+}
+
+/**
+ * Deletes responses nobody took before they expired, every RESPONSE_SWEEP_INTERVAL
+ */
+func sweepResponses() {
+	for range time.Tick(RESPONSE_SWEEP_INTERVAL) {
+		deleted := 0
+		for _, response := range takeStaleResponses(time.Now()) {
+			connected, err := false, error(nil)
+			if response.controller {
+				controllerLock.Lock()
+				if connected = controllerConn == response.conn; connected {
+					err = controllerConn.Delete(response.id)
+				}
+				controllerLock.Unlock()
+			} else {
+				commandLock.Lock()
+				if connected = commandConn == response.conn && !commandReconnecting; connected {
+					err = commandConn.Delete(response.id)
+				}
+				commandLock.Unlock()
+			}
+			if cerr, ok := err.(beanstalk.ConnError); !connected || ok && cerr.Err == beanstalk.ErrNotFound {
+				// Taken meanwhile, or left on server connection was lost to
+				continue
+			}
+			if err != nil {
+				log.Printf("Could not delete stale response %d in %s: %v", response.id, response.tube, err)
+			} else {
+				deleted++
+			}
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d stale response(s)", deleted)
+		}
+	}
+}
+
+/**
+ * Returns responses expired by now, forgetting them. Takes responsesLock itself
+ */
+func takeStaleResponses(now time.Time) []sentResponse {
+	responsesLock.Lock()
+	defer responsesLock.Unlock()
+	var stale []sentResponse
+	kept := sentResponses[:0]
+	for _, response := range sentResponses {
+		if now.After(response.expires) {
+			stale = append(stale, response)
+		} else {
+			kept = append(kept, response)
+		}
+	}
+	sentResponses = kept
+	return stale
+}
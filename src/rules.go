@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+/**
+ * Routing rule of tube, e.g. {"Match": {"version": 1}, "Set": {"version": 2, "meta.migrated": true}}. Rules are tried in
+ * order on JSON object payloads of jobs workerman reserves, the first one matching applies: fields are rewritten for
+ * worker, then job goes to Route tube or is dropped if asked to
+ */
+type Rule struct {
+	Match  map[string]interface{} `json:",omitempty"` // Field paths like "meta.version" with values payload must have, all of them
+	Set    map[string]interface{} `json:",omitempty"` // Field paths with values to write, objects on the way are created
+	Remove []string               `json:",omitempty"` // Field paths to remove
+	Route  string                 `json:",omitempty"` // Tube job is put into instead of running worker
+	Drop   bool                   `json:",omitempty"` // Job is deleted without running worker
+}
+
+/**
+ * Applies first rule of tube matching opened payload of reserved job. Returns true when job is done with, routed or
+ * dropped, worker must not be started for it then
+ */
+func applyJobRules(worker string, config EffectiveConfig, job *ReservedJob) bool {
+	if len(config.Rules) == 0 {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(job.plain))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if decoder.Decode(&payload) != nil {
+		// Rules are about JSON objects, anything else goes to worker as it is
+		return false
+	}
+	index := -1
+	for i, rule := range config.Rules {
+		if ruleMatches(rule, payload) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	rule := config.Rules[index]
+	countRuleHit(worker, index, len(config.Rules))
+	if rule.Drop {
+		log.Printf("Rule %d of %s dropped job %s%s", index, worker, job.Id, correlationTag(job))
+		publishJobEvent("finished", worker, job, "dropped by rule")
+		return rejectJob(worker, job, "delete", "")
+	}
+	// Job body is what worker gets unless it had to be fetched, opened, decompressed or migrated
+	cameAsIs := bytes.Equal(job.plain, job.Body)
+	rewritten := len(rule.Set) > 0 || len(rule.Remove) > 0
+	if rewritten {
+		for path, value := range rule.Set {
+			setField(payload, path, value)
+		}
+		for _, path := range rule.Remove {
+			removeField(payload, path)
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Could not rewrite job %s of %s by rule %d: %v", job.Id, worker, index, err)
+			return false
+		}
+		job.plain = body
+	}
+	if rule.Route == "" {
+		return false
+	}
+	body := job.Body
+	if rewritten {
+		if !cameAsIs {
+			// Rewritten payload of encrypted, compressed or offloaded job would be put in the clear
+			log.Printf("Rule %d of %s can not route job %s rewritten, it did not come as plain JSON, bury it", index, worker, job.Id)
+			return rejectJob(worker, job, "bury", "rule: can not route rewritten job that did not come as plain JSON")
+		}
+		body = job.plain
+	}
+	id, err := broker.Put(rule.Route, body, job.Priority, 0, job.TTR)
+	if err != nil {
+		log.Printf("Could not route job %s of %s to %s by rule %d: %v", job.Id, worker, rule.Route, index, err)
+		return rejectJob(worker, job, "release", "")
+	}
+	log.Printf("Rule %d of %s routed job %s to %s as %s%s", index, worker, job.Id, rule.Route, id, correlationTag(job))
+	// Routed claim check still refers to its object
+	job.claim = nil
+	return rejectJob(worker, job, "delete", "")
+}
+
+/**
+ * Checks if payload has all fields of Match with their values, compared as JSON
+ */
+func ruleMatches(rule Rule, payload map[string]interface{}) bool {
+	for path, want := range rule.Match {
+		have, found := lookupField(payload, path)
+		if !found {
+			return false
+		}
+		haveJson, _ := json.Marshal(have)
+		wantJson, _ := json.Marshal(want)
+		if !bytes.Equal(haveJson, wantJson) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Returns value at dotted path of payload
+ */
+func lookupField(payload map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	object := payload
+	for _, part := range parts[:len(parts)-1] {
+		next, isObject := object[part].(map[string]interface{})
+		if !isObject {
+			return nil, false
+		}
+		object = next
+	}
+	value, found := object[parts[len(parts)-1]]
+	return value, found
+}
+
+/**
+ * Writes value at dotted path of payload, replacing what is on the way but is no object
+ */
+func setField(payload map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	object := payload
+	for _, part := range parts[:len(parts)-1] {
+		next, isObject := object[part].(map[string]interface{})
+		if !isObject {
+			next = make(map[string]interface{})
+			object[part] = next
+		}
+		object = next
+	}
+	object[parts[len(parts)-1]] = value
+}
+
+/**
+ * Removes value at dotted path of payload, if it is there
+ */
+func removeField(payload map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	object := payload
+	for _, part := range parts[:len(parts)-1] {
+		next, isObject := object[part].(map[string]interface{})
+		if !isObject {
+			return
+		}
+		object = next
+	}
+	delete(object, parts[len(parts)-1])
+}
+
+/**
+ * Counts job rule index of tube applied to, in RuleHits of status. Takes stateLock itself
+ */
+func countRuleHit(tube string, index, rules int) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stats.RuleHits == nil {
+		stats.RuleHits = make(map[string][]uint64)
+	}
+	hits := stats.RuleHits[tube]
+	if len(hits) != rules {
+		// Rules of tube changed
+		hits = make([]uint64, rules)
+	}
+	hits[index]++
+	stats.RuleHits[tube] = hits
+}
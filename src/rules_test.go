@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+/**
+ * Decodes payload the way applyJobRules does, numbers kept as they were written
+ */
+func rulePayload(t *testing.T, data string) map[string]interface{} {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		match   string
+		payload string
+		want    bool
+	}{
+		{"empty match", `{}`, `{"version": 1}`, true},
+		{"number", `{"version": 1}`, `{"version": 1}`, true},
+		{"other number", `{"version": 1}`, `{"version": 2}`, false},
+		{"string is not number", `{"version": 1}`, `{"version": "1"}`, false},
+		{"nested path", `{"meta.source": "api"}`, `{"meta": {"source": "api"}}`, true},
+		{"missing field", `{"meta.source": "api"}`, `{"meta": {}}`, false},
+		{"path through non-object", `{"meta.source": "api"}`, `{"meta": "api"}`, false},
+		{"all fields must match", `{"a": true, "b": null}`, `{"a": true, "b": 0}`, false},
+		{"null", `{"b": null}`, `{"b": null}`, true},
+		{"object", `{"to": {"name": "x"}}`, `{"to": {"name": "x"}}`, true},
+		{"array", `{"tags": ["a", "b"]}`, `{"tags": ["b", "a"]}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule Rule
+			if err := json.Unmarshal([]byte(`{"Match": `+test.match+`}`), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if got := ruleMatches(rule, rulePayload(t, test.payload)); got != test.want {
+				t.Errorf("ruleMatches(%s, %s) = %v, want %v", test.match, test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetField(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		path    string
+		value   interface{}
+		want    string
+	}{
+		{"top level", `{"a": 1}`, "b", true, `{"a":1,"b":true}`},
+		{"overwrite", `{"a": 1}`, "a", 2, `{"a":2}`},
+		{"creates objects", `{}`, "meta.migrated.by", "rule", `{"meta":{"migrated":{"by":"rule"}}}`},
+		{"replaces non-object on the way", `{"meta": 1}`, "meta.v", 2, `{"meta":{"v":2}}`},
+		{"keeps siblings", `{"meta": {"a": 1}}`, "meta.b", 2, `{"meta":{"a":1,"b":2}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := rulePayload(t, test.payload)
+			setField(payload, test.path, test.value)
+			if got, _ := json.Marshal(payload); string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoveField(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		path    string
+		want    string
+	}{
+		{"top level", `{"a": 1, "b": 2}`, "a", `{"b":2}`},
+		{"nested", `{"meta": {"a": 1, "b": 2}}`, "meta.a", `{"meta":{"b":2}}`},
+		{"missing", `{"a": 1}`, "b", `{"a":1}`},
+		{"path through non-object", `{"meta": 1}`, "meta.a", `{"meta":1}`},
+		{"missing object", `{"a": 1}`, "meta.a", `{"a":1}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := rulePayload(t, test.payload)
+			removeField(payload, test.path)
+			if got, _ := json.Marshal(payload); string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
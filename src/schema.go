@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Schema files are checked for changes at most that often, and how many rejected jobs status keeps per tube */
+const (
+	SCHEMA_RECHECK       = time.Second
+	SCHEMA_REJECTED_KEPT = 20
+)
+
+/**
+ * Job buried because its payload does not match Schema of its tube, so it can be found with peek-buried and replayed
+ * once fixed
+ */
+type InvalidJob struct {
+	Id    string
+	Time  time.Time
+	Error string
+}
+
+var (
+	/** Schema could not be read or compiled, job is released rather than buried */
+	errSchemaUnavailable = errors.New("schema unavailable")
+
+	schemaLock sync.Mutex
+	schemas    = make(map[string]*compiledSchema) // By absolute path, guarded by schemaLock
+)
+
+/** Schema as of size and modification time of its file */
+type compiledSchema struct {
+	checked time.Time
+	info    os.FileInfo
+	schema  *jsonschema.Schema
+	err     error
+}
+
+/**
+ * Returns absolute path of file setting like Schema, relative ones are next to config file
+ */
+func configRelative(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	dir := filepath.Dir(cfgPath)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(myDir, dir)
+	}
+	return filepath.Join(dir, path)
+}
+
+/**
+ * Returns compiled schema at path, compiling it again when file changed. Takes schemaLock itself
+ */
+func loadSchema(path string) (*jsonschema.Schema, error) {
+	path = configRelative(path)
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+	state := schemas[path]
+	if state == nil {
+		state = &compiledSchema{}
+		schemas[path] = state
+	}
+	if time.Since(state.checked) < SCHEMA_RECHECK {
+		return state.schema, state.err
+	}
+	state.checked = time.Now()
+	info, err := os.Stat(path)
+	if err != nil {
+		state.info, state.schema, state.err = nil, nil, err
+		return nil, err
+	}
+	if old := state.info; old != nil && old.Size() == info.Size() && old.ModTime().Equal(info.ModTime()) {
+		return state.schema, state.err
+	}
+	state.info = info
+	state.schema, state.err = jsonschema.NewCompiler().Compile(path)
+	if state.err != nil {
+		log.Printf("Schema %s is not valid, jobs checked against it are released: %v", path, state.err)
+	} else {
+		log.Printf("Loaded schema %s", path)
+	}
+	return state.schema, state.err
+}
+
+/**
+ * Checks job payload against Schema of tube, nil if it matches or tube has none
+ */
+func checkPayload(config EffectiveConfig, body []byte) error {
+	if config.Schema == "" {
+		return nil
+	}
+	schema, err := loadSchema(config.Schema)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSchemaUnavailable, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return fmt.Errorf("payload is not JSON: %v", err)
+	}
+	return schema.Validate(payload)
+}
+
+/**
+ * Buries reserved job whose opened payload does not match Schema of tube, keeping the validation error in Invalid of
+ * status, or releases it when schema can not be loaded. True is returned then and worker must not be started
+ */
+func rejectInvalidJob(worker string, config EffectiveConfig, job *ReservedJob) bool {
+	err := checkPayload(config, job.plain)
+	if err == nil {
+		return false
+	}
+	message := strings.Join(strings.Fields(err.Error()), " ")
+	if errors.Is(err, errSchemaUnavailable) {
+		log.Printf("Could not check payload of job %s of %s, release it: %s", job.Id, worker, message)
+		return rejectJob(worker, job, "release", "schema: "+message)
+	}
+	log.Printf("Payload of job %s of %s does not match schema, bury it: %s", job.Id, worker, message)
+	stateLock.Lock()
+	if stats.Invalid == nil {
+		stats.Invalid = make(map[string][]InvalidJob)
+	}
+	rejected := append(stats.Invalid[worker], InvalidJob{job.Id, time.Now(), message})
+	if len(rejected) > SCHEMA_REJECTED_KEPT {
+		rejected = rejected[len(rejected)-SCHEMA_REJECTED_KEPT:]
+	}
+	stats.Invalid[worker] = rejected
+	stateLock.Unlock()
+	return rejectJob(worker, job, "bury", "schema: "+message)
+}
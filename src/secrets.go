@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	/** Secret stores worker secrets are fetched from */
+	vaultAddr      = flag.String("vault", "", "Vault address for vault: secrets, e.g. https://vault:8200. Default: VAULT_ADDR environment variable")
+	vaultTokenFile = flag.String("vault-token-file", "", "File with Vault token, read on each fetch so it may be renewed by an agent. Default: VAULT_TOKEN environment variable")
+	secretsRegion  = flag.String("secrets-region", "", "AWS region of aws: secrets not given as ARN. Default: from AWS_REGION or AWS config")
+	secretsTTL     = flag.Duration("secrets-ttl", 5*time.Minute, "How long fetched secret is reused before it is fetched again, shorter Vault lease takes precedence. Default: 5m")
+
+	/** Secret could not be fetched, job is released rather than failed */
+	errSecretUnavailable = errors.New("secret unavailable")
+
+	secretsLock    sync.Mutex
+	secretsCache   = make(map[string]cachedSecret)           // By reference, guarded by secretsLock
+	secretsClients = make(map[string]*secretsmanager.Client) // By region, empty for default, guarded by secretsLock
+)
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+/**
+ * Secret reference from Secrets setting: vault:<path>#<field> reads field of Vault secret (KV version 1 or 2),
+ * aws:<name or ARN>[#<field>] reads AWS Secrets Manager secret string, or field of it when it is JSON
+ */
+type secretRef struct {
+	store string
+	path  string
+	field string
+}
+
+func parseSecretRef(ref string) (secretRef, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return secretRef{}, fmt.Errorf("secret %q is not vault:<path>#<field> or aws:<name>[#<field>]", ref)
+	}
+	parsed := secretRef{store: parts[0], path: parts[1]}
+	if hash := strings.LastIndex(parsed.path, "#"); hash >= 0 {
+		parsed.path, parsed.field = parsed.path[:hash], parsed.path[hash+1:]
+	}
+	switch {
+	case parsed.store != "vault" && parsed.store != "aws":
+		return secretRef{}, fmt.Errorf("secret %q has unknown store %s, expected vault or aws", ref, parsed.store)
+	case parsed.store == "vault" && parsed.field == "":
+		return secretRef{}, fmt.Errorf("vault secret %q needs #<field>", ref)
+	}
+	return parsed, nil
+}
+
+/**
+ * Returns environment entries for secrets of tube, fetching ones not cached or expired.
+ * Values are never logged, errors name only the reference
+ */
+func secretEnv(secrets map[string]string) ([]string, error) {
+	env := make([]string, 0, len(secrets))
+	for name, ref := range secrets {
+		value, err := fetchSecret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s for %s: %v", errSecretUnavailable, ref, name, err)
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
+
+func fetchSecret(ref string) (string, error) {
+	secretsLock.Lock()
+	cached, has := secretsCache[ref]
+	secretsLock.Unlock()
+	if has && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+	parsed, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	ttl := *secretsTTL
+	var value string
+	if parsed.store == "vault" {
+		value, ttl, err = fetchVaultSecret(ctx, parsed, ttl)
+	} else {
+		value, err = fetchAWSSecret(ctx, parsed)
+	}
+	if err != nil {
+		return "", err
+	}
+	secretsLock.Lock()
+	secretsCache[ref] = cachedSecret{value, time.Now().Add(ttl)}
+	secretsLock.Unlock()
+	return value, nil
+}
+
+/**
+ * Reads secret with Vault HTTP API. KV version 2 nests fields in data.data, version 1 and other engines in data
+ */
+func fetchVaultSecret(ctx context.Context, ref secretRef, ttl time.Duration) (string, time.Duration, error) {
+	addr, token := *vaultAddr, os.Getenv("VAULT_TOKEN")
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", ttl, errors.New("no Vault address, set --vault or VAULT_ADDR")
+	}
+	if *vaultTokenFile != "" {
+		data, err := ioutil.ReadFile(*vaultTokenFile)
+		if err != nil {
+			return "", ttl, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(ref.path, "/"), nil)
+	if err != nil {
+		return "", ttl, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", ttl, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", ttl, fmt.Errorf("vault returned %s", response.Status)
+	}
+	var secret struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return "", ttl, fmt.Errorf("could not parse vault response: %v", err)
+	}
+	if lease := time.Duration(secret.LeaseDuration) * time.Second; lease > 0 && lease < ttl {
+		ttl = lease
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, versioned := fields["metadata"]; versioned {
+			fields = nested
+		}
+	}
+	value, ok := fields[ref.field].(string)
+	if !ok {
+		return "", ttl, fmt.Errorf("no string field %s", ref.field)
+	}
+	return value, ttl, nil
+}
+
+/**
+ * Reads secret string from AWS Secrets Manager, with field taken from it as JSON object when given
+ */
+func fetchAWSSecret(ctx context.Context, ref secretRef) (string, error) {
+	region := *secretsRegion
+	if arn := strings.Split(ref.path, ":"); len(arn) > 3 && arn[0] == "arn" {
+		// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+		region = arn[3]
+	}
+	secretsLock.Lock()
+	client := secretsClients[region]
+	secretsLock.Unlock()
+	if client == nil {
+		var options []func(*config.LoadOptions) error
+		if region != "" {
+			options = append(options, config.WithRegion(region))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, options...)
+		if err != nil {
+			return "", fmt.Errorf("could not load AWS config: %v", err)
+		}
+		client = secretsmanager.NewFromConfig(cfg)
+		secretsLock.Lock()
+		secretsClients[region] = client
+		secretsLock.Unlock()
+	}
+	output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref.path)})
+	if err != nil {
+		return "", err
+	}
+	value := aws.ToString(output.SecretString)
+	if output.SecretString == nil {
+		value = string(output.SecretBinary)
+	}
+	if ref.field == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret is not JSON, can not take field %s", ref.field)
+	}
+	field, ok := fields[ref.field].(string)
+	if !ok {
+		return "", fmt.Errorf("no string field %s", ref.field)
+	}
+	return field, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/** How long to wait for beanstalkd server to accept connection */
+const DIAL_TIMEOUT = 5 * time.Second
+
+/**
+ * Health of beanstalkd server, shown in status
+ */
+type ServerStatus struct {
+	Role      string // "primary" and "backup" from --connect, "shard" for servers set in tube settings
+	Healthy   bool
+	Active    bool // Tubes without own server and command tube use it
+	Tubes     uint // Subscribed tubes connected to it
+	LastCheck string
+	LastError string `json:",omitempty"`
+}
+
+var (
+	/** Interval between health checks of servers */
+	healthInterval = flag.Duration("health-interval", 5*time.Second, "Interval between health checks of beanstalkd servers. Default: 5s")
+)
+
+/**
+ * Returns servers given with --connect in order of preference: primary first, then backups
+ */
+func serverList() []string {
+	var servers []string
+	for _, address := range strings.Split(*server, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			servers = append(servers, address)
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"0.0.0.0:11300"}
+	}
+	return servers
+}
+
+/**
+ * Lists servers from --connect as healthy until checked
+ */
+func initServers() {
+	stats.Servers = make(map[string]*ServerStatus)
+	if !commandTubes() {
+		return
+	}
+	for i, address := range serverList() {
+		role := "backup"
+		if i == 0 {
+			role = "primary"
+		}
+		stats.Servers[address] = &ServerStatus{Role: role, Healthy: true}
+	}
+}
+
+/**
+ * Returns first healthy server from --connect, primary if none is. Caller must hold stateLock
+ */
+func activeServer() string {
+	servers := serverList()
+	for _, address := range servers {
+		if serverHealthy(address) {
+			return address
+		}
+	}
+	return servers[0]
+}
+
+/**
+ * Returns server of tube: its own from settings, or active one. Empty tube stands for command tube.
+ * Caller must hold stateLock
+ */
+func serverFor(tube string) string {
+	if tube != "" {
+		if own := effectiveConfig(tube).Server; own != "" {
+			return own
+		}
+	}
+	return activeServer()
+}
+
+/**
+ * Checks if server is not known to be down, caller must hold stateLock
+ */
+func serverHealthy(address string) bool {
+	status, has := stats.Servers[address]
+	return !has || status.Healthy
+}
+
+/**
+ * Connects to server with timeout, through proxy and TLS when configured. Connection is pinged while idle
+ */
+func dialServer(address string) (*beanstalk.Conn, error) {
+	netConn, err := dialNet(address, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	watched := newWatchedConn(netConn, address)
+	conn := beanstalk.NewConn(watched)
+	go watched.watch(conn)
+	return conn, nil
+}
+
+/**
+ * Connects to first reachable server from --connect, for commands run without daemon state
+ */
+func dialAny() (*beanstalk.Conn, error) {
+	var failures []string
+	for _, address := range serverList() {
+		conn, err := dialServer(address)
+		if err == nil {
+			return conn, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", address, err))
+	}
+	return nil, fmt.Errorf("could not connect to %s", strings.Join(failures, ", "))
+}
+
+/**
+ * Records failure to reach server, so backup takes over until health check finds it working. Takes stateLock itself
+ */
+func serverFailed(address string, err error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	setServerHealth(address, err)
+}
+
+/**
+ * Updates server health and logs changes, caller must hold stateLock
+ */
+func setServerHealth(address string, err error) {
+	status, has := stats.Servers[address]
+	if !has {
+		status = &ServerStatus{Role: "shard", Healthy: true}
+		stats.Servers[address] = status
+	}
+	status.LastCheck = time.Now().Format(time.RFC3339)
+	if err != nil {
+		status.LastError = err.Error()
+		if status.Healthy {
+			log.Printf("Server %s is down: %v", address, err)
+			publishEvent("server-down", "", address+": "+err.Error())
+		}
+	} else if !status.Healthy {
+		log.Printf("Server %s is up", address)
+		publishEvent("server-up", "", address)
+	}
+	status.Healthy = err == nil
+}
+
+/**
+ * Checks health of servers periodically and moves connections to preferred servers once they are healthy
+ */
+func checkServers() {
+	for {
+		time.Sleep(*healthInterval)
+		stateLock.Lock()
+		wanted := make(map[string]bool)
+		if commandTubes() {
+			for _, address := range serverList() {
+				wanted[address] = true
+			}
+		}
+		for tube := range connections {
+			wanted[serverFor(tube)] = true
+		}
+		stateLock.Unlock()
+		results := make(map[string]error)
+		for address := range wanted {
+			results[address] = checkServer(address)
+		}
+		stateLock.Lock()
+		for address := range stats.Servers {
+			if !wanted[address] {
+				delete(stats.Servers, address)
+			}
+		}
+		for address, err := range results {
+			setServerHealth(address, err)
+		}
+		active := activeServer()
+		used := make(map[string]uint)
+		for _, queue := range connections {
+			used[connServer[queue.conn]]++
+		}
+		for address, status := range stats.Servers {
+			status.Active = address == active
+			status.Tubes = used[address]
+		}
+		stateLock.Unlock()
+	}
+}
+
+/**
+ * Connects to server and reads its stats
+ */
+func checkServer(address string) error {
+	conn, err := dialServer(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Stats()
+	return err
+}
+
+/**
+ * Moves tubes and command connection to servers they should use, e.g. back to primary once it is healthy,
+ * or to new server set in tube settings. Takes stateLock itself
+ */
+func rebalanceServers() {
+	stateLock.Lock()
+	moves := make(map[string]string)
+	for tube, queue := range connections {
+		_, degraded := stats.Degraded[tube]
+		if target := serverFor(tube); !degraded && !recovering[queue.conn] && connServer[queue.conn] != target && serverHealthy(target) {
+			moves[tube] = target
+		}
+	}
+	command := activeServer()
+	stateLock.Unlock()
+	if !commandTubes() {
+		return
+	}
+	tubes := make([]string, 0, len(moves))
+	for tube := range moves {
+		tubes = append(tubes, tube)
+	}
+	sort.Strings(tubes)
+	for _, tube := range tubes {
+		conn, err := tubeConnOn(moves[tube])
+		if err != nil {
+			serverFailed(moves[tube], err)
+			continue
+		}
+		stateLock.Lock()
+		old, subscribed := connections[tube]
+		from := connServer[old.conn]
+		if subscribed {
+			connections[tube] = Queue{conn, &beanstalk.Tube{conn, tube}}
+			releaseConn(old.conn)
+		} else {
+			releaseConn(conn)
+		}
+		stateLock.Unlock()
+		if subscribed {
+			log.Printf("Moved %s from %s to %s", tube, from, moves[tube])
+			publishEvent("failover", tube, "moved to "+moves[tube])
+		}
+	}
+	moveCommandConn(command)
+}
+
+/**
+ * Moves command connection to given server, unless it is there already or being reconnected
+ */
+func moveCommandConn(address string) {
+	commandLock.Lock()
+	current := commandServer
+	reconnecting := commandReconnecting
+	commandLock.Unlock()
+	if reconnecting || current == address {
+		return
+	}
+	conn, err := dialServer(address)
+	if err != nil {
+		serverFailed(address, err)
+		return
+	}
+	commandLock.Lock()
+	old := commandConn
+	if commandReconnecting {
+		commandLock.Unlock()
+		conn.Close()
+		return
+	}
+	useCommandConn(conn, address)
+	commandLock.Unlock()
+	old.Close()
+	log.Printf("Moved command connection from %s to %s", current, address)
+	publishEvent("failover", "", fmt.Sprintf("command connection moved to %s", address))
+}
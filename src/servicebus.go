@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerBroker("servicebus", func() Broker {
+		return &serviceBusBroker{receivers: make(map[string]*azservicebus.Receiver), senders: make(map[string]*azservicebus.Sender)}
+	})
+}
+
+var (
+	/** Azure Service Bus settings for servicebus broker */
+	serviceBusConnection   = flag.String("servicebus", "", "Service Bus namespace connection string for --broker servicebus. Default: AZURE_SERVICEBUS_CONNECTION_STRING environment variable")
+	serviceBusPrefix       = flag.String("servicebus-prefix", "", "Prefix of queue or topic names, tube email is queue <prefix>email. Default: none")
+	serviceBusSubscription = flag.String("servicebus-subscription", "", "Receive from this subscription of topic <prefix><tube> instead of queue, put publishes to the topic. Default: none, use queues")
+)
+
+/**
+ * Azure Service Bus backend. Each tube is a queue, or a subscription of topic, received in peek-lock mode: job is locked
+ * for lock duration of the entity, renewed while worker runs. Failed job is dead-lettered, exit code 75 abandons it,
+ * Service Bus dead-letters it by itself after max delivery count
+ */
+type serviceBusBroker struct {
+	lock      sync.Mutex // Guards clients, receivers and senders
+	client    *azservicebus.Client
+	admin     *admin.Client
+	receivers map[string]*azservicebus.Receiver
+	senders   map[string]*azservicebus.Sender
+}
+
+/** Locked message along with receiver it has to be settled on */
+type serviceBusHandle struct {
+	receiver *azservicebus.Receiver
+	message  *azservicebus.ReceivedMessage
+}
+
+/**
+ * Returns client, creating it and admin client from connection string first time. Caller must hold b.lock
+ */
+func (b *serviceBusBroker) connection() (*azservicebus.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	connection := *serviceBusConnection
+	if connection == "" {
+		connection = os.Getenv("AZURE_SERVICEBUS_CONNECTION_STRING")
+	}
+	if connection == "" {
+		return nil, errors.New("no Service Bus connection string, set --servicebus or AZURE_SERVICEBUS_CONNECTION_STRING")
+	}
+	client, err := azservicebus.NewClientFromConnectionString(connection, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.admin, err = admin.NewClientFromConnectionString(connection, nil); err != nil {
+		client.Close(context.Background())
+		return nil, err
+	}
+	b.client = client
+	return client, nil
+}
+
+/**
+ * Returns receiver of tube, creating it first time
+ */
+func (b *serviceBusBroker) receiver(tube string) (*azservicebus.Receiver, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if receiver, has := b.receivers[tube]; has {
+		return receiver, nil
+	}
+	client, err := b.connection()
+	if err != nil {
+		return nil, err
+	}
+	options := &azservicebus.ReceiverOptions{ReceiveMode: azservicebus.ReceiveModePeekLock}
+	var receiver *azservicebus.Receiver
+	if *serviceBusSubscription != "" {
+		receiver, err = client.NewReceiverForSubscription(*serviceBusPrefix+tube, *serviceBusSubscription, options)
+	} else {
+		receiver, err = client.NewReceiverForQueue(*serviceBusPrefix+tube, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.receivers[tube] = receiver
+	return receiver, nil
+}
+
+/**
+ * Reads namespace properties, which needs the connection string to grant Manage rights
+ */
+func (b *serviceBusBroker) Check() error {
+	b.lock.Lock()
+	_, err := b.connection()
+	client := b.admin
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	_, err = client.GetNamespaceProperties(ctx, nil)
+	return err
+}
+
+/**
+ * Receiver is created by reserver, so there is nothing to do until then
+ */
+func (b *serviceBusBroker) Subscribe(tube string) {
+}
+
+func (b *serviceBusBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	sender := b.senders[tube]
+	delete(b.senders, tube)
+	b.lock.Unlock()
+	if sender != nil {
+		sender.Close(context.Background())
+	}
+}
+
+/**
+ * Active messages of queue or subscription, from runtime properties
+ */
+func (b *serviceBusBroker) Stats(tube string) (int, error) {
+	b.lock.Lock()
+	_, err := b.connection()
+	client := b.admin
+	b.lock.Unlock()
+	if err != nil {
+		tubeFailed(tube, err)
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	var active int64
+	if *serviceBusSubscription != "" {
+		var properties *admin.GetSubscriptionRuntimePropertiesResponse
+		if properties, err = client.GetSubscriptionRuntimeProperties(ctx, *serviceBusPrefix+tube, *serviceBusSubscription, nil); err == nil && properties != nil {
+			active = int64(properties.ActiveMessageCount)
+		} else if err == nil {
+			err = fmt.Errorf("subscription %s of topic %s not found", *serviceBusSubscription, *serviceBusPrefix+tube)
+		}
+	} else {
+		var properties *admin.GetQueueRuntimePropertiesResponse
+		if properties, err = client.GetQueueRuntimeProperties(ctx, *serviceBusPrefix+tube, nil); err == nil && properties != nil {
+			active = int64(properties.ActiveMessageCount)
+		} else if err == nil {
+			err = fmt.Errorf("queue %s not found", *serviceBusPrefix+tube)
+		}
+	}
+	if err != nil {
+		tubeFailed(tube, err)
+		return 0, err
+	}
+	return int(active), nil
+}
+
+/**
+ * Waits up to timeout for one message of tube and locks it. Time to run is what is left of its lock
+ */
+func (b *serviceBusBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	receiver, err := b.receiver(tube)
+	if err != nil {
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	messages, err := receiver.ReceiveMessages(ctx, 1, nil)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		// Receiver recovers its link by itself, jobs locked on it are still settled through it
+		tubeFailed(tube, err)
+		return nil, err
+	}
+	tubeRecovered(tube)
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	message := messages[0]
+	job := &ReservedJob{Id: message.MessageID, Body: message.Body, Priority: DEFAULT_PRIORITY, TTR: DEFAULT_TTR, handle: serviceBusHandle{receiver, message}}
+	if message.LockedUntil != nil {
+		if job.TTR = time.Until(*message.LockedUntil); job.TTR < time.Second {
+			job.TTR = time.Second
+		}
+	}
+	if priority, ok := message.ApplicationProperties["priority"].(int64); ok {
+		job.Priority = uint32(priority)
+	}
+	return job, nil
+}
+
+/**
+ * Closes receiver of tube, it is created again on next reserve
+ */
+func (b *serviceBusBroker) StopReserving(tube string) {
+	b.lock.Lock()
+	receiver := b.receivers[tube]
+	delete(b.receivers, tube)
+	b.lock.Unlock()
+	if receiver != nil {
+		receiver.Close(context.Background())
+	}
+}
+
+/**
+ * Runs settlement of locked message, lost lock means another consumer may have the job now
+ */
+func (b *serviceBusBroker) settle(job *ReservedJob, settle func(ctx context.Context, handle serviceBusHandle) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	err := settle(ctx, job.handle.(serviceBusHandle))
+	var sbErr *azservicebus.Error
+	if errors.As(err, &sbErr) && sbErr.Code == azservicebus.CodeLockLost {
+		return errLostReservation
+	}
+	return err
+}
+
+/**
+ * Renews lock of message for lock duration of its entity
+ */
+func (b *serviceBusBroker) Touch(job *ReservedJob) error {
+	return b.settle(job, func(ctx context.Context, handle serviceBusHandle) error {
+		return handle.receiver.RenewMessageLock(ctx, handle.message, nil)
+	})
+}
+
+func (b *serviceBusBroker) Delete(job *ReservedJob) error {
+	return b.settle(job, func(ctx context.Context, handle serviceBusHandle) error {
+		return handle.receiver.CompleteMessage(ctx, handle.message, nil)
+	})
+}
+
+/**
+ * Abandons message, so it is delivered again right away. Delivery count grows, past max delivery count of entity
+ * Service Bus dead-letters it
+ */
+func (b *serviceBusBroker) Release(job *ReservedJob) error {
+	return b.settle(job, func(ctx context.Context, handle serviceBusHandle) error {
+		return handle.receiver.AbandonMessage(ctx, handle.message, nil)
+	})
+}
+
+/**
+ * Moves message into dead-letter subqueue of its entity
+ */
+func (b *serviceBusBroker) Bury(job *ReservedJob) error {
+	reason := "worker failed"
+	return b.settle(job, func(ctx context.Context, handle serviceBusHandle) error {
+		return handle.receiver.DeadLetterMessage(ctx, handle.message, &azservicebus.DeadLetterOptions{Reason: &reason})
+	})
+}
+
+/**
+ * Sends job to queue or topic of tube, priority kept in application property. Delay schedules enqueue time,
+ * time to run is lock duration of entity for all jobs
+ */
+func (b *serviceBusBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	b.lock.Lock()
+	client, err := b.connection()
+	sender := b.senders[tube]
+	if err == nil && sender == nil {
+		if sender, err = client.NewSender(*serviceBusPrefix+tube, nil); err == nil {
+			b.senders[tube] = sender
+		}
+	}
+	b.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	id := newRequestId()
+	message := &azservicebus.Message{Body: body, MessageID: &id, ApplicationProperties: map[string]any{"priority": int64(priority)}}
+	if delay > 0 {
+		enqueue := time.Now().Add(delay)
+		message.ScheduledEnqueueTime = &enqueue
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	if err = sender.SendMessage(ctx, message, nil); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+)
+
+/**
+ * Mirroring of tube jobs into shadow tube, served by worker under test whose results are discarded: its jobs are
+ * deleted whatever it returns, without retries, and after hooks are not run. Only jobs workerman reserves are mirrored
+ */
+type Shadow struct {
+	Tube    string  // Tube copies go into
+	Percent float64 // Share of jobs copied, 0 to 100
+}
+
+/**
+ * Copies job into Shadow tube with chance of Percent, returns whether it did. Failure to copy is logged only, the job
+ * itself goes on as usual
+ */
+func mirrorJob(worker string, config EffectiveConfig, job *ReservedJob) bool {
+	shadow := config.Shadow
+	if shadow == nil || shadow.Tube == "" || shadow.Tube == worker || rand.Float64()*100 >= shadow.Percent {
+		return false
+	}
+	// Encrypted body goes as it came, shadow worker gets it opened the same way
+	if _, err := broker.Put(shadow.Tube, job.Body, job.Priority, 0, job.TTR); err != nil {
+		log.Printf("Could not mirror job %s of %s into %s: %v", job.Id, worker, shadow.Tube, err)
+		return false
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stats.Mirrored == nil {
+		stats.Mirrored = make(map[string]uint64)
+	}
+	stats.Mirrored[worker]++
+	return true
+}
+
+/**
+ * Returns tube jobs of tube are mirrored from, empty if it is no shadow tube. Caller must hold stateLock
+ */
+func shadowSource(tube string) string {
+	sources := make(map[string]bool, len(subscriptions)+len(tubeConfigs))
+	for source := range subscriptions {
+		sources[source] = true
+	}
+	for source := range tubeConfigs {
+		sources[source] = true
+	}
+	for source := range sources {
+		if shadow := schedulingConfig(source).Shadow; source != tube && shadow != nil && shadow.Tube == tube {
+			return source
+		}
+	}
+	return ""
+}
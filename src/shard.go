@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"flag"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Points each instance takes on hash ring, more spread tubes more evenly */
+const SHARD_VNODES = 64
+
+var (
+	/** Hosts each tube is served by over coordination backend */
+	shardReplicas = flag.Int("shard-replicas", 0, "Serve each tube on at most this many instances of --coordination fleet having a worker for it, picked by consistent hashing of tube over instances, so fewer hosts poll and reserve the same tube. Default: 0, every instance serves all its tubes")
+
+	/** Id of this instance in assignment, set before sharding starts */
+	shardInstance string
+
+	/** Tubes this instance could serve, guarded by stateLock */
+	shardCandidates = make(map[string]bool)
+
+	/** Instances serving each tube by last assignment, nil until fleet was reached. Guarded by stateLock */
+	shardAssigned map[string][]string
+
+	/**
+	 * Replaces tubes this instance could serve and returns those of each live instance as instance, tubes pairs, tubes
+	 * separated by newlines. Instances whose entry expired are forgotten. KEYS[1] is set of instances, ARGV: prefix,
+	 * instance, ttl in ms, tubes
+	 */
+	shardSync = redis.NewScript(1, `
+local own = ARGV[1] .. 'shard:' .. ARGV[2]
+redis.call('SET', own, ARGV[4], 'PX', ARGV[3])
+redis.call('SADD', KEYS[1], ARGV[2])
+local result = {}
+for _, instance in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	local tubes = redis.call('GET', ARGV[1] .. 'shard:' .. instance)
+	if tubes then
+		table.insert(result, instance)
+		table.insert(result, tubes)
+	else
+		redis.call('SREM', KEYS[1], instance)
+	end
+end
+return result`)
+)
+
+/**
+ * Starts tube assignment when --shard-replicas is set
+ */
+func startSharding() {
+	if *shardReplicas <= 0 {
+		return
+	}
+	if *coordinationURL == "" {
+		log.Fatalf("Fatal error: --shard-replicas needs --coordination")
+	}
+	shardInstance = fleetInstance()
+	go runSharding(coordinationPool())
+}
+
+/**
+ * Publishes tubes this instance could serve every FLEET_INTERVAL and assigns each tube to --shard-replicas of the
+ * instances publishing it. Instance leaving or falling silent for FLEET_TTL has its tubes taken over, draining one
+ * gives them up at once. While backend can not be reached, last assignment holds
+ */
+func runSharding(pool *redis.Pool) {
+	instance := shardInstance
+	log.Printf("Sharding tubes over fleet at %s as %s, %d instance(s) per tube", *coordinationURL, instance, *shardReplicas)
+	failing := false
+	for range time.Tick(FLEET_INTERVAL) {
+		var tubes []string
+		stateLock.Lock()
+		if !stats.Draining {
+			for tube := range shardCandidates {
+				tubes = append(tubes, tube)
+			}
+		}
+		stateLock.Unlock()
+		sort.Strings(tubes)
+		conn := pool.Get()
+		values, err := redis.Strings(shardSync.Do(conn, *coordinationPrefix+"shards", *coordinationPrefix, instance, FLEET_TTL.Milliseconds(), strings.Join(tubes, "\n")))
+		conn.Close()
+		if err != nil {
+			if !failing {
+				log.Printf("Could not sync tube assignment with fleet, keeping the last one: %v", err)
+				failing = true
+			}
+			continue
+		}
+		if failing {
+			log.Printf("Syncing tube assignment with fleet again")
+			failing = false
+		}
+		// Only instances having worker for tube take part in its assignment
+		eligible := make(map[string][]string)
+		for i := 0; i+1 < len(values); i += 2 {
+			for _, tube := range strings.Split(values[i+1], "\n") {
+				if tube != "" {
+					eligible[tube] = append(eligible[tube], values[i])
+				}
+			}
+		}
+		assigned := make(map[string][]string, len(tubes))
+		for _, tube := range tubes {
+			assigned[tube] = shardOwners(tube, eligible[tube], *shardReplicas)
+		}
+		stateLock.Lock()
+		for _, tube := range tubes {
+			if was, now := shardServes(tube), hasInstance(assigned[tube], instance); was != now {
+				if now {
+					log.Printf("Tube %s assigned to this instance", tube)
+				} else {
+					log.Printf("Tube %s assigned to %s, leaving it", tube, strings.Join(assigned[tube], ", "))
+				}
+			}
+		}
+		shardAssigned = assigned
+		stats.Shards = assigned
+		stateLock.Unlock()
+	}
+}
+
+/**
+ * Returns up to replicas instances serving tube: the first distinct ones clockwise from hash of tube on ring of
+ * SHARD_VNODES points per instance, so instances joining or leaving move only their share of tubes
+ */
+func shardOwners(tube string, instances []string, replicas int) []string {
+	type point struct {
+		hash     uint64
+		instance string
+	}
+	ring := make([]point, 0, len(instances)*SHARD_VNODES)
+	for _, instance := range instances {
+		for i := 0; i < SHARD_VNODES; i++ {
+			ring = append(ring, point{shardHash(instance + "#" + strconv.Itoa(i)), instance})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash || ring[i].hash == ring[j].hash && ring[i].instance < ring[j].instance
+	})
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= shardHash(tube) })
+	var owners []string
+	for i := 0; i < len(ring) && len(owners) < replicas; i++ {
+		if instance := ring[(start+i)%len(ring)].instance; !hasInstance(owners, instance) {
+			owners = append(owners, instance)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+/** Position of key on hash ring */
+func shardHash(key string) uint64 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+/**
+ * Checks if this instance is to serve tube. Tubes not assigned yet are served, so nothing is left out
+ * while backend can not be reached. Caller must hold stateLock
+ */
+func shardServes(tube string) bool {
+	owners, assigned := shardAssigned[tube]
+	return *shardReplicas <= 0 || !assigned || hasInstance(owners, shardInstance)
+}
+
+func hasInstance(instances []string, instance string) bool {
+	for _, other := range instances {
+		if other == instance {
+			return true
+		}
+	}
+	return false
+}
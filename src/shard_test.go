@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestShardOwners(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []string
+		replicas  int
+		want      int
+	}{
+		{"no instances", nil, 2, 0},
+		{"no replicas", []string{"a", "b"}, 0, 0},
+		{"one of one", []string{"a"}, 1, 1},
+		{"two of three", []string{"a", "b", "c"}, 2, 2},
+		{"more replicas than instances", []string{"a", "b"}, 5, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owners := shardOwners("email", test.instances, test.replicas)
+			if len(owners) != test.want {
+				t.Fatalf("got %d owners %v, want %d", len(owners), owners, test.want)
+			}
+			if !sort.StringsAreSorted(owners) {
+				t.Errorf("owners %v are not sorted", owners)
+			}
+			seen := make(map[string]bool)
+			for _, owner := range owners {
+				if seen[owner] {
+					t.Errorf("owner %s is listed twice in %v", owner, owners)
+				}
+				seen[owner] = true
+				if !hasInstance(test.instances, owner) {
+					t.Errorf("owner %s is not one of instances %v", owner, test.instances)
+				}
+			}
+			// Order of instances does not matter, every instance computes the same owners
+			reversed := make([]string, len(test.instances))
+			for i, instance := range test.instances {
+				reversed[len(reversed)-1-i] = instance
+			}
+			if again := shardOwners("email", reversed, test.replicas); !reflect.DeepEqual(again, owners) {
+				t.Errorf("got %v for reversed instances, want %v", again, owners)
+			}
+		})
+	}
+}
+
+func TestShardOwnersMoveOnlyShareOfJoiningInstance(t *testing.T) {
+	before := []string{"a", "b", "c", "d"}
+	after := append(before[:len(before):len(before)], "e")
+	moved := 0
+	const tubes = 1000
+	for i := 0; i < tubes; i++ {
+		tube := fmt.Sprintf("tube%d", i)
+		old, owners := shardOwners(tube, before, 1), shardOwners(tube, after, 1)
+		if reflect.DeepEqual(old, owners) {
+			continue
+		}
+		if !reflect.DeepEqual(owners, []string{"e"}) {
+			t.Fatalf("tube %s moved from %v to %v, not to joining instance", tube, old, owners)
+		}
+		moved++
+	}
+	// Joining instance takes about a fifth of tubes
+	if moved < tubes/10 || moved > tubes*3/10 {
+		t.Errorf("%d of %d tubes moved to joining instance, want about %d", moved, tubes, tubes/5)
+	}
+}
+
+func TestShardHash(t *testing.T) {
+	tests := []struct {
+		key  string
+		want uint64
+	}{
+		// First 8 bytes of md5, big endian
+		{"", 0xd41d8cd98f00b204},
+		{"a", 0x0cc175b9c0f1b6a8},
+	}
+	for _, test := range tests {
+		if got := shardHash(test.key); got != test.want {
+			t.Errorf("shardHash(%q) = %x, want %x", test.key, got, test.want)
+		}
+	}
+	if shardHash("a#0") == shardHash("a#1") {
+		t.Errorf("virtual nodes of instance hash the same")
+	}
+}
+
+func TestShardServes(t *testing.T) {
+	replicas, instance, assigned := *shardReplicas, shardInstance, shardAssigned
+	defer func() {
+		*shardReplicas, shardInstance, shardAssigned = replicas, instance, assigned
+	}()
+	shardInstance = "a"
+	tests := []struct {
+		name     string
+		replicas int
+		assigned map[string][]string
+		want     bool
+	}{
+		{"sharding off", 0, map[string][]string{"email": {"b"}}, true},
+		{"not assigned yet", 1, map[string][]string{}, true},
+		{"owner", 1, map[string][]string{"email": {"a", "b"}}, true},
+		{"other owners", 1, map[string][]string{"email": {"b", "c"}}, false},
+		{"no owners", 1, map[string][]string{"email": nil}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*shardReplicas, shardAssigned = test.replicas, test.assigned
+			if got := shardServes("email"); got != test.want {
+				t.Errorf("shardServes = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
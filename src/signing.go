@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var (
+	/** Shared key signing commands put into command tube */
+	commandKeyFile = flag.String("command-key", "", "File with shared key commands put into command tube are signed with (HMAC-SHA256), daemon rejects unsigned, forged and replayed ones. Default: none, commands are not signed")
+	commandKeyId   = flag.String("command-key-id", "", "Id of key in Keys of --access-file that --command-key of client commands is, for keys with limited scope. Default: none, key is daemon's --command-key")
+	commandMaxAge  = flag.Duration("command-max-age", time.Minute, "Signed command with timestamp further off than that is rejected. Default: 1m")
+
+	commandKey     []byte
+	commandKeyOnce sync.Once
+	commandKeyErr  error
+
+	/** Nonces of accepted signed commands with when they were signed, forgotten once too old to be accepted anyway */
+	seenNonces     = make(map[string]time.Time)
+	seenNoncesLock sync.Mutex
+)
+
+/**
+ * Command as put into command tube when signing is on. Signature is over Signed exactly as sent, so clients
+ * in other languages need no canonical JSON
+ */
+type SignedCommand struct {
+	KeyId     string `json:",omitempty"` // Key of access file signed with, --command-key if empty
+	Signed    string // WorkerCommand JSON, with Timestamp and Nonce set
+	Signature string // Hex encoded HMAC-SHA256 of Signed with shared key
+}
+
+/**
+ * Returns shared key from --command-key file, nil when signing is off. File is read once
+ */
+func loadCommandKey() ([]byte, error) {
+	commandKeyOnce.Do(func() {
+		if *commandKeyFile == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(*commandKeyFile)
+		if err != nil {
+			commandKeyErr = fmt.Errorf("could not read command key: %v", err)
+		} else if commandKey = bytes.TrimSpace(data); len(commandKey) == 0 {
+			commandKeyErr = fmt.Errorf("command key file %s is empty", *commandKeyFile)
+		}
+	})
+	return commandKey, commandKeyErr
+}
+
+func commandSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * Encodes command for command tube, signed with timestamp and nonce when there is a command key
+ */
+func encodeCommand(cmd WorkerCommand) ([]byte, error) {
+	key, err := loadCommandKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return json.Marshal(cmd)
+	}
+	cmd.Timestamp, cmd.Nonce = time.Now().Unix(), newRequestId()
+	signed, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(SignedCommand{*commandKeyId, string(signed), commandSignature(key, string(signed))})
+}
+
+/**
+ * Decodes command taken from command tube. With command key or keys in access file only signed commands are accepted:
+ * signature must match, timestamp be within --command-max-age, nonce not seen before and scope of key allow the command.
+ * Command key has admin scope
+ */
+func decodeCommand(body []byte) (WorkerCommand, error) {
+	var cmd WorkerCommand
+	key, err := loadCommandKey()
+	if err != nil {
+		return cmd, err
+	}
+	if key == nil && (access == nil || len(access.Keys) == 0) {
+		return cmd, unmarshalCommand(body, &cmd)
+	}
+	var envelope SignedCommand
+	if err := unmarshalCommand(body, &envelope); err != nil {
+		return cmd, err
+	}
+	if envelope.Signed == "" {
+		return cmd, errors.New("command is not signed")
+	}
+	scope := SCOPE_ADMIN
+	if envelope.KeyId != "" {
+		var named AccessKey
+		has := false
+		if access != nil {
+			named, has = access.Keys[envelope.KeyId]
+		}
+		if !has {
+			return cmd, fmt.Errorf("unknown key %s", envelope.KeyId)
+		}
+		key, scope = []byte(named.Secret), named.Scope
+	} else if key == nil {
+		return cmd, errors.New("command is not signed with a key of access file")
+	}
+	if !hmac.Equal([]byte(commandSignature(key, envelope.Signed)), []byte(envelope.Signature)) {
+		return cmd, errors.New("signature does not match")
+	}
+	if err := unmarshalCommand([]byte(envelope.Signed), &cmd); err != nil {
+		return cmd, err
+	}
+	cmd.keyId = envelope.KeyId
+	signedAt := time.Unix(cmd.Timestamp, 0)
+	if age := time.Since(signedAt); age > *commandMaxAge || age < -*commandMaxAge {
+		return cmd, fmt.Errorf("timestamp is %s off", age.Round(time.Second))
+	}
+	if cmd.Nonce == "" {
+		return cmd, errors.New("nonce is missing")
+	}
+	if need := commandScope(cmd.Command); !scopeAllows(scope, need) {
+		return cmd, fmt.Errorf("%s needs %s scope, key %s has %s", cmd.Command, need, envelope.KeyId, scope)
+	}
+	seenNoncesLock.Lock()
+	defer seenNoncesLock.Unlock()
+	for nonce, at := range seenNonces {
+		if time.Since(at) > 2**commandMaxAge {
+			delete(seenNonces, nonce)
+		}
+	}
+	if _, seen := seenNonces[cmd.Nonce]; seen {
+		return cmd, errors.New("command was replayed")
+	}
+	seenNonces[cmd.Nonce] = signedAt
+	return cmd, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * Signs command JSON with key of access file, or with --command-key if keyId is empty, as a client would
+ */
+func signedCommand(t *testing.T, keyId, secret, signed string) []byte {
+	body, err := json.Marshal(SignedCommand{KeyId: keyId, Signed: signed, Signature: commandSignature([]byte(secret), signed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+/**
+ * Makes key daemon signs and checks commands with as if read from --command-key, returning function restoring it
+ */
+func setCommandKey(key []byte) func() {
+	commandKeyOnce.Do(func() {})
+	saved := commandKey
+	commandKey = key
+	return func() { commandKey = saved }
+}
+
+/**
+ * Returns WorkerCommand JSON signed part of envelope consists of
+ */
+func signedPart(name string, timestamp int64, nonce string) string {
+	signed, _ := json.Marshal(WorkerCommand{Command: name, Timestamp: timestamp, Nonce: nonce})
+	return string(signed)
+}
+
+func TestCommandSignature(t *testing.T) {
+	tests := []struct {
+		key    string
+		signed string
+		want   string
+	}{
+		// RFC 4231 test case 2
+		{"Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"key", "", "5d5d139563c95b5967b9bd9a8c9b233a9dedb45072794cd232dc1b74832607d0"},
+	}
+	for _, test := range tests {
+		if got := commandSignature([]byte(test.key), test.signed); got != test.want {
+			t.Errorf("commandSignature(%q, %q) = %s, want %s", test.key, test.signed, got, test.want)
+		}
+	}
+}
+
+func TestDecodeCommandWithCommandKey(t *testing.T) {
+	defer setCommandKey([]byte("shared-secret"))()
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr string
+	}{
+		{"valid", signedCommand(t, "", "shared-secret", signedPart("setLimits", now, "k1")), ""},
+		{"unsigned", []byte(`{"Command":"pause"}`), "command is not signed"},
+		{"forged", signedCommand(t, "", "guessed", signedPart("pause", now, "k2")), "signature does not match"},
+		{"too old", signedCommand(t, "", "shared-secret", signedPart("pause", now-int64(2**commandMaxAge/time.Second), "k3")), "timestamp is"},
+		{"from the future", signedCommand(t, "", "shared-secret", signedPart("pause", now+int64(2**commandMaxAge/time.Second), "k4")), "timestamp is"},
+		{"no nonce", signedCommand(t, "", "shared-secret", signedPart("pause", now, "")), "nonce is missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeCommand(test.body)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("got error %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeCommandWithAccessKeys(t *testing.T) {
+	defer setCommandKey(nil)()
+	saved := access
+	defer func() { access = saved }()
+	access = &AccessConfig{Keys: map[string]AccessKey{
+		"ops":   {Secret: "ops-secret", Scope: SCOPE_OPERATE},
+		"admin": {Secret: "admin-secret", Scope: SCOPE_ADMIN},
+	}}
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr string
+		wantKey string
+	}{
+		{"valid", signedCommand(t, "ops", "ops-secret", signedPart("pause", now, "n1")), "", "ops"},
+		{"admin scope", signedCommand(t, "admin", "admin-secret", signedPart("deployWorker", now, "n2")), "", "admin"},
+		{"unknown fields are ignored", signedCommand(t, "ops", "ops-secret", fmt.Sprintf(`{"Command":"pause","Timestamp":%d,"Nonce":"n3","Comment":"from newer client"}`, now)), "", "ops"},
+		{"unsigned", []byte(`{"Command":"pause"}`), "command is not signed", ""},
+		{"unknown key", signedCommand(t, "other", "ops-secret", signedPart("pause", now, "n4")), "unknown key other", ""},
+		{"no key id without command key", signedCommand(t, "", "ops-secret", signedPart("pause", now, "n5")), "not signed with a key of access file", ""},
+		{"forged", signedCommand(t, "ops", "admin-secret", signedPart("pause", now, "n6")), "signature does not match", ""},
+		{"scope too narrow", signedCommand(t, "ops", "ops-secret", signedPart("setLimits", now, "n7")), "needs configure scope", ""},
+		{"data after envelope", append(signedCommand(t, "ops", "ops-secret", signedPart("pause", now, "n8")), []byte(" {}")...), "data after command", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, err := decodeCommand(test.body)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				if cmd.keyId != test.wantKey {
+					t.Errorf("got key %q, want %q", cmd.keyId, test.wantKey)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeCommandRejectsReplay(t *testing.T) {
+	defer setCommandKey([]byte("shared-secret"))()
+	body := signedCommand(t, "", "shared-secret", signedPart("pause", time.Now().Unix(), "replayed-nonce"))
+	if _, err := decodeCommand(body); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	if _, err := decodeCommand(body); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("second delivery: got error %v, want replay to be rejected", err)
+	}
+}
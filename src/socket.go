@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/**
+ * Error response for commands that could not be executed
+ */
+type CommandError struct {
+	Error string
+}
+
+/** Maximum size of a single command sent to control socket, enough for deployWorker with largest tarball */
+const MAX_SOCKET_COMMAND = DEPLOY_MAX_COMMAND
+
+var (
+	/** Path of unix domain control socket */
+	socketPath = flag.String("socket", os.Args[0]+".sock", "Control socket path, empty to disable. Default: executable path + .sock")
+
+	/** Path of put-only socket workers get, so they can not run other commands */
+	workerSocketPath = flag.String("worker-socket", "", "Socket accepting put commands only, passed to workers as WORKERMAN_SOCKET for follow-up jobs. Default: none, workers get no socket")
+
+	controlListener, workerListener net.Listener
+)
+
+/**
+ * Makes socket paths absolute, must be called before changing working directory
+ */
+func resolveSocketPath() {
+	for _, path := range []*string{socketPath, workerSocketPath} {
+		if *path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(*path); err == nil {
+			*path = abs
+		}
+	}
+}
+
+/**
+ * Starts accepting commands on control socket
+ *
+ * Protocol is the same as for command tube: one JSON encoded command per line,
+ * each command is answered with one line of JSON encoded response.
+ */
+func listenControlSocket() {
+	if *socketPath != "" {
+		controlListener = openSocket("socket", "control socket", *socketPath)
+		serveControlSocket(controlListener, *socketPath, false)
+	}
+	if *workerSocketPath != "" {
+		workerListener = openSocket("worker-socket", "worker socket", *workerSocketPath)
+		serveControlSocket(workerListener, *workerSocketPath, true)
+	}
+}
+
+/**
+ * Listens on unix socket at path, or takes it over from upgraded process. Returns nil if socket can not be used
+ */
+func openSocket(name, description, path string) net.Listener {
+	if listener := inheritedListener(name); listener != nil {
+		// Taken over from upgraded process, remove socket file on exit as if created here
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(true)
+		}
+		return listener
+	}
+	// Clean up socket left by previous run, but do not steal it from running instance
+	if _, err := os.Stat(path); err == nil {
+		if conn, dErr := net.Dial("unix", path); dErr == nil {
+			conn.Close()
+			log.Printf("Warning: %s disabled, %s is in use by another process", description, path)
+			return nil
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Printf("Warning: %s disabled, could not listen on %s: %v", description, path, err)
+		return nil
+	}
+	if cErr := os.Chmod(path, 0660); cErr != nil {
+		log.Printf("Warning: could not set permissions on %s: %v", path, cErr)
+	}
+	return listener
+}
+
+func serveControlSocket(listener net.Listener, path string, putOnly bool) {
+	if listener == nil {
+		return
+	}
+	if putOnly {
+		log.Printf("Listening for put commands of workers on %s", path)
+	} else {
+		log.Printf("Listening for commands on %s", path)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConn(conn, putOnly)
+		}
+	}()
+}
+
+/**
+ * Stops accepting commands on control and worker sockets and removes socket files
+ */
+func closeControlSocket() {
+	for _, listener := range []net.Listener{controlListener, workerListener} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+/**
+ * Reads commands from socket client until it disconnects. Worker socket is put only, so a compromised worker can not
+ * deploy, reconfigure or drain the daemon
+ */
+func serveControlConn(conn net.Conn, putOnly bool) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MAX_SOCKET_COMMAND)
+	for scanner.Scan() {
+		var cmd WorkerCommand
+		var payload []byte
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			log.Printf("Could not parse socket command: %v", scanner.Text())
+			payload, _ = json.Marshal(CommandError{fmt.Sprintf("Could not parse command: %v", err)})
+		} else if putOnly && cmd.Command != "put" {
+			log.Printf("Rejected %s command on worker socket", cmd.Command)
+			payload, _ = json.Marshal(CommandError{"worker socket accepts put only"})
+			payload = wrapResponse(cmd, payload)
+		} else {
+			pendingCommands.Add(1)
+			payload = executeCommand(cmd)
+			pendingCommands.Done()
+			if payload == nil {
+				payload, _ = json.Marshal(CommandError{fmt.Sprintf("Unknown or unsupported command: %s", cmd.Command)})
+			}
+			payload = wrapResponse(cmd, payload)
+		}
+		if _, err := conn.Write(append(payload, '\n')); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Could not read socket command: %v", err)
+		payload, _ := json.Marshal(CommandError{fmt.Sprintf("Could not read command: %v", err)})
+		conn.Write(append(payload, '\n'))
+	}
+}
+
+/**
+ * Sends command to the daemon through control socket and waits for response
+ */
+func sendSocketCommand(conn net.Conn, body []byte) ([]byte, error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*replyTimeout))
+	if _, err := conn.Write(append(body, '\n')); err != nil {
+		return nil, fmt.Errorf("could not send command to %s: %v", *socketPath, err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("could not read response from %s: %v", *socketPath, err)
+	}
+	return response[:len(response)-1], nil
+}
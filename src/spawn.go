@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	/** Rate workers are started at over all tubes */
+	maxSpawns  = flag.Float64("max-spawns", 0, "Workers started per second at most over all tubes, so a flood of ready jobs does not fork hundreds at once. 0 for no limit. Default: 0")
+	spawnBurst = flag.Int("spawn-burst", 10, "Workers that may be started at once before --max-spawns applies. Default: 10")
+
+	/** Token bucket of worker starts, guarded by spawnLock */
+	spawns struct {
+		tokens  float64
+		updated time.Time
+	}
+	spawnLock sync.Mutex
+)
+
+/**
+ * Refills bucket of worker starts. Caller must hold spawnLock
+ */
+func refillSpawns(now time.Time) {
+	burst := math.Max(1, float64(*spawnBurst))
+	if spawns.updated.IsZero() {
+		spawns.tokens = burst
+	} else {
+		spawns.tokens = math.Min(burst, spawns.tokens+now.Sub(spawns.updated).Seconds()**maxSpawns)
+	}
+	spawns.updated = now
+}
+
+/**
+ * Checks if --max-spawns allows starting a worker now. Takes spawnLock itself
+ */
+func spawnAllowed() bool {
+	if *maxSpawns <= 0 {
+		return true
+	}
+	spawnLock.Lock()
+	defer spawnLock.Unlock()
+	refillSpawns(time.Now())
+	return spawns.tokens >= 1
+}
+
+/**
+ * Counts worker start against --max-spawns. Reservers checking at once may overdraw, which holds back later starts
+ * until it is paid back. Takes spawnLock itself
+ */
+func takeSpawn() {
+	if *maxSpawns <= 0 {
+		return
+	}
+	spawnLock.Lock()
+	defer spawnLock.Unlock()
+	refillSpawns(time.Now())
+	spawns.tokens--
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Longest delay and long polling wait SQS accepts */
+const (
+	SQS_MAX_DELAY = 15 * time.Minute
+	SQS_MAX_WAIT  = 20 * time.Second
+)
+
+func init() {
+	registerBroker("sqs", func() Broker {
+		return &sqsBroker{queues: make(map[string]*sqsQueue)}
+	})
+}
+
+var (
+	/** Amazon SQS settings for sqs broker, credentials come from the usual AWS environment, config files or instance role */
+	sqsRegion     = flag.String("sqs-region", "", "AWS region of SQS queues for --broker sqs. Default: from AWS_REGION or AWS config")
+	sqsEndpoint   = flag.String("sqs-endpoint", "", "SQS endpoint URL instead of the regional one, e.g. for VPC endpoint or local emulator. Default: none")
+	sqsPrefix     = flag.String("sqs-prefix", "", "Prefix of queue names, tube email is queue <prefix>email. Default: none")
+	sqsVisibility = flag.Duration("sqs-visibility", DEFAULT_TTR, "Visibility timeout of received jobs, time to run extended while worker runs. Default: 1m")
+)
+
+/**
+ * Amazon SQS backend. Each tube is a queue received with long polling; job stays invisible to other consumers
+ * for --sqs-visibility, extended while worker runs. Failed jobs go to dead letter queue of redrive policy of the queue
+ */
+type sqsBroker struct {
+	lock   sync.Mutex // Guards client and queues
+	client *sqs.Client
+	queues map[string]*sqsQueue
+}
+
+/** Queue of tube as resolved on subscribe */
+type sqsQueue struct {
+	url        string
+	deadLetter string // URL of dead letter queue from redrive policy, empty without one
+}
+
+/** Receipt of job, needed to change or delete it */
+type sqsHandle struct {
+	queue   *sqsQueue
+	receipt string
+}
+
+/**
+ * Returns client, loading AWS config first time. Caller must hold b.lock
+ */
+func (b *sqsBroker) connection() (*sqs.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	var options []func(*config.LoadOptions) error
+	if *sqsRegion != "" {
+		options = append(options, config.WithRegion(*sqsRegion))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS config: %v", err)
+	}
+	b.client = sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+		if *sqsEndpoint != "" {
+			o.BaseEndpoint = aws.String(*sqsEndpoint)
+		}
+	})
+	return b.client, nil
+}
+
+/**
+ * Returns client and queue of tube, looking up its URL and dead letter queue first time
+ */
+func (b *sqsBroker) queue(tube string) (*sqs.Client, *sqsQueue, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	client, err := b.connection()
+	if err != nil {
+		return nil, nil, err
+	}
+	if queue, known := b.queues[tube]; known {
+		return client, queue, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	found, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(*sqsPrefix + tube)})
+	if err != nil {
+		return nil, nil, err
+	}
+	queue := &sqsQueue{url: aws.ToString(found.QueueUrl)}
+	attributes, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       found.QueueUrl,
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameRedrivePolicy},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if policy := attributes.Attributes[string(types.QueueAttributeNameRedrivePolicy)]; policy != "" {
+		var redrive struct {
+			DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+		}
+		json.Unmarshal([]byte(policy), &redrive)
+		// arn:aws:sqs:<region>:<account>:<name>
+		if arn := strings.Split(redrive.DeadLetterTargetArn, ":"); len(arn) == 6 {
+			dead, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(arn[5]), QueueOwnerAWSAccountId: aws.String(arn[4])})
+			if err != nil {
+				return nil, nil, fmt.Errorf("dead letter queue %s: %v", arn[5], err)
+			}
+			queue.deadLetter = aws.ToString(dead.QueueUrl)
+		}
+	}
+	b.queues[tube] = queue
+	return client, queue, nil
+}
+
+/**
+ * Records failure of tube, queue deleted meanwhile is looked up again on next reserve
+ */
+func (b *sqsBroker) failed(tube string, err error) error {
+	var missing *types.QueueDoesNotExist
+	if errors.As(err, &missing) {
+		b.lock.Lock()
+		delete(b.queues, tube)
+		b.lock.Unlock()
+	}
+	tubeFailed(tube, err)
+	return err
+}
+
+func (b *sqsBroker) Check() error {
+	b.lock.Lock()
+	client, err := b.connection()
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	_, err = client.ListQueues(ctx, &sqs.ListQueuesInput{QueueNamePrefix: aws.String(*sqsPrefix), MaxResults: aws.Int32(1)})
+	return err
+}
+
+func (b *sqsBroker) Subscribe(tube string) {
+	if _, _, err := b.queue(tube); err != nil {
+		b.failed(tube, fmt.Errorf("not connected: %v", err))
+	}
+}
+
+/**
+ * Forgets queue of tube, so its redrive policy is read again on next subscribe
+ */
+func (b *sqsBroker) Unsubscribe(tube string) {
+	b.lock.Lock()
+	delete(b.queues, tube)
+	b.lock.Unlock()
+}
+
+/**
+ * Approximate number of visible jobs, as SQS counts them
+ */
+func (b *sqsBroker) Stats(tube string) (int, error) {
+	client, queue, err := b.queue(tube)
+	if err != nil {
+		return 0, b.failed(tube, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	attributes, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queue.url),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages},
+	})
+	if err != nil {
+		return 0, b.failed(tube, err)
+	}
+	return strconv.Atoi(attributes.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessages)])
+}
+
+/**
+ * Long polls queue of tube for one job, hiding it from other consumers for --sqs-visibility
+ */
+func (b *sqsBroker) Reserve(tube string, timeout time.Duration) (*ReservedJob, error) {
+	client, queue, err := b.queue(tube)
+	if err != nil {
+		return nil, b.failed(tube, err)
+	}
+	wait := timeout
+	if wait > SQS_MAX_WAIT {
+		wait = SQS_MAX_WAIT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait+DIAL_TIMEOUT)
+	defer cancel()
+	received, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(queue.url),
+		MaxNumberOfMessages:   1,
+		WaitTimeSeconds:       int32((wait + time.Second - 1) / time.Second),
+		VisibilityTimeout:     sqsSeconds(*sqsVisibility),
+		MessageAttributeNames: []string{"priority", "encoding"},
+	})
+	if err != nil {
+		return nil, b.failed(tube, err)
+	}
+	tubeRecovered(tube)
+	if len(received.Messages) == 0 {
+		return nil, nil
+	}
+	message := received.Messages[0]
+	job := &ReservedJob{
+		Id:       aws.ToString(message.MessageId),
+		Body:     []byte(aws.ToString(message.Body)),
+		Priority: DEFAULT_PRIORITY,
+		TTR:      *sqsVisibility,
+		handle:   sqsHandle{queue, aws.ToString(message.ReceiptHandle)},
+	}
+	if value, has := message.MessageAttributes["encoding"]; has && aws.ToString(value.StringValue) == "base64" {
+		if job.Body, err = base64.StdEncoding.DecodeString(aws.ToString(message.Body)); err != nil {
+			log.Printf("Message %s of %s is not base64 as its encoding says: %v", job.Id, tube, err)
+			job.Body = []byte(aws.ToString(message.Body))
+		}
+	}
+	if value, has := message.MessageAttributes["priority"]; has {
+		if pri, err := strconv.ParseUint(aws.ToString(value.StringValue), 10, 32); err == nil {
+			job.Priority = uint32(pri)
+		}
+	}
+	return job, nil
+}
+
+/**
+ * Whole seconds of visibility timeout, at least one
+ */
+func sqsSeconds(d time.Duration) int32 {
+	if d < time.Second {
+		return 1
+	}
+	return int32(d / time.Second)
+}
+
+func (b *sqsBroker) StopReserving(tube string) {
+}
+
+/**
+ * Extends visibility timeout of job by --sqs-visibility from now
+ */
+func (b *sqsBroker) Touch(job *ReservedJob) error {
+	return b.changeVisibility(job, sqsSeconds(*sqsVisibility))
+}
+
+func (b *sqsBroker) Delete(job *ReservedJob) error {
+	handle := job.handle.(sqsHandle)
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	_, err := b.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(handle.queue.url), ReceiptHandle: aws.String(handle.receipt)})
+	return err
+}
+
+/**
+ * Makes job visible again right away
+ */
+func (b *sqsBroker) Release(job *ReservedJob) error {
+	return b.changeVisibility(job, 0)
+}
+
+/**
+ * Moves job into dead letter queue of redrive policy. Without one job stays hidden until visibility timeout ends,
+ * then it is received again
+ */
+func (b *sqsBroker) Bury(job *ReservedJob) error {
+	handle := job.handle.(sqsHandle)
+	if handle.queue.deadLetter == "" {
+		return nil
+	}
+	if _, err := b.send(handle.queue.deadLetter, job.Body, job.Priority, 0); err != nil {
+		return err
+	}
+	return b.Delete(job)
+}
+
+func (b *sqsBroker) changeVisibility(job *ReservedJob, seconds int32) error {
+	handle := job.handle.(sqsHandle)
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	_, err := b.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(handle.queue.url),
+		ReceiptHandle:     aws.String(handle.receipt),
+		VisibilityTimeout: seconds,
+	})
+	return err
+}
+
+/**
+ * Sends job into queue of tube, priority kept in message attribute. Time to run is --sqs-visibility for all jobs
+ */
+func (b *sqsBroker) Put(tube string, body []byte, priority uint32, delay, ttr time.Duration) (string, error) {
+	if delay > SQS_MAX_DELAY {
+		return "", fmt.Errorf("delay over %v is not supported by sqs broker", SQS_MAX_DELAY)
+	}
+	_, queue, err := b.queue(tube)
+	if err != nil {
+		return "", err
+	}
+	return b.send(queue.url, body, priority, delay)
+}
+
+func (b *sqsBroker) send(url string, body []byte, priority uint32, delay time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	attributes := map[string]types.MessageAttributeValue{
+		"priority": {DataType: aws.String("Number"), StringValue: aws.String(strconv.FormatUint(uint64(priority), 10))},
+	}
+	message := string(body)
+	if !sqsSafe(body) {
+		// Message bodies are XML text, binary ones are sent encoded
+		message = base64.StdEncoding.EncodeToString(body)
+		attributes["encoding"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("base64")}
+	}
+	sent, err := b.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(url),
+		MessageBody:       aws.String(message),
+		DelaySeconds:      int32(delay / time.Second),
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(sent.MessageId), nil
+}
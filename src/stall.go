@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/** Exit code when main loop is wedged beyond recovery, so that supervisor restarts the daemon */
+const EXIT_STALLED = 3
+
+var (
+	stallTimeout = flag.Duration("stall-timeout", time.Minute, "Restart connection, or exit, when main loop does not complete a cycle for that long, 0 to disable. Default: 1m")
+
+	/** What main loop is doing, for watchdog to tell where it got stuck */
+	loop struct {
+		sync.Mutex
+		beat  time.Time
+		stage string
+		tube  string // Tube whose connection is in use, empty for command connection
+		conn  *beanstalk.Conn
+		polls map[string]*loopPoll // Tube stats in flight by tube, main loop polls several at once
+	}
+)
+
+/**
+ * Records main loop progress: name of blocking operation about to start, and connection it uses
+ */
+func loopStage(stage, tube string, conn *beanstalk.Conn) {
+	loop.Lock()
+	loop.beat = time.Now()
+	loop.stage, loop.tube, loop.conn = stage, tube, conn
+	if stage == "tube stats" && tube != "" {
+		if loop.polls == nil {
+			loop.polls = make(map[string]*loopPoll)
+		}
+		if poll := loop.polls[tube]; poll != nil {
+			poll.conn = conn
+		} else {
+			loop.polls[tube] = &loopPoll{loop.beat, conn}
+		}
+	}
+	loop.Unlock()
+}
+
+/** Tube stats request of main loop */
+type loopPoll struct {
+	started time.Time
+	conn    *beanstalk.Conn
+}
+
+/**
+ * Records tube stats request finished
+ */
+func pollFinished(tube string) {
+	loop.Lock()
+	delete(loop.polls, tube)
+	loop.Unlock()
+}
+
+/**
+ * Watches main loop progress. When it is stuck on tube connection, that connection is closed and recovered.
+ * When stuck anywhere else, or still stuck after that, exits with EXIT_STALLED
+ */
+func stallWatchdog() {
+	if *stallTimeout <= 0 {
+		return
+	}
+	loopStage("start", "", nil)
+	var recovered time.Time
+	for range time.Tick(*stallTimeout / 4) {
+		loop.Lock()
+		beat, stage, tube, conn := loop.beat, loop.stage, loop.tube, loop.conn
+		// Of tube stats in flight, the oldest is the one stuck
+		if stage == "tube stats" {
+			var oldest time.Time
+			for polled, poll := range loop.polls {
+				if oldest.IsZero() || poll.started.Before(oldest) {
+					oldest, tube, conn = poll.started, polled, poll.conn
+				}
+			}
+		}
+		loop.Unlock()
+		stalled := time.Since(beat)
+		if stalled < *stallTimeout {
+			continue
+		}
+		message := fmt.Sprintf("main loop stalled for %v in %s", stalled.Truncate(time.Second), stage)
+		if tube != "" {
+			message += " of " + tube
+		}
+		if recovered.Equal(beat) && stalled < 2**stallTimeout {
+			// Recovery in progress, give it time
+			continue
+		}
+		stateLock.Lock()
+		stats.Stalls++
+		stats.LastStall = time.Now().Format(time.RFC3339) + ": " + message
+		stateLock.Unlock()
+		publishEvent("stalled", tube, message)
+		if tube == "" || conn == nil || recovered.Equal(beat) {
+			log.Printf("Fatal error: %s, exiting", message)
+			sdNotify("STATUS=Exiting, " + message)
+			os.Exit(EXIT_STALLED)
+		}
+		log.Printf("Watchdog: %s, reconnecting it", message)
+		degradeTube(tube, conn, fmt.Errorf("%s", message))
+		recovered = beat
+	}
+}
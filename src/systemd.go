@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+/** How often STATUS= is refreshed at most */
+const SYSTEMD_STATUS_INTERVAL = time.Second
+
+var (
+	/** systemd variables, passed on to new binary on hot upgrade */
+	systemdEnv []string
+
+	notifyAddr       *net.UnixAddr
+	watchdogInterval time.Duration
+	lastWatchdog     time.Time
+	lastStatus       time.Time
+	lastStatusText   string
+)
+
+/**
+ * Reads NOTIFY_SOCKET and WATCHDOG_USEC set by systemd for Type=notify services
+ */
+func initSystemd() {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	notifyAddr = &net.UnixAddr{Name: socket, Net: "unixgram"}
+	systemdEnv = []string{"NOTIFY_SOCKET=" + os.Getenv("NOTIFY_SOCKET")}
+	if usec := os.Getenv("WATCHDOG_USEC"); usec != "" {
+		systemdEnv = append(systemdEnv, "WATCHDOG_USEC="+usec)
+	}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		pid, pidErr := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+		if pidErr != nil || pid == os.Getpid() {
+			// Ping twice per watchdog period, as systemd recommends
+			watchdogInterval = time.Duration(usec) * time.Microsecond / 2
+			log.Printf("systemd watchdog enabled, pinging every %v", watchdogInterval)
+		}
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+}
+
+/**
+ * Sends state to systemd, does nothing when not started by systemd
+ */
+func sdNotify(state string) {
+	if notifyAddr == nil {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, notifyAddr)
+	if err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+	}
+}
+
+/**
+ * Called from main loop: pings watchdog, so wedged loop gets restarted, and refreshes status line.
+ * Takes stateLock itself
+ */
+func systemdTick() {
+	if notifyAddr == nil {
+		return
+	}
+	now := time.Now()
+	if watchdogInterval > 0 && now.Sub(lastWatchdog) >= watchdogInterval {
+		sdNotify("WATCHDOG=1")
+		lastWatchdog = now
+	}
+	if now.Sub(lastStatus) >= SYSTEMD_STATUS_INTERVAL {
+		lastStatus = now
+		stateLock.Lock()
+		text := fmt.Sprintf("%d worker(s) running, %d run(s) total", stats.TotalRunning, stats.TotalRuns)
+		if stats.Draining {
+			text = "Draining, " + text
+		} else if !stats.Ready {
+			text = "Not ready: " + stats.NotReady + ", " + text
+		}
+		stateLock.Unlock()
+		if text != lastStatusText {
+			sdNotify("STATUS=" + text)
+			lastStatusText = text
+		}
+	}
+}
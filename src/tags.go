@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+)
+
+/** What host offers, for Requires of tubes */
+var hostTagsFlag = flag.String("tags", "", "Comma separated tags of host, e.g. gpu,eu-west, only tubes whose Requires are all among them are subscribed. Default: none, only tubes without Requires are")
+
+/**
+ * Returns tags of host, sorted
+ */
+func hostTags() []string {
+	var tags []string
+	for _, tag := range strings.Split(*hostTagsFlag, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+/**
+ * Checks if tube may be served on this host and records tags it misses in status, logging when that changes.
+ * Caller must hold stateLock
+ */
+func tagsMatch(tube string) bool {
+	missing := strings.Join(missingTags(effectiveConfig(tube)), ",")
+	if missing == stats.Unmatched[tube] {
+		return missing == ""
+	}
+	if missing == "" {
+		delete(stats.Unmatched, tube)
+		log.Printf("Host has all tags %s requires now, serving it", tube)
+		return true
+	}
+	if stats.Unmatched == nil {
+		stats.Unmatched = make(map[string]string)
+	}
+	stats.Unmatched[tube] = missing
+	log.Printf("Not serving %s, host lacks tags %s it requires", tube, missing)
+	return false
+}
+
+/**
+ * Returns tags tube requires that host does not have, none if it may be served here
+ */
+func missingTags(config EffectiveConfig) []string {
+	have := make(map[string]bool)
+	for _, tag := range hostTags() {
+		have[tag] = true
+	}
+	var missing []string
+	for _, tag := range config.Requires {
+		if !have[tag] {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+)
+
+/** Tenant of tube is the part of its name before separator, "acme" of "acme.email" */
+const TENANT_SEPARATOR = "."
+
+/** Tubes of several customers served by one deployment */
+var tenantsEnabled = flag.Bool("tenants", false, "Treat part of tube names before first dot as tenant, e.g. acme of acme.email, for tenant limits, pause and status rollups with acme.* patterns. Default: false")
+
+/**
+ * Tubes of tenant rolled up in status
+ */
+type TenantStatus struct {
+	Tubes   uint // Subscribed tubes of tenant
+	Running uint
+	Runs    uint64
+	Errors  uint64
+	Limit   *uint `json:",omitempty"` // Workers allowed over all its tubes, unlimited if not set
+	Paused  bool  `json:",omitempty"`
+}
+
+/**
+ * Returns tenant of tube, empty when tenants are not enabled or tube name has none
+ */
+func tenantOf(tube string) string {
+	if !*tenantsEnabled {
+		return ""
+	}
+	if separator := strings.Index(tube, TENANT_SEPARATOR); separator > 0 {
+		return tube[:separator]
+	}
+	return ""
+}
+
+/**
+ * Returns tenant given as pattern of all its tubes, "acme" of "acme.*", empty if key is no such pattern
+ */
+func tenantPattern(key string) string {
+	if !*tenantsEnabled || !strings.HasSuffix(key, TENANT_SEPARATOR+"*") {
+		return ""
+	}
+	return strings.TrimSuffix(key, TENANT_SEPARATOR+"*")
+}
+
+/**
+ * Checks if tenant of tube is not paused and runs less workers than its limit. Caller must hold stateLock
+ */
+func tenantAllows(tube string) bool {
+	tenant := tenantOf(tube)
+	if tenant == "" {
+		return true
+	}
+	if stats.Paused[tenant+TENANT_SEPARATOR+"*"] {
+		return false
+	}
+	limit, has := limits.Tenants[tenant]
+	return !has || tenantRunning(tenant) < limit
+}
+
+/**
+ * Sets limit of workers over all tubes of tenant. Caller must hold stateLock
+ */
+func setTenantLimit(tenant string, limit uint) {
+	if limits.Tenants == nil {
+		limits.Tenants = make(map[string]uint)
+	}
+	limits.Tenants[tenant] = limit
+	log.Printf("Setting tenant %s => %d", tenant, limit)
+}
+
+/**
+ * Returns workers running for all tubes of tenant. Caller must hold stateLock
+ */
+func tenantRunning(tenant string) uint {
+	var running uint
+	for tube, count := range stats.Running {
+		if tenantOf(tube) == tenant {
+			running += count
+		}
+	}
+	return running
+}
+
+/**
+ * Rolls status of subscribed tubes up by tenant. Caller must hold stateLock
+ */
+func updateTenants() {
+	if !*tenantsEnabled {
+		return
+	}
+	tenants := make(map[string]*TenantStatus)
+	rollup := func(tenant string) *TenantStatus {
+		if tenants[tenant] == nil {
+			tenants[tenant] = &TenantStatus{Paused: stats.Paused[tenant+TENANT_SEPARATOR+"*"]}
+			if limit, has := limits.Tenants[tenant]; has {
+				tenants[tenant].Limit = &limit
+			}
+		}
+		return tenants[tenant]
+	}
+	for tube := range subscriptions {
+		if tenant := tenantOf(tube); tenant != "" {
+			status := rollup(tenant)
+			status.Tubes++
+			status.Running += stats.Running[tube]
+			status.Runs += stats.Runs[tube]
+			status.Errors += stats.Errors[tube]
+		}
+	}
+	// Limited tenants show up before their tubes do
+	for tenant := range limits.Tenants {
+		rollup(tenant)
+	}
+	stats.Tenants = tenants
+}
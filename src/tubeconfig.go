@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Dispatch priority of tubes without one configured, lower is dispatched first like beanstalkd job priority */
+const DEFAULT_PRIORITY = 1024
+
+/** Daemon environment variables workers get unless --worker-env or InheritEnv says otherwise */
+const DEFAULT_WORKER_ENV = "PATH,HOME,USER,LOGNAME,LANG,LC_ALL,TZ,TMPDIR"
+
+/**
+ * Duration read from config as "30s" string
+ */
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+/**
+ * Worker settings, in config file either as defaults or per tube overrides
+ *
+ * Fields left out are inherited: tube settings > defaults > built in defaults.
+ */
+type TubeConfig struct {
+	Limit    *uint             `json:",omitempty"` // Concurrency limit, Queues from limits take precedence
+	Timeout  *Duration         `json:",omitempty"` // Worker is killed after running that long, 0 for no timeout
+	Retry    *uint             `json:",omitempty"` // How many times failed worker run is retried
+	Priority *uint32           `json:",omitempty"` // Dispatch order when capacity is short, lower goes first
+	Weight   *uint             `json:",omitempty"` // Share of capacity among tubes of same priority when it is short
+	Cost     *uint             `json:",omitempty"` // Resource units worker counts for against total limit, e.g. 4 for heavy one
+	Env      map[string]string `json:",omitempty"` // Extra environment, merged with defaults
+	Secrets  map[string]string `json:",omitempty"` // Environment fetched from secret stores at spawn, variable => reference
+	Features []string          `json:",omitempty"` // Experimental behaviors, "-name" disables one enabled in defaults
+	Resident *uint             `json:",omitempty"` // Instances kept running regardless of jobs, 0 to start worker per job
+	Server   string            `json:",omitempty"` // Beanstalkd server holding the tube, instead of --connect servers
+
+	InheritEnv []string   `json:",omitempty"` // Daemon environment variables passed to worker, "*" for all, instead of --worker-env
+	Umask      string     `json:",omitempty"` // Octal umask worker is started with, instead of --umask
+	Autoscale  *Autoscale `json:",omitempty"` // Limit follows backlog up to Max, Limit being the least
+
+	GlobalLimit *uint      `json:",omitempty"` // Workers over all instances sharing --coordination, 0 for no such limit
+	Requires    []string   `json:",omitempty"` // Tags host must have in --tags to serve the tube, e.g. ["gpu"]
+	Shadow      *Shadow    `json:",omitempty"` // Share of jobs copied into tube of worker under test, see shadow.go
+	Schema      string     `json:",omitempty"` // JSON Schema file reserved payloads must match, relative to config file
+	Compression string     `json:",omitempty"` // "gzip" or "zstd" reserved payloads always are, "none" to pass them as they are
+	Rules       []Rule     `json:",omitempty"` // Routing and rewriting of reserved payloads, tube rules replace default ones
+	Input       string     `json:",omitempty"` // How reserved payload is given to worker: "stdin", "json", "args" or "file"
+	Args        []string   `json:",omitempty"` // Argument templates for Input "args" or "file", e.g. ["--user", "{{.user_id}}"]
+	Migration   *Migration `json:",omitempty"` // Payload versions reserved payloads are upgraded through, see migrate.go
+	Canary      *Canary    `json:",omitempty"` // Share of runs new worker version gets until promoted or rolled back, see canary.go
+}
+
+/**
+ * Config file contents, limits are kept on top level for compatibility
+ */
+type ConfigFile struct {
+	Limits
+	Defaults *TubeConfig            `json:",omitempty"`
+	Tubes    map[string]*TubeConfig `json:",omitempty"`
+	Freeze   []FreezeWindow         `json:",omitempty"` // When deployWorker and syncWorkers are rejected
+}
+
+/**
+ * Effective worker settings with where each of them comes from
+ */
+type EffectiveConfig struct {
+	Limit    uint
+	Timeout  Duration
+	Retry    uint
+	Priority uint32
+	Weight   uint
+	Cost     uint
+	Env      map[string]string
+	Secrets  map[string]string // References only, values are fetched at spawn
+	Features []string
+	Resident uint
+	Server   string            // Empty for --connect servers
+	Sources  map[string]string // Setting => "limits", "tube", "defaults" or "builtin"
+
+	InheritEnv []string
+	Umask      string // Empty for umask of daemon
+	Autoscale  *Autoscale
+
+	GlobalLimit uint
+	Requires    []string
+	Shadow      *Shadow
+	Schema      string // Empty for payloads not checked
+	Compression string // Empty to detect compressed payloads by magic bytes
+	Rules       []Rule
+	Input       string // Empty for payload on stdin as it is
+	Args        []string
+	Migration   *Migration
+	Canary      *Canary
+
+	features  map[string]bool
+	baseLimit uint // Limit without autoscaling
+}
+
+var (
+	/** Which parts of daemon environment workers are started with */
+	workerEnvNames = flag.String("worker-env", DEFAULT_WORKER_ENV, "Comma separated daemon environment variables passed to workers, \"*\" for all. Default: "+DEFAULT_WORKER_ENV)
+	workerUmask    = flag.String("umask", "", "Octal umask workers are started with, e.g. 027. Default: umask of daemon")
+
+	/** Settings for all tubes */
+	tubeDefaults *TubeConfig
+
+	/** Per tube settings */
+	tubeConfigs = make(map[string]*TubeConfig)
+)
+
+/**
+ * Merges built in defaults, config defaults, tube settings and limits into effective settings
+ */
+func effectiveConfig(tube string) EffectiveConfig {
+	return resolveConfig(tube, true)
+}
+
+/**
+ * Effective settings for checks run every scheduling cycle: without Sources, Env, Secrets and InheritEnv, which are
+ * left nil so that little is allocated
+ */
+func schedulingConfig(tube string) EffectiveConfig {
+	return resolveConfig(tube, false)
+}
+
+/**
+ * Merges settings of tube, with where they come from and worker environment only if full
+ */
+func resolveConfig(tube string, full bool) EffectiveConfig {
+	config := EffectiveConfig{
+		Limit:    *defaultQueueLimit,
+		Priority: DEFAULT_PRIORITY,
+		Weight:   DEFAULT_WEIGHT,
+		Cost:     DEFAULT_COST,
+		Features: []string{},
+		features: make(map[string]bool),
+		Umask:    *workerUmask,
+	}
+	if full {
+		config.Env, config.Secrets = make(map[string]string), make(map[string]string)
+		config.InheritEnv = strings.Split(*workerEnvNames, ",")
+		config.Sources = map[string]string{"Limit": "builtin", "Timeout": "builtin", "Retry": "builtin", "Priority": "builtin", "Weight": "builtin", "Cost": "builtin", "GlobalLimit": "builtin", "Resident": "builtin", "Server": "builtin", "InheritEnv": "builtin", "Umask": "builtin", "Autoscale": "builtin", "Requires": "builtin", "Shadow": "builtin", "Schema": "builtin", "Compression": "builtin", "Rules": "builtin", "Input": "builtin", "Args": "builtin", "Migration": "builtin", "Canary": "builtin"}
+	}
+	layers := []struct {
+		name   string
+		config *TubeConfig
+	}{{"defaults", tubeDefaults}, {"tube", tubeConfigs[tube]}}
+	for _, layer := range layers {
+		if layer.config == nil {
+			continue
+		}
+		if layer.config.Limit != nil {
+			config.Limit = *layer.config.Limit
+			config.source("Limit", layer.name)
+		}
+		if layer.config.Timeout != nil {
+			config.Timeout = *layer.config.Timeout
+			config.source("Timeout", layer.name)
+		}
+		if layer.config.Retry != nil {
+			config.Retry = *layer.config.Retry
+			config.source("Retry", layer.name)
+		}
+		if layer.config.Priority != nil {
+			config.Priority = *layer.config.Priority
+			config.source("Priority", layer.name)
+		}
+		if layer.config.Weight != nil && *layer.config.Weight > 0 {
+			config.Weight = *layer.config.Weight
+			config.source("Weight", layer.name)
+		}
+		if layer.config.Cost != nil && *layer.config.Cost > 0 {
+			config.Cost = *layer.config.Cost
+			config.source("Cost", layer.name)
+		}
+		if layer.config.GlobalLimit != nil {
+			config.GlobalLimit = *layer.config.GlobalLimit
+			config.source("GlobalLimit", layer.name)
+		}
+		if layer.config.Resident != nil {
+			config.Resident = *layer.config.Resident
+			config.source("Resident", layer.name)
+		}
+		if layer.config.Server != "" {
+			config.Server = layer.config.Server
+			config.source("Server", layer.name)
+		}
+		if layer.config.InheritEnv != nil {
+			config.InheritEnv = layer.config.InheritEnv
+			config.source("InheritEnv", layer.name)
+		}
+		if layer.config.Umask != "" {
+			config.Umask = layer.config.Umask
+			config.source("Umask", layer.name)
+		}
+		if layer.config.Autoscale != nil {
+			config.Autoscale = layer.config.Autoscale
+			config.source("Autoscale", layer.name)
+		}
+		if layer.config.Requires != nil {
+			config.Requires = layer.config.Requires
+			config.source("Requires", layer.name)
+		}
+		if layer.config.Shadow != nil {
+			config.Shadow = layer.config.Shadow
+			config.source("Shadow", layer.name)
+		}
+		if layer.config.Schema != "" {
+			config.Schema = layer.config.Schema
+			config.source("Schema", layer.name)
+		}
+		if layer.config.Rules != nil {
+			config.Rules = layer.config.Rules
+			config.source("Rules", layer.name)
+		}
+		if layer.config.Migration != nil {
+			config.Migration = layer.config.Migration
+			config.source("Migration", layer.name)
+		}
+		if layer.config.Canary != nil {
+			config.Canary = layer.config.Canary
+			config.source("Canary", layer.name)
+		}
+		if layer.config.Input != "" {
+			config.Input = layer.config.Input
+			config.source("Input", layer.name)
+		}
+		if layer.config.Args != nil {
+			config.Args = layer.config.Args
+			config.source("Args", layer.name)
+		}
+		if layer.config.Compression != "" {
+			config.Compression = layer.config.Compression
+			config.source("Compression", layer.name)
+		}
+		if full {
+			for key, value := range layer.config.Env {
+				config.Env[key] = value
+				config.source("Env."+key, layer.name)
+			}
+			for key, ref := range layer.config.Secrets {
+				config.Secrets[key] = ref
+				config.source("Secrets."+key, layer.name)
+			}
+		}
+		mergeFeatures(&config, layer.name, layer.config.Features)
+	}
+	if limit, has := limits.Queues[tube]; has {
+		config.Limit = limit
+		config.source("Limit", "limits")
+	}
+	config.baseLimit = config.Limit
+	if scaled, has := stats.Autoscaled[tube]; has && config.Autoscale != nil && scaled > config.Limit {
+		if scaled > config.Autoscale.Max {
+			scaled = config.Autoscale.Max
+		}
+		config.Limit = scaled
+		config.source("Limit", "autoscale")
+	}
+	return config
+}
+
+/**
+ * Records layer setting comes from, unless Sources are left out
+ */
+func (config *EffectiveConfig) source(setting, layer string) {
+	if config.Sources != nil {
+		config.Sources[setting] = layer
+	}
+}
+
+/**
+ * Returns worker environment: whitelisted part of daemon environment with configured variables added,
+ * so credentials daemon was started with do not leak to workers
+ */
+func workerEnv(config EffectiveConfig) []string {
+	inherit := make(map[string]bool, len(config.InheritEnv))
+	for _, name := range config.InheritEnv {
+		inherit[strings.TrimSpace(name)] = true
+	}
+	env := make([]string, 0, len(config.InheritEnv)+len(config.Env))
+	for _, entry := range os.Environ() {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if _, overridden := config.Env[name]; !overridden && (inherit[name] || inherit["*"]) {
+			env = append(env, entry)
+		}
+	}
+	for key, value := range config.Env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+/**
+ * Parses octal umask setting, -1 for empty one meaning umask of daemon
+ */
+func parseUmask(umask string) (int, error) {
+	if umask == "" {
+		return -1, nil
+	}
+	value, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || value > 0777 {
+		return -1, fmt.Errorf("umask %q is not octal 000 to 777", umask)
+	}
+	return int(value), nil
+}
+
+/**
+ * Returns JSON encoded effective settings of subscribed tubes, or only of tubes given in options
+ */
+func getConfig(options map[string]string) []byte {
+	configs := make(map[string]EffectiveConfig)
+	for tube := range subscriptions {
+		if _, wanted := options[tube]; len(options) == 0 || wanted {
+			configs[tube] = effectiveConfig(tube)
+		}
+	}
+	response, err := json.Marshal(struct {
+		Defaults *TubeConfig
+		Tubes    map[string]EffectiveConfig
+	}{tubeDefaults, configs})
+	if err != nil {
+		log.Printf("Could not encode config: %v", err)
+		return nil
+	}
+	return response
+}
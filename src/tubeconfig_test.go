@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/**
+ * Replaces config file settings and limits of tubes for test, returning function restoring them
+ */
+func setTubeConfig(t *testing.T, defaults string, tubes map[string]string, queues map[string]uint) func() {
+	savedDefaults, savedConfigs, savedQueues := tubeDefaults, tubeConfigs, limits.Queues
+	tubeDefaults, tubeConfigs = nil, make(map[string]*TubeConfig)
+	if defaults != "" {
+		tubeDefaults = new(TubeConfig)
+		if err := json.Unmarshal([]byte(defaults), tubeDefaults); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tube, data := range tubes {
+		config := new(TubeConfig)
+		if err := json.Unmarshal([]byte(data), config); err != nil {
+			t.Fatal(err)
+		}
+		tubeConfigs[tube] = config
+	}
+	limits.Queues = queues
+	return func() {
+		tubeDefaults, tubeConfigs, limits.Queues = savedDefaults, savedConfigs, savedQueues
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaults   string
+		tube       string
+		queues     map[string]uint
+		autoscaled map[string]uint
+		limit      uint
+		retry      uint
+		priority   uint32
+		weight     uint
+		cost       uint
+		env        map[string]string
+		features   []string
+		sources    map[string]string
+	}{
+		{
+			name:  "builtin",
+			limit: *defaultQueueLimit, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Limit": "builtin", "Retry": "builtin", "Priority": "builtin"},
+		},
+		{
+			name:     "defaults",
+			defaults: `{"Limit": 3, "Retry": 2, "Priority": 10, "Env": {"A": "1"}}`,
+			limit:    3, retry: 2, priority: 10, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{"A": "1"}, features: []string{},
+			sources: map[string]string{"Limit": "defaults", "Retry": "defaults", "Priority": "defaults", "Env.A": "defaults"},
+		},
+		{
+			name:     "tube over defaults",
+			defaults: `{"Limit": 3, "Retry": 2, "Env": {"A": "1", "B": "1"}}`,
+			tube:     `{"Limit": 7, "Env": {"B": "2", "C": "2"}}`,
+			limit:    7, retry: 2, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{"A": "1", "B": "2", "C": "2"}, features: []string{},
+			sources: map[string]string{"Limit": "tube", "Retry": "defaults", "Env.A": "defaults", "Env.B": "tube", "Env.C": "tube"},
+		},
+		{
+			name:     "zero limit kept",
+			defaults: `{"Limit": 3}`,
+			tube:     `{"Limit": 0}`,
+			limit:    0, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Limit": "tube"},
+		},
+		{
+			name:   "limits over tube",
+			tube:   `{"Limit": 7}`,
+			queues: map[string]uint{"email": 2, "other": 9},
+			limit:  2, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Limit": "limits"},
+		},
+		{
+			name:     "features disabled by tube",
+			defaults: `{"Features": ["a", "b"]}`,
+			tube:     `{"Features": ["-a", "c"]}`,
+			limit:    *defaultQueueLimit, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{"b", "c"},
+			sources: map[string]string{"Features.a": "tube", "Features.b": "defaults", "Features.c": "tube"},
+		},
+		{
+			name:       "autoscaled up to max",
+			tube:       `{"Limit": 2, "Autoscale": {"Max": 6}}`,
+			autoscaled: map[string]uint{"email": 10},
+			limit:      6, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Limit": "autoscale", "Autoscale": "tube"},
+		},
+		{
+			name:       "autoscaled below limit ignored",
+			tube:       `{"Limit": 4, "Autoscale": {"Max": 6}}`,
+			autoscaled: map[string]uint{"email": 3},
+			limit:      4, priority: DEFAULT_PRIORITY, weight: DEFAULT_WEIGHT, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Limit": "tube"},
+		},
+		{
+			name:     "weight",
+			defaults: `{"Weight": 2}`,
+			tube:     `{"Weight": 4}`,
+			limit:    *defaultQueueLimit, priority: DEFAULT_PRIORITY, weight: 4, cost: DEFAULT_COST,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Weight": "tube"},
+		},
+		{
+			name:     "zero weight and cost ignored",
+			defaults: `{"Weight": 3, "Cost": 2}`,
+			tube:     `{"Weight": 0, "Cost": 0}`,
+			limit:    *defaultQueueLimit, priority: DEFAULT_PRIORITY, weight: 3, cost: 2,
+			env: map[string]string{}, features: []string{},
+			sources: map[string]string{"Weight": "defaults", "Cost": "defaults"},
+		},
+	}
+	savedAutoscaled := stats.Autoscaled
+	defer func() { stats.Autoscaled = savedAutoscaled }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tubes := map[string]string{}
+			if test.tube != "" {
+				tubes["email"] = test.tube
+			}
+			defer setTubeConfig(t, test.defaults, tubes, test.queues)()
+			stats.Autoscaled = test.autoscaled
+			got := effectiveConfig("email")
+			if got.Limit != test.limit || got.Retry != test.retry || got.Priority != test.priority {
+				t.Errorf("got limit %d, retry %d, priority %d, want %d, %d, %d", got.Limit, got.Retry, got.Priority,
+					test.limit, test.retry, test.priority)
+			}
+			if got.Weight != test.weight || got.Cost != test.cost {
+				t.Errorf("got weight %d, cost %d, want %d, %d", got.Weight, got.Cost, test.weight, test.cost)
+			}
+			if !reflect.DeepEqual(got.Env, test.env) {
+				t.Errorf("got Env %v, want %v", got.Env, test.env)
+			}
+			if !reflect.DeepEqual(got.Features, test.features) {
+				t.Errorf("got Features %v, want %v", got.Features, test.features)
+			}
+			for setting, source := range test.sources {
+				if got.Sources[setting] != source {
+					t.Errorf("%s comes from %q, want %q", setting, got.Sources[setting], source)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulingConfig(t *testing.T) {
+	defer setTubeConfig(t, `{"Limit": 3, "Env": {"A": "1"}, "Secrets": {"B": "env:B"}, "Features": ["a"]}`,
+		map[string]string{"email": `{"Weight": 2, "Features": ["b"]}`}, map[string]uint{"email": 4})()
+	full, scheduling := effectiveConfig("email"), schedulingConfig("email")
+	if scheduling.Sources != nil || scheduling.Env != nil || scheduling.Secrets != nil || scheduling.InheritEnv != nil {
+		t.Errorf("scheduling config has Sources %v, Env %v, Secrets %v, InheritEnv %v", scheduling.Sources, scheduling.Env,
+			scheduling.Secrets, scheduling.InheritEnv)
+	}
+	full.Sources, full.Env, full.Secrets, full.InheritEnv = nil, nil, nil, nil
+	if !reflect.DeepEqual(full, scheduling) {
+		t.Errorf("scheduling config %+v differs from effective config %+v", scheduling, full)
+	}
+}
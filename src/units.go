@@ -0,0 +1,30 @@
+package main
+
+/** Resource units worker of tube without Cost counts for against total limit */
+const DEFAULT_COST = 1
+
+/**
+ * Counts cost tube has now for its worker starting. Caller must hold stateLock
+ */
+func addUnits(tube string) {
+	cost := schedulingConfig(tube).Cost
+	stats.Units[tube] += cost
+	stats.TotalUnits += cost
+}
+
+/**
+ * Stops counting units of worker of tube that finished, before Running is decreased. Cost may have changed since
+ * workers running started, so their average is taken, and nothing is left once the last one finishes.
+ * Caller must hold stateLock
+ */
+func removeUnits(tube string) {
+	units := stats.Units[tube]
+	if running := stats.Running[tube]; running > 1 {
+		units /= running
+	}
+	stats.Units[tube] -= units
+	stats.TotalUnits -= units
+	if stats.Units[tube] == 0 {
+		delete(stats.Units, tube)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	/** Environment variable listing files inherited from upgraded process, e.g. "state:3,ready:4,socket:5" */
+	UPGRADE_ENV = "_WORKERMAN_UPGRADE"
+	/** How long new binary gets to report it is ready to take over */
+	UPGRADE_TIMEOUT = 30 * time.Second
+)
+
+/**
+ * Handed over by upgraded process: its pid and workers still running under it
+ */
+type UpgradeState struct {
+	Parent  int
+	Workers []UpgradeWorker
+}
+
+type UpgradeWorker struct {
+	Tube    string
+	Pid     int
+	Started uint64 // Start time from /proc, tells reused pid apart
+}
+
+var (
+	/** Files inherited from upgraded process by name */
+	inherited = make(map[string]*os.File)
+
+	/** Process which handed over to us, 0 if started normally */
+	upgradeParent int
+
+	/** Set once new binary took over: commands are no longer read, process exits when workers finish. Guarded by stateLock */
+	handedOver bool
+)
+
+/**
+ * Picks up files passed by upgraded process, must be called before anything is opened
+ */
+func loadInherited() {
+	spec := os.Getenv(UPGRADE_ENV)
+	if spec == "" {
+		return
+	}
+	os.Unsetenv(UPGRADE_ENV)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if fd, err := strconv.Atoi(parts[1]); err == nil {
+			inherited[parts[0]] = os.NewFile(uintptr(fd), parts[0])
+		}
+	}
+	upgradeParent = os.Getppid()
+	log.Printf("Taking over from upgraded process %d", upgradeParent)
+}
+
+/**
+ * Returns listener handed over by upgraded process, nil if there is none
+ */
+func inheritedListener(name string) net.Listener {
+	file, has := inherited[name]
+	if !has {
+		return nil
+	}
+	delete(inherited, name)
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		log.Printf("Could not use inherited %s listener: %v", name, err)
+		return nil
+	}
+	return listener
+}
+
+/**
+ * Returns duplicate of listener file descriptor to pass to new process
+ */
+func listenerFile(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, fmt.Errorf("unsupported listener %T", listener)
+}
+
+/**
+ * Starts hot upgrade on SIGUSR2
+ */
+func listenUpgrade() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			upgrade()
+		}
+	}()
+}
+
+/**
+ * Starts new binary, hands over listeners, workers directory lock and running workers,
+ * then stops reading commands and exits once own workers finish
+ */
+func upgrade() {
+	if os.Getpid() == 1 || os.Getenv(SUPERVISED_ENV) == "worker" {
+		log.Printf("Hot upgrade is not possible when running as PID 1 or under --daemon supervisor, restart instead")
+		return
+	}
+	stateLock.Lock()
+	done := handedOver
+	stateLock.Unlock()
+	if done {
+		return
+	}
+	log.Printf("Upgrading: starting new binary")
+	var files []*os.File
+	var spec []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	pass := func(name string, file *os.File) {
+		spec = append(spec, fmt.Sprintf("%s:%d", name, 3+len(files)))
+		files = append(files, file)
+	}
+	state, err := upgradeStateFile()
+	if err != nil {
+		log.Printf("Upgrade failed: could not write state: %v", err)
+		return
+	}
+	pass("state", state)
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		log.Printf("Upgrade failed: %v", err)
+		return
+	}
+	defer ready.Close()
+	pass("ready", readyWriter)
+	if workersLock != nil {
+		if lock, err := syscall.Dup(int(workersLock.Fd())); err == nil {
+			pass("lock", os.NewFile(uintptr(lock), "lock"))
+		}
+	}
+	for name, listener := range map[string]net.Listener{"socket": controlListener, "worker-socket": workerListener, "http": httpListener, "grpc": grpcListener} {
+		if listener == nil {
+			continue
+		}
+		if file, err := listenerFile(listener); err == nil {
+			pass(name, file)
+		} else {
+			log.Printf("Upgrade: %s listener is not handed over: %v", name, err)
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Dir = myDir
+	cmd.Env = append(append(os.Environ(), systemdEnv...), UPGRADE_ENV+"="+strings.Join(spec, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	childDone, err := startChild(cmd)
+	if err != nil {
+		log.Printf("Upgrade failed: could not start %s: %v", executable, err)
+		return
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		childDone()
+		exited <- err
+	}()
+	readyWriter.Close()
+	confirmed := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := ready.Read(buf)
+		confirmed <- n == 1
+	}()
+	select {
+	case ok := <-confirmed:
+		if !ok {
+			log.Printf("Upgrade failed: new process %d did not take over", cmd.Process.Pid)
+			return
+		}
+	case err := <-exited:
+		log.Printf("Upgrade failed: new process exited: %v", err)
+		return
+	case <-time.After(UPGRADE_TIMEOUT):
+		log.Printf("Upgrade failed: new process %d is not ready after %v, killing it", cmd.Process.Pid, UPGRADE_TIMEOUT)
+		cmd.Process.Kill()
+		return
+	}
+	log.Printf("Handed over to new process %d, exiting once running workers finish", cmd.Process.Pid)
+	sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+	publishEvent("upgraded", "", fmt.Sprintf("handed over to pid %d", cmd.Process.Pid))
+	stateLock.Lock()
+	handedOver = true
+	stats.Draining = true
+	stateLock.Unlock()
+	// Socket files now belong to the new process
+	for _, listener := range []net.Listener{controlListener, workerListener} {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	closeControlSocket()
+	closeHttp()
+	closeGrpc()
+}
+
+/**
+ * Writes running workers into unlinked temporary file, to be read by new process
+ */
+func upgradeStateFile() (*os.File, error) {
+	state := UpgradeState{Parent: os.Getpid()}
+	if workersDir, err := os.Getwd(); err == nil {
+		for _, pid := range childPids(os.Getpid()) {
+			tube, resident := orphanTube(pid, workersDir)
+			info, ok := procStat(pid)
+			// Resident workers are stopped, new process starts its own
+			if tube != "" && !resident && ok && !info.zombie {
+				state.Workers = append(state.Workers, UpgradeWorker{tube, pid, info.started})
+			}
+		}
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "workerman-upgrade")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+/**
+ * In new process: counts workers of upgraded process as running until they exit, then tells it to stop
+ */
+func completeUpgrade() {
+	if file, has := inherited["state"]; has {
+		var state UpgradeState
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err == nil {
+			err = json.Unmarshal(content, &state)
+		}
+		if err != nil {
+			log.Printf("Could not read upgrade state: %v", err)
+		}
+		for _, worker := range state.Workers {
+			if info, ok := procStat(worker.Pid); ok && info.started == worker.Started {
+				adoptWorker(worker.Tube, worker.Pid, worker.Started, false)
+			}
+		}
+	}
+	if ready, has := inherited["ready"]; has {
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kr/beanstalk"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Beanstalkd limit on tube name length */
+const MAX_TUBE_NAME = 200
+
+/**
+ * Validation report printed by validate command
+ */
+type Report struct {
+	Problems int
+	Warnings int
+}
+
+func (r *Report) Ok(format string, a ...interface{}) {
+	fmt.Printf("[OK  ] %s\n", fmt.Sprintf(format, a...))
+}
+
+func (r *Report) Warn(format string, a ...interface{}) {
+	r.Warnings++
+	fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, a...))
+}
+
+func (r *Report) Fail(format string, a ...interface{}) {
+	r.Problems++
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, a...))
+}
+
+/**
+ * Checks if name can be used as beanstalkd tube name
+ */
+func checkTubeName(name string) error {
+	if name == "" {
+		return beanstalk.ErrEmpty
+	}
+	if len(name) > MAX_TUBE_NAME {
+		return beanstalk.ErrTooLong
+	}
+	if name[0] == '-' {
+		return fmt.Errorf("name starts with '-'")
+	}
+	for _, c := range name {
+		if !strings.ContainsRune(beanstalk.NameChars, c) {
+			return fmt.Errorf("%v: %q", beanstalk.ErrBadChar, c)
+		}
+	}
+	return nil
+}
+
+/**
+ * Checks config, workers directory and beanstalkd connectivity without dispatching anything
+ */
+func runValidate(name string, args []string) int {
+	fs := newFlagSet(name, "[--offline]")
+	offline := fs.Bool("offline", false, "Do not check beanstalkd connectivity")
+	parseFlagSet(fs, args)
+	report := &Report{}
+	cfgPath = os.Args[0] + ".json"
+	limits = Limits{Total: WORKERS_MAX, Min: WORKERS_MIN, Queues: make(map[string]uint)}
+	if _, err := os.Stat(cfgPath); os.IsNotExist(err) {
+		report.Ok("Config file %s does not exist, defaults will be used", cfgPath)
+	} else if loaded, err := loadConfig(cfgPath); err != nil {
+		report.Fail("Config file %s: %v", cfgPath, err)
+	} else {
+		report.Ok("Config file %s", cfgPath)
+		limits = loaded.Limits
+		tubeDefaults, tubeConfigs = loaded.Defaults, loaded.Tubes
+		freezeWindows = loaded.Freeze
+	}
+	applyEnvLimits()
+	workers := validateWorkers(report)
+	validateWorkersGit(report)
+	validateArtifacts(report)
+	if *readOnlyWorkers {
+		report.Ok("Workers directory is read-only with --read-only-workers, deployWorker, rollbackWorker and promoteWorker will be rejected")
+	}
+	validateFreeze(report)
+	validateLimits(report, workers)
+	validatePolicy(report)
+	validateIntegrity(report, workers)
+	if !*offline {
+		if commandTubes() {
+			validateConnectivity(report)
+		}
+		validateBroker(report)
+	}
+	fmt.Printf("%d problem(s), %d warning(s) found\n", report.Problems, report.Warnings)
+	if report.Problems > 0 {
+		return 1
+	}
+	return 0
+}
+
+/**
+ * Checks connectivity of broker other than beanstalkd, if it can tell
+ */
+func validateBroker(report *Report) {
+	if *brokerName == "beanstalkd" {
+		return
+	}
+	openBroker()
+	defer stopPlugins()
+	checker, ok := broker.(brokerChecker)
+	if !ok {
+		report.Warn("Connectivity of %s broker can not be checked", *brokerName)
+	} else if err := checker.Check(); err != nil {
+		report.Fail("Broker %s: %v", *brokerName, err)
+	} else {
+		report.Ok("Broker %s is reachable", *brokerName)
+	}
+}
+
+/**
+ * Checks integrity manifest and its signature, and that every worker matches it
+ */
+func validateIntegrity(report *Report, workers map[string]bool) {
+	if *integrityManifest == "" {
+		return
+	}
+	integrityLock.Lock()
+	_, err := manifestSums()
+	integrityLock.Unlock()
+	if err != nil {
+		report.Fail("Integrity manifest %s: %v", *integrityManifest, err)
+		return
+	}
+	if *integrityKey == "" {
+		report.Warn("Integrity manifest %s is not verified, set --integrity-key", *integrityManifest)
+	} else {
+		report.Ok("Integrity manifest %s is signed with deploy key", *integrityManifest)
+	}
+	names := make([]string, 0, len(workers))
+	for worker := range workers {
+		names = append(names, worker)
+	}
+	sort.Strings(names)
+	for _, worker := range names {
+		if violation := integrityViolation(worker, filepath.Join(*workersPath, worker)); violation != "" {
+			report.Fail("Worker %s will not be run: %s", worker, violation)
+		}
+	}
+}
+
+/**
+ * Checks workers directory is git checkout with upstream branch, with --workers-git
+ */
+func validateWorkersGit(report *Report) {
+	if !*workersGit {
+		return
+	}
+	if *readOnlyWorkers {
+		report.Fail("--workers-git can not be used with --read-only-workers")
+	}
+	if upstream, err := git("-C", *workersPath, "rev-parse", "--abbrev-ref", "@{upstream}"); err != nil {
+		report.Fail("Workers directory %s is no git checkout with upstream branch: %v", *workersPath, err)
+	} else {
+		report.Ok("Workers directory %s follows %s", *workersPath, upstream)
+	}
+}
+
+/**
+ * Checks artifact manifest can be read, workers are fetched by daemon itself
+ */
+func validateArtifacts(report *Report) {
+	if *artifactManifest == "" {
+		return
+	}
+	if *readOnlyWorkers {
+		report.Fail("--artifact-manifest can not be used with --read-only-workers")
+	}
+	if manifest, err := readArtifactManifest(); err != nil {
+		report.Fail("Artifact manifest %s: %v", *artifactManifest, err)
+	} else {
+		report.Ok("Artifact manifest %s: %d worker(s)", *artifactManifest, len(manifest))
+	}
+}
+
+/**
+ * Checks freeze windows of config file parse, warning if deploys are frozen right now
+ */
+func validateFreeze(report *Report) {
+	for i, window := range freezeWindows {
+		if _, err := window.contains(time.Now()); err != nil {
+			report.Fail("Freeze window %d %s: %v, deploys are rejected until it is fixed", i, window, err)
+		}
+	}
+	if window := activeFreeze(time.Now()); window != "" {
+		report.Warn("Deploys are frozen now: %s", window)
+	} else if len(freezeWindows) > 0 {
+		report.Ok("%d freeze window(s), deploys are not frozen now", len(freezeWindows))
+	}
+}
+
+/**
+ * Checks policy script loads
+ */
+func validatePolicy(report *Report) {
+	if *policyPath == "" {
+		return
+	}
+	if err := loadPolicy(); err != nil {
+		report.Fail("Policy %s: %v", *policyPath, err)
+	} else {
+		report.Ok("Policy %s", *policyPath)
+	}
+}
+
+/**
+ * Checks workers directory, returns worker names found
+ */
+func validateWorkers(report *Report) map[string]bool {
+	workers := make(map[string]bool)
+	if info, err := os.Stat(*workersPath); err != nil || !info.IsDir() {
+		report.Fail("Workers directory %s is not accessible", *workersPath)
+		return workers
+	}
+	files, err := filepath.Glob(filepath.Join(*workersPath, "*"))
+	if err != nil {
+		report.Fail("Workers directory %s: %v", *workersPath, err)
+		return workers
+	}
+	sort.Strings(files)
+	report.Ok("Workers directory %s: %d file(s)", *workersPath, len(files))
+	if len(files) == 0 {
+		report.Warn("No workers found, nothing will be dispatched")
+	}
+	for _, file := range files {
+		worker := filepath.Base(file)
+		if notWorker(worker) {
+			continue
+		}
+		workers[worker] = true
+		if err := checkTubeName(worker); err != nil {
+			report.Fail("Worker %s: invalid tube name: %v", worker, err)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			report.Fail("Worker %s: %v", worker, err)
+		} else if !info.Mode().IsRegular() {
+			report.Fail("Worker %s: not a regular file", worker)
+		} else if info.Mode().Perm()&0111 == 0 {
+			report.Fail("Worker %s: not executable", worker)
+		} else {
+			report.Ok("Worker %s", worker)
+		}
+	}
+	return workers
+}
+
+/**
+ * Checks that Min <= per tube limit <= Total, for configured tubes and workers found
+ */
+func validateLimits(report *Report, workers map[string]bool) {
+	if limits.Total == 0 {
+		report.Fail("Total limit is 0, only minimal workers will run")
+	}
+	if limits.Min > limits.Total {
+		report.Fail("Minimal workers %d is greater than total limit %d", limits.Min, limits.Total)
+	} else {
+		report.Ok("Limits: total %d, minimal %d", limits.Total, limits.Min)
+	}
+	known := make(map[string]bool)
+	for tube := range workers {
+		known[tube] = true
+	}
+	for tube := range limits.Queues {
+		known[tube] = true
+		if !workers[tube] {
+			report.Warn("Limit set for %s, but there is no such worker", tube)
+		}
+	}
+	for tube := range tubeConfigs {
+		known[tube] = true
+		if !workers[tube] {
+			report.Warn("Settings given for %s, but there is no such worker", tube)
+		}
+	}
+	tubes := make([]string, 0, len(known))
+	for tube := range known {
+		tubes = append(tubes, tube)
+	}
+	sort.Strings(tubes)
+	for _, tube := range tubes {
+		config := effectiveConfig(tube)
+		if config.Limit < limits.Min {
+			report.Fail("Limit %d for %s (from %s) is less than minimal workers %d", config.Limit, tube, config.Sources["Limit"], limits.Min)
+		} else if config.Limit > limits.Total {
+			report.Fail("Limit %d for %s (from %s) is greater than total limit %d", config.Limit, tube, config.Sources["Limit"], limits.Total)
+		}
+		if tubeConfigs[tube] != nil && tubeConfigs[tube].Weight != nil && *tubeConfigs[tube].Weight == 0 ||
+			tubeDefaults != nil && tubeDefaults.Weight != nil && *tubeDefaults.Weight == 0 {
+			report.Fail("Weight of %s is 0, it must be at least 1", tube)
+		}
+		if tubeConfigs[tube] != nil && tubeConfigs[tube].Cost != nil && *tubeConfigs[tube].Cost == 0 ||
+			tubeDefaults != nil && tubeDefaults.Cost != nil && *tubeDefaults.Cost == 0 {
+			report.Fail("Cost of %s is 0, it must be at least 1", tube)
+		}
+		if config.GlobalLimit > 0 && *coordinationURL == "" {
+			report.Warn("GlobalLimit of %s (from %s) has no effect without --coordination, limits are per host", tube, config.Sources["GlobalLimit"])
+		}
+		if shadow := config.Shadow; shadow != nil {
+			if shadow.Tube == "" || shadow.Tube == tube || shadow.Percent < 0 || shadow.Percent > 100 {
+				report.Fail("Shadow of %s (from %s) needs another Tube and Percent from 0 to 100", tube, config.Sources["Shadow"])
+			} else if !reserveMode(tube) {
+				report.Warn("Shadow of %s (from %s) mirrors nothing, jobs are only mirrored in reserve mode", tube, config.Sources["Shadow"])
+			}
+		}
+		if compression := config.Compression; compression != "" && compression != "gzip" && compression != "zstd" && compression != "none" {
+			report.Fail("Compression %q of %s (from %s) is none of gzip, zstd or none", compression, tube, config.Sources["Compression"])
+		}
+		for i, rule := range config.Rules {
+			if rule.Route != "" && (rule.Drop || rule.Route == tube || checkTubeName(rule.Route) != nil) {
+				report.Fail("Rule %d of %s (from %s) needs valid Route to another tube and not Drop both", i, tube, config.Sources["Rules"])
+			}
+			paths := append([]string{}, rule.Remove...)
+			for path := range rule.Match {
+				paths = append(paths, path)
+			}
+			for path := range rule.Set {
+				paths = append(paths, path)
+			}
+			for _, path := range paths {
+				if path == "" || strings.Trim(path, ".") != path || strings.Contains(path, "..") {
+					report.Fail("Rule %d of %s (from %s) has invalid field path %q", i, tube, config.Sources["Rules"], path)
+				}
+			}
+		}
+		if len(config.Rules) > 0 && !reserveMode(tube) {
+			report.Warn("Rules of %s (from %s) apply to nothing, payloads are only routed in reserve mode", tube, config.Sources["Rules"])
+		}
+		switch config.Input {
+		case "", "stdin", "json":
+			if len(config.Args) > 0 {
+				report.Warn("Args of %s (from %s) are not passed, Input is not args or file", tube, config.Sources["Args"])
+			}
+		case "args", "file":
+			if config.Input == "args" && len(config.Args) == 0 {
+				report.Fail("Input args of %s (from %s) needs Args", tube, config.Sources["Input"])
+			}
+			if config.features["prefork"] {
+				report.Fail("Input %s of %s (from %s) can not be used with prefork, preforked workers take payload on stdin", config.Input, tube, config.Sources["Input"])
+			}
+			if err := checkArgs(config.Args); err != nil {
+				report.Fail("Args of %s (from %s): %v", tube, config.Sources["Args"], err)
+			}
+		default:
+			report.Fail("Input %q of %s (from %s) is none of stdin, json, args or file", config.Input, tube, config.Sources["Input"])
+		}
+		if config.Input != "" && config.Input != "stdin" && !reserveMode(tube) {
+			report.Warn("Input of %s (from %s) has no effect, payloads are only delivered in reserve mode", tube, config.Sources["Input"])
+		}
+		if migration := config.Migration; migration != nil {
+			field, scripts := migrationPaths(tube, migration)
+			if migration.Current < 1 || strings.Trim(field, ".") != field || strings.Contains(field, "..") {
+				report.Fail("Migration of %s (from %s) needs Current version of at least 1 and valid Field", tube, config.Sources["Migration"])
+			} else if !reserveMode(tube) {
+				report.Warn("Migration of %s (from %s) upgrades nothing, payloads are only migrated in reserve mode", tube, config.Sources["Migration"])
+			}
+			for version := 1; version < migration.Current; version++ {
+				script := filepath.Join(scripts, strconv.Itoa(version))
+				if info, err := os.Stat(script); err != nil || info.Mode().Perm()&0111 == 0 {
+					report.Warn("Migration of %s has no executable %s, payloads of version %d are buried", tube, script, version)
+				}
+			}
+		}
+		if canary := config.Canary; canary != nil {
+			if canary.Percent < 0 || canary.Percent > 100 || canary.MaxErrorPercent < 0 || canary.MaxErrorPercent > 100 {
+				report.Fail("Canary of %s (from %s) needs Percent and MaxErrorPercent from 0 to 100", tube, config.Sources["Canary"])
+			} else if config.Resident > 0 || config.features["prefork"] {
+				report.Warn("Canary of %s (from %s) has no effect, resident and preforked workers always start worker file", tube, config.Sources["Canary"])
+			}
+		}
+		if config.Schema != "" {
+			if _, err := loadSchema(config.Schema); err != nil {
+				report.Fail("Schema %s of %s (from %s) can not be loaded: %v", config.Schema, tube, config.Sources["Schema"], err)
+			} else if !reserveMode(tube) {
+				report.Warn("Schema of %s (from %s) checks nothing, payloads are only checked in reserve mode", tube, config.Sources["Schema"])
+			}
+		}
+		if missing := missingTags(config); len(missing) > 0 {
+			report.Warn("%s requires tags %s (from %s) this host lacks in --tags, it is not subscribed", tube, strings.Join(missing, ","), config.Sources["Requires"])
+		}
+		if config.Cost > limits.Total {
+			report.Fail("Cost %d of %s (from %s) is greater than total limit %d, its worker never fits", config.Cost, tube, config.Sources["Cost"], limits.Total)
+		}
+		if config.Timeout.Duration < 0 {
+			report.Fail("Timeout %s for %s (from %s) is negative", config.Timeout, tube, config.Sources["Timeout"])
+		}
+		for _, feature := range config.Features {
+			if _, known := knownFeatures[feature]; !known {
+				report.Fail("Unknown feature %s for %s (from %s)", feature, tube, config.Sources["Features."+feature])
+			}
+		}
+		for name, ref := range config.Secrets {
+			if _, err := parseSecretRef(ref); err != nil {
+				report.Fail("Secret %s for %s (from %s): %v", name, tube, config.Sources["Secrets."+name], err)
+			}
+		}
+		if _, err := parseUmask(config.Umask); err != nil {
+			report.Fail("Umask for %s (from %s): %v", tube, config.Sources["Umask"], err)
+		}
+		if scale := config.Autoscale; scale != nil && scale.Max <= config.Limit {
+			report.Fail("Autoscale Max %d for %s (from %s) is not above its limit %d", scale.Max, tube, config.Sources["Autoscale"], config.Limit)
+		} else if scale != nil && scale.Max > limits.Total {
+			report.Warn("Autoscale Max %d for %s (from %s) is greater than total limit %d", scale.Max, tube, config.Sources["Autoscale"], limits.Total)
+		}
+	}
+}
+
+/**
+ * Checks that beanstalkd servers are reachable: --connect ones and the ones set in tube settings
+ */
+func validateConnectivity(report *Report) {
+	servers := serverList()
+	seen := make(map[string]bool)
+	for _, address := range servers {
+		seen[address] = true
+	}
+	configs := []*TubeConfig{tubeDefaults}
+	for _, config := range tubeConfigs {
+		configs = append(configs, config)
+	}
+	for _, config := range configs {
+		if config != nil && config.Server != "" && !seen[config.Server] {
+			seen[config.Server] = true
+			servers = append(servers, config.Server)
+		}
+	}
+	for _, address := range servers {
+		validateServer(report, address)
+	}
+	setTubeNames()
+	for _, tube := range []string{commandTubeName, responseTubeName} {
+		if err := checkTubeName(tube); err != nil {
+			report.Fail("Control tube %s: invalid name: %v", tube, err)
+		}
+	}
+}
+
+/**
+ * Checks that beanstalkd server is reachable
+ */
+func validateServer(report *Report, address string) {
+	netConn, err := dialNet(address, *replyTimeout)
+	if err != nil {
+		report.Fail("Beanstalkd %s: %v", address, err)
+		return
+	}
+	conn := beanstalk.NewConn(netConn)
+	defer conn.Close()
+	serverStats, err := conn.Stats()
+	if err != nil {
+		report.Fail("Beanstalkd %s: %v", address, err)
+		return
+	}
+	report.Ok("Beanstalkd %s: version %s", address, serverStats["version"])
+}
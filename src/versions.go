@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/** Directory in workers directory keeping inactive versions of deployed workers */
+const VERSIONS_DIR = ".workerman-versions"
+
+/**
+ * Worker to switch with rollbackWorker or promoteWorker over gRPC and HTTP
+ */
+type SwitchRequest struct {
+	Worker string
+}
+
+/**
+ * Copies worker file about to be replaced by deployWorker into VERSIONS_DIR as previous version, dropping version
+ * rolled back from before, as the new one supersedes it. Caller must hold deployLock
+ */
+func keepPrevious(worker string) error {
+	content, err := ioutil.ReadFile(worker)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(VERSIONS_DIR, 0755); err != nil {
+		return err
+	}
+	base := filepath.Join(VERSIONS_DIR, worker)
+	if err := writeFileAtomic(base+".previous", content, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(base + ".next"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/**
+ * Process rollbackWorker and promoteWorker commands: renames kept version of worker over worker file, keeping the one
+ * it replaces to switch back to. rollbackWorker activates previous version, promoteWorker the one rolled back from.
+ * Takes stateLock itself
+ */
+func switchWorkerCommand(command string, options map[string]string) []byte {
+	var response interface{}
+	var workers []string
+	for worker := range options {
+		workers = append(workers, worker)
+	}
+	if len(workers) != 1 {
+		response = CommandError{command + " needs one worker in Options"}
+	} else if switched, err := switchWorker(command, workers[0]); err != nil {
+		log.Printf("Could not switch worker %s: %v", workers[0], err)
+		response = CommandError{fmt.Sprintf("could not switch worker %s: %v", workers[0], err)}
+	} else {
+		awaitSubscription(switched)
+		response = switched
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not encode response: %v", err)
+		return nil
+	}
+	return payload
+}
+
+/**
+ * Makes kept version active, the active one is kept as previous version on promote and as version to promote on rollback
+ */
+func switchWorker(command, worker string) (*DeployResponse, error) {
+	if err := checkWorkerName(worker); err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		return nil, errors.New("daemon runs with --dry-run")
+	}
+	if err := checkWorkersWritable(); err != nil {
+		return nil, err
+	}
+	deployLock.Lock()
+	defer deployLock.Unlock()
+	base := filepath.Join(VERSIONS_DIR, worker)
+	from, to := base+".previous", base+".next"
+	if command == "promoteWorker" {
+		from, to = to, from
+	}
+	content, err := ioutil.ReadFile(from)
+	if os.IsNotExist(err) {
+		if command == "promoteWorker" {
+			return nil, errors.New("no rolled back version to promote")
+		}
+		return nil, errors.New("no previous version kept to roll back to")
+	} else if err != nil {
+		return nil, err
+	}
+	active, err := ioutil.ReadFile(worker)
+	if err == nil {
+		err = writeFileAtomic(to, active, 0755)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Running workers keep executing the file renamed over, the next run gets the version switched to
+	if err := writeFileAtomic(worker, content, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(from); err != nil {
+		return nil, err
+	}
+	sum := checksumOf(content)
+	if command == "promoteWorker" {
+		log.Printf("Promoted worker %s to version %s rolled back from", worker, sum)
+		publishEvent("switched", worker, "promoted "+sum)
+	} else {
+		log.Printf("Rolled back worker %s to previous version %s", worker, sum)
+		publishEvent("switched", worker, "rolled back to "+sum)
+	}
+	return &DeployResponse{Worker: worker, Checksum: sum, Replaced: active != nil}, nil
+}
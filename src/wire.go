@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"log"
+	"strconv"
+)
+
+/**
+ * Header byte of commands and responses in command tubes encoded otherwise than JSON, which starts with "{". Protobuf
+ * message is google.protobuf.Value of the same document
+ */
+const (
+	WIRE_MSGPACK  = 0x01
+	WIRE_PROTOBUF = 0x02
+)
+
+/** Encoding client commands use through command tubes */
+var controlEncoding = flag.String("control-encoding", "json", "Encoding of commands workerman commands send through command tubes, json, msgpack or protobuf, responses come back the same. Default: json")
+
+/**
+ * Returns header byte of encoding, 0 for JSON
+ */
+func wireEncoding(name string) (byte, error) {
+	switch name {
+	case "", "json":
+		return 0, nil
+	case "msgpack":
+		return WIRE_MSGPACK, nil
+	case "protobuf":
+		return WIRE_PROTOBUF, nil
+	}
+	return 0, fmt.Errorf("unknown encoding %q, use json, msgpack or protobuf", name)
+}
+
+/**
+ * Returns body taken from command tube as JSON, with header byte of encoding it came in, 0 for JSON
+ */
+func decodeWire(body []byte) ([]byte, byte, error) {
+	if len(body) == 0 || body[0] != WIRE_MSGPACK && body[0] != WIRE_PROTOBUF {
+		return body, 0, nil
+	}
+	var document interface{}
+	switch body[0] {
+	case WIRE_MSGPACK:
+		if err := msgpack.Unmarshal(body[1:], &document); err != nil {
+			return nil, body[0], fmt.Errorf("invalid msgpack: %v", err)
+		}
+	case WIRE_PROTOBUF:
+		var value structpb.Value
+		if err := proto.Unmarshal(body[1:], &value); err != nil {
+			return nil, body[0], fmt.Errorf("invalid protobuf: %v", err)
+		}
+		document = value.AsInterface()
+	}
+	data, err := json.Marshal(document)
+	return data, body[0], err
+}
+
+/**
+ * Returns JSON document in encoding of header byte, as it is for JSON
+ */
+func encodeWire(encoding byte, document []byte) ([]byte, error) {
+	if encoding == 0 {
+		return document, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value = wireValue(value)
+	var data []byte
+	var err error
+	switch encoding {
+	case WIRE_MSGPACK:
+		data, err = msgpack.Marshal(value)
+	case WIRE_PROTOBUF:
+		var message *structpb.Value
+		if message, err = structpb.NewValue(value); err == nil {
+			data, err = proto.Marshal(message)
+		}
+	default:
+		err = fmt.Errorf("unknown encoding %d", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{encoding}, data...), nil
+}
+
+/**
+ * Returns decoded JSON with numbers as integers where they are, so counters keep their precision in msgpack
+ */
+func wireValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = wireValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = wireValue(item)
+		}
+	}
+	return value
+}
+
+/**
+ * Returns response to command in encoding command came in, compressed if big, see responseBody
+ */
+func encodeResponse(cmd WorkerCommand, payload []byte) []byte {
+	response := wrapResponse(cmd, payload)
+	if encoded, err := encodeWire(cmd.encoding, response); err != nil {
+		log.Printf("Could not encode response to %s, sending JSON: %v", cmd.Command, err)
+	} else {
+		response = encoded
+	}
+	return compressResponse(response)
+}